@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+var (
+	img2webpPath string
+	ffmpegPath   string
+)
+
+// Animation asks for an animated thumbnail of GIFs and motion photos (with
+// -ffmpeg): the first Frames (30) at up to FPS (10) frames a second, as
+// "webp" (the default, with -img2webp) or "gif". The thumbnail stays a
+// still, for clients that can't play it.
+type Animation struct {
+	Format string  `json:"format"`
+	Frames int     `json:"frames"`
+	FPS    float64 `json:"fps"`
+}
+
+const (
+	maxAnimationFrames = 120
+	maxAnimationFPS    = 15
+)
+
+// settings are the animation's format, frames and frame rate, defaulted
+func (a Animation) settings() (string, int, float64, error) {
+	format, frames, fps := a.Format, a.Frames, a.FPS
+	switch format {
+	case "":
+		format = "webp"
+	case "webp", "gif":
+	default:
+		return "", 0, 0, fmt.Errorf("Unknown animation format %q (webp or gif)", a.Format)
+	}
+	if format == "webp" && img2webpPath == "" {
+		return "", 0, 0, fmt.Errorf("Animated webp needs -img2webp")
+	}
+	if frames == 0 {
+		frames = 30
+	}
+	if fps == 0 {
+		fps = 10
+	}
+	if frames < 2 || frames > maxAnimationFrames {
+		return "", 0, 0, fmt.Errorf("Invalid animation frames %d, expected 2 to %d", a.Frames, maxAnimationFrames)
+	}
+	if fps < 0 || fps > maxAnimationFPS {
+		return "", 0, 0, fmt.Errorf("Invalid animation fps %v, expected up to %d", a.FPS, maxAnimationFPS)
+	}
+	return format, frames, fps, nil
+}
+
+// writeAnimation writes the animated thumbnail, "" if the source is a still
+func writeAnimation(t Task) (string, error) {
+	format, n, fps, err := t.Animate.settings()
+	if err != nil {
+		return "", err
+	}
+	frames, err := animationFrames(t.Filename, n, fps)
+	if err != nil {
+		return "", err
+	}
+	if len(frames) < 2 {
+		return "", nil
+	}
+
+	w, h := fitSize(t, frames[0].Bounds(), thumbWidth)
+	for i, frame := range frames {
+		frames[i] = resize.Resize(w, h, frame, resize.Bilinear)
+	}
+
+	f, err := createOutput(t)
+	if err != nil {
+		return "", err
+	}
+	release := encodeSlot()
+	if format == "gif" {
+		err = encodeGIF(f, frames, fps, t)
+	} else {
+		err = encodeWebP(f.Name(), frames, fps)
+	}
+	release()
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", noSpace(err)
+	}
+
+	location, _, err := publishOutput(t, f.Name(), outputName(t, f.Name(), "animation", "."+format), "image/"+format)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return location, nil
+}
+
+// animationFrames samples up to n frames, fps apart, from a GIF or the video
+// of a motion photo, and none from anything else
+func animationFrames(filename string, n int, fps float64) ([]image.Image, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if g, err := gif.DecodeAll(bytes.NewReader(data)); err == nil {
+		return gifFrames(g, n, fps), nil
+	}
+	if offset := motionVideo(data); offset >= 0 {
+		if ffmpegPath == "" {
+			return nil, fmt.Errorf("Animating motion photos needs -ffmpeg")
+		}
+		return videoFrames(data[offset:], n, fps)
+	}
+	return nil, nil
+}
+
+// gifFrames composites the GIF's frames, as they'd be shown, every 1/fps
+func gifFrames(g *gif.GIF, n int, fps float64) []image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	snapshot := func() *image.RGBA {
+		c := image.NewRGBA(canvas.Bounds())
+		copy(c.Pix, canvas.Pix)
+		return c
+	}
+
+	var frames []image.Image
+	// when the next sample is due, and until when the current frame shows
+	next, shown := 0.0, 0.0
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = snapshot()
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		// browsers play unset (or 0) delays at 10 frames a second too
+		delay := 0.1
+		if i < len(g.Delay) && g.Delay[i] > 0 {
+			delay = float64(g.Delay[i]) / 100
+		}
+		for shown += delay; next < shown && len(frames) < n; next += 1 / fps {
+			frames = append(frames, snapshot())
+		}
+		if len(frames) == n {
+			break
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames
+}
+
+// motionVideo is where the MP4 appended to a motion photo's JPEG (as both
+// Google and Samsung do) starts, or -1
+func motionVideo(data []byte) int {
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return -1
+	}
+	for i := 0; ; {
+		j := bytes.Index(data[i:], []byte("ftyp"))
+		if j < 0 {
+			return -1
+		}
+		start := i + j - 4
+		// a plausible box size and brand, not just those bytes in the JPEG
+		if start >= 2 && start+12 <= len(data) {
+			size := int(data[start])<<24 | int(data[start+1])<<16 | int(data[start+2])<<8 | int(data[start+3])
+			brand := string(data[start+8 : start+12])
+			switch brand {
+			case "mp41", "mp42", "isom", "qt  ", "avc1", "iso4", "iso5", "iso6":
+				if size >= 16 && size <= 256 {
+					return start
+				}
+			}
+		}
+		i += j + 4
+	}
+}
+
+// videoFrames has ffmpeg sample the video's frames
+func videoFrames(video []byte, n int, fps float64) ([]image.Image, error) {
+	dir, err := createTempDir()
+	if err != nil {
+		return nil, err
+	}
+	defer removeTemp(dir)
+	input := filepath.Join(dir, "motion.mp4")
+	if err := ioutil.WriteFile(input, video, 0600); err != nil {
+		return nil, noSpace(err)
+	}
+
+	cmd := exec.Command(ffmpegPath, "-v", "error", "-i", input,
+		"-vf", "fps="+strconv.FormatFloat(fps, 'f', -1, 64),
+		"-frames:v", strconv.Itoa(n), filepath.Join(dir, "%04d.png"))
+	release, err := sandbox(cmd, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, &codedError{code: "DECODE_FAILED", msg: fmt.Sprintf("ffmpeg failed: %s", err), detail: string(bytes.TrimSpace(output))}
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*.png"))
+	var frames []image.Image
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		frame, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+// encodeGIF writes the frames over the background (GIFs have no partial
+// transparency), dithered to a fixed palette so frames don't flicker
+func encodeGIF(w io.Writer, frames []image.Image, fps float64, t Task) error {
+	bg := t.Background
+	if bg == "" {
+		bg = background
+	}
+	c, err := parseColor(bg)
+	if err != nil {
+		return err
+	}
+
+	g := &gif.GIF{}
+	delay := int(math.Round(100 / fps))
+	for _, frame := range frames {
+		p := image.NewPaletted(frame.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(p, p.Bounds(), flatten(frame, c), frame.Bounds().Min)
+		g.Image = append(g.Image, p)
+		g.Delay = append(g.Delay, delay)
+	}
+	return gif.EncodeAll(w, g)
+}
+
+// encodeWebP has img2webp put the frames, as PNGs, in an animated WebP
+func encodeWebP(output string, frames []image.Image, fps float64) error {
+	dir, err := createTempDir()
+	if err != nil {
+		return err
+	}
+	defer removeTemp(dir)
+
+	args := []string{"-loop", "0", "-lossy", "-q", strconv.Itoa(jpegQuality),
+		"-d", strconv.Itoa(int(math.Round(1000 / fps)))}
+	for i, frame := range frames {
+		name := filepath.Join(dir, fmt.Sprintf("%04d.png", i))
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		err = png.Encode(f, frame)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		args = append(args, name)
+	}
+
+	cmd := exec.Command(img2webpPath, append(args, "-o", output)...)
+	release, err := sandbox(cmd, dir, filepath.Dir(output))
+	if err != nil {
+		return err
+	}
+	defer release()
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("img2webp failed: %s: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
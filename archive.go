@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// splitArchive splits a filename like "shoot.zip!DSC0001.NEF" into the
+// archive and the entry within it. ok is false for an ordinary file.
+func splitArchive(filename string) (archive, entry string, ok bool) {
+	i := strings.Index(filename, "!")
+	if i < 0 {
+		return "", "", false
+	}
+	archive, entry = filename[:i], filename[i+1:]
+	switch lower := strings.ToLower(archive); {
+	case strings.HasSuffix(lower, ".zip"), strings.HasSuffix(lower, ".tar"),
+		strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archive, entry, entry != ""
+	}
+	return "", "", false
+}
+
+// extractEntry copies one entry of a ZIP or (gzipped) TAR archive to a temp
+// file, with the entry's extension, since dcraw and the editors need a path.
+// The caller removes it.
+func extractEntry(archive, entry string) (string, error) {
+	out, err := createTemp("*" + filepath.Ext(entry))
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		err = extractZip(out, archive, entry)
+	} else {
+		err = extractTar(out, archive, entry)
+	}
+	if err != nil {
+		removeTemp(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+func extractZip(w io.Writer, archive, entry string) error {
+	z, err := zip.OpenReader(archive)
+	if err != nil {
+		return fmt.Errorf("Could not open %s: %s", archive, err)
+	}
+	defer z.Close()
+
+	for _, f := range z.File {
+		if f.Name != entry {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("Could not read %s in %s: %s", entry, archive, err)
+		}
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return err
+	}
+	return fmt.Errorf("No %s in %s", entry, archive)
+}
+
+func extractTar(w io.Writer, archive, entry string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return fmt.Errorf("Could not open %s: %s", archive, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if lower := strings.ToLower(archive); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("Could not open %s: %s", archive, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("No %s in %s", entry, archive)
+		} else if err != nil {
+			return fmt.Errorf("Could not read %s: %s", archive, err)
+		}
+		if strings.TrimPrefix(h.Name, "./") == entry && h.Typeflag == tar.TypeReg {
+			_, err = io.Copy(w, tr)
+			return err
+		}
+	}
+}
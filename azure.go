@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	azureAccount          string
+	azureConnectionString string
+
+	// azureClient is connected once something is stored in a container
+	azureClient    *azblob.Client
+	azureClientErr error
+	azureOnce      sync.Once
+)
+
+// openAzure connects with -azureConnectionString (or the usual
+// AZURE_STORAGE_CONNECTION_STRING), otherwise to -azureAccount as the
+// managed identity, or whatever else DefaultAzureCredential finds
+func openAzure() error {
+	azureOnce.Do(func() {
+		connection := azureConnectionString
+		if connection == "" {
+			connection = os.Getenv("AZURE_STORAGE_CONNECTION_STRING")
+		}
+		if connection != "" {
+			azureClient, azureClientErr = azblob.NewClientFromConnectionString(connection, nil)
+		} else if azureAccount != "" {
+			var cred *azidentity.DefaultAzureCredential
+			cred, azureClientErr = azidentity.NewDefaultAzureCredential(nil)
+			if azureClientErr == nil {
+				azureClient, azureClientErr = azblob.NewClient(fmt.Sprintf("https://%s.blob.core.windows.net/", azureAccount), cred, nil)
+			}
+		} else {
+			azureClientErr = fmt.Errorf("-azureAccount or -azureConnectionString is needed")
+		}
+		if azureClientErr != nil {
+			azureClientErr = fmt.Errorf("Could not connect to Azure Blob Storage: %s", azureClientErr)
+		}
+	})
+	return azureClientErr
+}
+
+// azureStorage is an Azure Blob Storage container, "azblob://container/name"
+type azureStorage struct {
+	container string
+}
+
+func newAzureStorage(container string) (Storage, error) {
+	if err := openAzure(); err != nil {
+		return nil, err
+	}
+	return &azureStorage{container}, nil
+}
+
+func (s *azureStorage) blob(name string) *blob.Client {
+	return azureClient.ServiceClient().NewContainerClient(s.container).NewBlobClient(name)
+}
+
+func (s *azureStorage) Open(name string) (io.ReadCloser, error) {
+	resp, err := azureClient.DownloadStream(context.Background(), s.container, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *azureStorage) Write(name string, r io.Reader, contentType string) error {
+	_, err := azureClient.UploadStream(context.Background(), s.container, name, r, &azblob.UploadStreamOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+	})
+	return err
+}
+
+func (s *azureStorage) Stat(name string) (StorageInfo, error) {
+	props, err := s.blob(name).GetProperties(context.Background(), nil)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	info := StorageInfo{}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	if props.LastModified != nil {
+		info.ModTime = *props.LastModified
+	}
+	return info, nil
+}
+
+func (s *azureStorage) Remove(name string) error {
+	_, err := azureClient.DeleteBlob(context.Background(), s.container, name, nil)
+	return err
+}
+
+// PublicURL is the blob's URL, which can be fetched if the container allows
+// public access (or with a SAS appended)
+func (s *azureStorage) PublicURL(name string) string {
+	return s.blob(name).URL()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	niceness          int
+	cgroupDir         string
+	backgroundNice    int
+	backgroundWorkers int
+
+	backgroundOnce  sync.Once
+	backgroundSlots chan struct{}
+)
+
+func checkPriority(t Task) error {
+	switch t.Priority {
+	case "", "background":
+		return nil
+	}
+	return fmt.Errorf("Unknown priority %q (background)", t.Priority)
+}
+
+// throttle runs only -backgroundWorkers background tasks at once, the rest
+// wait here rather than on workers that interactive tasks could have
+func throttle(t Task, send func(Task) TaskResult) TaskResult {
+	if t.Priority != "background" || backgroundWorkers <= 0 {
+		return send(t)
+	}
+	backgroundOnce.Do(func() {
+		backgroundSlots = make(chan struct{}, backgroundWorkers)
+	})
+	backgroundSlots <- struct{}{}
+	defer func() { <-backgroundSlots }()
+	return send(t)
+}
+
+// prioritized is processTask, at -backgroundNice for background tasks
+func prioritized(t Task) TaskResult {
+	if t.Priority != "background" {
+		return processTask(t)
+	}
+	var r TaskResult
+	if err := lowPriority(backgroundNice, func() { r = processTask(t) }); err != nil {
+		logTaskf(t.Id, "warn", "Running at normal priority: %s", err)
+		return processTask(t)
+	}
+	return r
+}
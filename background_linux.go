@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+)
+
+// lowPriority runs f on a thread of its own at nice (a thread's nice value
+// is its own on Linux), so the helpers it starts inherit it too. The thread
+// is never unlocked, so it exits with the goroutine rather than going back
+// to the scheduler still niced.
+func lowPriority(nice int, f func()) error {
+	var err error
+	done := make(chan struct{})
+	go func() {
+		runtime.LockOSThread()
+		defer close(done)
+		if err = syscall.Setpriority(syscall.PRIO_PROCESS, syscall.Gettid(), nice); err != nil {
+			return
+		}
+		f()
+	}()
+	<-done
+	return err
+}
+
+// applyPriority sets -nice on every thread we have (and so the ones they'll
+// start), and moves the process into -cgroup, whose cpu.weight and cpu.max
+// then apply to the helpers too
+func applyPriority() error {
+	if niceness != 0 {
+		tasks, err := filepath.Glob("/proc/self/task/*")
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(filepath.Base(task))
+			if err != nil {
+				continue
+			}
+			if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, niceness); err != nil {
+				return fmt.Errorf("Could not set -nice %d: %s", niceness, err)
+			}
+		}
+	}
+	if cgroupDir != "" {
+		err := ioutil.WriteFile(filepath.Join(cgroupDir, "cgroup.procs"), []byte(strconv.Itoa(syscall.Getpid())), 0644)
+		if err != nil {
+			return fmt.Errorf("Could not join -cgroup %s: %s", cgroupDir, err)
+		}
+	}
+	return nil
+}
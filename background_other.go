@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// nice values are per process elsewhere, so background tasks only get fewer workers
+func lowPriority(nice int, f func()) error {
+	return errors.New("per task nice values are only supported on Linux")
+}
+
+func applyPriority() error {
+	if niceness != 0 || cgroupDir != "" {
+		return fmt.Errorf("-nice and -cgroup are only supported on Linux")
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+	"image"
+	"image/draw"
+)
+
+// BurstFrame is how one of a "burst" task's files scored, Best being the
+// one its preview and thumbnail are of
+type BurstFrame struct {
+	Filename string  `json:"filename"`
+	Scores   *Scores `json:"scores"`
+	Best     bool    `json:"best,omitempty"`
+}
+
+// burstImage is a "burst" task: Files are near duplicates (a burst, or a
+// few tries at the same shot), and only the best of them gets a preview and
+// thumbnail. Each frame is scored on its preview: its sharpness relative to
+// the sharpest, less its clipped pixels, plus how sharp its faces' eyes are
+// relative to the other frames' when the camera recorded faces.
+func burstImage(t Task) TaskResult {
+	resp := TaskResult{Id: t.Id}
+	if len(t.Files) < 2 {
+		resp.Error = "A burst needs at least 2 files"
+		return resp
+	}
+
+	var frames []BurstFrame
+	var locals []string
+	for i, filename := range t.Files {
+		local, scores, err := scoreFrame(t, filename)
+		if err != nil {
+			if !t.Partial {
+				resp.setError(err)
+				return resp
+			}
+			resp.Response.failed("burst "+filename, err)
+			continue
+		}
+		if local != filename {
+			defer removeTemp(local)
+		}
+		frames = append(frames, BurstFrame{Filename: filename, Scores: scores})
+		locals = append(locals, local)
+		t.progress.stage("decode", 60*(i+1)/len(t.Files))
+	}
+	if len(frames) == 0 {
+		resp.Error = "None of the burst's files could be decoded"
+		return resp
+	}
+
+	var sharpest, eyes float64
+	for _, f := range frames {
+		if f.Scores.Sharpness > sharpest {
+			sharpest = f.Scores.Sharpness
+		}
+		if f.Scores.Eyes != nil && *f.Scores.Eyes > eyes {
+			eyes = *f.Scores.Eyes
+		}
+	}
+	best, bestRank := 0, 0.0
+	for i, f := range frames {
+		var rank float64
+		if sharpest > 0 {
+			rank = f.Scores.Sharpness / sharpest
+		}
+		rank -= (f.Scores.OverExposed + f.Scores.UnderExposed) / 50
+		if f.Scores.Eyes != nil && eyes > 0 {
+			rank += *f.Scores.Eyes / eyes
+		}
+		if i == 0 || rank > bestRank {
+			best, bestRank = i, rank
+		}
+	}
+	frames[best].Best = true
+
+	one := t
+	one.Op, one.Files, one.decode = "", nil, nil
+	one.Filename, one.source = locals[best], frames[best].Filename
+	r := resizeImage(one)
+	if r.Error != "" {
+		return r
+	}
+	r.Response.Burst = frames
+	r.Response.Failures = append(resp.Response.Failures, r.Response.Failures...)
+	return r
+}
+
+// scoreFrame is one of a burst's files, fetched if it's remote, and its
+// scores
+func scoreFrame(t Task, filename string) (string, *Scores, error) {
+	local := filename
+	if isRemote(filename) {
+		var err error
+		if local, err = fetchSource(filename); err != nil {
+			return "", nil, err
+		}
+	}
+	scores, err := frameScores(t, filename, local)
+	if err != nil {
+		if local != filename {
+			removeTemp(local)
+		}
+		return "", nil, err
+	}
+	return local, scores, nil
+}
+
+func frameScores(t Task, filename, local string) (*Scores, error) {
+	if err := checkFormat(filename, local); err != nil {
+		return nil, err
+	}
+	one := t
+	one.Filename, one.decode = local, nil
+	img, err := decodeSource(one)
+	if err != nil {
+		return nil, err
+	}
+	if uint(img.Bounds().Dx()) > previewWidth {
+		img = resize.Resize(previewWidth, 0, img, resize.Bilinear)
+	}
+	scores := computeScores(img)
+	if exiftoolPath == "" {
+		return scores, nil
+	}
+	regions, err := focusRegions(local)
+	if err != nil {
+		logTaskf(t.Id, "warn", "Could not read the regions of %s: %s", filename, err)
+		return scores, nil
+	}
+
+	// the eyes are in the upper middle of a face
+	b := img.Bounds()
+	gray := image.NewGray(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+	var sum float64
+	var faces int
+	for _, r := range regions {
+		if r.Type != "face" {
+			continue
+		}
+		w, h := float64(b.Dx()), float64(b.Dy())
+		band := image.Rect(int((r.X+r.Width*0.1)*w), int((r.Y+r.Height*0.2)*h),
+			int((r.X+r.Width*0.9)*w), int((r.Y+r.Height*0.5)*h))
+		sum += laplacianVariance(gray, band)
+		faces++
+	}
+	if faces > 0 {
+		eyes := sum / float64(faces)
+		scores.Eyes = &eyes
+	}
+	return scores, nil
+}
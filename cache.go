@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	previewCacheDir string
+	previewCacheMB  int64
+
+	// previewCache is set with -previewCache
+	previewCache *embeddedCache
+)
+
+// embeddedCache keeps the embedded previews dcraw extracted, by the hash of
+// the RAW (or what /render made, by its ETag), in dir/<2 hex>/<hash>. The least
+// recently used are evicted past limit bytes.
+type embeddedCache struct {
+	dir   string
+	limit int64
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	size    int64
+}
+
+type cacheEntry struct {
+	size int64
+	used time.Time
+}
+
+// openCache indexes what's already in dir, by modification time (which is
+// touched on every hit)
+func openCache(dir string, limit int64) (*embeddedCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &embeddedCache{dir: dir, limit: limit, entries: map[string]*cacheEntry{}}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) == ".tmp" {
+			return err
+		}
+		c.entries[filepath.Base(path)] = &cacheEntry{info.Size(), info.ModTime()}
+		c.size += info.Size()
+		return nil
+	})
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, err
+}
+
+// hashFile is the hex SHA-256 of a file's contents
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *embeddedCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// get copies the cached preview to w, if there is one
+func (c *embeddedCache) get(key string, w io.Writer) bool {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		e.used = time.Now()
+	}
+	c.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		c.remove(key)
+		return false
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return false
+	}
+	os.Chtimes(f.Name(), time.Now(), time.Now())
+	return true
+}
+
+// put caches the preview in r, written to a temp name then renamed so
+// concurrent readers never see part of it
+func (c *embeddedCache) put(key string, r io.Reader) {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logf("warn", "Could not cache preview: %s", err)
+		return
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "*.tmp")
+	if err != nil {
+		logf("warn", "Could not cache preview: %s", err)
+		return
+	}
+	size, err := io.Copy(f, r)
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		logf("warn", "Could not cache preview: %s", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[key]; ok {
+		c.size -= old.size
+	}
+	c.entries[key] = &cacheEntry{size, time.Now()}
+	c.size += size
+	c.evict()
+}
+
+func (c *embeddedCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.size
+		delete(c.entries, key)
+	}
+	os.Remove(c.path(key))
+}
+
+// evict removes the least recently used previews until under the limit,
+// with c.mu held
+func (c *embeddedCache) evict() {
+	for c.size > c.limit && len(c.entries) > 0 {
+		var oldest string
+		for key, e := range c.entries {
+			if oldest == "" || e.used.Before(c.entries[oldest].used) {
+				oldest = key
+			}
+		}
+		c.size -= c.entries[oldest].size
+		delete(c.entries, oldest)
+		os.Remove(c.path(oldest))
+	}
+}
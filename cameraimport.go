@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the "imaging import" command
+var (
+	gphoto2Path    string
+	cameraPort     string
+	importDir      string
+	importManifest string
+)
+
+// Imported is a file pulled off the camera, as the manifest keeps it
+type Imported struct {
+	Folder   string    `json:"folder"`
+	File     string    `json:"file"`
+	Local    string    `json:"local"`
+	Imported time.Time `json:"imported"`
+	Id       int       `json:"id"`
+	Error    string    `json:"error,omitempty"`
+	Preview  string    `json:"preview,omitempty"`
+}
+
+// cameraFile is a file gphoto2 lists, Number being how it's asked for
+type cameraFile struct {
+	folder, name string
+	number       int
+}
+
+// gphoto2's folder headers and file lines, "#12  IMG_0012.CR3  rd ..."
+var (
+	gphotoFolder = regexp.MustCompile(`in folder '([^']*)'`)
+	gphotoFile   = regexp.MustCompile(`^#(\d+)\s+(\S+)`)
+)
+
+// importCamera pulls the files of the connected camera (or -cameraPort's)
+// that -importManifest doesn't have yet into -importDir over PTP, with
+// gphoto2, and submits a task for each, numbered from 1. The manifest has
+// every file imported, with its result once it's done.
+func importCamera(template Task, submit func([]byte, func(TaskResult))) error {
+	manifest := importManifest
+	if manifest == "" {
+		manifest = filepath.Join(importDir, "manifest.json")
+	}
+	var imported []Imported
+	if data, err := ioutil.ReadFile(manifest); err == nil {
+		if err := json.Unmarshal(data, &imported); err != nil {
+			return fmt.Errorf("Could not read %s: %s", manifest, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	had := map[string]bool{}
+	for _, i := range imported {
+		had[i.Folder+"/"+i.File] = true
+	}
+
+	files, err := listCamera()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(importDir, 0755); err != nil {
+		return err
+	}
+
+	// the manifest is saved as each file is pulled and as it's processed, so
+	// an import that's cut short isn't pulled all over again
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	save := func() {
+		if err := writeManifest(manifest, imported); err != nil {
+			logf("error", "Could not save %s: %s", manifest, err)
+		}
+	}
+	id := 0
+	for _, f := range files {
+		if had[f.folder+"/"+f.name] {
+			continue
+		}
+		local, err := pullFile(f)
+		if err != nil {
+			logf("error", "Could not import %s/%s: %s", f.folder, f.name, err)
+			continue
+		}
+		id++
+		task, err := fileTask(template, id, local)
+		mu.Lock()
+		entry := len(imported)
+		imported = append(imported, Imported{Folder: f.folder, File: f.name, Local: local, Imported: time.Now().UTC(), Id: id})
+		if err != nil {
+			imported[entry].Error = err.Error()
+		}
+		save()
+		mu.Unlock()
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		submit(task, func(r TaskResult) {
+			mu.Lock()
+			imported[entry].Error, imported[entry].Preview = r.Error, r.Response.Preview
+			save()
+			mu.Unlock()
+			wg.Done()
+		})
+	}
+	wg.Wait()
+	logf("info", "Imported %d files from the camera", id)
+	return nil
+}
+
+func writeManifest(manifest string, imported []Imported) error {
+	data, err := json.MarshalIndent(imported, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := manifest + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, manifest)
+}
+
+func gphoto2(args ...string) *exec.Cmd {
+	if cameraPort != "" {
+		args = append([]string{"--port", cameraPort}, args...)
+	}
+	return exec.Command(gphoto2Path, args...)
+}
+
+// listCamera is every file on the camera, in every folder
+func listCamera() ([]cameraFile, error) {
+	var stderr bytes.Buffer
+	cmd := gphoto2("--list-files")
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, &codedError{code: "CAMERA_FAILED", msg: fmt.Sprintf("gphoto2 could not list the camera's files: %s", err), detail: strings.TrimSpace(stderr.String())}
+	}
+
+	var files []cameraFile
+	var folder string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := gphotoFolder.FindStringSubmatch(line); m != nil {
+			folder = m[1]
+		} else if m := gphotoFile.FindStringSubmatch(line); m != nil && folder != "" {
+			var n int
+			fmt.Sscan(m[1], &n)
+			files = append(files, cameraFile{folder, m[2], n})
+		}
+	}
+	return files, nil
+}
+
+// pullFile copies a file off the camera into -importDir, as a new name if
+// there's one like it already (say from another card)
+func pullFile(f cameraFile) (string, error) {
+	ext := filepath.Ext(f.name)
+	local := filepath.Join(importDir, f.name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(local); os.IsNotExist(err) {
+			break
+		}
+		local = filepath.Join(importDir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(f.name, ext), i, ext))
+	}
+
+	var stderr bytes.Buffer
+	cmd := gphoto2("--folder", f.folder, "--get-file", fmt.Sprint(f.number), "--filename", local)
+	cmd.Stdout, cmd.Stderr = ioutil.Discard, &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(local)
+		return "", &codedError{code: "CAMERA_FAILED", msg: fmt.Sprintf("gphoto2 failed: %s", err), detail: strings.TrimSpace(stderr.String())}
+	}
+	return local, nil
+}
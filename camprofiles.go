@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	cameraProfilesPath string
+	cameraProfiles     []cameraProfile
+)
+
+// cameraProfile is how to render RAWs from cameras matching Camera, a glob
+// like "Fujifilm X-*" of dcraw's make and model (case doesn't matter). The
+// first match in -cameraProfiles is used.
+type cameraProfile struct {
+	Camera string `json:"camera"`
+	// DcrawArgs are added when demosaicing, e.g. ["-q", "3"]
+	DcrawArgs []string `json:"dcrawArgs"`
+	// Curve is [[in, out], ...] from 0 to 255, straight lines in between
+	Curve   [][2]float64 `json:"curve"`
+	Sharpen *SharpenOp   `json:"sharpen"`
+}
+
+func loadCameraProfiles(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(data, &cameraProfiles)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not read -cameraProfiles: %s", err)
+	}
+	for _, p := range cameraProfiles {
+		if _, err := filepath.Match(strings.ToLower(p.Camera), ""); err != nil {
+			return fmt.Errorf("Invalid camera %q in -cameraProfiles: %s", p.Camera, err)
+		}
+		for _, arg := range p.DcrawArgs {
+			// these choose what dcraw renders, which the pipeline decides
+			switch arg {
+			case "-c", "-e", "-h", "-T", "-i", "-v":
+				return fmt.Errorf("%s can't be in the dcrawArgs of %q", arg, p.Camera)
+			}
+		}
+		if err := checkCurve(p.Curve); err != nil {
+			return fmt.Errorf("Invalid curve of %q in -cameraProfiles: %s", p.Camera, err)
+		}
+	}
+	return nil
+}
+
+// checkCurve makes sure a curve's points are in 0-255 and go left to right,
+// or applyCurve would divide by zero between two at the same x
+func checkCurve(curve [][2]float64) error {
+	for i, pt := range curve {
+		if pt[0] < 0 || pt[0] > 255 || pt[1] < 0 || pt[1] > 255 {
+			return fmt.Errorf("point %v isn't within 0-255", pt)
+		}
+		if i > 0 && pt[0] <= curve[i-1][0] {
+			return fmt.Errorf("point %v isn't right of %v", pt, curve[i-1])
+		}
+	}
+	return nil
+}
+
+// profileFor is the profile of the camera that took filename, nil if none
+// matches (or it's not a RAW)
+func profileFor(filename string) *cameraProfile {
+	if len(cameraProfiles) == 0 {
+		return nil
+	}
+	raw, err := identify(filename)
+	if err != nil {
+		return nil
+	}
+	camera := strings.ToLower(raw.Camera)
+	for i, p := range cameraProfiles {
+		if ok, _ := filepath.Match(strings.ToLower(p.Camera), camera); ok {
+			return &cameraProfiles[i]
+		}
+	}
+	return nil
+}
+
+// apply gives a demosaiced image the profile's tone curve and sharpening
+func (p *cameraProfile) apply(img image.Image) image.Image {
+	if p == nil {
+		return img
+	}
+	if len(p.Curve) > 0 {
+		img = applyCurve(img, p.Curve)
+	}
+	if p.Sharpen != nil {
+		img = sharpen(img, p.Sharpen.Amount, p.Sharpen.Radius)
+	}
+	return img
+}
+
+func applyCurve(img image.Image, curve [][2]float64) image.Image {
+	var lut [256]uint8
+	for i := range lut {
+		x := float64(i)
+		y := x
+		for j, pt := range curve {
+			if x <= pt[0] {
+				if j == 0 {
+					y = pt[1]
+				} else {
+					prev := curve[j-1]
+					y = prev[1] + (pt[1]-prev[1])*(x-prev[0])/(pt[0]-prev[0])
+				}
+				break
+			}
+			// past the last point
+			y = pt[1]
+		}
+		lut[i] = uint8(clampInt(int(y+0.5), 0, 255))
+	}
+
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] = lut[dst.Pix[i]]
+		dst.Pix[i+1] = lut[dst.Pix[i+1]]
+		dst.Pix[i+2] = lut[dst.Pix[i+2]]
+	}
+	return dst
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCheckCurve(t *testing.T) {
+	tests := []struct {
+		name    string
+		curve   [][2]float64
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"S curve", [][2]float64{{0, 0}, {64, 50}, {192, 205}, {255, 255}}, false},
+		{"one point", [][2]float64{{128, 140}}, false},
+		{"the same x twice", [][2]float64{{0, 0}, {128, 100}, {128, 160}, {255, 255}}, true},
+		{"backwards", [][2]float64{{0, 0}, {192, 205}, {64, 50}}, true},
+		{"past 255", [][2]float64{{0, 0}, {300, 255}}, true},
+		{"negative", [][2]float64{{0, -10}, {255, 255}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkCurve(tt.curve); (err != nil) != tt.wantErr {
+				t.Errorf("checkCurve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestApplyCurve(t *testing.T) {
+	tests := []struct {
+		name  string
+		curve [][2]float64
+		in    uint8
+		want  uint8
+	}{
+		{"between points", [][2]float64{{0, 0}, {100, 200}}, 50, 100},
+		{"before the first", [][2]float64{{100, 50}, {200, 150}}, 10, 50},
+		{"past the last", [][2]float64{{0, 0}, {100, 200}}, 150, 200},
+		{"inverted", [][2]float64{{0, 255}, {255, 0}}, 55, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewGray(image.Rect(0, 0, 1, 1))
+			img.SetGray(0, 0, color.Gray{tt.in})
+			got := applyCurve(img, tt.curve).(*image.RGBA).Pix
+			if got[0] != tt.want || got[1] != tt.want || got[2] != tt.want {
+				t.Errorf("applyCurve() = %v, want %d", got[:3], tt.want)
+			}
+			if got[3] != 0xff {
+				t.Errorf("applyCurve() alpha = %d, want 255", got[3])
+			}
+		})
+	}
+}
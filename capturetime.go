@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the EXIF tags with the capture time
+const (
+	tagDateTime            = 306
+	tagExifIFD             = 34665
+	tagDateTimeOriginal    = 36867
+	tagDateTimeDigitized   = 36868
+	tagOffsetTimeOriginal  = 36881
+	tagOffsetTimeDigitized = 36882
+)
+
+// sourceTime is when the task's photo was taken, or the file's modification
+// time if that can't be told
+func sourceTime(t Task) (time.Time, error) {
+	when, err := captureTime(t.Filename)
+	if err == nil {
+		return when, nil
+	}
+	logTaskf(t.Id, "warn", "Using the modification time of %s: %s", t.Filename, err)
+	info, err := os.Stat(t.Filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// captureTime is when the photo was taken: the EXIF DateTimeOriginal of
+// JPEGs and TIFF based RAWs (in the local time zone unless they say),
+// otherwise the timestamp dcraw reads
+func captureTime(filename string) (time.Time, error) {
+	if r, err := exifReader(filename); err == nil {
+		if when, ok := exifTime(r); ok {
+			return when, nil
+		}
+	}
+	raw, err := identify(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// (dcraw prints it with ctime)
+	when, err := time.ParseInLocation(time.ANSIC, raw.Timestamp, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("No capture time in %s", filename)
+	}
+	return when, nil
+}
+
+// exifReader is the TIFF structure holding a file's EXIF, the file itself
+// unless it's a JPEG
+func exifReader(filename string) (io.ReaderAt, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return bytes.NewReader(data), nil
+	}
+	for _, s := range jpegSegments(data) {
+		if s[1] == 0xe1 && bytes.HasPrefix(s[4:], []byte("Exif\x00\x00")) {
+			return bytes.NewReader(s[10:]), nil
+		}
+	}
+	return nil, fmt.Errorf("No EXIF in %s", filename)
+}
+
+func exifTime(r io.ReaderAt) (time.Time, bool) {
+	offsets, order, err := tiffIFDs(r)
+	if err != nil || len(offsets) == 0 {
+		return time.Time{}, false
+	}
+	ifd0, err := readIFD(r, order, offsets[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+	tags := []map[uint16]tiffEntry{}
+	if e, ok := ifd0[tagExifIFD]; ok {
+		if exif, err := readIFD(r, order, uint32(e.value(order))); err == nil {
+			tags = append(tags, exif)
+		}
+	}
+	tags = append(tags, ifd0)
+
+	for _, ifd := range tags {
+		for _, tag := range []uint16{tagDateTimeOriginal, tagDateTimeDigitized, tagDateTime} {
+			e, ok := ifd[tag]
+			if !ok || e.Type != 2 {
+				continue
+			}
+			value := strings.TrimRight(string(e.Data), "\x00 ")
+			location := time.Local
+			offsetTag := map[uint16]uint16{tagDateTimeOriginal: tagOffsetTimeOriginal, tagDateTimeDigitized: tagOffsetTimeDigitized}[tag]
+			if o, ok := ifd[offsetTag]; ok && o.Type == 2 {
+				if zone, err := time.Parse("-07:00", strings.TrimRight(string(o.Data), "\x00 ")); err == nil {
+					location = zone.Location()
+				}
+			}
+			if when, err := time.ParseInLocation("2006:01:02 15:04:05", value, location); err == nil {
+				return when, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// datedOutputDir is the task's OutputDir with the capture date's folders
+// added, "2024/05/17"
+func datedOutputDir(t Task, when time.Time) (string, error) {
+	if t.OutputDir == "" {
+		return "", fmt.Errorf("dateFolders needs an outputDir")
+	}
+	date := when.Format("2006/01/02")
+	if isRemote(t.OutputDir) {
+		u, err := url.Parse(t.OutputDir)
+		if err != nil {
+			return "", err
+		}
+		u.Path = path.Join(u.Path, date)
+		return u.String(), nil
+	}
+	dir := filepath.Join(t.OutputDir, filepath.FromSlash(date))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", noSpace(err)
+	}
+	return dir, nil
+}
+
+// setCaptureTimes sets the modification time of the local outputs
+func setCaptureTimes(r Resp, when time.Time) {
+	for _, f := range r.files() {
+		if f != "" && !isRemote(f) {
+			os.Chtimes(f, when, when)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// the "imaging process <files>" (and identify and watch) commands, which make
+// the tasks themselves
+var (
+	preset    string
+	recursive bool
+	ignore    stringList
+)
+
+// stringList is a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// presets are the task templates -preset can name, other than a JSON file
+var presets = map[string]Task{
+	"web":      {Format: "jpeg"},
+	"png":      {Format: "png"},
+	"cull":     {Scores: true, Regions: true},
+	"tiles":    {Op: "tiles"},
+	"identify": {Op: "identify"},
+}
+
+// the extensions looked for in directories, dcraw's RAWs and what we decode
+var imageExts = map[string]bool{
+	".3fr": true, ".arw": true, ".cr2": true, ".cr3": true, ".crw": true, ".dcr": true,
+	".dng": true, ".erf": true, ".iiq": true, ".k25": true, ".kdc": true, ".mef": true,
+	".mos": true, ".mrw": true, ".nef": true, ".nrw": true, ".orf": true, ".pef": true,
+	".raf": true, ".raw": true, ".rw2": true, ".rwl": true, ".sr2": true, ".srf": true,
+	".srw": true, ".x3f": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".tif": true, ".tiff": true,
+	".pbm": true, ".pgm": true, ".ppm": true, ".pnm": true, ".psd": true, ".psb": true,
+	".gif": true,
+}
+
+// version is set when building, with -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+// command is a subcommand, "imaging <name> [flags] [args]"
+type command struct {
+	usage, about string
+	// flags are the command's own, on top of the ones every command takes
+	flags func(fs *flag.FlagSet)
+	// args is whether it takes files (or directories) after, or among, the flags
+	args bool
+}
+
+var commands = map[string]command{
+	"serve": {
+		usage: "imaging [serve] [flags]",
+		about: "Handles JSON tasks from stdin, or from redis with -redis, kafka with -kafka or HTTP with -http, writing a result for each.",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&redisURL, "redis", "", "read tasks from and push results to redis at this URL, instead of stdin/stdout")
+			fs.StringVar(&redisTasks, "redisTasks", "imaging:tasks", "redis list (or stream, with -redisGroup) to take tasks from")
+			fs.StringVar(&redisResults, "redisResults", "imaging:results", "redis list (or stream, with -redisGroup) to push results to")
+			fs.StringVar(&redisGroup, "redisGroup", "", "use redis streams with this consumer group")
+			fs.StringVar(&redisConsumer, "redisConsumer", "", "consumer name within -redisGroup (default host-pid)")
+			fs.StringVar(&kafkaBrokers, "kafka", "", "consume tasks from and produce results to kafka at these brokers (comma separated), instead of stdin/stdout")
+			fs.StringVar(&kafkaTasks, "kafkaTasks", "imaging.tasks", "kafka topic to consume tasks from")
+			fs.StringVar(&kafkaResults, "kafkaResults", "imaging.results", "kafka topic to produce results to")
+			fs.StringVar(&kafkaGroup, "kafkaGroup", "imaging", "kafka consumer group, which shares out the task topic's partitions")
+			fs.StringVar(&kafkaKey, "kafkaKey", "id", "key results by the task's \"id\", or \"none\"")
+			fs.StringVar(&httpAddr, "http", "", "take batches of tasks POSTed to /tasks at this address, streaming back each result as it's done, instead of stdin/stdout")
+			fs.Int64Var(&httpBodyMB, "httpBodyMB", 16, "with -http, the largest batch of tasks taken, in MB")
+			fs.DurationVar(&httpWriteTimeout, "httpWriteTimeout", time.Hour, "with -http, the longest a batch's results (or a render) can take to send back")
+			fs.StringVar(&renderRoot, "renderRoot", "", "with -http, serve /render for the files in this directory")
+			fs.StringVar(&renderCacheDir, "renderCache", "", "with -http, cache what /render makes in this directory")
+			fs.Int64Var(&renderCacheMB, "renderCacheMB", 1024, "evict the least recently used from -renderCache past this size")
+			fs.BoolVar(&zstdInput, "zstdInput", false, "tasks on stdin are zstd compressed")
+			fs.Float64Var(&clientRate, "clientRate", 0, "tasks a second each apiKey (or without -clientKeys, each -http client) can send before they're RATE_LIMITED, 0 for no limit")
+			fs.IntVar(&clientBurst, "clientBurst", 10, "tasks a client can send at once, within -clientRate")
+			fs.IntVar(&clientDaily, "clientDaily", 0, "tasks a client can send a day before they're QUOTA_EXCEEDED, 0 for no limit")
+			fs.StringVar(&clientKeysPath, "clientKeys", "", "JSON object of the only apiKeys accepted, each with its own {rate, burst, daily, workers, outputDir, inputDir, tenant}")
+		},
+	},
+	"process": {
+		usage: "imaging process [flags] <files, globs or directories>",
+		about: "Makes a task for each file, numbered from 1, and writes their results.",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&preset, "preset", "", "the task to run on each file: web, png, cull, tiles, identify, one of -presets or a .json file")
+			fs.BoolVar(&recursive, "r", false, "look for images in directories too")
+			fs.Var(&ignore, "ignore", "skip files and directories matching this pattern (can be repeated)")
+		},
+		args: true,
+	},
+	"identify": {
+		usage: "imaging identify [flags] <files, globs or directories>",
+		about: "Writes what's known about each file (its camera, size and metadata) without rendering it.",
+		flags: func(fs *flag.FlagSet) {
+			fs.BoolVar(&recursive, "r", false, "look for images in directories too")
+			fs.Var(&ignore, "ignore", "skip files and directories matching this pattern (can be repeated)")
+		},
+		args: true,
+	},
+	"watch": {
+		usage: "imaging watch [flags] <directories or globs>",
+		about: "Processes images as they're added to (or change in) the directories and their subdirectories, until stopped.",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&preset, "preset", "", "the task to run on each file: web, png, cull, tiles, identify, one of -presets or a .json file")
+			fs.Var(&ignore, "ignore", "skip files and directories matching this pattern (can be repeated)")
+			fs.DurationVar(&watchInterval, "watchInterval", 2*time.Second, "how often to look for new files")
+			fs.BoolVar(&watchExisting, "watchExisting", false, "process the files already there too")
+		},
+		args: true,
+	},
+	"import": {
+		usage: "imaging import [flags]",
+		about: "Pulls the files it hasn't yet off a camera connected over USB (PTP, with gphoto2) into -importDir, processes each and keeps a manifest of what was imported.",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&preset, "preset", "", "the task to run on each file: web, png, cull, tiles, identify, one of -presets or a .json file")
+			fs.StringVar(&gphoto2Path, "gphoto2", "gphoto2", "path to gphoto2")
+			fs.StringVar(&cameraPort, "cameraPort", "", "gphoto2 port of the camera, e.g. usb:001,004, if there's more than one")
+			fs.StringVar(&importDir, "importDir", ".", "directory to import files into")
+			fs.StringVar(&importManifest, "importManifest", "", "JSON manifest of the files imported so far (default manifest.json in -importDir)")
+		},
+	},
+	"schema": {
+		usage: "imaging schema [-of task|result]",
+		about: "Prints the JSON Schema of tasks, which they're checked against, or of results. With -http they're at /schema/task and /schema/result too.",
+		flags: func(fs *flag.FlagSet) {
+			fs.StringVar(&schemaOf, "of", "task", "the schema to print, task or result")
+		},
+	},
+	"version": {
+		usage: "imaging version",
+		about: "Prints the version.",
+	},
+}
+
+// parseArgs picks the command and parses its flags, from the environment
+// then the command line, and the files (which the flags can follow) for
+// commands that take them. Without a command it's serve, as it was before
+// there were commands.
+func parseArgs() (name string, files []string, err error) {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	c, ok := commands[name]
+	if !ok {
+		return "", nil, fmt.Errorf("Unknown command %q (serve, process, identify, watch, import, schema or version)", name)
+	}
+
+	// the command's flags and everybody's, printed apart
+	own := flag.NewFlagSet(name, flag.ExitOnError)
+	if c.flags != nil {
+		c.flags(own)
+	}
+	fs := flag.NewFlagSet("imaging "+name, flag.ExitOnError)
+	own.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "usage: %s\n\n%s\n", c.usage, c.about)
+		if name == "serve" {
+			fmt.Fprintf(out, "\nThe other commands are process, identify, watch, import, schema and version, see imaging <command> -h\n")
+		}
+		if c.flags != nil {
+			fmt.Fprintf(out, "\nFlags:\n")
+			own.SetOutput(out)
+			own.PrintDefaults()
+		}
+		fmt.Fprintf(out, "\nFlags of every command:\n")
+		flag.CommandLine.SetOutput(out)
+		flag.PrintDefaults()
+	}
+
+	if err := applyEnv(fs); err != nil {
+		return "", nil, err
+	}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return "", nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		if !c.args {
+			return "", nil, fmt.Errorf("Unexpected %q, usage: %s", fs.Arg(0), c.usage)
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if c.args && len(files) == 0 {
+		return "", nil, fmt.Errorf("Nothing to %s, usage: %s", name, c.usage)
+	}
+	return name, files, nil
+}
+
+// presetTask is the task -preset names (in -presets first), or reads from a .json file
+func presetTask() (Task, error) {
+	if preset == "" {
+		return Task{}, nil
+	}
+	namedPresetsMu.RLock()
+	_, named := namedPresets[preset]
+	namedPresetsMu.RUnlock()
+	if named {
+		// looked up as each task is handled, so reloads apply
+		return Task{Preset: preset}, nil
+	}
+	if t, ok := presets[preset]; ok {
+		return t, nil
+	}
+	if strings.HasSuffix(preset, ".json") {
+		var t Task
+		data, err := ioutil.ReadFile(preset)
+		if err == nil {
+			err = json.Unmarshal(data, &t)
+		}
+		if err == nil && t.Preset != "" {
+			// the file's own preset under it, for fileTask to leave be
+			base, err := lookupPreset(t.Preset)
+			if err != nil {
+				return Task{}, err
+			}
+			if err := json.Unmarshal(data, &base); err != nil {
+				return Task{}, err
+			}
+			t = base
+			t.Preset = ""
+		}
+		if err != nil {
+			return Task{}, fmt.Errorf("Could not read preset %s: %s", preset, err)
+		}
+		return t, nil
+	}
+	return Task{}, fmt.Errorf("Unknown preset %q", preset)
+}
+
+// ignored is whether a -ignore pattern matches the file's name or path
+func ignored(filename string) bool {
+	for _, pattern := range ignore {
+		if ok, _ := filepath.Match(pattern, filepath.Base(filename)); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filename); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// expandFiles expands globs the shell didn't, and directories (only with -r)
+func expandFiles(args []string) []string {
+	var files []string
+	for _, arg := range args {
+		matches := []string{arg}
+		if _, err := os.Stat(arg); os.IsNotExist(err) {
+			if m, _ := filepath.Glob(arg); len(m) > 0 {
+				matches = m
+			}
+		}
+
+		for _, name := range matches {
+			if ignored(name) {
+				continue
+			}
+			info, err := os.Stat(name)
+			if err != nil || !info.IsDir() {
+				// let the task report what's wrong with it
+				files = append(files, name)
+				continue
+			}
+			if !recursive {
+				logf("warn", "Skipping directory %s, use -r to process it", name)
+				continue
+			}
+			filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					logf("warn", "Could not read %s: %s", path, err)
+					return nil
+				}
+				if path != name && ignored(path) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if !info.IsDir() && imageExts[strings.ToLower(filepath.Ext(path))] {
+					files = append(files, path)
+				}
+				return nil
+			})
+		}
+	}
+	return files
+}
+
+// processFiles hands a task for each file to handle, numbered from 1
+func processFiles(args []string, template Task, handle func([]byte, func())) error {
+	for i, filename := range expandFiles(args) {
+		task, err := fileTask(template, i+1, filename)
+		if err != nil {
+			return err
+		}
+		handle(task, func() {})
+	}
+	return nil
+}
+
+// fileTask is the template for a file, marshalled for handle
+func fileTask(template Task, id int, filename string) ([]byte, error) {
+	t := template
+	if t.Preset != "" {
+		// a -presets one, filled in here (as each file's found, so reloads
+		// apply) as t is marshalled whole, zero values and all, which
+		// applyPreset would take as set over it
+		var err error
+		if t, err = lookupPreset(t.Preset); err != nil {
+			return nil, err
+		}
+		t.Preset = ""
+	}
+	t.Id = id
+	t.Filename = filename
+	t.FilenameBase64 = filenameBase64(filename)
+	// with the width dcraw can decode at half size when that's enough
+	if t.Op == "" && t.ImageWidth == 0 {
+		if raw, err := identify(filename); err == nil {
+			t.ImageWidth = uint(raw.Width)
+		}
+	}
+	return marshal(t)
+}
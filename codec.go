@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// encoding of tasks and results, "json" (NDJSON) or "msgpack" (concatenated
+// MessagePack values, with the same field names as the JSON). Logs and
+// progress events stay JSON either way.
+var encoding string
+
+func checkEncoding() error {
+	switch encoding {
+	case "json", "msgpack":
+		return nil
+	}
+	return fmt.Errorf("Unknown -encoding %q (json or msgpack)", encoding)
+}
+
+func unmarshalTask(data []byte, t *Task) error {
+	if encoding == "json" {
+		if err := validateTask(data); err != nil {
+			return err
+		}
+	}
+	return unmarshal(data, t)
+}
+
+func unmarshal(data []byte, v interface{}) error {
+	if encoding == "msgpack" {
+		dec := msgpack.NewDecoder(bytes.NewReader(data))
+		dec.SetCustomStructTag("json")
+		return dec.Decode(v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func marshal(v interface{}) ([]byte, error) {
+	if encoding == "msgpack" {
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		err := enc.Encode(v)
+		return buf.Bytes(), err
+	}
+	return json.Marshal(v)
+}
+
+// Meta is a task's own data, echoed back in its result as it was sent
+// (whatever the encoding, it's never decoded)
+type Meta []byte
+
+func (m Meta) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	return m, nil
+}
+
+func (m *Meta) UnmarshalJSON(data []byte) error {
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+func (m Meta) EncodeMsgpack(enc *msgpack.Encoder) error {
+	if m == nil {
+		return enc.EncodeNil()
+	}
+	return enc.Encode(msgpack.RawMessage(m))
+}
+
+func (m *Meta) DecodeMsgpack(dec *msgpack.Decoder) error {
+	raw, err := dec.DecodeRaw()
+	*m = Meta(raw)
+	return err
+}
+
+// readTasks calls handle with each task read from r, NDJSON lines or
+// MessagePack values. An inline task is followed by its file, its length
+// as 8 bytes (big endian) then that many bytes, which becomes its Filename
+// until its result is written.
+func readTasks(r io.Reader, handle func([]byte, func())) error {
+	br := bufio.NewReader(r)
+	next := func() ([]byte, error) {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		return bytes.TrimSuffix(line, []byte("\n")), err
+	}
+	if encoding == "msgpack" {
+		// the decoder reads br directly, as a ByteScanner, so what it
+		// hasn't decoded is still there for readInline
+		dec := msgpack.NewDecoder(br)
+		next = func() ([]byte, error) {
+			raw, err := dec.DecodeRaw()
+			return raw, err
+		}
+	}
+
+	for {
+		task, err := next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// whether its file follows is all that's read first, as it has to
+		// be read past however the rest of the task turns out
+		var head struct {
+			Inline bool `json:"inline"`
+		}
+		if !bytes.Contains(task, []byte("inline")) || unmarshal(task, &head) != nil || !head.Inline {
+			handle(task, func() {})
+			continue
+		}
+		var t Task
+		if unmarshalTask(task, &t) != nil {
+			if err := skipInline(br); err != nil {
+				return fmt.Errorf("Could not read past the file of an invalid inline task: %s", err)
+			}
+			// to fail as it would have
+			handle(task, func() {})
+			continue
+		}
+		filename, err := readInline(br, t)
+		if err != nil {
+			return fmt.Errorf("Could not read the file of inline task %d: %s", t.Id, err)
+		}
+		// the task as it was sent but for its file, not t marshalled whole,
+		// which applyPreset would take as setting every field
+		task, err = setFields(task, map[string]interface{}{"filename": filename, "filenameBase64": nil, "inline": false})
+		if err != nil {
+			removeTemp(filename)
+			return err
+		}
+		handle(task, func() { removeTemp(filename) })
+	}
+}
+
+// setFields is an encoded task with the fields set (or, if nil, removed)
+// and the rest left as they were
+func setFields(task []byte, fields map[string]interface{}) ([]byte, error) {
+	if encoding == "msgpack" {
+		var m map[string]msgpack.RawMessage
+		if err := unmarshal(task, &m); err != nil {
+			return nil, err
+		}
+		for name, v := range fields {
+			delete(m, name)
+			if v != nil {
+				raw, err := msgpack.Marshal(v)
+				if err != nil {
+					return nil, err
+				}
+				m[name] = raw
+			}
+		}
+		return marshal(m)
+	}
+
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(task, &m); err != nil {
+		return nil, err
+	}
+	for name, v := range fields {
+		delete(m, name)
+		if v != nil {
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			m[name] = raw
+		}
+	}
+	return json.Marshal(m)
+}
+
+// readInline copies an inline task's file to a temp file, named like its
+// Filename (if it has one) for the extension
+func readInline(r io.Reader, t Task) (string, error) {
+	var length uint64
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	f, err := createTemp("*" + filepath.Ext(t.Filename))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(f, r, int64(length)); err != nil {
+		removeTemp(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// skipInline reads past an inline task's file
+func skipInline(r io.Reader) error {
+	var length uint64
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, r, int64(length))
+	return err
+}
+
+// writeRecord writes a result, a line unless it's MessagePack (which frames itself)
+func (s *stream) writeRecord(record []byte) error {
+	if encoding == "msgpack" && s.concurrent {
+		_, err := s.w.Write(record)
+		return err
+	}
+	if encoding == "msgpack" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, err := s.w.Write(record); err != nil {
+			return err
+		}
+		return s.written()
+	}
+	return s.writeLine(record)
+}
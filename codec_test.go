@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/vmihailenco/msgpack/v5"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMetaMsgpack(t *testing.T) {
+	defer func(e string) { encoding = e }(encoding)
+	encoding = "msgpack"
+
+	meta, err := msgpack.Marshal(map[string]interface{}{"album": "trip", "ids": []int{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		meta Meta
+	}{
+		{"a map", Meta(meta)},
+		{"a string", Meta{0xa3, 'a', 'b', 'c'}},
+		{"none", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := marshal(Task{Id: 7, Meta: tt.meta, Filename: "a.cr2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Task
+			if err := unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Id != 7 || got.Filename != "a.cr2" {
+				t.Errorf("unmarshal() = id %d, filename %q, want 7, a.cr2", got.Id, got.Filename)
+			}
+			if !bytes.Equal(got.Meta, tt.meta) {
+				t.Errorf("Meta = %x, want %x", []byte(got.Meta), []byte(tt.meta))
+			}
+
+			// and back out in its result as it came in
+			data, err = marshal(TaskResult{Id: got.Id, Meta: got.Meta})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r TaskResult
+			if err := unmarshal(data, &r); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(r.Meta, tt.meta) {
+				t.Errorf("result Meta = %x, want %x", []byte(r.Meta), []byte(tt.meta))
+			}
+		})
+	}
+}
+
+func TestReadInlineTask(t *testing.T) {
+	defer func(e string, named map[string]json.RawMessage) { encoding, namedPresets = e, named }(encoding, namedPresets)
+	namedPresets = map[string]json.RawMessage{"site": json.RawMessage(`{"format":"png","thumbWidth":120}`)}
+	file := []byte("not really a jpeg")
+	// what it sets over its preset, and so has to come through as it was sent
+	sent := map[string]interface{}{"id": 3, "inline": true, "filename": "a.jpg", "preset": "site", "thumbWidth": 80}
+
+	tests := []struct {
+		encoding string
+	}{
+		{"json"},
+		{"msgpack"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			encoding = tt.encoding
+			task, err := marshal(sent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var in bytes.Buffer
+			in.Write(task)
+			if encoding == "json" {
+				in.WriteByte('\n')
+			}
+			binary.Write(&in, binary.BigEndian, uint64(len(file)))
+			in.Write(file)
+
+			var handled [][]byte
+			err = readTasks(&in, func(task []byte, done func()) {
+				handled = append(handled, task)
+				t.Cleanup(done)
+			})
+			if err != nil || len(handled) != 1 {
+				t.Fatalf("readTasks() = %d tasks, error %v, want 1", len(handled), err)
+			}
+			var got Task
+			if err := unmarshalTask(handled[0], &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyPreset(handled[0], &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Id != 3 || got.Inline || got.Format != "png" || got.ThumbWidth != 80 {
+				t.Errorf("task = id %d, inline %v, format %q, thumbWidth %d, want 3, false, png, 80", got.Id, got.Inline, got.Format, got.ThumbWidth)
+			}
+			if data, err := ioutil.ReadFile(got.Filename); err != nil || !bytes.Equal(data, file) {
+				t.Errorf("file %s = %q, %v, want %q", got.Filename, data, err, file)
+			}
+		})
+	}
+}
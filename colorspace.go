@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+	"sync"
+	"unicode/utf16"
+)
+
+// chromaticities are a color space's primaries and white point, in CIE xy
+type chromaticities struct {
+	r, g, b, w [2]float64
+}
+
+var (
+	d65 = [2]float64{0.3127, 0.3290}
+	d50 = [2]float64{0.3457, 0.3585}
+
+	sRGBSpace      = chromaticities{[2]float64{0.64, 0.33}, [2]float64{0.30, 0.60}, [2]float64{0.15, 0.06}, d65}
+	displayP3Space = chromaticities{[2]float64{0.680, 0.320}, [2]float64{0.265, 0.690}, [2]float64{0.150, 0.060}, d65}
+	// what dcraw renders with -o 4 (the widest it has, so nothing P3 has is lost)
+	proPhotoSpace = chromaticities{[2]float64{0.7347, 0.2653}, [2]float64{0.1596, 0.8404}, [2]float64{0.0366, 0.0001}, d50}
+)
+
+type matrix [3][3]float64
+
+func (m matrix) mul(n matrix) matrix {
+	var p matrix
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				p[i][j] += m[i][k] * n[k][j]
+			}
+		}
+	}
+	return p
+}
+
+func (m matrix) apply(v [3]float64) [3]float64 {
+	var p [3]float64
+	for i := 0; i < 3; i++ {
+		p[i] = m[i][0]*v[0] + m[i][1]*v[1] + m[i][2]*v[2]
+	}
+	return p
+}
+
+func (m matrix) inverse() matrix {
+	det := m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+	var inv matrix
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			// the cofactor of (j, i), over the determinant
+			a, b := (j+1)%3, (j+2)%3
+			c, d := (i+1)%3, (i+2)%3
+			inv[i][j] = (m[a][c]*m[b][d] - m[a][d]*m[b][c]) / det
+		}
+	}
+	return inv
+}
+
+// xyz is a chromaticity as XYZ, with Y 1
+func xyz(c [2]float64) [3]float64 {
+	return [3]float64{c[0] / c[1], 1, (1 - c[0] - c[1]) / c[1]}
+}
+
+// toXYZ is the matrix from the space's linear RGB to XYZ, under its own white
+func (c chromaticities) toXYZ() matrix {
+	r, g, b := xyz(c.r), xyz(c.g), xyz(c.b)
+	m := matrix{{r[0], g[0], b[0]}, {r[1], g[1], b[1]}, {r[2], g[2], b[2]}}
+	s := m.inverse().apply(xyz(c.w))
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			m[i][j] *= s[j]
+		}
+	}
+	return m
+}
+
+// bradford adapts XYZ under one white to how it looks under another
+func bradford(from, to [2]float64) matrix {
+	b := matrix{{0.8951, 0.2664, -0.1614}, {-0.7502, 1.7135, 0.0367}, {0.0389, -0.0685, 1.0296}}
+	f, t := b.apply(xyz(from)), b.apply(xyz(to))
+	scale := matrix{{t[0] / f[0], 0, 0}, {0, t[1] / f[1], 0}, {0, 0, t[2] / f[2]}}
+	return b.inverse().mul(scale).mul(b)
+}
+
+// conversion is the matrix from one space's linear RGB to another's
+func conversion(from, to chromaticities) matrix {
+	m := from.toXYZ()
+	if from.w != to.w {
+		m = bradford(from.w, to.w).mul(m)
+	}
+	return to.toXYZ().inverse().mul(m)
+}
+
+// sRGB and Display P3 share the sRGB transfer curve
+func srgbDecode(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// dcrawCurve is dcraw's BT.709 style curve of power 1/p and toe slope ts,
+// which it applies whatever the output space, and its inverse
+func dcrawCurve(p, ts float64) (decode, encode func(float64) float64) {
+	// the toe meets the power curve at t0 with the same slope, where
+	// (1+a) t0^(1/p) - a = ts t0 and (1+a)/p t0^(1/p-1) = ts
+	lo, hi := 1e-9, 1.0
+	var a, t0 float64
+	for i := 0; i < 60; i++ {
+		t0 = (lo + hi) / 2
+		a = ts * p * math.Pow(t0, 1-1/p) // 1+a, from the slopes
+		if a*math.Pow(t0, 1/p)-(a-1) > ts*t0 {
+			lo = t0
+		} else {
+			hi = t0
+		}
+	}
+	a--
+	knee := ts * t0
+	decode = func(v float64) float64 {
+		if v < knee {
+			return v / ts
+		}
+		return math.Pow((v+a)/(1+a), p)
+	}
+	encode = func(v float64) float64 {
+		if v < t0 {
+			return v * ts
+		}
+		return (1+a)*math.Pow(v, 1/p) - a
+	}
+	return decode, encode
+}
+
+// convertColors re-encodes img from one space to another through linear light,
+// with the curve it's encoded with (decode) and is to be (encode). Colors are
+// clipped to the new space, so wider to narrower loses those that don't fit.
+func convertColors(img image.Image, from, to chromaticities, decode, encode func(float64) float64) *image.RGBA {
+	m := conversion(from, to)
+
+	// tables either side of the matrix, as pow per pixel is slow
+	var linear [65536]float32
+	for i := range linear {
+		linear[i] = float32(decode(float64(i) / 65535))
+	}
+	const steps = 16384
+	var encoded [steps + 1]uint8
+	for i := range encoded {
+		encoded[i] = uint8(math.Round(encode(float64(i)/steps) * 255))
+	}
+	clip := func(v float64) uint8 {
+		if v <= 0 {
+			return 0
+		}
+		if v >= 1 {
+			return 255
+		}
+		return encoded[int(v*steps+0.5)]
+	}
+
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	src, ok := img.(*image.RGBA64)
+	if !ok {
+		src = image.NewRGBA64(dst.Bounds())
+		draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	}
+	sb := src.Bounds()
+	for y := 0; y < sb.Dy(); y++ {
+		row := src.Pix[y*src.Stride:]
+		out := dst.Pix[y*dst.Stride:]
+		for x := 0; x < sb.Dx(); x++ {
+			s := row[x*8:]
+			rgb := m.apply([3]float64{
+				float64(linear[int(s[0])<<8|int(s[1])]),
+				float64(linear[int(s[2])<<8|int(s[3])]),
+				float64(linear[int(s[4])<<8|int(s[5])]),
+			})
+			d := out[x*4:]
+			d[0], d[1], d[2] = clip(rgb[0]), clip(rgb[1]), clip(rgb[2])
+			d[3] = s[6]
+		}
+	}
+	return dst
+}
+
+// toDisplayP3 converts a decoded source to P3, which P3 tasks are worked on
+// in: from ProPhoto if dcraw rendered it (with -o 4 -6, see decodeSource),
+// otherwise from sRGB (which P3 holds all of)
+func toDisplayP3(img image.Image, t Task, demosaiced bool) image.Image {
+	if !demosaiced {
+		return convertColors(img, sRGBSpace, displayP3Space, srgbDecode, srgbEncode)
+	}
+	p := dcrawGamma
+	if t.Gamma != 0 {
+		p *= t.Gamma
+	}
+	// kept on dcraw's curve, so P3 tasks look like any other
+	decode, encode := dcrawCurve(p, dcrawSlope)
+	return convertColors(img, proPhotoSpace, displayP3Space, decode, encode)
+}
+
+// toSRGB converts an image worked on in P3 to sRGB
+func toSRGB(img image.Image) image.Image {
+	return convertColors(img, displayP3Space, sRGBSpace, srgbDecode, srgbEncode)
+}
+
+// writeDisplayP3 writes the P3 preview and thumbnail of a DisplayP3 task,
+// tagged as such
+func writeDisplayP3(t Task, preview, thumb image.Image) (string, string, error) {
+	t.icc = "p3"
+	var written []string
+	for i, img := range []image.Image{preview, thumb} {
+		f, err := createOutput(t)
+		if err != nil {
+			return "", "", err
+		}
+		err = encodeInSlot(f, img, t)
+		f.Close()
+		if err == nil {
+			var location string
+			location, _, err = publishOutput(t, f.Name(), outputName(t, f.Name(), []string{"previewP3", "thumbnailP3"}[i], formatExt(t)), formatType(t))
+			written = append(written, location)
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			for _, w := range written {
+				unpublishOutput(w)
+			}
+			return "", "", noSpace(err)
+		}
+	}
+	return written[0], written[1], nil
+}
+
+var (
+	iccOnce                       sync.Once
+	sRGBProfile, displayP3Profile []byte
+)
+
+// iccProfiles are the ICC profiles the outputs of P3 tasks are tagged with
+func iccProfiles() (srgb, p3 []byte) {
+	iccOnce.Do(func() {
+		sRGBProfile = iccProfile("sRGB", sRGBSpace)
+		displayP3Profile = iccProfile("Display P3", displayP3Space)
+	})
+	return sRGBProfile, displayP3Profile
+}
+
+// iccProfile is a v4 matrix/TRC display profile of a space with the sRGB
+// curve, adapted (as ICC does everything) to D50
+func iccProfile(name string, c chromaticities) []byte {
+	be := binary.BigEndian
+	s15 := func(v float64) []byte {
+		b := make([]byte, 4)
+		be.PutUint32(b, uint32(int32(math.Round(v*65536))))
+		return b
+	}
+	xyzTag := func(v [3]float64) []byte {
+		t := append([]byte("XYZ \x00\x00\x00\x00"), s15(v[0])...)
+		return append(append(t, s15(v[1])...), s15(v[2])...)
+	}
+	mluc := func(s string) []byte {
+		t := []byte("mluc\x00\x00\x00\x00")
+		u := utf16.Encode([]rune(s))
+		t = append(t, 0, 0, 0, 1, 0, 0, 0, 12, 'e', 'n', 'U', 'S')
+		l := make([]byte, 8)
+		be.PutUint32(l, uint32(2*len(u)))
+		be.PutUint32(l[4:], 28)
+		t = append(t, l...)
+		for _, r := range u {
+			t = append(t, byte(r>>8), byte(r))
+		}
+		return t
+	}
+
+	// the sRGB curve, as parametric function 3
+	para := append([]byte("para\x00\x00\x00\x00"), 0, 3, 0, 0)
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		para = append(para, s15(v)...)
+	}
+	chad := []byte("sf32\x00\x00\x00\x00")
+	adapt := bradford(c.w, d50)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			chad = append(chad, s15(adapt[i][j])...)
+		}
+	}
+	m := adapt.mul(c.toXYZ())
+	d50XYZ := [3]float64{0.9642, 1, 0.8249}
+
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"desc", mluc(name)},
+		{"cprt", mluc("No copyright, use freely")},
+		{"wtpt", xyzTag(d50XYZ)},
+		{"chad", chad},
+		{"rXYZ", xyzTag([3]float64{m[0][0], m[1][0], m[2][0]})},
+		{"gXYZ", xyzTag([3]float64{m[0][1], m[1][1], m[2][1]})},
+		{"bXYZ", xyzTag([3]float64{m[0][2], m[1][2], m[2][2]})},
+		{"rTRC", para},
+		{"gTRC", para},
+		{"bTRC", para},
+	}
+
+	header := make([]byte, 128)
+	be.PutUint32(header[8:], 0x04300000)
+	copy(header[12:], "mntrRGB XYZ ")
+	// a fixed date, so outputs stay deterministic
+	for i, v := range []uint16{2016, 1, 1, 0, 0, 0} {
+		be.PutUint16(header[24+2*i:], v)
+	}
+	copy(header[36:], "acsp")
+	copy(header[68:], xyzTag(d50XYZ)[8:])
+
+	table := make([]byte, 4+12*len(tags))
+	be.PutUint32(table, uint32(len(tags)))
+	var body []byte
+	offset := len(header) + len(table)
+	offsets := map[string]int{}
+	for i, tag := range tags {
+		at, shared := offsets[string(tag.data)]
+		if !shared {
+			at = offset + len(body)
+			offsets[string(tag.data)] = at
+			body = append(body, tag.data...)
+			for len(body)%4 != 0 {
+				body = append(body, 0)
+			}
+		}
+		e := table[4+12*i:]
+		copy(e, tag.sig)
+		be.PutUint32(e[4:], uint32(at))
+		be.PutUint32(e[8:], uint32(len(tag.data)))
+	}
+
+	profile := append(append(header, table...), body...)
+	be.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+// withICC tags an encoded JPEG (an APP2 segment, after any JFIF one) or PNG
+// (an iCCP chunk, after the IHDR) with an ICC profile
+func withICC(data []byte, format, name string, profile []byte) []byte {
+	var out bytes.Buffer
+	if format == "png" {
+		const ihdrEnd = 8 + 4 + 4 + 13 + 4
+		if len(data) < ihdrEnd {
+			return data
+		}
+		var compressed bytes.Buffer
+		z := zlib.NewWriter(&compressed)
+		z.Write(profile)
+		z.Close()
+		chunk := append(append([]byte("iCCP"+name), 0, 0), compressed.Bytes()...)
+
+		out.Write(data[:ihdrEnd])
+		binary.Write(&out, binary.BigEndian, uint32(len(chunk)-4))
+		out.Write(chunk)
+		binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+		out.Write(data[ihdrEnd:])
+		return out.Bytes()
+	}
+
+	if len(data) < 4 {
+		return data
+	}
+	at := 2
+	if data[2] == 0xff && data[3] == 0xe0 && len(data) >= 6 {
+		at += 2 + int(binary.BigEndian.Uint16(data[4:]))
+	}
+	// one segment holds it, the profiles are well under 64KB
+	app2 := []byte{0xff, 0xe2, 0, 0}
+	binary.BigEndian.PutUint16(app2[2:], uint16(2+12+2+len(profile)))
+	app2 = append(append(append(app2, "ICC_PROFILE\x00"...), 1, 1), profile...)
+	out.Write(data[:at])
+	out.Write(app2)
+	out.Write(data[at:])
+	return out.Bytes()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+	"unicode/utf16"
+)
+
+// iccTags are the tags of an ICC profile by signature, checking each is
+// within it and 4 byte aligned
+func iccTags(t *testing.T, profile []byte) map[string][]byte {
+	be := binary.BigEndian
+	if len(profile) < 132 || int(be.Uint32(profile)) != len(profile) {
+		t.Fatalf("profile size %d doesn't match its header", len(profile))
+	}
+	if string(profile[36:40]) != "acsp" || string(profile[12:24]) != "mntrRGB XYZ " {
+		t.Fatalf("not a display RGB profile")
+	}
+	tags := map[string][]byte{}
+	n := int(be.Uint32(profile[128:]))
+	for i := 0; i < n; i++ {
+		e := profile[132+12*i:]
+		offset, size := int(be.Uint32(e[4:])), int(be.Uint32(e[8:]))
+		if offset%4 != 0 || offset+size > len(profile) {
+			t.Fatalf("tag %s at %d of %d bytes is outside the profile", e[:4], offset, size)
+		}
+		tags[string(e[:4])] = profile[offset : offset+size]
+	}
+	return tags
+}
+
+func TestICCProfile(t *testing.T) {
+	srgb, p3 := iccProfiles()
+	tests := []struct {
+		name    string
+		profile []byte
+		// the red primary, in D50 XYZ
+		red [3]float64
+	}{
+		{"sRGB", srgb, [3]float64{0.4361, 0.2225, 0.0139}},
+		{"Display P3", p3, [3]float64{0.5151, 0.2412, -0.0011}},
+	}
+	s15 := func(b []byte) float64 { return float64(int32(binary.BigEndian.Uint32(b))) / 65536 }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := iccTags(t, tt.profile)
+			for _, sig := range []string{"desc", "cprt", "wtpt", "chad", "rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"} {
+				if tags[sig] == nil {
+					t.Fatalf("no %s tag", sig)
+				}
+			}
+
+			desc := tags["desc"]
+			u := make([]uint16, (len(desc)-28)/2)
+			for i := range u {
+				u[i] = binary.BigEndian.Uint16(desc[28+2*i:])
+			}
+			if got := string(utf16.Decode(u)); got != tt.name {
+				t.Errorf("desc = %q, want %q", got, tt.name)
+			}
+
+			// the primaries add up to the D50 white point
+			d50 := [3]float64{0.9642, 1, 0.8249}
+			for i := 0; i < 3; i++ {
+				sum := s15(tags["rXYZ"][8+4*i:]) + s15(tags["gXYZ"][8+4*i:]) + s15(tags["bXYZ"][8+4*i:])
+				if math.Abs(sum-d50[i]) > 0.002 {
+					t.Errorf("primaries add up to %.4f, want %.4f", sum, d50[i])
+				}
+				if got := s15(tags["rXYZ"][8+4*i:]); math.Abs(got-tt.red[i]) > 0.002 {
+					t.Errorf("red primary is %.4f, want %.4f", got, tt.red[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWithICC(t *testing.T) {
+	srgb, _ := iccProfiles()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	var j, p bytes.Buffer
+	jpeg.Encode(&j, img, nil)
+	png.Encode(&p, img)
+	jfif := withDPI(j.Bytes(), "jpeg", 300)
+
+	t.Run("JPEG after JFIF", func(t *testing.T) {
+		out := withICC(jfif, "jpeg", "sRGB", srgb)
+		segments := jpegSegments(out)
+		if len(segments) < 2 || segments[0][1] != 0xe0 || segments[1][1] != 0xe2 {
+			t.Fatalf("the profile's APP2 isn't after the JFIF APP0")
+		}
+		if !bytes.Equal(segments[1][4:18], []byte("ICC_PROFILE\x00\x01\x01")) || !bytes.Equal(segments[1][18:], srgb) {
+			t.Errorf("APP2 doesn't hold the profile")
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("doesn't decode: %s", err)
+		}
+	})
+	t.Run("PNG", func(t *testing.T) {
+		out := withICC(p.Bytes(), "png", "sRGB", srgb)
+		const ihdrEnd = 8 + 4 + 4 + 13 + 4
+		length := int(binary.BigEndian.Uint32(out[ihdrEnd:]))
+		chunk := out[ihdrEnd+4 : ihdrEnd+8+length]
+		if !bytes.HasPrefix(chunk, []byte("iCCPsRGB\x00\x00")) {
+			t.Fatalf("no iCCP chunk after the IHDR")
+		}
+		if crc := binary.BigEndian.Uint32(out[ihdrEnd+8+length:]); crc != crc32.ChecksumIEEE(chunk) {
+			t.Errorf("iCCP CRC = %x, want %x", crc, crc32.ChecksumIEEE(chunk))
+		}
+		if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+			t.Errorf("doesn't decode: %s", err)
+		}
+	})
+	t.Run("too short", func(t *testing.T) {
+		if out := withICC([]byte{0xff, 0xd8}, "jpeg", "sRGB", srgb); len(out) != 2 {
+			t.Errorf("withICC() changed %d bytes that aren't a JPEG", len(out))
+		}
+	})
+}
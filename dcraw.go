@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	dcrawTimeout time.Duration
+	// dcrawParallel is how many dcraws can run at once, its memory being
+	// what small machines run out of first
+	dcrawParallel int
+	dcrawOnce     sync.Once
+	dcrawSlots    chan struct{}
+	// dcrawMissing is set when there's no dcraw to run, RAWs are only decoded
+	// by the other -decoders then
+	dcrawMissing bool
+)
+
+// runDcraw runs dcraw with args, writing its output to stdout. It's killed if
+// it runs longer than -dcrawTimeout (corrupt files can make it hang forever),
+// and whatever it said on stderr is kept as the error's detail.
+func runDcraw(args []string, stdout io.Writer) error {
+	return runRawDecoder("dcraw", dcrawTimeout, args, stdout)
+}
+
+// runRawDecoder runs dcraw, or LibRaw's dcraw_emu for "libraw", as runDcraw
+// does but killed after timeout. Their errors are DCRAW_ or LIBRAW_FAILED
+// (or _TIMEOUT).
+func runRawDecoder(name string, timeout time.Duration, args []string, stdout io.Writer) error {
+	code := strings.ToUpper(name)
+	path := dcrawPath
+	if name == "libraw" {
+		path = librawPath
+		// dcraw_emu writes to a file unless told "-Z -"
+		args = append([]string{}, args...)
+		if i := indexOf(args, "-c"); i >= 0 {
+			args = append(append(args[:i:i], "-Z", "-"), args[i+1:]...)
+		}
+	} else if dcrawMissing {
+		return &codedError{code: "DCRAW_FAILED", msg: fmt.Sprintf("dcraw isn't installed at %s", dcrawPath)}
+	}
+	if dcrawParallel > 0 {
+		// (waiting for a slot doesn't count towards the timeout)
+		dcrawOnce.Do(func() {
+			dcrawSlots = make(chan struct{}, dcrawParallel)
+		})
+		dcrawSlots <- struct{}{}
+		defer func() { <-dcrawSlots }()
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// the source is always last
+	source, unlink, err := plainPath(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	defer unlink()
+	args = append(args[:len(args)-1:len(args)-1], source)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+	release, err := sandbox(cmd)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return &codedError{
+			code:   code + "_TIMEOUT",
+			msg:    fmt.Sprintf("%s was killed after %s", name, timeout),
+			detail: strings.TrimSpace(stderr.String()),
+		}
+	}
+	if err != nil {
+		return &codedError{
+			code:   code + "_FAILED",
+			msg:    fmt.Sprintf("%s failed: %s", name, err),
+			detail: strings.TrimSpace(stderr.String()),
+		}
+	}
+	return nil
+}
+
+// isCode is true if err is a codedError with the code
+func isCode(err error, code string) bool {
+	c, ok := err.(*codedError)
+	return ok && c.code == code
+}
+
+// demosaicQualities are dcraw's -q interpolations by name
+var demosaicQualities = map[string]string{
+	"fast": "0", // bilinear
+	"vng":  "1",
+	"ppg":  "2",
+	"ahd":  "3",
+}
+
+// demosaicArgs are the dcraw options for the task's demosaic quality, none
+// for dcraw's default
+func demosaicArgs(t Task) ([]string, error) {
+	if t.Demosaic == "" {
+		return nil, nil
+	}
+	q, ok := demosaicQualities[t.Demosaic]
+	if !ok {
+		return nil, fmt.Errorf("Unknown demosaic %q (fast, vng, ppg or ahd)", t.Demosaic)
+	}
+	return []string{"-q", q}, nil
+}
+
+// withoutArg is args without an option and its n values
+func withoutArg(args []string, option string, n int) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == option {
+			i += n
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
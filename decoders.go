@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// decodersList is -decoders, the order sources are decoded in until one
+	// works: "dcraw", "libraw" (LibRaw's dcraw_emu, at -libraw), "embedded"
+	// (the RAW's largest JPEG preview) and "native" (Go's decoders, for
+	// anything that isn't a RAW). dcraw and libraw can have their own
+	// timeout, "libraw:30s".
+	decodersList string
+	librawPath   string
+	decoders     []decoderStep
+)
+
+type decoderStep struct {
+	name    string
+	timeout time.Duration
+}
+
+func loadDecoders() error {
+	decoders = nil
+	seen := map[string]bool{}
+	for _, d := range strings.Split(decodersList, ",") {
+		parts := strings.SplitN(strings.TrimSpace(d), ":", 2)
+		step := decoderStep{name: parts[0], timeout: dcrawTimeout}
+		switch step.name {
+		case "dcraw":
+		case "libraw":
+			if librawPath == "" {
+				return fmt.Errorf("The libraw decoder needs -libraw")
+			}
+		case "embedded", "native":
+			if len(parts) == 2 {
+				return fmt.Errorf("Only dcraw and libraw can have a timeout in -decoders")
+			}
+		default:
+			return fmt.Errorf("Unknown decoder %q in -decoders (libraw, dcraw, embedded or native)", step.name)
+		}
+		if seen[step.name] {
+			return fmt.Errorf("The %s decoder is in -decoders twice", step.name)
+		}
+		seen[step.name] = true
+		if len(parts) == 2 {
+			var err error
+			if step.timeout, err = time.ParseDuration(parts[1]); err != nil {
+				return fmt.Errorf("Invalid timeout for %s in -decoders: %s", step.name, err)
+			}
+		}
+		decoders = append(decoders, step)
+	}
+	return nil
+}
+
+// rawDecode runs dcraw or libraw with args into out, and is the args it ran
+// with (the white balance can fall back). dcraw's embedded previews come
+// from -previewCache, if they're in it.
+func rawDecode(t Task, d decoderStep, args []string, out *os.File) ([]string, error) {
+	if d.name == "libraw" && args[1] == "-e" {
+		return args, &codedError{code: "LIBRAW_FAILED", msg: "libraw doesn't extract embedded previews"}
+	}
+	// the embedded preview is the same whatever size is asked for
+	var cacheKey string
+	if d.name == "dcraw" && args[1] == "-e" && previewCache != nil {
+		cacheKey, _ = hashFile(t.Filename)
+	}
+	if cacheKey != "" && previewCache.get(cacheKey, out) {
+		return args, nil
+	}
+	// in case a failed get (or decoder) left anything behind
+	out.Truncate(0)
+	out.Seek(0, 0)
+	if args[1] != "-e" {
+		args = fallbackWhiteBalance(t, args)
+	}
+	err := runRawDecoder(d.name, d.timeout, args, out)
+	if cacheKey != "" && err == nil {
+		out.Seek(0, 0)
+		previewCache.put(cacheKey, out)
+	}
+	return args, err
+}
+
+// isTimeout is true if err is a decoder being killed
+func isTimeout(err error) bool {
+	c, ok := err.(*codedError)
+	return ok && strings.HasSuffix(c.code, "_TIMEOUT")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+var dedupe bool
+
+// inflight is a task that's queued or running, which identical tasks wait on
+type inflight struct {
+	done   chan struct{}
+	result TaskResult
+}
+
+var (
+	inflightMu    sync.Mutex
+	inflightTasks = map[string]*inflight{}
+)
+
+// taskKey is the same for tasks of the same tenant and owner that only
+// differ by id, meta and apiKey. The owner's in it as coalesced tasks share
+// their outputs, which one client mustn't get another's of.
+func taskKey(t Task) string {
+	t.Id, t.Meta, t.APIKey = 0, nil, ""
+	key, _ := json.Marshal(t)
+	return t.tenant + "\x00" + t.owner + "\x00" + string(key)
+}
+
+// coalesce runs t, unless an identical task is already queued or running, in
+// which case that task's result (and output files) are shared with t
+func coalesce(t Task, run func(Task) TaskResult) TaskResult {
+	if !dedupe {
+		return run(t)
+	}
+	key := taskKey(t)
+
+	inflightMu.Lock()
+	if f, ok := inflightTasks[key]; ok {
+		inflightMu.Unlock()
+		logTaskf(t.Id, "debug", "Coalesced with an identical task")
+		<-f.done
+		r := f.result
+		r.Id = t.Id
+		return r
+	}
+	f := &inflight{done: make(chan struct{})}
+	inflightTasks[key] = f
+	inflightMu.Unlock()
+
+	f.result = run(t)
+
+	inflightMu.Lock()
+	delete(inflightTasks, key)
+	inflightMu.Unlock()
+	close(f.done)
+
+	return f.result
+}
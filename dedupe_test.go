@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTaskKey(t *testing.T) {
+	base := Task{Id: 1, Filename: "a.jpg", owner: "key a", tenant: "acme"}
+	tests := []struct {
+		name string
+		t    Task
+		same bool
+	}{
+		{"another id, meta and apiKey", Task{Id: 2, Filename: "a.jpg", Meta: Meta(`{"n":1}`), APIKey: "a", owner: "key a", tenant: "acme"}, true},
+		{"another file", Task{Id: 1, Filename: "b.jpg", owner: "key a", tenant: "acme"}, false},
+		{"another owner", Task{Id: 1, Filename: "a.jpg", owner: "key b", tenant: "acme"}, false},
+		{"another tenant", Task{Id: 1, Filename: "a.jpg", owner: "key a", tenant: "other"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := taskKey(tt.t) == taskKey(base); got != tt.same {
+				t.Errorf("taskKey() same = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+)
+
+// denoiseArgs is dcraw's wavelet denoising for the task's Denoise, whose
+// 1 to 100 is dcraw's useful thresholds of 10 to 1000
+func denoiseArgs(t Task) ([]string, error) {
+	if t.Denoise < 0 || t.Denoise > 100 {
+		return nil, fmt.Errorf("Invalid denoise %d, expected 0 to 100", t.Denoise)
+	}
+	if t.Denoise == 0 {
+		return nil, nil
+	}
+	return []string{"-n", strconv.Itoa(t.Denoise * 10)}, nil
+}
+
+// denoise is for sources dcraw didn't render: the chroma noise is blurred
+// away (the eye barely sees color detail) and the luma smoothed by a
+// bilateral filter, which keeps edges
+func denoise(img image.Image, strength int) image.Image {
+	if strength <= 0 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	// the chroma, as R and G of an image to blur
+	luma := make([]float64, w*h)
+	chroma := image.NewRGBA(src.Bounds())
+	for i := 0; i < w*h; i++ {
+		p := src.Pix[i*4:]
+		y, cb, cr := color.RGBToYCbCr(p[0], p[1], p[2])
+		luma[i] = float64(y)
+		chroma.Pix[i*4], chroma.Pix[i*4+1], chroma.Pix[i*4+3] = cb, cr, 0xff
+	}
+	chroma = gaussianBlur(chroma, 0.5+float64(strength)/25)
+
+	// differences of more than a few sigma are edges, left alone
+	const radius = 2
+	sigma := 1 + float64(strength)*0.25
+	var rangeWeight [256]float64
+	for d := range rangeWeight {
+		rangeWeight[d] = math.Exp(-float64(d*d) / (2 * sigma * sigma))
+	}
+	var spaceWeight [2*radius + 1][2*radius + 1]float64
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			spaceWeight[dy+radius][dx+radius] = math.Exp(-float64(dx*dx+dy*dy) / (2 * radius * radius))
+		}
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			center := luma[y*w+x]
+			var sum, total float64
+			for dy := -radius; dy <= radius; dy++ {
+				sy := clampInt(y+dy, 0, h-1)
+				for dx := -radius; dx <= radius; dx++ {
+					v := luma[sy*w+clampInt(x+dx, 0, w-1)]
+					weight := spaceWeight[dy+radius][dx+radius] * rangeWeight[int(math.Abs(v-center))]
+					sum += v * weight
+					total += weight
+				}
+			}
+
+			i := (y*w + x) * 4
+			r, g, bl := color.YCbCrToRGB(uint8(sum/total+0.5), chroma.Pix[i], chroma.Pix[i+1])
+			src.Pix[i], src.Pix[i+1], src.Pix[i+2] = r, g, bl
+		}
+	}
+	return src
+}
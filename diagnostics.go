@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diagnosticsDir keeps a bundle for each source that fails to decode, with
+// the first diagnosticsKB of it, to reproduce camera specific bugs offline.
+// Bundles older than diagnosticsTTL are removed, and the oldest once they
+// take more than diagnosticsMB.
+var (
+	diagnosticsDir string
+	diagnosticsKB  int
+	diagnosticsTTL time.Duration
+	diagnosticsMB  int
+	diagnosticsMu  sync.Mutex
+)
+
+// saveDiagnostics bundles a decode failure in a new dir of -diagnostics:
+// the task, the error (and dcraw's, with its stderr), the start of what
+// dcraw wrote to dcrawOut and the start of the source. It's the bundle's
+// path, "" without -diagnostics or if it couldn't be written.
+func saveDiagnostics(t Task, dcrawOut string, dcrawErr, err error) string {
+	if diagnosticsDir == "" {
+		return ""
+	}
+	pruneDiagnostics()
+	dir, mkErr := ioutil.TempDir(diagnosticsDir, fmt.Sprintf("task%d-", t.Id))
+	if mkErr != nil {
+		logTaskf(t.Id, "warn", "Could not save diagnostics: %s", mkErr)
+		return ""
+	}
+
+	// the bundle may be shared, the client's credentials aren't
+	redacted := t
+	if redacted.APIKey != "" {
+		redacted.APIKey = "redacted"
+	}
+	redacted.Filename, redacted.OutputDir = redactURL(t.Filename), redactURL(t.OutputDir)
+	task, _ := json.MarshalIndent(redacted, "", "  ")
+	errors := []string{"decode: " + err.Error()}
+	var stderr string
+	if dcrawErr == err {
+		errors = nil
+	}
+	if dcrawErr != nil {
+		errors = append(errors, "dcraw: "+dcrawErr.Error())
+		if c, ok := dcrawErr.(*codedError); ok {
+			stderr = c.detail
+		}
+	}
+	// the source's extension, which is all some decoders go by
+	ext := filepath.Ext(t.Filename)
+	if !isPlain(ext) {
+		ext = ""
+	}
+	for _, f := range []struct {
+		name string
+		err  error
+	}{
+		{"task.json", ioutil.WriteFile(filepath.Join(dir, "task.json"), task, 0644)},
+		{"error.txt", ioutil.WriteFile(filepath.Join(dir, "error.txt"), []byte(strings.Join(errors, "\n")+"\n"), 0644)},
+		{"dcraw.stderr", ioutil.WriteFile(filepath.Join(dir, "dcraw.stderr"), []byte(stderr), 0644)},
+		{"dcraw.stdout", copyHead(dcrawOut, filepath.Join(dir, "dcraw.stdout"))},
+		{"source" + ext, copyHead(t.Filename, filepath.Join(dir, "source"+ext))},
+	} {
+		if f.err != nil {
+			logTaskf(t.Id, "warn", "Could not save %s to diagnostics: %s", f.name, f.err)
+		}
+	}
+	logTaskf(t.Id, "info", "Saved diagnostics of %s to %s", t.Filename, dir)
+	return dir
+}
+
+// withDiagnostics is err with the bundle saveDiagnostics returned, if any
+func withDiagnostics(err error, bundle string) error {
+	if bundle == "" {
+		return err
+	}
+	if c, ok := err.(*codedError); ok {
+		withBundle := *c
+		withBundle.diagnostics = bundle
+		return &withBundle
+	}
+	return &codedError{msg: err.Error(), diagnostics: bundle}
+}
+
+// redactURL is a URL without the password in it
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "redacted")
+	}
+	return u.String()
+}
+
+// pruneDiagnostics removes the bundles past -diagnosticsTTL, then the oldest
+// until the rest fit in -diagnosticsMB
+func pruneDiagnostics() {
+	diagnosticsMu.Lock()
+	defer diagnosticsMu.Unlock()
+
+	infos, err := ioutil.ReadDir(diagnosticsDir)
+	if err != nil {
+		return
+	}
+	type bundle struct {
+		name string
+		mod  time.Time
+		size int64
+	}
+	var bundles []bundle
+	var total int64
+	for _, info := range infos {
+		if !info.IsDir() || !strings.HasPrefix(info.Name(), "task") {
+			continue
+		}
+		b := bundle{name: filepath.Join(diagnosticsDir, info.Name()), mod: info.ModTime()}
+		filepath.Walk(b.name, func(_ string, info os.FileInfo, err error) error {
+			if err == nil {
+				b.size += info.Size()
+			}
+			return nil
+		})
+		bundles = append(bundles, b)
+		total += b.size
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].mod.Before(bundles[j].mod) })
+
+	limit := int64(diagnosticsMB) << 20
+	for _, b := range bundles {
+		expired := diagnosticsTTL > 0 && time.Since(b.mod) > diagnosticsTTL
+		if !expired && (diagnosticsMB <= 0 || total <= limit) {
+			continue
+		}
+		if err := os.RemoveAll(b.name); err != nil {
+			logf("warn", "Could not remove diagnostics %s: %s", b.name, err)
+			continue
+		}
+		total -= b.size
+	}
+}
+
+// copyHead copies the first -diagnosticsKB of from to to
+func copyHead(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.LimitReader(in, int64(diagnosticsKB)<<10))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
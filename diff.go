@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+)
+
+// Comparison is the response to a "diff" task, how close Filename and
+// CompareTo are
+type Comparison struct {
+	// PSNR is in dB over RGB, infinite (reported as 0) when identical
+	PSNR float64 `json:"psnr"`
+	// SSIM is the mean structural similarity of the luma, 1 when identical
+	SSIM float64 `json:"ssim"`
+	// Identical is whether every pixel matches
+	Identical bool `json:"identical"`
+}
+
+// diffImage compares Filename to CompareTo (resized to match, if it's not the
+// same size) and writes an image of where they differ, brighter for more
+func diffImage(t Task) TaskResult {
+	resp := TaskResult{Id: t.Id}
+	if t.CompareTo == "" {
+		resp.Error = "A diff needs compareTo"
+		return resp
+	}
+
+	if err := checkFormat(t.CompareTo, t.CompareTo); err != nil {
+		resp.setError(err)
+		return resp
+	}
+	a, err := decodeSource(t)
+	if err != nil {
+		resp.setError(err)
+		return resp
+	}
+	other := t
+	other.Filename = t.CompareTo
+	b, err := decodeSource(other)
+	if err != nil {
+		resp.setError(err)
+		return resp
+	}
+
+	ra, rb := toRGBA(a), toRGBA(b)
+	if ra.Bounds() != rb.Bounds() {
+		rb = toRGBA(resize.Resize(uint(ra.Bounds().Dx()), uint(ra.Bounds().Dy()), b, resize.Bilinear))
+	}
+
+	diff, mse := differences(ra, rb)
+	c := &Comparison{SSIM: ssim(ra, rb), Identical: mse == 0}
+	if mse > 0 {
+		c.PSNR = 10 * math.Log10(255*255/mse)
+	}
+	resp.Response.Comparison = c
+
+	f, err := createOutput(t)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if err := encodeInSlot(f, diff, t); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		resp.Error = err.Error()
+		return resp
+	}
+	f.Close()
+	if resp.Response.Diff, _, err = publishOutput(t, f.Name(), outputName(t, f.Name(), "diff", formatExt(t)), formatType(t)); err != nil {
+		os.Remove(f.Name())
+		resp.Error = err.Error()
+		return resp
+	}
+
+	return resp
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// differences is the per-channel absolute difference of a and b, stretched
+// so small changes show, and their mean squared error
+func differences(a, b *image.RGBA) (*image.RGBA, float64) {
+	diff := image.NewRGBA(a.Bounds())
+	var sum float64
+	for i := 0; i < len(a.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			d := int(a.Pix[i+c]) - int(b.Pix[i+c])
+			sum += float64(d * d)
+			if d < 0 {
+				d = -d
+			}
+			diff.Pix[i+c] = uint8(clampInt(d*4, 0, 255))
+		}
+		diff.Pix[i+3] = 0xff
+	}
+	return diff, sum / float64(len(a.Pix)/4*3)
+}
+
+// ssim is the mean SSIM over 8x8 windows of the luma
+func ssim(a, b *image.RGBA) float64 {
+	const (
+		window = 8
+		c1     = (0.01 * 255) * (0.01 * 255)
+		c2     = (0.03 * 255) * (0.03 * 255)
+	)
+	ga, gb := image.NewGray(a.Bounds()), image.NewGray(b.Bounds())
+	draw.Draw(ga, ga.Bounds(), a, image.ZP, draw.Src)
+	draw.Draw(gb, gb.Bounds(), b, image.ZP, draw.Src)
+
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	if w < window || h < window {
+		if ga.Rect.Empty() {
+			return 1
+		}
+		return ssimWindow(ga, gb, ga.Rect, c1, c2)
+	}
+
+	var total float64
+	var n int
+	for y := 0; y+window <= h; y += window {
+		for x := 0; x+window <= w; x += window {
+			total += ssimWindow(ga, gb, image.Rect(x, y, x+window, y+window), c1, c2)
+			n++
+		}
+	}
+	return total / float64(n)
+}
+
+func ssimWindow(a, b *image.Gray, r image.Rectangle, c1, c2 float64) float64 {
+	var sa, sb, saa, sbb, sab float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			va, vb := float64(a.GrayAt(x, y).Y), float64(b.GrayAt(x, y).Y)
+			sa += va
+			sb += vb
+			saa += va * va
+			sbb += vb * vb
+			sab += va * vb
+		}
+	}
+	n := float64(r.Dx() * r.Dy())
+	ma, mb := sa/n, sb/n
+	va, vb := saa/n-ma*ma, sbb/n-mb*mb
+	cov := sab/n - ma*mb
+	return ((2*ma*mb + c1) * (2*cov + c2)) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+}
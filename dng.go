@@ -0,0 +1,178 @@
+package main
+
+import (
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+)
+
+// the TIFF/DNG tags needed to find previews and the default crop
+const (
+	tagNewSubFileType    = 254
+	tagImageWidth        = 256
+	tagImageLength       = 257
+	tagCompression       = 259
+	tagStripOffsets      = 273
+	tagOrientation       = 274
+	tagStripByteCounts   = 279
+	tagSubIFDs           = 330
+	tagJPEGOffset        = 513
+	tagJPEGLength        = 514
+	tagDNGVersion        = 50706
+	tagDefaultCropOrigin = 50719
+	tagDefaultCropSize   = 50720
+	tagActiveArea        = 50829
+)
+
+// dngPreview is a JPEG rendered by the DNG's converter, stored in the file
+type dngPreview struct {
+	offset, length int64
+	width, height  int
+}
+
+type dngInfo struct {
+	orientation int
+	previews    []dngPreview
+	// the raw's active area, and the crop within it the converter intended
+	rawWidth, rawHeight int
+	defaultCrop         image.Rectangle
+}
+
+// readDNG finds the previews, orientation and crop of a DNG, and is nil for
+// anything else
+func readDNG(filename string) (*dngInfo, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	offsets, order, err := tiffIFDs(f)
+	if err != nil {
+		return nil, nil // not a TIFF, so not a DNG
+	}
+	ifd0, err := readIFD(f, order, offsets[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ifd0[tagDNGVersion]; !ok {
+		return nil, nil
+	}
+
+	d := &dngInfo{orientation: int(ifd0[tagOrientation].value(order))}
+
+	// the raw and previews can be in IFD0, the chained IFDs and the SubIFDs
+	ifds := []map[uint16]tiffEntry{ifd0}
+	for _, offset := range offsets[1:] {
+		if ifd, err := readIFD(f, order, offset); err == nil {
+			ifds = append(ifds, ifd)
+		}
+	}
+	for _, offset := range ifd0[tagSubIFDs].values(order) {
+		if ifd, err := readIFD(f, order, uint32(offset)); err == nil {
+			ifds = append(ifds, ifd)
+		}
+	}
+
+	for _, ifd := range ifds {
+		width := int(ifd[tagImageWidth].value(order))
+		height := int(ifd[tagImageLength].value(order))
+		compression := ifd[tagCompression].value(order)
+
+		if ifd[tagNewSubFileType].value(order) == 0 {
+			// the raw image itself (which may be lossless JPEG compressed too)
+			d.rawWidth, d.rawHeight = width, height
+			if area := ifd[tagActiveArea].values(order); len(area) == 4 {
+				// top, left, bottom, right
+				d.rawWidth, d.rawHeight = int(area[3]-area[1]), int(area[2]-area[0])
+			}
+			d.defaultCrop = image.Rect(0, 0, d.rawWidth, d.rawHeight)
+			origin := ifd[tagDefaultCropOrigin].values(order)
+			size := ifd[tagDefaultCropSize].values(order)
+			if len(origin) == 2 && len(size) == 2 {
+				x, y := int(math.Round(origin[0])), int(math.Round(origin[1]))
+				d.defaultCrop = image.Rect(x, y, x+int(math.Round(size[0])), y+int(math.Round(size[1])))
+			}
+			continue
+		}
+
+		// SubFileType 1, reduced resolution: previews are JPEGs, thumbnails usually aren't
+		if compression != 6 && compression != 7 {
+			continue
+		}
+		p := dngPreview{width: width, height: height}
+		if _, ok := ifd[tagJPEGOffset]; ok {
+			p.offset = int64(ifd[tagJPEGOffset].value(order))
+			p.length = int64(ifd[tagJPEGLength].value(order))
+		} else if strips := ifd[tagStripOffsets].values(order); len(strips) == 1 {
+			p.offset = int64(strips[0])
+			p.length = int64(ifd[tagStripByteCounts].value(order))
+		}
+		if p.length > 0 {
+			d.previews = append(d.previews, p)
+		}
+	}
+
+	return d, nil
+}
+
+// decodePreview decodes the largest preview, turned upright, if it's at least
+// as wide as the preview image. nil means use the raw instead.
+func (d *dngInfo) decodePreview(filename string) image.Image {
+	if d == nil {
+		return nil
+	}
+
+	var best *dngPreview
+	for i, p := range d.previews {
+		width := p.width
+		if d.orientation >= 5 {
+			width = p.height
+		}
+		if uint(width) >= previewWidth && (best == nil || p.width*p.height > best.width*best.height) {
+			best = &d.previews[i]
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	img, err := jpeg.Decode(io.NewSectionReader(f, best.offset, best.length))
+	if err != nil {
+		logf("warn", "Could not decode the DNG preview of %s, using the raw: %s", filename, err)
+		return nil
+	}
+
+	return orient(img, d.orientation)
+}
+
+// applyCrop applies the DNG's default crop to the raw once dcraw has decoded (and
+// turned, and maybe halved) it
+func (d *dngInfo) applyCrop(img image.Image) image.Image {
+	if d == nil || d.rawWidth == 0 || d.defaultCrop.Empty() {
+		return img
+	}
+
+	r := orientRect(d.defaultCrop, d.rawWidth, d.rawHeight, d.orientation)
+	uprightWidth := d.rawWidth
+	if d.orientation >= 5 {
+		uprightWidth = d.rawHeight
+	}
+	scale := float64(img.Bounds().Dx()) / float64(uprightWidth)
+	scaled := image.Rect(
+		int(math.Round(float64(r.Min.X)*scale)),
+		int(math.Round(float64(r.Min.Y)*scale)),
+		int(math.Round(float64(r.Max.X)*scale)),
+		int(math.Round(float64(r.Max.Y)*scale)),
+	)
+
+	return cropImage(img, scaled)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+var (
+	darktablePath   string
+	rawtherapeePath string
+)
+
+// sidecar is the edit file darktable (.xmp) or RawTherapee (.pp3) keeps next
+// to a RAW, when the matching program is configured. If both are there the
+// one edited last wins.
+func sidecar(filename string) string {
+	var (
+		path   string
+		newest os.FileInfo
+	)
+	for ext, program := range map[string]string{".xmp": darktablePath, ".pp3": rawtherapeePath} {
+		if program == "" {
+			continue
+		}
+		info, err := os.Stat(filename + ext)
+		if err != nil || (newest != nil && !info.ModTime().After(newest.ModTime())) {
+			continue
+		}
+		newest, path = info, filename+ext
+	}
+	return path
+}
+
+// hasEdits is whether the task's RAW is to be rendered with its sidecar's
+// edits, which nothing rendered before (its embedded previews) has
+func hasEdits(t Task) bool {
+	return !t.IgnoreEdits && t.Page <= 1 && sidecar(t.Filename) != ""
+}
+
+// renderEdits renders the RAW with the user's edits applied and copies the
+// TIFF into out, as dcraw would have. false means there are no edits to
+// apply (or they failed to render) and dcraw should be used instead.
+func renderEdits(t Task, out *os.File) bool {
+	if !hasEdits(t) {
+		return false
+	}
+	edits := sidecar(t.Filename)
+
+	t.progress.stage("edits", 0)
+	if err := runEditor(t.Filename, edits, out); err != nil {
+		logTaskf(t.Id, "warn", "Could not render edits for %s, using dcraw: %s", t.Filename, err)
+		out.Truncate(0)
+		out.Seek(0, 0)
+		return false
+	}
+
+	out.Sync()
+	out.Seek(0, 0)
+	return true
+}
+
+func runEditor(filename, edits string, out *os.File) error {
+	// both programs insist on naming their own output, so give them a dir
+	dir, err := createTempDir()
+	if err != nil {
+		return err
+	}
+	defer removeTemp(dir)
+	rendered := filepath.Join(dir, "rendered.tif")
+	filename, unlink, err := plainPath(filename)
+	if err != nil {
+		return err
+	}
+	defer unlink()
+	edits, unlinkEdits, err := plainPath(edits)
+	if err != nil {
+		return err
+	}
+	defer unlinkEdits()
+
+	var cmd *exec.Cmd
+	if filepath.Ext(edits) == ".xmp" {
+		// a private config dir and in-memory library, so concurrent renders
+		// don't fight over (or pollute) the user's darktable library
+		cmd = exec.Command(darktablePath, filename, edits, rendered,
+			"--width", strconv.Itoa(int(previewWidth)), "--hq", "true",
+			"--core", "--configdir", dir, "--library", ":memory:",
+			"--conf", "plugins/imageio/format/tiff/bpp=8")
+	} else {
+		// -c has to come last
+		cmd = exec.Command(rawtherapeePath, "-o", rendered, "-p", edits, "-b8", "-t", "-Y", "-c", filename)
+	}
+
+	release, err := sandbox(cmd, dir)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, output)
+	}
+
+	f, err := os.Open(rendered)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(out, f)
+	return err
+}
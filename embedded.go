@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+)
+
+// the tags pointing at previews, besides dng.go's
+const (
+	tagMakerNote       = 37500
+	tagNikonPreviewIFD = 0x0011
+)
+
+// embeddedJPEG is a JPEG preview stored in a RAW, length bytes at offset in r
+type embeddedJPEG struct {
+	r              io.ReaderAt
+	offset, length int64
+	width, height  int
+}
+
+// decodeEmbedded decodes the largest JPEG preview of a RAW, in process (so
+// without dcraw), if it's at least minWidth wide. nil means there isn't one.
+func decodeEmbedded(filename string, minWidth uint) image.Image {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var best *embeddedJPEG
+	for _, p := range embeddedPreviews(f) {
+		p := p
+		if uint(p.width) >= minWidth && (best == nil || p.width*p.height > best.width*best.height) {
+			best = &p
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	img, err := jpeg.Decode(io.NewSectionReader(best.r, best.offset, best.length))
+	if err != nil {
+		return nil
+	}
+	return img
+}
+
+// embeddedPreviews are the JPEGs in a RAW: in the header of a RAF, or the
+// IFDs, SubIFDs, EXIF and Nikon MakerNote of TIFF based RAWs (NEF, CR2,
+// ARW, PEF and the like). Only baseline JPEGs that decode are kept, which
+// leaves out lossless JPEG raws.
+func embeddedPreviews(r io.ReaderAt) []embeddedJPEG {
+	var candidates []embeddedJPEG
+
+	header := make([]byte, 92)
+	if _, err := r.ReadAt(header, 0); err == nil && bytes.HasPrefix(header, []byte("FUJIFILMCCD-RAW")) {
+		candidates = append(candidates, embeddedJPEG{
+			r:      r,
+			offset: int64(binary.BigEndian.Uint32(header[84:])),
+			length: int64(binary.BigEndian.Uint32(header[88:])),
+		})
+	} else {
+		candidates = tiffPreviews(r)
+	}
+
+	var previews []embeddedJPEG
+	for _, c := range candidates {
+		if c.length <= 0 {
+			continue
+		}
+		config, err := jpeg.DecodeConfig(io.NewSectionReader(c.r, c.offset, c.length))
+		if err != nil {
+			continue
+		}
+		c.width, c.height = config.Width, config.Height
+		previews = append(previews, c)
+	}
+	return previews
+}
+
+func tiffPreviews(r io.ReaderAt) []embeddedJPEG {
+	offsets, order, err := tiffIFDs(r)
+	if err != nil {
+		return nil
+	}
+
+	var candidates []embeddedJPEG
+	seen := map[uint32]bool{}
+	var walk func(offset uint32, depth int)
+	walk = func(offset uint32, depth int) {
+		if seen[offset] || depth > 3 {
+			return
+		}
+		seen[offset] = true
+		ifd, err := readIFD(r, order, offset)
+		if err != nil {
+			return
+		}
+
+		if _, ok := ifd[tagJPEGOffset]; ok {
+			candidates = append(candidates, embeddedJPEG{
+				r:      r,
+				offset: int64(ifd[tagJPEGOffset].value(order)),
+				length: int64(ifd[tagJPEGLength].value(order)),
+			})
+		}
+		if c := ifd[tagCompression].value(order); c == 6 || c == 7 {
+			if strips := ifd[tagStripOffsets].values(order); len(strips) == 1 {
+				candidates = append(candidates, embeddedJPEG{
+					r:      r,
+					offset: int64(strips[0]),
+					length: int64(ifd[tagStripByteCounts].value(order)),
+				})
+			}
+		}
+
+		for _, sub := range ifd[tagSubIFDs].values(order) {
+			walk(uint32(sub), depth+1)
+		}
+		if e, ok := ifd[tagExifIFD]; ok {
+			walk(uint32(e.value(order)), depth+1)
+		}
+		if e, ok := ifd[tagMakerNote]; ok {
+			candidates = append(candidates, nikonPreviews(e.Data)...)
+		}
+	}
+	for _, offset := range offsets {
+		walk(offset, 0)
+	}
+	return candidates
+}
+
+// nikonPreviews are the previews in a Nikon MakerNote, a TIFF of its own
+// after "Nikon\0" and a version, with offsets from its own header
+func nikonPreviews(note []byte) []embeddedJPEG {
+	if !bytes.HasPrefix(note, []byte("Nikon\x00")) || len(note) < 18 {
+		return nil
+	}
+	r := bytes.NewReader(note[10:])
+	offsets, order, err := tiffIFDs(r)
+	if err != nil || len(offsets) == 0 {
+		return nil
+	}
+	ifd, err := readIFD(r, order, offsets[0])
+	if err != nil {
+		return nil
+	}
+	e, ok := ifd[tagNikonPreviewIFD]
+	if !ok {
+		return nil
+	}
+	preview, err := readIFD(r, order, uint32(e.value(order)))
+	if err != nil {
+		return nil
+	}
+	return []embeddedJPEG{{
+		r:      r,
+		offset: int64(preview[tagJPEGOffset].value(order)),
+		length: int64(preview[tagJPEGLength].value(order)),
+	}}
+}
+
+// rawOrientation is the Orientation in IFD0 of a TIFF based RAW, which its
+// embedded previews are stored without, 1 (upright) if it hasn't one
+func rawOrientation(filename string) int {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+	offsets, order, err := tiffIFDs(f)
+	if err != nil {
+		return 1
+	}
+	ifd0, err := readIFD(f, order, offsets[0])
+	if err != nil {
+		return 1
+	}
+	if orientation := int(ifd0[tagOrientation].value(order)); orientation > 1 {
+		return orientation
+	}
+	return 1
+}
+
+// uprightPreview turns a RAW's embedded preview upright by the RAW's
+// orientation, as the outputs don't keep the tag. A preview turned a quarter
+// already (it's portrait, the sensor landscape) is left as it is.
+func uprightPreview(t Task, img image.Image) image.Image {
+	orientation := rawOrientation(t.Filename)
+	if orientation >= 5 {
+		if raw, err := identify(t.Filename); err == nil {
+			var fw, fh int
+			fmt.Sscanf(raw.Fields["Full size"], "%d x %d", &fw, &fh)
+			if b := img.Bounds(); fw > 0 && fh > 0 && (b.Dx() > b.Dy()) != (fw > fh) {
+				return img
+			}
+		}
+	}
+	return orient(img, orientation)
+}
+
+// cropToActive crops a RAW's embedded preview to the sensor's active area,
+// for cameras whose preview includes the masked (black) borders dcraw
+// reports as the difference between its "Full size" and "Image size". The
+// margins are scaled to the preview and split between its edges by how
+// much of each is black. Previews without black edges are left alone, as
+// they're cropped already but can still have about the full size's shape.
+func cropToActive(t Task, img image.Image) image.Image {
+	raw, err := identify(t.Filename)
+	if err != nil {
+		return img
+	}
+	var fw, fh, aw, ah int
+	fmt.Sscanf(raw.Fields["Full size"], "%d x %d", &fw, &fh)
+	fmt.Sscanf(raw.Fields["Image size"], "%d x %d", &aw, &ah)
+	if fw <= 0 || fh <= 0 || aw <= 0 || ah <= 0 || (aw >= fw && ah >= fh) {
+		return img
+	}
+
+	b := img.Bounds()
+	pw, ph := b.Dx(), b.Dy()
+	// a preview the camera already turned upright
+	if (pw > ph) != (fw > fh) {
+		fw, fh, aw, ah = fh, fw, ah, aw
+	}
+	// one that's cropped already has the active area's shape
+	if math.Abs(float64(pw)/float64(ph)-float64(fw)/float64(fh)) > 0.01 {
+		return img
+	}
+	scale := float64(pw) / float64(fw)
+	marginX := int(math.Round(float64(fw-aw) * scale))
+	marginY := int(math.Round(float64(fh-ah) * scale))
+	if marginX < 0 {
+		marginX = 0
+	}
+	if marginY < 0 {
+		marginY = 0
+	}
+
+	// dark is how many of the columns or rows from an edge are near black,
+	// up to limit, at(i, j) being the jth pixel of the ith of n
+	dark := func(at func(i, j int) (int, int), n, limit int) int {
+		for i := 0; i < limit; i++ {
+			var sum, count int
+			for j := 0; j < n; j += 4 {
+				sum += int(color.GrayModel.Convert(img.At(at(i, j))).(color.Gray).Y)
+				count++
+			}
+			if count == 0 || sum/count > 16 {
+				return i
+			}
+		}
+		return limit
+	}
+	l := dark(func(i, j int) (int, int) { return b.Min.X + i, b.Min.Y + j }, ph, marginX)
+	r := dark(func(i, j int) (int, int) { return b.Max.X - 1 - i, b.Min.Y + j }, ph, marginX)
+	tp := dark(func(i, j int) (int, int) { return b.Min.X + j, b.Min.Y + i }, pw, marginY)
+	bt := dark(func(i, j int) (int, int) { return b.Min.X + j, b.Max.Y - 1 - i }, pw, marginY)
+	if l+r+tp+bt == 0 {
+		return img
+	}
+	split := func(first, last, margin int) int {
+		if first+last == 0 {
+			return margin / 2
+		}
+		return margin * first / (first + last)
+	}
+	left, top := split(l, r, marginX), split(tp, bt, marginY)
+
+	logTaskf(t.Id, "debug", "Cropping the embedded preview of %s to its active area", t.Filename)
+	return cropImage(img, image.Rect(left, top, left+pw-marginX, top+ph-marginY))
+}
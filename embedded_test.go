@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+func testJPEG(w, h int) []byte {
+	var b bytes.Buffer
+	jpeg.Encode(&b, image.NewRGBA(image.Rect(0, 0, w, h)), nil)
+	return b.Bytes()
+}
+
+func TestEmbeddedPreviews(t *testing.T) {
+	small, large := testJPEG(16, 8), testJPEG(64, 32)
+	both := append(append([]byte{}, small...), large...)
+	ifd := uint32(8 + len(both))
+
+	raf := make([]byte, 92)
+	copy(raf, "FUJIFILMCCD-RAW")
+	binary.BigEndian.PutUint32(raf[84:], 92)
+	binary.BigEndian.PutUint32(raf[88:], uint32(len(large)))
+	raf = append(raf, large...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want []int
+	}{
+		{"JPEGInterchangeFormat", testTIFF(both, []testTag{
+			{tagJPEGOffset, 4, []uint32{8}},
+			{tagJPEGLength, 4, []uint32{uint32(len(small))}},
+		}), []int{16}},
+		{"a JPEG strip, and one on the next page", testTIFF(both, []testTag{
+			{tagCompression, 3, []uint32{6}},
+			{tagStripOffsets, 4, []uint32{8}},
+			{tagStripByteCounts, 4, []uint32{uint32(len(small))}},
+		}, []testTag{
+			{tagJPEGOffset, 4, []uint32{8 + uint32(len(small))}},
+			{tagJPEGLength, 4, []uint32{uint32(len(large))}},
+		}), []int{16, 64}},
+		// a SubIFD of itself is only read once
+		{"SubIFD loop", testTIFF(both, []testTag{
+			{tagSubIFDs, 4, []uint32{ifd}},
+			{tagJPEGOffset, 4, []uint32{8}},
+			{tagJPEGLength, 4, []uint32{uint32(len(small))}},
+		}), []int{16}},
+		{"offset past the end", testTIFF(both, []testTag{
+			{tagJPEGOffset, 4, []uint32{1 << 30}},
+			{tagJPEGLength, 4, []uint32{uint32(len(small))}},
+		}), nil},
+		{"not a JPEG", testTIFF(both, []testTag{
+			{tagJPEGOffset, 4, []uint32{9}},
+			{tagJPEGLength, 4, []uint32{uint32(len(small))}},
+		}), nil},
+		{"no length", testTIFF(both, []testTag{{tagJPEGOffset, 4, []uint32{8}}}), nil},
+		{"RAF", raf, []int{64}},
+		{"RAF truncated", raf[:200], nil},
+		{"neither", []byte("not a RAW at all"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, p := range embeddedPreviews(bytes.NewReader(tt.data)) {
+				got = append(got, p.width)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("embeddedPreviews() widths = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("embeddedPreviews() widths = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeEmbedded(t *testing.T) {
+	small, large := testJPEG(16, 8), testJPEG(64, 32)
+	raw := testTIFF(append(append([]byte{}, small...), large...), []testTag{
+		{tagJPEGOffset, 4, []uint32{8}},
+		{tagJPEGLength, 4, []uint32{uint32(len(small))}},
+	}, []testTag{
+		{tagJPEGOffset, 4, []uint32{8 + uint32(len(small))}},
+		{tagJPEGLength, 4, []uint32{uint32(len(large))}},
+	})
+	name := writeTestFile(t, raw).Name()
+
+	tests := []struct {
+		name     string
+		minWidth uint
+		want     int
+	}{
+		{"the largest", 0, 64},
+		{"wide enough", 64, 64},
+		{"too narrow", 65, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := decodeEmbedded(name, tt.minWidth)
+			got := 0
+			if img != nil {
+				got = img.Bounds().Dx()
+			}
+			if got != tt.want {
+				t.Errorf("decodeEmbedded() is %d wide, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUprightPreview(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		w, h   int
+		wantW  int
+		wantH  int
+		turned bool
+	}{
+		{"upright", testTIFF(nil, []testTag{{tagOrientation, 3, []uint32{1}}}), 60, 40, 60, 40, false},
+		{"no orientation", testTIFF(nil, []testTag{{tagImageWidth, 3, []uint32{60}}}), 60, 40, 60, 40, false},
+		{"upside down", testTIFF(nil, []testTag{{tagOrientation, 3, []uint32{3}}}), 60, 40, 60, 40, true},
+		{"portrait", testTIFF(nil, []testTag{{tagOrientation, 3, []uint32{6}}}), 60, 40, 40, 60, true},
+		{"not a TIFF", []byte("FUJIFILMCCD-RAW 0201"), 60, 40, 60, 40, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preview := image.NewRGBA(image.Rect(0, 0, tt.w, tt.h))
+			// a corner to see it turn by
+			preview.Pix[3] = 0xff
+			f := writeTestFile(t, tt.data)
+			got := uprightPreview(Task{Filename: f.Name()}, preview)
+			if b := got.Bounds(); b.Dx() != tt.wantW || b.Dy() != tt.wantH {
+				t.Errorf("uprightPreview() is %dx%d, want %dx%d", b.Dx(), b.Dy(), tt.wantW, tt.wantH)
+			}
+			if _, _, _, a := got.At(0, 0).RGBA(); (a == 0) != tt.turned {
+				t.Errorf("uprightPreview() turned %v, want %v", a == 0, tt.turned)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	background    string
+	deterministic bool
+	// jpegEncoder is the JPEG encoder of tasks that don't pick one
+	jpegEncoder string
+
+	encodeParallel int
+	encodeOnce     sync.Once
+	encodeSlots    chan struct{}
+)
+
+// encodeSlot waits until fewer than -encodeParallel tasks are resizing and
+// encoding, the func returned lets the next one go (and can be called again)
+func encodeSlot() func() {
+	if encodeParallel <= 0 {
+		return func() {}
+	}
+	encodeOnce.Do(func() {
+		encodeSlots = make(chan struct{}, encodeParallel)
+	})
+	encodeSlots <- struct{}{}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-encodeSlots })
+	}
+}
+
+// encodeInSlot is encodeImage in an encode slot, for the outputs made
+// outside of the one the preview and thumbnail hold
+func encodeInSlot(w io.Writer, img image.Image, t Task) error {
+	release := encodeSlot()
+	defer release()
+	return encodeImage(w, img, t)
+}
+
+// the encoder settings, fixed so identical inputs and options give identical
+// bytes. Go's encoders write no timestamps or other metadata, and always
+// subsample JPEG's chroma 4:2:0; -deterministic keeps to them, as mozjpeg's
+// bytes change with the build of the library.
+const (
+	jpegQuality = 75
+	pngLevel    = png.DefaultCompression
+)
+
+func checkEncoder(encoder string) error {
+	switch encoder {
+	case "", "stdlib":
+	case "mozjpeg":
+		if !mozjpegBuilt {
+			return fmt.Errorf("This build has no mozjpeg, build with cgo and -tags mozjpeg")
+		}
+	default:
+		return fmt.Errorf("Unknown encoder %q (stdlib or mozjpeg)", encoder)
+	}
+	return nil
+}
+
+// encodeJPEG is the task's JPEG encoder, Go's own or mozjpeg, whose trellis
+// quantization and tables make previews about 30% smaller at the same
+// quality
+func encodeJPEG(t Task) func(io.Writer, image.Image, int) error {
+	if usesMozJPEG(t) {
+		return func(w io.Writer, img image.Image, quality int) error {
+			return encodeMozJPEG(w, img, quality, t.DPI)
+		}
+	}
+	return func(w io.Writer, img image.Image, quality int) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+}
+
+// usesMozJPEG is whether the task's JPEGs are mozjpeg's, which sets their
+// resolution itself
+func usesMozJPEG(t Task) bool {
+	if deterministic {
+		return false
+	}
+	encoder := t.Encoder
+	if encoder == "" {
+		encoder = jpegEncoder
+	}
+	return encoder == "mozjpeg" && (t.Format == "" || t.Format == "jpeg")
+}
+
+// encodeImage writes img in the task's format, JPEG unless it's "png". JPEG
+// has no alpha, so transparent images are flattened over the background
+// first rather than left to the encoder (which turns them black).
+func encodeImage(w io.Writer, img image.Image, t Task) error {
+	if t.DPI > 0 && !usesMozJPEG(t) || t.icc != "" {
+		// the resolution and color space go in headers once the encoder is done
+		var buf bytes.Buffer
+		plain := t
+		plain.DPI, plain.icc = 0, ""
+		if usesMozJPEG(t) {
+			plain.DPI = t.DPI
+		}
+		if err := encodeImage(&buf, img, plain); err != nil {
+			return err
+		}
+		data := buf.Bytes()
+		if srgb, p3 := iccProfiles(); t.icc == "p3" {
+			data = withICC(data, t.Format, "Display P3", p3)
+		} else if t.icc == "srgb" {
+			data = withICC(data, t.Format, "sRGB", srgb)
+		}
+		_, err := w.Write(withDPI(data, t.Format, t.DPI-plain.DPI))
+		return err
+	}
+
+	switch t.Format {
+	case "", "jpeg":
+		bg := t.Background
+		if bg == "" {
+			bg = background
+		}
+		c, err := parseColor(bg)
+		if err != nil {
+			return err
+		}
+		flat := flatten(img, c)
+		quality, err := jpegQualityFor(flat, t)
+		if err != nil {
+			return err
+		}
+		return encodeJPEG(t)(w, flat, quality)
+	case "png":
+		enc := png.Encoder{CompressionLevel: pngLevel}
+		return enc.Encode(w, img)
+	}
+	return fmt.Errorf("Unknown format %q", t.Format)
+}
+
+// formatExt is the file extension for the task's output format
+func formatExt(t Task) string {
+	if t.Format == "png" {
+		return ".png"
+	}
+	return ".jpg"
+}
+
+// formatType is the MIME type for the task's output format
+func formatType(t Task) string {
+	if t.Format == "png" {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+// flatten composites img over a solid color, unless it's already opaque
+func flatten(img image.Image, bg color.Color) image.Image {
+	if o, ok := img.(interface {
+		Opaque() bool
+	}); ok && o.Opaque() {
+		return img
+	}
+
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(bg), image.ZP, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flat
+}
+
+// parseColor parses a hex color, "#rrggbb" or "rrggbb"
+func parseColor(s string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("Invalid color %q, expected #rrggbb", s)
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// envName is the environment variable for a flag, -previewWidth is
+// IMAGING_PREVIEW_WIDTH. A run of capitals is one word: -minFreeMB is
+// IMAGING_MIN_FREE_MB.
+func envName(flagName string) string {
+	var b strings.Builder
+	b.WriteString("IMAGING_")
+	upper := true
+	for _, r := range flagName {
+		if unicode.IsUpper(r) && !upper {
+			b.WriteByte('_')
+		}
+		upper = unicode.IsUpper(r)
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// applyEnv sets a command's flags from the environment. It's done before
+// parsing the command line, so flags given there win over the environment.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("Invalid %s %q: %s", envName(f.Name), value, setErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		flag string
+		want string
+	}{
+		{"dcraw", "IMAGING_DCRAW"},
+		{"previewWidth", "IMAGING_PREVIEW_WIDTH"},
+		{"minFreeMB", "IMAGING_MIN_FREE_MB"},
+		{"sandboxMemMB", "IMAGING_SANDBOX_MEM_MB"},
+		{"downloadKBps", "IMAGING_DOWNLOAD_KBPS"},
+		{"outputTTL", "IMAGING_OUTPUT_TTL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			if got := envName(tt.flag); got != tt.want {
+				t.Errorf("envName(%q) = %q, want %q", tt.flag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		want    int
+		wantErr bool
+	}{
+		{"unset", "", 10, false},
+		{"set", "20", 20, false},
+		{"invalid", "lots", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			minFree := fs.Int("minFreeMB", 10, "")
+			if tt.env != "" {
+				t.Setenv("IMAGING_MIN_FREE_MB", tt.env)
+			}
+			err := applyEnv(fs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *minFree != tt.want {
+				t.Errorf("-minFreeMB = %d, want %d", *minFree, tt.want)
+			}
+		})
+	}
+}
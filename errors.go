@@ -0,0 +1,56 @@
+package main
+
+// codedError is an error a client can act on without parsing the message,
+// its code (and whether trying again later may succeed) are put in the result
+type codedError struct {
+	code      string
+	retryable bool
+	msg       string
+	// detail is anything else useful for debugging, e.g. dcraw's stderr
+	detail string
+	// diagnostics is where a decode failure was saved with -diagnostics
+	diagnostics string
+}
+
+func (e *codedError) Error() string {
+	return e.msg
+}
+
+// invalidTask is INVALID_TASK with err's message, for a task whose fields
+// can't be made sense of together
+func invalidTask(err error) error {
+	if _, ok := err.(*codedError); ok {
+		return err
+	}
+	return &codedError{code: "INVALID_TASK", msg: err.Error()}
+}
+
+// OutputFailure is an output of a Partial task that couldn't be made, its
+// error as a task's would be
+type OutputFailure struct {
+	Output    string `json:"output"`
+	Error     string `json:"error"`
+	Code      string `json:"code,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// failed records an output of a Partial task failing
+func (r *Resp) failed(output string, err error) {
+	f := OutputFailure{Output: output, Error: err.Error()}
+	if c, ok := err.(*codedError); ok {
+		f.Code, f.Retryable, f.Detail = c.code, c.retryable, c.detail
+	}
+	r.Failures = append(r.Failures, f)
+}
+
+// setError fails the result with err, and its code if it has one
+func (r *TaskResult) setError(err error) {
+	r.Error = err.Error()
+	if c, ok := err.(*codedError); ok {
+		r.Code = c.code
+		r.Retryable = c.retryable
+		r.Detail = c.detail
+		r.Diagnostics = c.diagnostics
+	}
+}
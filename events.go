@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	eventsPath       string
+	progressAfter    time.Duration
+	progressInterval time.Duration
+
+	// events is nil unless -events is set
+	events *stream
+)
+
+type progressEvent struct {
+	SchemaVersion int    `json:"schemaVersion,omitempty"`
+	Id            int    `json:"id"`
+	Event         string `json:"event"`
+	Stage         string `json:"stage"`
+	Pct           int    `json:"pct"`
+}
+
+// openEvents sets up the events stream, which is shared with the results
+// when it's "stdout" so lines are never interleaved
+func openEvents() error {
+	switch eventsPath {
+	case "":
+		return nil
+	case "stdout":
+		events = results
+		if failures == results {
+			// results went to -results (or redis), stdout is free
+			events = &stream{w: os.Stdout, mu: &sync.Mutex{}}
+		}
+	case "stderr":
+		events = &stream{w: os.Stderr, mu: &logMu}
+	default:
+		f, err := os.OpenFile(eventsPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("Could not open events stream: %s", err)
+		}
+		events = &stream{w: f, mu: &sync.Mutex{}}
+	}
+	return nil
+}
+
+func emitEvent(e interface{}) {
+	eBytes, err := json.Marshal(e)
+	if err != nil {
+		logf("error", "Could not marshal event: %+v", e)
+		return
+	}
+
+	events.writeLine(eBytes)
+}
+
+// progress reports the stage a task is in, but only once it has been running
+// longer than -progressAfter, so quick tasks don't flood the stream
+type progress struct {
+	mu    sync.Mutex
+	event progressEvent
+	start time.Time
+	last  time.Time
+	done  chan struct{}
+}
+
+// trackProgress returns nil when events are disabled (and stages aren't
+// being logged by -verbose, or hooked), which is safe to use
+func trackProgress(id int) *progress {
+	if events == nil && !verbose && len(hooks) == 0 {
+		return nil
+	}
+
+	p := &progress{
+		event: progressEvent{SchemaVersion: stampSchema(), Id: id, Event: "progress", Stage: "queued"},
+		start: time.Now(),
+		last:  time.Now(),
+		done:  make(chan struct{}),
+	}
+	if events == nil {
+		return p
+	}
+
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.emit()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// stage moves the task on to a new stage, pct is how far along the whole task is
+func (p *progress) stage(stage string, pct int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	logTaskf(p.event.Id, "debug", "%s finished in %s, starting %s", p.event.Stage, time.Since(p.last), stage)
+	stageCompleted(p.event.Id, p.event.Stage, time.Since(p.last))
+	p.event.Stage, p.event.Pct = stage, pct
+	p.last = time.Now()
+	p.mu.Unlock()
+	p.emit()
+}
+
+func (p *progress) emit() {
+	if events == nil || time.Since(p.start) < progressAfter {
+		return
+	}
+	p.mu.Lock()
+	e := p.event
+	p.mu.Unlock()
+	emitEvent(e)
+}
+
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	logTaskf(p.event.Id, "debug", "%s finished in %s, done after %s", p.event.Stage, time.Since(p.last), time.Since(p.start))
+	stageCompleted(p.event.Id, p.event.Stage, time.Since(p.last))
+	p.mu.Unlock()
+	close(p.done)
+}
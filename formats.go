@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// allowFormats and denyFormats are comma separated extensions ("tif") and
+// MIME types ("image/tiff", or "image/*")
+var (
+	allowFormats string
+	denyFormats  string
+)
+
+// formatTypes are the MIME types of inputs the mime package doesn't know
+var formatTypes = map[string]string{
+	"tif":  "image/tiff",
+	"tiff": "image/tiff",
+	"psd":  "image/vnd.adobe.photoshop",
+	"dng":  "image/x-adobe-dng",
+	"cr2":  "image/x-canon-cr2",
+	"cr3":  "image/x-canon-cr3",
+	"nef":  "image/x-nikon-nef",
+	"arw":  "image/x-sony-arw",
+	"raf":  "image/x-fuji-raf",
+	"orf":  "image/x-olympus-orf",
+	"rw2":  "image/x-panasonic-rw2",
+	"pef":  "image/x-pentax-pef",
+	"heic": "image/heic",
+}
+
+// checkFormat rejects an input with UNSUPPORTED_FORMAT unless -allowFormats
+// (if set) lists its extension or MIME type, and -denyFormats doesn't. name
+// is what it was sent as (tasks with no Filename have nothing to check),
+// local where it's been fetched to, or "" to check by name alone before it's
+// fetched (which lets through names that don't say).
+func checkFormat(name, local string) error {
+	if (allowFormats == "" && denyFormats == "") || name == "" {
+		return nil
+	}
+	if _, entry, ok := splitArchive(name); ok {
+		name = entry
+	}
+	ext, mimeType := inputFormat(name, local)
+	if mimeType == "" {
+		return nil
+	}
+	matches := func(list string) bool {
+		for _, f := range strings.Split(list, ",") {
+			f = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(f), "."))
+			switch {
+			case f == "":
+			case f == mimeType:
+				return true
+			case strings.HasSuffix(f, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(f, "*")):
+				return true
+			case !strings.Contains(f, "/") && typeByExtension(f) == mimeType:
+				// an extension stands for its type, whatever the input is named
+				return true
+			case !strings.Contains(f, "/") && typeByExtension(f) == "" && f == ext:
+				return true
+			}
+		}
+		return false
+	}
+	if (allowFormats != "" && !matches(allowFormats)) || (denyFormats != "" && matches(denyFormats)) {
+		return &codedError{code: "UNSUPPORTED_FORMAT", msg: fmt.Sprintf("%s (%s) isn't accepted here", path.Base(filepath.ToSlash(name)), mimeType)}
+	}
+	return nil
+}
+
+// inputFormat is a file's extension, lower case without the dot, and its
+// MIME type: by its contents where they're recognised (so a renamed file is
+// still what it is), otherwise by its extension, otherwise what its contents
+// look like. Without local it's by extension alone, "" if that's unknown.
+func inputFormat(name, local string) (string, string) {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(filepath.ToSlash(name)), "."))
+	byName := typeByExtension(ext)
+	if local == "" {
+		return ext, byName
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return ext, "application/octet-stream"
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	if t := sniffFormat(head, byName); t != "" {
+		return ext, t
+	}
+	f.Seek(0, io.SeekStart)
+	if _, format, err := image.DecodeConfig(f); err == nil {
+		return ext, "image/" + format
+	}
+	if byName != "" {
+		return ext, byName
+	}
+	return ext, strings.SplitN(http.DetectContentType(head), ";", 2)[0]
+}
+
+func typeByExtension(ext string) string {
+	if t, ok := formatTypes[ext]; ok {
+		return t
+	}
+	if ext == "" {
+		return ""
+	}
+	return strings.SplitN(mime.TypeByExtension("."+ext), ";", 2)[0]
+}
+
+// tiffRAWs are the RAWs that are TIFFs to look at, told apart by name
+var tiffRAWs = map[string]bool{
+	"image/x-adobe-dng":  true,
+	"image/x-canon-cr2":  true,
+	"image/x-nikon-nef":  true,
+	"image/x-sony-arw":   true,
+	"image/x-pentax-pef": true,
+}
+
+// sniffFormat is the type of the formats image.DecodeConfig doesn't know, by
+// their first bytes, or "". byName is the type the input's name gives.
+func sniffFormat(head []byte, byName string) string {
+	has := func(at int, magic string) bool {
+		return len(head) >= at+len(magic) && string(head[at:at+len(magic)]) == magic
+	}
+	switch {
+	case has(0, "8BPS"):
+		return "image/vnd.adobe.photoshop"
+	case has(0, "FUJIFILMCCD-RAW"):
+		return "image/x-fuji-raf"
+	case has(0, "IIRO"), has(0, "IIRS"), has(0, "MMOR"):
+		return "image/x-olympus-orf"
+	case has(0, "IIU\x00"):
+		return "image/x-panasonic-rw2"
+	case has(0, "II*\x00"), has(0, "MM\x00*"):
+		if tiffRAWs[byName] {
+			return byName
+		}
+		return "image/tiff"
+	case has(4, "ftypcrx "):
+		return "image/x-canon-cr3"
+	case has(4, "ftypheic"), has(4, "ftypheix"), has(4, "ftyphevc"), has(4, "ftypmif1"), has(4, "ftypmsf1"):
+		return "image/heic"
+	}
+	return ""
+}
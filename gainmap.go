@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+)
+
+// gainMap is the HDR gain map of an UltraHDR / Adobe gain map JPEG, the
+// second image in its MPF, and the segments describing how to apply it (its
+// hdrgm XMP, or ISO 21496-1 metadata)
+type gainMap struct {
+	img      image.Image
+	segments [][]byte
+	// the size of the primary image it covers
+	primary image.Rectangle
+}
+
+const (
+	xmpNamespace = "http://ns.adobe.com/xap/1.0/\x00"
+	hdrgmXMLNS   = "http://ns.adobe.com/hdr-gain-map/1.0/"
+	isoGainMap   = "urn:iso:std:iso:ts:21496:-1\x00"
+)
+
+func checkHDR(t Task) error {
+	if t.HDR && t.Format == "png" {
+		return fmt.Errorf("HDR gain maps need JPEG outputs")
+	}
+	return nil
+}
+
+// hdrGainMap is the source's gain map when an HDR task's preview and
+// thumbnail are made of the whole source, so it still lines up with them.
+// nil means plain outputs.
+func hdrGainMap(t Task, src image.Image) *gainMap {
+	if !t.HDR || src == nil {
+		return nil
+	}
+	if len(t.Ops) > 0 || t.LensCorrection {
+		logTaskf(t.Id, "warn", "The gain map of %s is left out, it wouldn't match the preview after ops or lens correction", t.Filename)
+		return nil
+	}
+	data, err := ioutil.ReadFile(t.Filename)
+	if err != nil || !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return nil
+	}
+	gm, err := readGainMap(data)
+	if err != nil {
+		logTaskf(t.Id, "warn", "Could not read the gain map of %s: %s", t.Filename, err)
+		return nil
+	}
+	if gm == nil || gm.primary != src.Bounds().Sub(src.Bounds().Min) {
+		return nil
+	}
+	return gm
+}
+
+// jpegSegments are the marker segments of a JPEG up to its scan, each
+// with its marker and length
+func jpegSegments(data []byte) [][]byte {
+	var segments [][]byte
+	for at := 2; at+4 <= len(data) && data[at] == 0xff; {
+		marker := data[at+1]
+		length := int(binary.BigEndian.Uint16(data[at+2:]))
+		end := at + 2 + length
+		if marker == 0xda || length < 2 || end > len(data) {
+			break
+		}
+		segments = append(segments, data[at:end])
+		at = end
+	}
+	return segments
+}
+
+// readGainMap finds the gain map among the images of a JPEG's MPF segment,
+// nil if it hasn't one
+func readGainMap(data []byte) (*gainMap, error) {
+	var primary image.Rectangle
+	var images []io.Reader
+	for _, s := range jpegSegments(data) {
+		switch {
+		case s[1] >= 0xc0 && s[1] <= 0xcf && s[1] != 0xc4 && s[1] != 0xc8 && s[1] != 0xcc && len(s) >= 9:
+			// start of frame: precision, height, width
+			primary = image.Rect(0, 0, int(binary.BigEndian.Uint16(s[7:])), int(binary.BigEndian.Uint16(s[5:])))
+		case s[1] == 0xe2 && bytes.HasPrefix(s[4:], []byte("MPF\x00")):
+			var err error
+			// (the TIFF header is after the marker, length and "MPF\0")
+			if images, err = mpfImages(data, s, bytes.Index(data, s)+8); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, r := range images {
+		img, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		var described [][]byte
+		for _, s := range jpegSegments(img) {
+			xmp := s[1] == 0xe1 && bytes.HasPrefix(s[4:], []byte(xmpNamespace)) && bytes.Contains(s, []byte(hdrgmXMLNS))
+			iso := s[1] == 0xe2 && bytes.HasPrefix(s[4:], []byte(isoGainMap))
+			if xmp || iso {
+				described = append(described, s)
+			}
+		}
+		if len(described) == 0 {
+			// a depth map or another view, say
+			continue
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(img))
+		if err != nil {
+			return nil, err
+		}
+		return &gainMap{img: decoded, segments: described, primary: primary}, nil
+	}
+	return nil, nil
+}
+
+// mpfImages are the images after the first an MPF segment lists, whose
+// offsets are from its TIFF header (at base in data)
+func mpfImages(data, segment []byte, base int) ([]io.Reader, error) {
+	tiff := segment[8:]
+	if len(tiff) < 8 {
+		return nil, fmt.Errorf("short MPF segment")
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if tiff[0] == 'I' {
+		order = binary.LittleEndian
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return nil, fmt.Errorf("bad MPF IFD offset")
+	}
+	var entries []byte
+	for i := 0; i < int(order.Uint16(tiff[ifd:])); i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[e:]) == 0xb002 {
+			count, offset := int(order.Uint32(tiff[e+4:])), int(order.Uint32(tiff[e+8:]))
+			if offset+count > len(tiff) {
+				return nil, fmt.Errorf("bad MP entry offset")
+			}
+			entries = tiff[offset : offset+count]
+		}
+	}
+
+	var images []io.Reader
+	for e := 16; e+16 <= len(entries); e += 16 {
+		size, offset := int(order.Uint32(entries[e+4:])), int(order.Uint32(entries[e+8:]))
+		start := base + offset
+		if offset == 0 || start+size > len(data) {
+			continue
+		}
+		images = append(images, bytes.NewReader(data[start:start+size]))
+	}
+	return images, nil
+}
+
+// encodeHDR is encodeImage, followed by the gain map sized to match img
+// (as the source's is to it), making an UltraHDR JPEG
+func encodeHDR(w io.Writer, img image.Image, t Task, gm *gainMap) error {
+	if gm == nil {
+		return encodeImage(w, img, t)
+	}
+	var primary bytes.Buffer
+	if err := encodeImage(&primary, img, t); err != nil {
+		return err
+	}
+
+	b, gb := img.Bounds(), gm.img.Bounds()
+	scale := float64(b.Dx()) / float64(gm.primary.Dx())
+	width := uint(float64(gb.Dx())*scale + 0.5)
+	height := uint(float64(gb.Dy())*scale + 0.5)
+	if width == 0 || height == 0 {
+		width, height = 1, 1
+	}
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, resize.Resize(width, height, gm.img, resize.Bilinear), &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return err
+	}
+	var gainMap bytes.Buffer
+	gainMap.Write(encoded.Bytes()[:2])
+	for _, s := range gm.segments {
+		gainMap.Write(s)
+	}
+	gainMap.Write(encoded.Bytes()[2:])
+
+	_, err := w.Write(withGainMap(primary.Bytes(), gainMap.Bytes()))
+	return err
+}
+
+// withGainMap puts the hdrgm XMP (with a Container directory of the two
+// images) and an MPF segment pointing at the gain map into the primary,
+// then appends the gain map
+func withGainMap(primary, gainMap []byte) []byte {
+	at := 2
+	if len(primary) >= 6 && primary[2] == 0xff && primary[3] == 0xe0 {
+		at += 2 + int(binary.BigEndian.Uint16(primary[4:]))
+	}
+
+	xmp := []byte(xmpNamespace + fmt.Sprintf(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">`+
+		`<rdf:Description rdf:about="" xmlns:Container="http://ns.google.com/photos/1.0/container/" xmlns:Item="http://ns.google.com/photos/1.0/container/item/" xmlns:hdrgm="%s" hdrgm:Version="1.0">`+
+		`<Container:Directory><rdf:Seq>`+
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="Primary" Item:Mime="image/jpeg"/></rdf:li>`+
+		`<rdf:li rdf:parseType="Resource"><Container:Item Item:Semantic="GainMap" Item:Mime="image/jpeg" Item:Length="%d"/></rdf:li>`+
+		`</rdf:Seq></Container:Directory></rdf:Description></rdf:RDF></x:xmpmeta>`, hdrgmXMLNS, len(gainMap)))
+	app1 := append([]byte{0xff, 0xe1, byte((len(xmp) + 2) >> 8), byte(len(xmp) + 2)}, xmp...)
+
+	// MPF: a big endian TIFF header, an IFD of version, count and the
+	// entries, then the two 16 byte entries
+	mpf := new(bytes.Buffer)
+	mpf.WriteString("MPF\x00")
+	tiff := new(bytes.Buffer)
+	tiff.Write([]byte{'M', 'M', 0, 0x2a, 0, 0, 0, 8})
+	binary.Write(tiff, binary.BigEndian, uint16(3))
+	entry := func(tag, typ uint16, count, value uint32) {
+		binary.Write(tiff, binary.BigEndian, []uint16{tag, typ})
+		binary.Write(tiff, binary.BigEndian, []uint32{count, value})
+	}
+	ifdEnd := uint32(8 + 2 + 3*12 + 4)
+	entry(0xb000, 7, 4, binary.BigEndian.Uint32([]byte("0100")))
+	entry(0xb001, 4, 1, 2)
+	entry(0xb002, 7, 32, ifdEnd)
+	binary.Write(tiff, binary.BigEndian, uint32(0))
+
+	mpfLength := 4 + mpf.Len() + tiff.Len() + 32
+	primaryLength := uint32(len(primary) + len(app1) + mpfLength)
+	// the gain map's offset is from the TIFF header
+	header := uint32(at + len(app1) + 4 + mpf.Len())
+	binary.Write(tiff, binary.BigEndian, []uint32{0x030000, primaryLength, 0, 0})
+	binary.Write(tiff, binary.BigEndian, []uint32{0, uint32(len(gainMap)), primaryLength - header, 0})
+	app2 := append([]byte{0xff, 0xe2, byte((mpfLength - 2) >> 8), byte(mpfLength - 2)}, mpf.Bytes()...)
+	app2 = append(app2, tiff.Bytes()...)
+
+	var out bytes.Buffer
+	out.Write(primary[:at])
+	out.Write(app1)
+	out.Write(app2)
+	out.Write(primary[at:])
+	out.Write(gainMap)
+	return out.Bytes()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+func TestJPEGSegments(t *testing.T) {
+	app0 := []byte{0xff, 0xe0, 0, 4, 1, 2}
+	app1 := []byte{0xff, 0xe1, 0, 2}
+	sos := []byte{0xff, 0xda, 0, 2}
+	soi := []byte{0xff, 0xd8}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"up to the scan", join(soi, app0, app1, sos, app0), 2},
+		{"truncated segment", join(soi, app0, app1[:3]), 1},
+		{"length past the end", join(soi, []byte{0xff, 0xe1, 0xff, 0xff, 0}), 0},
+		// a length (of itself) under 2 would leave a segment too short to read
+		{"length of 0", join(soi, []byte{0xff, 0xe1, 0, 0}, app0), 0},
+		{"not a marker", join(soi, []byte{1, 2, 3, 4}), 0},
+		{"empty", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jpegSegments(tt.data); len(got) != tt.want {
+				t.Errorf("jpegSegments() has %d segments, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestReadGainMap(t *testing.T) {
+	defer func(bg string) { background = bg }(background)
+	background = "#ffffff"
+
+	src := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	gray := image.NewGray(image.Rect(0, 0, 16, 12))
+	for i := range gray.Pix {
+		gray.Pix[i] = 128
+	}
+	xmp := append([]byte(xmpNamespace), `<x:xmpmeta xmlns:hdrgm="`+hdrgmXMLNS+`"/>`...)
+	segment := append([]byte{0xff, 0xe1, byte((len(xmp) + 2) >> 8), byte(len(xmp) + 2)}, xmp...)
+	var hdr bytes.Buffer
+	if err := encodeHDR(&hdr, src, Task{}, &gainMap{img: gray, segments: [][]byte{segment}, primary: src.Bounds()}); err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	if err := jpeg.Encode(&plain, src, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the MPF segment's TIFF, with its IFD offset past the segment
+	badIFD := bytes.Replace(hdr.Bytes(), []byte{'M', 'M', 0, 0x2a, 0, 0, 0, 8}, []byte{'M', 'M', 0, 0x2a, 0, 0, 0x10, 0}, 1)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    bool
+		wantErr bool
+	}{
+		{"UltraHDR", hdr.Bytes(), true, false},
+		{"plain", plain.Bytes(), false, false},
+		{"bad IFD offset", badIFD, false, true},
+		{"truncated", hdr.Bytes()[:len(hdr.Bytes())/2], false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gm, err := readGainMap(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readGainMap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (gm != nil) != tt.want {
+				t.Fatalf("readGainMap() = %v, want a gain map %v", gm, tt.want)
+			}
+			if gm == nil {
+				return
+			}
+			if gm.primary != src.Bounds() {
+				t.Errorf("primary = %v, want %v", gm.primary, src.Bounds())
+			}
+			// the gain map is resized to match the preview, as it was the source
+			if b := gm.img.Bounds(); b.Dx() != 16 || b.Dy() != 12 {
+				t.Errorf("gain map is %v, want 16x12", b)
+			}
+			if c := color.GrayModel.Convert(gm.img.At(0, 0)).(color.Gray); c.Y < 120 || c.Y > 136 {
+				t.Errorf("gain map is %d, want about 128", c.Y)
+			}
+		})
+	}
+}
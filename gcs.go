@@ -0,0 +1,78 @@
+package main
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	gcsBucket       string
+	gcsPrefix       string
+	gcsCacheControl string
+
+	// gcsClient is connected once something is stored in a bucket
+	gcsClient    *storage.Client
+	gcsClientErr error
+	gcsOnce      sync.Once
+)
+
+// openGCS connects with the application default credentials
+func openGCS() error {
+	gcsOnce.Do(func() {
+		client, err := storage.NewClient(context.Background())
+		if err != nil {
+			gcsClientErr = fmt.Errorf("Could not connect to Google Cloud Storage: %s", err)
+		}
+		gcsClient = client
+	})
+	return gcsClientErr
+}
+
+// gcsStorage is a Google Cloud Storage bucket, "gs://bucket/name"
+type gcsStorage struct {
+	bucket     *storage.BucketHandle
+	bucketName string
+}
+
+func newGCSStorage(bucket string) (Storage, error) {
+	if err := openGCS(); err != nil {
+		return nil, err
+	}
+	return &gcsStorage{gcsClient.Bucket(bucket), bucket}, nil
+}
+
+func (s *gcsStorage) Open(name string) (io.ReadCloser, error) {
+	return s.bucket.Object(name).NewReader(context.Background())
+}
+
+func (s *gcsStorage) Write(name string, r io.Reader, contentType string) error {
+	w := s.bucket.Object(name).NewWriter(context.Background())
+	w.ContentType = contentType
+	w.CacheControl = gcsCacheControl
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	// the upload is only complete (or failed) once closed
+	return w.Close()
+}
+
+func (s *gcsStorage) Stat(name string) (StorageInfo, error) {
+	attrs, err := s.bucket.Object(name).Attrs(context.Background())
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Size: attrs.Size, ModTime: attrs.Updated}, nil
+}
+
+func (s *gcsStorage) Remove(name string) error {
+	return s.bucket.Object(name).Delete(context.Background())
+}
+
+func (s *gcsStorage) PublicURL(name string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/%s/%s", s.bucketName, name)
+}
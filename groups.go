@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// groupEvent is written to the results once every task of a group is done,
+// so a client can mark an album done without counting results itself
+type groupEvent struct {
+	SchemaVersion int     `json:"schemaVersion,omitempty"`
+	Event         string  `json:"event"`
+	GroupId       string  `json:"groupId"`
+	Tasks         int     `json:"tasks"`
+	Succeeded     int     `json:"succeeded"`
+	Failed        int     `json:"failed"`
+	Seconds       float64 `json:"seconds"`
+	// Failures are the ids of the tasks that failed
+	Failures []int `json:"failures,omitempty"`
+	// Expired is set when the rest of the group didn't come within -groupTTL
+	Expired bool `json:"expired,omitempty"`
+}
+
+type taskGroup struct {
+	event groupEvent
+	start time.Time
+}
+
+var (
+	groupsMu sync.Mutex
+	groups   = map[string]*taskGroup{}
+
+	// groupTTL is how long a group waits for the rest of its tasks before its
+	// event is written without them
+	groupTTL time.Duration
+
+	// groupWatchers are also sent each group's event, by group (see
+	// watchGroup)
+	groupWatchers = map[string]map[chan []byte]bool{}
+)
+
+func checkGroup(t Task) error {
+	if t.GroupId != "" && t.GroupSize <= 0 {
+		return fmt.Errorf("groupId needs a groupSize, the number of tasks in the group")
+	}
+	return nil
+}
+
+// groupOf is as much of a task as counts it towards its group, from a task
+// that couldn't be unmarshalled (or validated) as a whole
+func groupOf(input []byte) Task {
+	var g struct {
+		Id        int    `json:"id"`
+		GroupId   string `json:"groupId"`
+		GroupSize int    `json:"groupSize"`
+	}
+	unmarshal(input, &g)
+	return Task{Id: g.Id, GroupId: g.GroupId, GroupSize: g.GroupSize}
+}
+
+// trackGroup counts the task towards its group (the first of them starting
+// the clock), returning done with the group's event written after the
+// result of its last task is emitted, and before it's done
+func trackGroup(t Task, done func(TaskResult)) func(TaskResult) {
+	if t.GroupId == "" || t.GroupSize <= 0 {
+		return done
+	}
+	groupsMu.Lock()
+	if groups[t.GroupId] == nil {
+		g := &taskGroup{
+			event: groupEvent{Event: "group", GroupId: t.GroupId, Tasks: t.GroupSize},
+			start: time.Now(),
+		}
+		groups[t.GroupId] = g
+		if groupTTL > 0 {
+			time.AfterFunc(groupTTL, func() { expireGroup(t.GroupId, g) })
+		}
+	}
+	groupsMu.Unlock()
+
+	return func(r TaskResult) {
+		defer done(r)
+
+		groupsMu.Lock()
+		g := groups[t.GroupId]
+		if g == nil {
+			// more tasks than its groupSize, they're done without it
+			groupsMu.Unlock()
+			return
+		}
+		if r.Error != "" {
+			g.event.Failed++
+			g.event.Failures = append(g.event.Failures, r.Id)
+		} else {
+			g.event.Succeeded++
+		}
+		finished := g.event.Succeeded+g.event.Failed >= g.event.Tasks
+		if finished {
+			delete(groups, t.GroupId)
+		}
+		groupsMu.Unlock()
+		if finished {
+			writeGroup(g)
+		}
+	}
+}
+
+// expireGroup writes the event of a group that's still waiting on tasks
+func expireGroup(id string, g *taskGroup) {
+	groupsMu.Lock()
+	if groups[id] != g {
+		// finished
+		groupsMu.Unlock()
+		return
+	}
+	delete(groups, id)
+	g.event.Expired = true
+	groupsMu.Unlock()
+	writeGroup(g)
+}
+
+func writeGroup(g *taskGroup) {
+	g.event.SchemaVersion = stampSchema()
+	g.event.Seconds = time.Since(g.start).Seconds()
+	gBytes, err := marshal(g.event)
+	if err != nil {
+		logf("error", "Could not marshal group event: %s", err)
+		return
+	}
+	if err := results.writeRecord(gBytes); err != nil {
+		logf("error", "Could not write group event: %s", err)
+	}
+
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	for events := range groupWatchers[g.event.GroupId] {
+		select {
+		case events <- gBytes:
+		default:
+		}
+	}
+}
+
+// watchGroup has the event of the group id sent to events too, until the
+// func returned is called. An event is dropped if events is full.
+func watchGroup(id string, events chan []byte) func() {
+	groupsMu.Lock()
+	defer groupsMu.Unlock()
+	if groupWatchers[id] == nil {
+		groupWatchers[id] = map[chan []byte]bool{}
+	}
+	groupWatchers[id][events] = true
+	return func() {
+		groupsMu.Lock()
+		defer groupsMu.Unlock()
+		delete(groupWatchers[id], events)
+		if len(groupWatchers[id]) == 0 {
+			delete(groupWatchers, id)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"testing"
+)
+
+func TestTrackGroup(t *testing.T) {
+	defer func(s *stream) { results = s }(results)
+	results = &stream{w: ioutil.Discard, mu: &sync.Mutex{}}
+
+	tests := []struct {
+		name       string
+		size       int
+		errs       []string
+		wantEvents int
+		want       groupEvent
+	}{
+		{"all succeeded", 2, []string{"", ""}, 1, groupEvent{Tasks: 2, Succeeded: 2}},
+		{"one failed", 2, []string{"", "bad"}, 1, groupEvent{Tasks: 2, Succeeded: 1, Failed: 1, Failures: []int{2}}},
+		{"still waiting", 3, []string{"", ""}, 0, groupEvent{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := "album " + tt.name
+			events := make(chan []byte, 2)
+			defer watchGroup(id, events)()
+			defer func() {
+				groupsMu.Lock()
+				delete(groups, id)
+				groupsMu.Unlock()
+			}()
+
+			// how many events there were when the last task was done
+			var whenDone int
+			for i, e := range tt.errs {
+				task := Task{Id: i + 1, GroupId: id, GroupSize: tt.size}
+				trackGroup(task, func(TaskResult) { whenDone = len(events) })(TaskResult{Id: task.Id, Error: e})
+			}
+			if len(events) != tt.wantEvents {
+				t.Fatalf("got %d events, want %d", len(events), tt.wantEvents)
+			}
+			if whenDone != tt.wantEvents {
+				t.Errorf("the last task was done before its group's event")
+			}
+			if tt.wantEvents == 0 {
+				return
+			}
+			var got groupEvent
+			if err := json.Unmarshal(<-events, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.GroupId != id || got.Tasks != tt.want.Tasks || got.Succeeded != tt.want.Succeeded || got.Failed != tt.want.Failed || len(got.Failures) != len(tt.want.Failures) {
+				t.Errorf("event = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+	"image"
+	"math"
+	"os"
+	"sort"
+)
+
+// plane is one channel (or the weights) of an image being fused, 0 to 1
+type plane struct {
+	w, h int
+	p    []float32
+}
+
+func newPlane(w, h int) *plane {
+	return &plane{w, h, make([]float32, w*h)}
+}
+
+func (p *plane) at(x, y int) float32 {
+	return p.p[clampInt(y, 0, p.h-1)*p.w+clampInt(x, 0, p.w-1)]
+}
+
+// mergeImage is an "hdrmerge" task: Filename and its Brackets (other
+// exposures of the same scene, from a tripod or near enough) are aligned to
+// Filename and exposure fused (Mertens et al.) into a preview and thumbnail.
+// The merge is done at the preview's size, it's all the outputs need.
+func mergeImage(t Task) TaskResult {
+	resp := TaskResult{Id: t.Id}
+	if len(t.Brackets) < 1 || len(t.Brackets) > 6 {
+		resp.Error = "An hdrmerge needs 2 to 7 exposures, the filename and its brackets"
+		return resp
+	}
+
+	t.progress.stage("decode", 0)
+	var exposures []*image.RGBA
+	for i, filename := range append([]string{t.Filename}, t.Brackets...) {
+		bracket := t
+		bracket.Filename = filename
+		if i > 0 && isRemote(filename) {
+			local, err := fetchSource(filename)
+			if err != nil {
+				resp.setError(err)
+				return resp
+			}
+			defer removeTemp(local)
+			bracket.Filename = local
+		}
+		if err := checkFormat(filename, bracket.Filename); i > 0 && err != nil {
+			resp.setError(err)
+			return resp
+		}
+		// a decode of its own, the task's is the reference's
+		bracket.decode = nil
+		img, err := decodeSource(bracket)
+		if err != nil {
+			resp.setError(err)
+			return resp
+		}
+		if i == 0 {
+			w, h := fitSize(t, img.Bounds(), previewWidth)
+			img = resize.Resize(w, h, img, resize.Bilinear)
+		} else {
+			b := exposures[0].Bounds()
+			img = resize.Resize(uint(b.Dx()), uint(b.Dy()), img, resize.Bilinear)
+		}
+		exposures = append(exposures, toRGBA(img))
+		t.progress.stage("decode", 50*(i+1)/(len(t.Brackets)+1))
+	}
+
+	t.progress.stage("align", 50)
+	for i := 1; i < len(exposures); i++ {
+		dx, dy := alignShift(exposures[0], exposures[i], 5)
+		if dx != 0 || dy != 0 {
+			logTaskf(t.Id, "debug", "Shifted bracket %d by %d, %d", i, dx, dy)
+			exposures[i] = shiftImage(exposures[i], dx, dy)
+		}
+	}
+
+	t.progress.stage("merge", 60)
+	merged := fuseExposures(exposures)
+
+	t.progress.stage("encode", 85)
+	var err error
+	if resp.Response.Preview, err = writeMerged(t, merged, "preview"); err != nil {
+		resp.setError(err)
+		return resp
+	}
+	w, h := fitSize(t, merged.Bounds(), thumbWidth)
+	if resp.Response.Thumbnail, err = writeMerged(t, resize.Resize(w, h, merged, resize.Bilinear), "thumbnail"); err != nil {
+		unpublishOutput(resp.Response.Preview)
+		resp.setError(err)
+		return resp
+	}
+	return resp
+}
+
+func writeMerged(t Task, img image.Image, output string) (string, error) {
+	f, err := createOutput(t)
+	if err != nil {
+		return "", err
+	}
+	err = encodeInSlot(f, img, t)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", noSpace(err)
+	}
+	location, _, err := publishOutput(t, f.Name(), outputName(t, f.Name(), output, formatExt(t)), formatType(t))
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return location, nil
+}
+
+// alignShift is how far b has to move to line up with a, by Ward's median
+// threshold bitmaps, which look the same whatever the exposure. Each of the
+// levels halves the image, so it finds shifts of up to 2^levels pixels.
+func alignShift(a, b *image.RGBA, levels int) (int, int) {
+	ga, gb := grayPlane(a), grayPlane(b)
+	q := sharedPercentile(ga, gb)
+	var shift func(ga, gb *plane, level int) (int, int)
+	shift = func(ga, gb *plane, level int) (int, int) {
+		var dx, dy int
+		if level > 0 && ga.w >= 16 && ga.h >= 16 {
+			dx, dy = shift(halve(ga), halve(gb), level-1)
+			dx, dy = dx*2, dy*2
+		}
+		ta, ea := thresholdBitmap(ga, q)
+		tb, eb := thresholdBitmap(gb, q)
+		// (by the fraction wrong, or shifting out of the frame would win)
+		best, bx, by := 2.0, dx, dy
+		for sy := dy - 1; sy <= dy+1; sy++ {
+			for sx := dx - 1; sx <= dx+1; sx++ {
+				var errs, compared int
+				for y := 0; y < ga.h; y++ {
+					oy := y - sy
+					if oy < 0 || oy >= gb.h {
+						continue
+					}
+					for x := 0; x < ga.w; x++ {
+						ox := x - sx
+						if ox < 0 || ox >= gb.w {
+							continue
+						}
+						i, o := y*ga.w+x, oy*gb.w+ox
+						if ea[i] && eb[o] {
+							compared++
+							if ta[i] != tb[o] {
+								errs++
+							}
+						}
+					}
+				}
+				if compared > 0 && float64(errs)/float64(compared) < best {
+					best, bx, by = float64(errs)/float64(compared), sx, sy
+				}
+			}
+		}
+		return bx, by
+	}
+	return shift(ga, gb, levels)
+}
+
+func grayPlane(img *image.RGBA) *plane {
+	b := img.Bounds()
+	g := newPlane(b.Dx(), b.Dy())
+	for i := range g.p {
+		px := img.Pix[i*4:]
+		g.p[i] = (0.299*float32(px[0]) + 0.587*float32(px[1]) + 0.114*float32(px[2])) / 255
+	}
+	return g
+}
+
+// halve averages 2x2 blocks
+func halve(p *plane) *plane {
+	h := newPlane(p.w/2, p.h/2)
+	for y := 0; y < h.h; y++ {
+		for x := 0; x < h.w; x++ {
+			h.p[y*h.w+x] = (p.at(2*x, 2*y) + p.at(2*x+1, 2*y) + p.at(2*x, 2*y+1) + p.at(2*x+1, 2*y+1)) / 4
+		}
+	}
+	return h
+}
+
+// sharedPercentile is the percentile to threshold a and b at, the median
+// unless one of them is clipped (or crushed) past it: then the middle of
+// what's left unclipped in both
+func sharedPercentile(a, b *plane) float64 {
+	lo, hi := 0.0, 1.0
+	for _, p := range []*plane{a, b} {
+		// (at the darkest or brightest the image gets, gray clips below white)
+		min, max := p.p[0], p.p[0]
+		for _, v := range p.p {
+			if v < min {
+				min = v
+			}
+			if v > max {
+				max = v
+			}
+		}
+		var crushed, clipped int
+		for _, v := range p.p {
+			if v <= min+4.0/255 {
+				crushed++
+			} else if v >= max-4.0/255 {
+				clipped++
+			}
+		}
+		lo = math.Max(lo, float64(crushed)/float64(len(p.p)))
+		hi = math.Min(hi, 1-float64(clipped)/float64(len(p.p)))
+	}
+	if lo >= hi || (lo < 0.5 && hi > 0.5) {
+		return 0.5
+	}
+	return (lo + hi) / 2
+}
+
+// thresholdBitmap is which pixels are above the q percentile, and which are
+// far enough from it (4 levels in 8 bits) for that to mean anything
+func thresholdBitmap(p *plane, q float64) ([]bool, []bool) {
+	sorted := append([]float32(nil), p.p...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	threshold := sorted[int(q*float64(len(sorted)-1))]
+	above, certain := make([]bool, len(p.p)), make([]bool, len(p.p))
+	for i, v := range p.p {
+		above[i] = v > threshold
+		certain[i] = math.Abs(float64(v-threshold)) > 4.0/255
+	}
+	return above, certain
+}
+
+// shiftImage moves img by dx, dy, repeating the edges into the gap
+func shiftImage(img *image.RGBA, dx, dy int) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := 0; y < b.Dy(); y++ {
+		sy := clampInt(y-dy, 0, b.Dy()-1)
+		for x := 0; x < b.Dx(); x++ {
+			sx := clampInt(x-dx, 0, b.Dx()-1)
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], img.Pix[sy*img.Stride+sx*4:])
+		}
+	}
+	return dst
+}
+
+// fuseExposures blends the exposures by how contrasty, saturated and well
+// exposed each of their pixels is, blending the weights' and the images'
+// pyramids so there are no seams where they change
+func fuseExposures(exposures []*image.RGBA) *image.RGBA {
+	b := exposures[0].Bounds()
+	n := len(exposures)
+
+	weights := make([]*plane, n)
+	channels := make([][3]*plane, n)
+	for k, img := range exposures {
+		weights[k] = newPlane(b.Dx(), b.Dy())
+		for c := range channels[k] {
+			channels[k][c] = newPlane(b.Dx(), b.Dy())
+		}
+		gray := grayPlane(img)
+		for y := 0; y < b.Dy(); y++ {
+			for x := 0; x < b.Dx(); x++ {
+				i := y*b.Dx() + x
+				px := img.Pix[y*img.Stride+x*4:]
+				r, g, bl := float64(px[0])/255, float64(px[1])/255, float64(px[2])/255
+				channels[k][0].p[i], channels[k][1].p[i], channels[k][2].p[i] = float32(r), float32(g), float32(bl)
+
+				contrast := math.Abs(float64(gray.at(x-1, y) + gray.at(x+1, y) + gray.at(x, y-1) + gray.at(x, y+1) - 4*gray.p[i]))
+				mean := (r + g + bl) / 3
+				saturation := math.Sqrt(((r-mean)*(r-mean) + (g-mean)*(g-mean) + (bl-mean)*(bl-mean)) / 3)
+				exposed := wellExposed(r) * wellExposed(g) * wellExposed(bl)
+				weights[k].p[i] = float32(contrast*saturation*exposed + 1e-12)
+			}
+		}
+	}
+	for i := range weights[0].p {
+		var sum float32
+		for k := range weights {
+			sum += weights[k].p[i]
+		}
+		for k := range weights {
+			weights[k].p[i] /= sum
+		}
+	}
+
+	// down to about 16 pixels
+	levels := 1
+	for s := b.Dx(); s > 16 && s*b.Dy()/b.Dx() > 16; s /= 2 {
+		levels++
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for c := 0; c < 3; c++ {
+		var blended []*plane
+		for k := range exposures {
+			w := gaussianPyramid(weights[k], levels)
+			l := laplacianPyramid(channels[k][c], levels)
+			for level := range l {
+				if k == 0 {
+					blended = append(blended, newPlane(l[level].w, l[level].h))
+				}
+				for i := range l[level].p {
+					blended[level].p[i] += w[level].p[i] * l[level].p[i]
+				}
+			}
+		}
+		out := collapse(blended)
+		for i, v := range out.p {
+			dst.Pix[i*4+c] = uint8(clampInt(int(v*255+0.5), 0, 255))
+		}
+	}
+	for i := 3; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] = 0xff
+	}
+	return dst
+}
+
+// wellExposed is how near v is to the middle, a gaussian of sigma 0.2
+func wellExposed(v float64) float64 {
+	return math.Exp(-(v - 0.5) * (v - 0.5) / (2 * 0.2 * 0.2))
+}
+
+// blur is the 5 tap binomial filter, one way then the other
+func blur(p *plane) *plane {
+	kernel := [5]float32{1.0 / 16, 4.0 / 16, 6.0 / 16, 4.0 / 16, 1.0 / 16}
+	tmp, out := newPlane(p.w, p.h), newPlane(p.w, p.h)
+	for y := 0; y < p.h; y++ {
+		for x := 0; x < p.w; x++ {
+			var v float32
+			for i, k := range kernel {
+				v += k * p.at(x+i-2, y)
+			}
+			tmp.p[y*p.w+x] = v
+		}
+	}
+	for y := 0; y < p.h; y++ {
+		for x := 0; x < p.w; x++ {
+			var v float32
+			for i, k := range kernel {
+				v += k * tmp.at(x, y+i-2)
+			}
+			out.p[y*p.w+x] = v
+		}
+	}
+	return out
+}
+
+func down(p *plane) *plane {
+	blurred := blur(p)
+	d := newPlane((p.w+1)/2, (p.h+1)/2)
+	for y := 0; y < d.h; y++ {
+		for x := 0; x < d.w; x++ {
+			d.p[y*d.w+x] = blurred.at(2*x, 2*y)
+		}
+	}
+	return d
+}
+
+// up is p doubled (to w x h) and smoothed
+func up(p *plane, w, h int) *plane {
+	u := newPlane(w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			u.p[y*w+x] = p.at(x/2, y/2)
+		}
+	}
+	return blur(u)
+}
+
+func gaussianPyramid(p *plane, levels int) []*plane {
+	pyramid := []*plane{p}
+	for len(pyramid) < levels {
+		pyramid = append(pyramid, down(pyramid[len(pyramid)-1]))
+	}
+	return pyramid
+}
+
+// laplacianPyramid is what each level of the gaussian pyramid adds to the
+// one below it, and the smallest level as it is
+func laplacianPyramid(p *plane, levels int) []*plane {
+	g := gaussianPyramid(p, levels)
+	pyramid := make([]*plane, levels)
+	for level := 0; level < levels-1; level++ {
+		u := up(g[level+1], g[level].w, g[level].h)
+		l := newPlane(g[level].w, g[level].h)
+		for i := range l.p {
+			l.p[i] = g[level].p[i] - u.p[i]
+		}
+		pyramid[level] = l
+	}
+	pyramid[levels-1] = g[levels-1]
+	return pyramid
+}
+
+func collapse(pyramid []*plane) *plane {
+	out := pyramid[len(pyramid)-1]
+	for level := len(pyramid) - 2; level >= 0; level-- {
+		l := pyramid[level]
+		u := up(out, l.w, l.h)
+		for i := range u.p {
+			u.p[i] += l.p[i]
+		}
+		out = u
+	}
+	return out
+}
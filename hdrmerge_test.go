@@ -0,0 +1,104 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// testExposure is a 96x64 texture moved by dx, dy and scaled by gain, as a
+// bracket of it would be
+func testExposure(dx, dy int, gain float64) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 96, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 96; x++ {
+			sx, sy := float64(x-dx), float64(y-dy)
+			v := 0.5 + 0.4*math.Sin(sx/5)*math.Cos(sy/7) + 0.05*math.Sin(sx*sy/40)
+			c := uint8(clampInt(int(v*gain*255), 0, 255))
+			img.Pix[y*img.Stride+x*4], img.Pix[y*img.Stride+x*4+1], img.Pix[y*img.Stride+x*4+2], img.Pix[y*img.Stride+x*4+3] = c, c, c, 0xff
+		}
+	}
+	return img
+}
+
+func TestAlignShift(t *testing.T) {
+	tests := []struct {
+		name   string
+		dx, dy int
+		gain   float64
+	}{
+		{"aligned", 0, 0, 1},
+		{"aligned, darker", 0, 0, 0.5},
+		{"shifted", 3, -2, 1},
+		{"shifted, darker", -5, 4, 0.5},
+		{"shifted, brighter", 7, 6, 1.6},
+	}
+	reference := testExposure(0, 0, 1)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// b moves by the opposite of how it's off
+			dx, dy := alignShift(reference, testExposure(tt.dx, tt.dy, tt.gain), 5)
+			if dx != -tt.dx || dy != -tt.dy {
+				t.Errorf("alignShift() = %d, %d, want %d, %d", dx, dy, -tt.dx, -tt.dy)
+			}
+		})
+	}
+}
+
+func TestShiftImage(t *testing.T) {
+	img := testExposure(0, 0, 1)
+	tests := []struct {
+		name   string
+		dx, dy int
+	}{
+		{"none", 0, 0},
+		{"right and up", 3, -2},
+		{"left and down", -5, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shifted := shiftImage(img, tt.dx, tt.dy)
+			for _, p := range []image.Point{{10, 10}, {40, 30}, {0, 0}, {95, 63}} {
+				// the edges are repeated into the gap
+				from := image.Pt(clampInt(p.X-tt.dx, 0, 95), clampInt(p.Y-tt.dy, 0, 63))
+				if got, want := shifted.RGBAAt(p.X, p.Y), img.RGBAAt(from.X, from.Y); got != want {
+					t.Errorf("shifted at %v = %v, want %v (from %v)", p, got, want, from)
+				}
+			}
+		})
+	}
+}
+
+func TestFuseExposures(t *testing.T) {
+	mid := testExposure(0, 0, 1)
+	tests := []struct {
+		name      string
+		exposures []*image.RGBA
+		// the fused image's mean, and how far it may be from it
+		mean, within float64
+	}{
+		{"one", []*image.RGBA{mid}, meanOf(mid), 1},
+		{"the same twice", []*image.RGBA{mid, mid}, meanOf(mid), 1},
+		// the well exposed middle wins over the dark and bright brackets
+		{"bracketed", []*image.RGBA{testExposure(0, 0, 0.4), mid, testExposure(0, 0, 1.8)}, meanOf(mid), 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fused := fuseExposures(tt.exposures)
+			if fused.Bounds() != mid.Bounds() {
+				t.Fatalf("fused bounds = %v, want %v", fused.Bounds(), mid.Bounds())
+			}
+			if got := meanOf(fused); math.Abs(got-tt.mean) > tt.within {
+				t.Errorf("fused mean = %.1f, want %.1f±%g", got, tt.mean, tt.within)
+			}
+		})
+	}
+}
+
+func meanOf(img *image.RGBA) float64 {
+	var sum float64
+	for i := 0; i < len(img.Pix); i += 4 {
+		sum += float64(img.Pix[i])
+	}
+	return sum / float64(len(img.Pix)/4)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var heartbeat time.Duration
+
+type heartbeatEvent struct {
+	SchemaVersion int    `json:"schemaVersion,omitempty"`
+	Event         string `json:"event"`
+	Queued        int    `json:"queued"`
+	Running       int    `json:"running"`
+	Completed     int    `json:"completed"`
+}
+
+// startHeartbeats writes a heartbeat to the results every -heartbeat, so a
+// supervisor can tell a wedged process (running but completed not moving)
+// from one that's just idle, wherever the results are going. They stop once
+// the func returned is called (before the results are closed), which waits
+// for one that's being written.
+func startHeartbeats(pool *workerPool) func() {
+	if heartbeat <= 0 {
+		return func() {}
+	}
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+			queued, running, completed := pool.stats()
+			hBytes, err := marshal(heartbeatEvent{
+				SchemaVersion: stampSchema(),
+				Event:         "heartbeat",
+				Queued:        queued,
+				Running:       running,
+				Completed:     completed,
+			})
+			if err != nil {
+				logf("error", "Could not marshal heartbeat: %s", err)
+				continue
+			}
+			if err := results.writeRecord(hBytes); err != nil {
+				logf("error", "Could not write heartbeat: %s", err)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+		})
+	}
+}
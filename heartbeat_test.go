@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a buffer the test can read while heartbeats are written
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.Write(p)
+}
+
+func (l *lockedBuffer) lines() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return bytes.Count(l.b.Bytes(), []byte("\n"))
+}
+
+func TestStartHeartbeats(t *testing.T) {
+	defer func(s *stream, h time.Duration, e string) { results, heartbeat, encoding = s, h, e }(results, heartbeat, encoding)
+	var out lockedBuffer
+	results, heartbeat, encoding = &stream{w: &out, mu: &sync.Mutex{}}, 5*time.Millisecond, "json"
+
+	stop := startHeartbeats(&workerPool{})
+	time.Sleep(30 * time.Millisecond)
+	stop()
+	written := out.lines()
+	if written == 0 {
+		t.Fatal("no heartbeats were written")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if out.lines() != written {
+		t.Errorf("%d heartbeats were written once stopped", out.lines()-written)
+	}
+	// (as it is both deferred and an atExit)
+	stop()
+}
+
+func TestStartHeartbeatsOff(t *testing.T) {
+	defer func(h time.Duration) { heartbeat = h }(heartbeat)
+	heartbeat = 0
+	startHeartbeats(&workerPool{})()
+}
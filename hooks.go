@@ -0,0 +1,51 @@
+package main
+
+import "time"
+
+// Hooks are told about tasks as they go through the pipeline, for an
+// embedder's own metrics, auditing or UI updates. This is package main, so
+// an embedder adds a file of its own that registers them when it's built:
+//
+//	func init() { addHooks(&metrics{}) }
+//
+// They're called from the tasks' goroutines, concurrently, and should
+// return quickly.
+type Hooks interface {
+	OnTaskStart(t Task)
+	// OnStageComplete is called as a task moves on from a stage (see
+	// progress.stage), "queued" being the first
+	OnStageComplete(id int, stage string, took time.Duration)
+	// OnTaskDone is called once the result is written, failed or not. A task
+	// turned down before it started (invalid, or over its client's quota)
+	// is done without OnTaskStart, in no time.
+	OnTaskDone(r TaskResult, took time.Duration)
+	// OnError is called for a failed result, before OnTaskDone
+	OnError(r TaskResult)
+}
+
+var hooks []Hooks
+
+func addHooks(h Hooks) {
+	hooks = append(hooks, h)
+}
+
+func taskStarted(t Task) {
+	for _, h := range hooks {
+		h.OnTaskStart(t)
+	}
+}
+
+func stageCompleted(id int, stage string, took time.Duration) {
+	for _, h := range hooks {
+		h.OnStageComplete(id, stage, took)
+	}
+}
+
+func taskDone(r TaskResult, took time.Duration) {
+	for _, h := range hooks {
+		if r.Error != "" {
+			h.OnError(r)
+		}
+		h.OnTaskDone(r, took)
+	}
+}
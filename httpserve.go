@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// httpAddr is where to listen for batches of tasks, instead of stdin
+	httpAddr string
+	// httpBodyMB is the largest batch that's read, httpWriteTimeout how
+	// long its results can take to stream back
+	httpBodyMB       int64
+	httpWriteTimeout time.Duration
+
+	// renderRoot is the directory /render's files are in, it isn't served
+	// without one
+	renderRoot     string
+	renderCacheDir string
+	renderCacheMB  int64
+	// renderCache is set with -renderCache
+	renderCache *embeddedCache
+)
+
+func checkHTTP() error {
+	if httpAddr == "" {
+		return nil
+	}
+	if redisURL != "" || kafkaBrokers != "" {
+		return fmt.Errorf("Tasks come from -http, -redis or -kafka, only one")
+	}
+	if encoding != "json" {
+		return fmt.Errorf("-http takes JSON tasks, not -encoding %s", encoding)
+	}
+	if httpBodyMB <= 0 {
+		return fmt.Errorf("Invalid -httpBodyMB %d, expected more than 0", httpBodyMB)
+	}
+	return nil
+}
+
+// serveHTTP takes batches of tasks POSTed to /tasks, as a JSON array or one
+// task a line, and answers with each task's result as soon as it's done
+// rather than when the whole batch is: server-sent events ("result" for
+// each, then "done") if the client accepts text/event-stream, otherwise one
+// result a line. The results are written to stdout too, as always, and so
+// is the event of any group ("group", or a line) a task of the batch finishes.
+func serveHTTP(addr string, submit, render func(string, []byte, func(TaskResult))) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tasks", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Tasks are POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+		tasks, err := readBatch(http.MaxBytesReader(w, req.Body, httpBodyMB<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flusher, _ := w.(http.Flusher)
+		events := strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+		if events {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+		}
+		w.WriteHeader(http.StatusOK)
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		// buffered for the whole batch, so a client that's gone away
+		// doesn't hold up the workers
+		results := make(chan TaskResult, len(tasks))
+		groupIds := map[string]bool{}
+		for _, task := range tasks {
+			if id := groupOf(task).GroupId; id != "" {
+				groupIds[id] = true
+			}
+		}
+		groupEvents := make(chan []byte, len(groupIds))
+		for id := range groupIds {
+			defer watchGroup(id, groupEvents)()
+		}
+		writeEvent := func(event []byte) {
+			if events {
+				fmt.Fprintf(w, "event: group\ndata: %s\n\n", event)
+			} else {
+				w.Write(append(event, '\n'))
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		for _, task := range tasks {
+			submit(clientAddr(req), task, func(r TaskResult) { results <- r })
+		}
+		for received := 0; received < len(tasks); {
+			var r TaskResult
+			select {
+			case r = <-results:
+				received++
+			case event := <-groupEvents:
+				writeEvent(event)
+				continue
+			case <-req.Context().Done():
+				return
+			}
+			_, line, err := resultRecord(r)
+			if err != nil {
+				logTaskf(r.Id, "error", "Could not marshal task result: %+v", r)
+				continue
+			}
+			if events {
+				fmt.Fprintf(w, "event: result\ndata: %s\n\n", line)
+			} else {
+				w.Write(append(line, '\n'))
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		// a group's event is sent before its last task is done
+		for len(groupEvents) > 0 {
+			writeEvent(<-groupEvents)
+		}
+		if events {
+			fmt.Fprintf(w, "event: done\ndata: {\"tasks\":%d}\n\n", len(tasks))
+		}
+	})
+	mux.HandleFunc("/schema/", serveSchema)
+	if renderRoot != "" {
+		mux.HandleFunc("/render", func(w http.ResponseWriter, req *http.Request) {
+			serveRender(w, req, render)
+		})
+	}
+	logf("info", "Listening for tasks on %s", addr)
+	server := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+		// a batch is read before any of it runs
+		ReadTimeout:  time.Minute,
+		WriteTimeout: httpWriteTimeout,
+		IdleTimeout:  2 * time.Minute,
+	}
+	return server.ListenAndServe()
+}
+
+// clientAddr is who sent a request, its host without the port (which is
+// new each connection)
+func clientAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// readBatch splits a batch into its tasks, from a JSON array or from one
+// task a line
+func readBatch(body io.Reader) ([][]byte, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var tasks []json.RawMessage
+		if err := json.Unmarshal(data, &tasks); err != nil {
+			return nil, fmt.Errorf("Could not read batch: %s", err)
+		}
+		batch := make([][]byte, len(tasks))
+		for i, task := range tasks {
+			batch[i] = task
+		}
+		return batch, nil
+	}
+
+	var batch [][]byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			batch = append(batch, line)
+		}
+	}
+	return batch, nil
+}
+
+// serveRender is GET /render?file=...&w=400&q=80&fmt=png: the preview of a
+// file in -renderRoot made on demand, w wide (-previewWidth if unset) with
+// JPEG quality q, in fmt "jpeg" (the default) or "png", for the API key in
+// the X-API-Key header. Its ETag is by the source's contents and the
+// parameters, so a client's If-None-Match is answered without rendering and
+// -renderCache can serve the same render again. Whatever goes wrong with the
+// file is a 404, so what's in -renderRoot can't be probed.
+func serveRender(w http.ResponseWriter, req *http.Request, submit func(string, []byte, func(TaskResult))) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Renders are GET", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	t := Task{Format: query.Get("fmt"), APIKey: req.Header.Get("X-API-Key")}
+	file := query.Get("file")
+	if file == "" {
+		http.Error(w, "A render needs a file", http.StatusBadRequest)
+		return
+	}
+	limits, err := limitsFor(t.APIKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	notFound := func() {
+		http.Error(w, "Could not render "+file, http.StatusNotFound)
+	}
+	source, filename, ok := renderFile(file, limits)
+	if !ok {
+		notFound()
+		return
+	}
+	t.Filename = filename
+	switch t.Format {
+	case "", "jpeg", "png":
+	default:
+		http.Error(w, fmt.Sprintf("Unknown fmt %q (jpeg or png)", t.Format), http.StatusBadRequest)
+		return
+	}
+	width := previewWidth
+	if v := query.Get("w"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil || n == 0 {
+			http.Error(w, fmt.Sprintf("Invalid w %q", v), http.StatusBadRequest)
+			return
+		}
+		width = uint(n)
+	}
+	if v := query.Get("q"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, fmt.Sprintf("Invalid q %q, expected 1 to 100", v), http.StatusBadRequest)
+			return
+		}
+		t.Quality = n
+	}
+	t.Ops = []Op{{Resize: &ResizeOp{Width: width}}}
+	renderTag := func(token string) string {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s %d %d %s", token, width, t.Quality, t.Format)))
+		return `"` + hex.EncodeToString(sum[:16]) + `"`
+	}
+	serve := func(etag string, content io.ReadSeeker) {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", formatType(t))
+		http.ServeContent(w, req, "", time.Time{}, content)
+	}
+
+	// answered from the file's hash alone, if it can be
+	token, err := hashFile(source)
+	if err != nil {
+		notFound()
+		return
+	}
+	etag := renderTag(token)
+	if req.Header.Get("If-None-Match") == etag {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	var cached bytes.Buffer
+	if renderCache != nil && renderCache.get(etag[1:len(etag)-1], &cached) {
+		serve(etag, bytes.NewReader(cached.Bytes()))
+		return
+	}
+
+	task, err := marshal(t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	results := make(chan TaskResult, 1)
+	submit(clientAddr(req), task, func(r TaskResult) { results <- r })
+	removeRendered := func(r TaskResult) {
+		for _, f := range r.Response.files() {
+			if f != "" {
+				os.Remove(f)
+			}
+		}
+	}
+	var r TaskResult
+	select {
+	case r = <-results:
+	case <-req.Context().Done():
+		// the client's gone, but the render still has to be cleaned up
+		go func() { removeRendered(<-results) }()
+		return
+	}
+	defer removeRendered(r)
+	switch {
+	case r.Code == "UNAUTHORIZED" || r.Code == "FORBIDDEN":
+		http.Error(w, r.Error, http.StatusUnauthorized)
+		return
+	case r.Code == "RATE_LIMITED" || r.Code == "QUOTA_EXCEEDED":
+		http.Error(w, r.Error, http.StatusTooManyRequests)
+		return
+	case r.Error != "":
+		notFound()
+		return
+	}
+	rendered, err := ioutil.ReadFile(r.Response.Preview)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Response.Token != "" {
+		etag = renderTag(r.Response.Token)
+	}
+	if renderCache != nil {
+		renderCache.put(etag[1:len(etag)-1], bytes.NewReader(rendered))
+	}
+	serve(etag, bytes.NewReader(rendered))
+}
+
+// renderFile is where a render's file is, beneath -renderRoot with links
+// resolved so none leads out of it, and the task's Filename for it: for a
+// tenant with its own dirs that's relative to them, as scopeTask puts it
+// back beneath them. It's not ok if it's missing or outside of either.
+func renderFile(file string, limits clientLimits) (source, filename string, ok bool) {
+	root, err := filepath.EvalSymlinks(renderRoot)
+	if err != nil {
+		return "", "", false
+	}
+	source, err = filepath.EvalSymlinks(filepath.Join(root, filepath.FromSlash(path.Clean("/"+filepath.ToSlash(file)))))
+	if err != nil || !beneath(root, source) {
+		return "", "", false
+	}
+
+	dir := limits.InputDir
+	if dir == "" {
+		dir = limits.OutputDir
+	}
+	if dir == "" {
+		return source, source, true
+	}
+	if isRemote(dir) {
+		return "", "", false
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil || !beneath(dir, source) {
+		return "", "", false
+	}
+	filename, _ = filepath.Rel(dir, source)
+	return source, filename, true
+}
+
+// beneath is whether name is dir or in it, both absolute or both relative
+func beneath(dir, name string) bool {
+	rel, err := filepath.Rel(dir, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
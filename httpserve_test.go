@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderFile(t *testing.T) {
+	defer func(r string) { renderRoot = r }(renderRoot)
+	dir := t.TempDir()
+	renderRoot = filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "secret.jpg")
+	for _, name := range []string{filepath.Join(renderRoot, "shoot", "a.jpg"), filepath.Join(renderRoot, "b.jpg"), outside} {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte("jpeg"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(renderRoot, "link.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(renderRoot, "shoot", "a.jpg"), filepath.Join(renderRoot, "inside.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	root, _ := filepath.EvalSymlinks(renderRoot)
+	shoot := clientLimits{InputDir: filepath.Join(renderRoot, "shoot")}
+
+	tests := []struct {
+		name     string
+		file     string
+		limits   clientLimits
+		filename string
+		ok       bool
+	}{
+		{"in the root", "shoot/a.jpg", clientLimits{}, filepath.Join(root, "shoot", "a.jpg"), true},
+		// rooted, so it is the root's secret.jpg, which there isn't
+		{"climbing out", "../secret.jpg", clientLimits{}, "", false},
+		{"a link out", "link.jpg", clientLimits{}, "", false},
+		{"a link within", "inside.jpg", clientLimits{}, filepath.Join(root, "shoot", "a.jpg"), true},
+		{"missing", "c.jpg", clientLimits{}, "", false},
+		{"in the tenant's dir", "shoot/a.jpg", shoot, "a.jpg", true},
+		{"outside the tenant's dir", "b.jpg", shoot, "", false},
+		{"by the tenant's output dir", "shoot/a.jpg", clientLimits{OutputDir: renderRoot}, filepath.Join("shoot", "a.jpg"), true},
+		{"a remote tenant", "b.jpg", clientLimits{InputDir: "s3://bucket/photos"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, filename, ok := renderFile(tt.file, tt.limits)
+			if ok != tt.ok || (ok && filename != tt.filename) {
+				t.Errorf("renderFile(%q) = %q, %v, want %q, %v", tt.file, filename, ok, tt.filename, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			// as scopeTask takes it
+			task := Task{Filename: filename}
+			if err := scopeInputs(&task, tt.limits); err != nil {
+				t.Errorf("scopeInputs() error = %v", err)
+			}
+		})
+	}
+}
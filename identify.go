@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"golang.org/x/image/tiff"
+	"image"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// rawInfo is the metadata dcraw reports for a file with `-i -v`
+type rawInfo struct {
+	Camera      string
+	Timestamp   string
+	ISO         float64
+	Aperture    float64
+	FocalLength float64
+	Width       int
+	Height      int
+	// every "Key: value" line dcraw printed, for anything not parsed above
+	Fields map[string]string
+}
+
+// identify asks dcraw for the metadata of filename without decoding it
+func identify(filename string) (rawInfo, error) {
+	info := rawInfo{Fields: map[string]string{}}
+
+	var out bytes.Buffer
+	if err := runDcraw([]string{"-i", "-v", filename}, &out); err != nil {
+		return info, err
+	}
+
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		kv := strings.SplitN(scanner.Text(), ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		info.Fields[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+
+	info.Camera = info.Fields["Camera"]
+	info.Timestamp = info.Fields["Timestamp"]
+	info.ISO = leadingFloat(info.Fields["ISO speed"])
+	info.Aperture = leadingFloat(strings.TrimPrefix(info.Fields["Aperture"], "f/"))
+	info.FocalLength = leadingFloat(info.Fields["Focal length"])
+	fmt.Sscanf(info.Fields["Image size"], "%d x %d", &info.Width, &info.Height)
+
+	return info, nil
+}
+
+// leadingFloat parses the number at the start of s, e.g. "24.0 mm" is 24
+func leadingFloat(s string) float64 {
+	if fields := strings.Fields(s); len(fields) > 0 {
+		f, _ := strconv.ParseFloat(fields[0], 64)
+		return f
+	}
+	return 0
+}
+
+// identifyImage describes a file without rendering it: RAWs through dcraw,
+// anything else by its header (including how many pages a TIFF has)
+func identifyImage(t Task) TaskResult {
+	resp := TaskResult{Id: t.Id}
+
+	f, err := os.Open(t.Filename)
+	if os.IsNotExist(err) {
+		resp.Error = "File does not exist"
+		return resp
+	} else if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	defer f.Close()
+
+	// RAWs are mostly TIFFs too, so dcraw has to be asked first
+	if raw, err := identify(t.Filename); err == nil {
+		resp.Response.Info = &Info{
+			Format: "raw",
+			Camera: raw.Camera,
+			Width:  raw.Width,
+			Height: raw.Height,
+			Pages:  1,
+		}
+		return resp
+	}
+
+	if pages, err := tiffPageCount(f); err == nil {
+		config, err := tiff.DecodeConfig(f)
+		if err != nil {
+			resp.Error = err.Error()
+			return resp
+		}
+		resp.Response.Info = &Info{
+			Format: "tiff",
+			Width:  config.Width,
+			Height: config.Height,
+			Pages:  pages,
+		}
+		return resp
+	}
+
+	config, format, err := image.DecodeConfig(f)
+	if err != nil {
+		resp.Error = fmt.Sprintf("Could not identify image: %s", err)
+		return resp
+	}
+	resp.Response.Info = &Info{
+		Format: format,
+		Width:  config.Width,
+		Height: config.Height,
+		Pages:  1,
+	}
+	return resp
+}
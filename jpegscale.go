@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"github.com/jbuchbinder/gopnm"
+	"image"
+	"image/jpeg"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// djpegPath, if set, is libjpeg-turbo's djpeg, to decode JPEGs at 1/2, 1/4
+// or 1/8 size (scaling their DCT) when that's still big enough for the task,
+// rather than decoding all 50MP for a 1200px preview
+var djpegPath string
+
+// decodeScaled is the JPEG source decoded as small as the task allows, nil
+// if it isn't a JPEG, can't be scaled by at least half or needs every pixel
+// (see shrinkFactor)
+func decodeScaled(t Task) image.Image {
+	if djpegPath == "" || t.Page > 1 {
+		return nil
+	}
+	f, err := os.Open(t.Filename)
+	if err != nil {
+		return nil
+	}
+	config, err := jpeg.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return nil
+	}
+
+	factor := shrinkFactor(t, image.Rect(0, 0, config.Width, config.Height))
+	scale := 1
+	for _, s := range []int{8, 4, 2} {
+		if s <= factor {
+			scale = s
+			break
+		}
+	}
+	if scale == 1 {
+		return nil
+	}
+
+	source, unlink, err := plainPath(t.Filename)
+	if err != nil {
+		return nil
+	}
+	defer unlink()
+	args := []string{"-scale", "1/" + strconv.Itoa(scale), "-pnm", source}
+	var out, stderr bytes.Buffer
+	cmd := exec.Command(djpegPath, args...)
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	release, err := sandbox(cmd)
+	if err == nil {
+		err = cmd.Run()
+		release()
+	}
+	if err != nil {
+		// CMYK, say, which djpeg won't write as a PNM
+		logTaskf(t.Id, "debug", "djpeg can't scale %s, decoding all of it: %s", t.Filename, bytes.TrimSpace(stderr.Bytes()))
+		return nil
+	}
+	img, err := pnm.Decode(&out)
+	if err != nil {
+		logTaskf(t.Id, "debug", "Could not read djpeg's output, decoding all of %s: %s", t.Filename, err)
+		return nil
+	}
+	t.decoded("jpegScaled", args[:2])
+	return img
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// jpegtranPath, if set, rotates and crops JPEGs losslessly
+var jpegtranPath string
+
+// jpegMCU reads a JPEG's frame header for its size and the size of its
+// MCUs, the blocks jpegtran can move around without decoding them
+func jpegMCU(r io.Reader) (width, height, mcuWidth, mcuHeight int, err error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xff, 0xd8} {
+		return 0, 0, 0, 0, fmt.Errorf("not a JPEG")
+	}
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil {
+			return 0, 0, 0, 0, err
+		}
+		if marker[0] != 0xff {
+			return 0, 0, 0, 0, fmt.Errorf("bad JPEG marker")
+		}
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return 0, 0, 0, 0, fmt.Errorf("bad JPEG segment")
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 0, 0, 0, 0, err
+		}
+
+		switch m := marker[1]; {
+		case m >= 0xc0 && m <= 0xcf && m != 0xc4 && m != 0xc8 && m != 0xcc:
+			// SOFn: precision, height, width, components, then id, HxV sampling, table of each
+			if len(segment) < 6 {
+				return 0, 0, 0, 0, fmt.Errorf("bad JPEG frame header")
+			}
+			height = int(binary.BigEndian.Uint16(segment[1:]))
+			width = int(binary.BigEndian.Uint16(segment[3:]))
+			n := int(segment[5])
+			maxH, maxV := 1, 1
+			for i := 0; i < n && 6+i*3+1 < len(segment); i++ {
+				s := segment[6+i*3+1]
+				if h := int(s >> 4); h > maxH {
+					maxH = h
+				}
+				if v := int(s & 0x0f); v > maxV {
+					maxV = v
+				}
+			}
+			if n == 1 {
+				// a single component isn't interleaved, its blocks are 8x8
+				maxH, maxV = 1, 1
+			}
+			return width, height, 8 * maxH, 8 * maxV, nil
+		case m == 0xda:
+			return 0, 0, 0, 0, fmt.Errorf("no JPEG frame header")
+		}
+	}
+}
+
+// transformJPEG runs the task's ops through jpegtran, when the source is a
+// JPEG and they're only rotations and crops on MCU boundaries, returning
+// the (temp) result. The caller removes it. "" means the ops have to be
+// done the usual way.
+func transformJPEG(t Task) (string, error) {
+	if jpegtranPath == "" || len(t.Ops) == 0 || t.LensCorrection || t.Page > 1 ||
+		(t.Format != "" && t.Format != "jpeg") || t.Exposure != 0 || t.Brightness != 0 || t.Gamma != 0 || t.DisplayP3 || t.Denoise != 0 || t.LUT != "" || t.Trim {
+		return "", nil
+	}
+	f, err := os.Open(t.Filename)
+	if err != nil {
+		return "", nil // decodeSource will say what's wrong
+	}
+	w, h, mw, mh, err := jpegMCU(f)
+	f.Close()
+	if err != nil {
+		return "", nil
+	}
+
+	steps, ok := jpegtranSteps(t.Ops, w, h, mw, mh)
+	if !ok {
+		return "", nil
+	}
+
+	input := t.Filename
+	for _, step := range steps {
+		out, err := createTemp("*.jpg")
+		if err != nil {
+			return "", err
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command(jpegtranPath, append(append([]string{"-copy", "none", "-perfect"}, step...), input)...)
+		cmd.Stdout, cmd.Stderr = out, &stderr
+		release, err := sandbox(cmd)
+		if err == nil {
+			err = cmd.Run()
+			release()
+		}
+		out.Close()
+		if input != t.Filename {
+			removeTemp(input)
+		}
+		if err != nil {
+			removeTemp(out.Name())
+			logTaskf(t.Id, "debug", "jpegtran can't transform losslessly, decoding instead: %s", bytes.TrimSpace(stderr.Bytes()))
+			return "", nil
+		}
+		input = out.Name()
+	}
+	if input == t.Filename {
+		// nothing to do, but the source is still a copy away from the preview
+		return "", nil
+	}
+	return input, nil
+}
+
+// jpegtranSteps are jpegtran's args for each of the ops on a w x h JPEG of mw
+// x mh MCUs; ok is false unless they're all rotations by right angles and
+// crops (within the image) from MCU boundaries
+func jpegtranSteps(ops []Op, w, h, mw, mh int) ([][]string, bool) {
+	var steps [][]string
+	for _, op := range ops {
+		switch {
+		case op.Rotate != nil && op.count() == 1:
+			degrees := ((op.Rotate.Degrees % 360) + 360) % 360
+			if degrees%90 != 0 {
+				return nil, false // let applyOps report it
+			}
+			if degrees == 0 {
+				continue
+			}
+			// -perfect refuses when partial edge blocks would have to move
+			steps = append(steps, []string{"-rotate", strconv.Itoa(degrees)})
+			if degrees != 180 {
+				w, h, mw, mh = h, w, mh, mw
+			}
+		case op.Crop != nil && op.count() == 1:
+			c := op.Crop
+			r := image.Rect(c.X, c.Y, c.X+c.Width, c.Y+c.Height)
+			if r.Empty() || !r.In(image.Rect(0, 0, w, h)) || c.X%mw != 0 || c.Y%mh != 0 {
+				return nil, false
+			}
+			steps = append(steps, []string{"-crop", fmt.Sprintf("%dx%d+%d+%d", c.Width, c.Height, c.X, c.Y)})
+			w, h = c.Width, c.Height
+		default:
+			return nil, false
+		}
+	}
+	return steps, true
+}
+
+// decodeJPEGFile decodes a JPEG on disk
+func decodeJPEGFile(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return jpeg.Decode(f)
+}
+
+// copyFile copies a file's contents to w
+func copyFile(w io.Writer, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"reflect"
+	"testing"
+)
+
+func TestJPEGMCU(t *testing.T) {
+	var color, gray bytes.Buffer
+	// Go's encoder subsamples color 4:2:0, so its MCUs are 16x16
+	jpeg.Encode(&color, image.NewRGBA(image.Rect(0, 0, 40, 24)), nil)
+	jpeg.Encode(&gray, image.NewGray(image.Rect(0, 0, 40, 24)), nil)
+	// a frame header of 4:2:2, 3 components: id, sampling, table
+	sof := []byte{0xff, 0xd8, 0xff, 0xc0, 0, 17, 8, 0, 24, 0, 40, 3, 1, 0x21, 0, 2, 0x11, 1, 3, 0x11, 1}
+
+	tests := []struct {
+		name                string
+		data                []byte
+		mcuWidth, mcuHeight int
+		wantErr             bool
+	}{
+		{"4:2:0", color.Bytes(), 16, 16, false},
+		{"gray", gray.Bytes(), 8, 8, false},
+		{"4:2:2", sof, 16, 8, false},
+		{"not a JPEG", []byte("\x89PNG"), 0, 0, true},
+		{"truncated frame header", sof[:12], 0, 0, true},
+		{"short frame header", []byte{0xff, 0xd8, 0xff, 0xc0, 0, 4, 8, 0}, 0, 0, true},
+		{"segment shorter than its length", []byte{0xff, 0xd8, 0xff, 0xe0, 0, 1}, 0, 0, true},
+		{"bad marker", []byte{0xff, 0xd8, 0x12, 0x34, 0, 2}, 0, 0, true},
+		{"scan before the frame", []byte{0xff, 0xd8, 0xff, 0xda, 0, 2}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, h, mw, mh, err := jpegMCU(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("jpegMCU() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if w != 40 || h != 24 || mw != tt.mcuWidth || mh != tt.mcuHeight {
+				t.Errorf("jpegMCU() = %dx%d of %dx%d MCUs, want 40x24 of %dx%d", w, h, mw, mh, tt.mcuWidth, tt.mcuHeight)
+			}
+		})
+	}
+}
+
+func TestJpegtranSteps(t *testing.T) {
+	rotate := func(degrees int) Op { return Op{Rotate: &RotateOp{Degrees: degrees}} }
+	crop := func(x, y, w, h int) Op { return Op{Crop: &CropOp{X: x, Y: y, Width: w, Height: h}} }
+
+	tests := []struct {
+		name   string
+		ops    []Op
+		want   [][]string
+		wantOk bool
+	}{
+		{"aligned crop", []Op{crop(16, 32, 100, 50)}, [][]string{{"-crop", "100x50+16+32"}}, true},
+		{"unaligned crop", []Op{crop(8, 0, 100, 50)}, nil, false},
+		{"crop past the edge", []Op{crop(0, 0, 700, 50)}, nil, false},
+		{"empty crop", []Op{crop(0, 0, 0, 50)}, nil, false},
+		{"rotations", []Op{rotate(90), rotate(-90), rotate(360)}, [][]string{{"-rotate", "90"}, {"-rotate", "270"}}, true},
+		{"not a right angle", []Op{rotate(45)}, nil, false},
+		// turned, the 16x8 MCUs are 8x16 and the image 480x640
+		{"crop after a rotation", []Op{rotate(90), crop(8, 16, 400, 600)}, [][]string{{"-rotate", "90"}, {"-crop", "400x600+8+16"}}, true},
+		{"unaligned after a rotation", []Op{rotate(90), crop(16, 8, 400, 600)}, nil, false},
+		{"a resize", []Op{{Resize: &ResizeOp{Width: 100}}}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := jpegtranSteps(tt.ops, 640, 480, 16, 8)
+			if ok != tt.wantOk || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("jpegtranSteps() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// schemaOf is which schema "imaging schema" prints, "task" or "result"
+	schemaOf string
+	// strictTasks fails tasks with fields the schema doesn't have, rather
+	// than warning about them
+	strictTasks bool
+)
+
+// schema is a JSON Schema (draft-07), made from the Go types so it can't
+// drift from what's actually read and written
+type schema map[string]interface{}
+
+var (
+	taskSchema   = schemaFor(reflect.TypeOf(Task{}), "Task")
+	resultSchema = schemaFor(reflect.TypeOf(TaskResult{}), "TaskResult")
+)
+
+var (
+	metaType = reflect.TypeOf(Meta{})
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaFor is t's schema, its structs as definitions (a struct can contain
+// itself, an Op's ops say)
+func schemaFor(t reflect.Type, title string) schema {
+	defs := schema{}
+	typeSchema(t, defs)
+	s := schema{
+		"$schema":     "http://json-schema.org/draft-07/schema#",
+		"title":       title,
+		"definitions": defs,
+	}
+	for k, v := range defs[t.Name()].(schema) {
+		s[k] = v
+	}
+	return s
+}
+
+func typeSchema(t reflect.Type, defs schema) schema {
+	switch t {
+	case metaType, rawType:
+		// anything at all
+		return schema{}
+	case timeType:
+		return schema{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := typeSchema(t.Elem(), defs)
+		return schema{"anyOf": []interface{}{s, schema{"type": "null"}}}
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return schema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return schema{"type": []interface{}{"array", "null"}, "items": typeSchema(t.Elem(), defs)}
+	case reflect.Map:
+		return schema{"type": []interface{}{"object", "null"}, "additionalProperties": typeSchema(t.Elem(), defs)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			properties := schema{}
+			structFields(t, defs, properties)
+			return schema{"type": "object", "properties": properties}
+		}
+		ref := schema{"$ref": "#/definitions/" + t.Name()}
+		if _, ok := defs[t.Name()]; ok {
+			return ref
+		}
+		// a placeholder while the fields are done
+		defs[t.Name()] = schema{}
+		properties := schema{}
+		structFields(t, defs, properties)
+		defs[t.Name()] = schema{"type": "object", "properties": properties}
+		return ref
+	}
+	return schema{}
+}
+
+// structFields adds t's fields to properties by their JSON names, those of
+// embedded structs as their own, the way encoding/json does
+func structFields(t reflect.Type, defs, properties schema) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			structFields(f.Type, defs, properties)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = typeSchema(f.Type, defs)
+	}
+}
+
+// validateTask checks a JSON task against the Task schema, so a field of the
+// wrong type is an error naming the field rather than a zero value. One the
+// schema doesn't have (misspelled, say) is only warned about, as it always
+// was ignored, unless -strictTasks.
+func validateTask(data []byte) error {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return err
+	}
+	var problems, unknown []string
+	validate(taskSchema, taskSchema, v, "", &problems, &unknown)
+	if strictTasks {
+		problems = append(problems, unknown...)
+	} else if len(unknown) > 0 {
+		logf("warn", "Ignoring fields of a task: %s", strings.Join(unknown, ", "))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	msg := problems[0]
+	if len(problems) > 1 {
+		msg = fmt.Sprintf("%s (and %d more)", msg, len(problems)-1)
+	}
+	return &codedError{code: "INVALID_TASK", msg: msg, detail: strings.Join(problems, "\n")}
+}
+
+// validate adds what's wrong with v to problems, and fields the schema
+// doesn't have to unknown, at is where v is
+func validate(root, s schema, v interface{}, at string, problems, unknown *[]string) {
+	if ref, ok := s["$ref"].(string); ok {
+		s = root["definitions"].(schema)[strings.TrimPrefix(ref, "#/definitions/")].(schema)
+	}
+	// encoding/json takes null for anything, as the zero value
+	if v == nil {
+		return
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		s = anyOf[0].(schema)
+		validate(root, s, v, at, problems, unknown)
+		return
+	}
+	types, ok := s["type"]
+	if !ok {
+		return
+	}
+	name := at
+	if name == "" {
+		name = "the task"
+	}
+	got := jsonType(v)
+	var want []string
+	switch types := types.(type) {
+	case string:
+		want = []string{types}
+	case []interface{}:
+		for _, t := range types {
+			want = append(want, t.(string))
+		}
+	}
+	matches := false
+	for _, w := range want {
+		if w == got || (w == "number" && got == "integer") {
+			matches = true
+		}
+	}
+	if !matches {
+		*problems = append(*problems, fmt.Sprintf("%s is %s, expected %s", name, article(got), article(want[0])))
+		return
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		if min, ok := s["minimum"].(int); ok {
+			if n, err := v.Float64(); err == nil && n < float64(min) {
+				*problems = append(*problems, fmt.Sprintf("%s is %s, expected at least %d", name, v, min))
+			}
+		}
+	case []interface{}:
+		items, _ := s["items"].(schema)
+		for i, item := range v {
+			validate(root, items, item, fmt.Sprintf("%s[%d]", at, i), problems, unknown)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		properties, _ := s["properties"].(schema)
+		for _, k := range keys {
+			field := k
+			if at != "" {
+				field = at + "." + k
+			}
+			if properties == nil {
+				if more, ok := s["additionalProperties"].(schema); ok {
+					validate(root, more, v[k], field, problems, unknown)
+				}
+				continue
+			}
+			p, ok := properties[k]
+			if !ok {
+				p, ok = foldedProperty(properties, k)
+			}
+			if !ok {
+				*unknown = append(*unknown, fmt.Sprintf("%s isn't a field", field))
+				continue
+			}
+			validate(root, p.(schema), v[k], field, problems, unknown)
+		}
+	}
+}
+
+// foldedProperty is the property named k but for case, which encoding/json
+// takes as that field
+func foldedProperty(properties schema, k string) (interface{}, bool) {
+	for name, p := range properties {
+		if strings.EqualFold(name, k) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if strings.ContainsAny(v.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	}
+	return "object"
+}
+
+func article(t string) string {
+	switch t {
+	case "null":
+		return t
+	case "array", "integer", "object":
+		return "an " + t
+	}
+	return "a " + t
+}
+
+// serveSchema answers GET /schema/task and /schema/result
+func serveSchema(w http.ResponseWriter, req *http.Request) {
+	s := taskSchema
+	switch strings.TrimPrefix(req.URL.Path, "/schema/") {
+	case "task":
+	case "result":
+		s = resultSchema
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s)
+}
+
+// printSchema is the "schema" command
+func printSchema() error {
+	s := taskSchema
+	switch schemaOf {
+	case "task":
+	case "result":
+		s = resultSchema
+	default:
+		return fmt.Errorf("Unknown schema %q (task or result)", schemaOf)
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
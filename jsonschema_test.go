@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateTask(t *testing.T) {
+	defer func(strict bool) { strictTasks = strict }(strictTasks)
+
+	tests := []struct {
+		name    string
+		task    string
+		strict  bool
+		wantErr bool
+	}{
+		{"valid", `{"id":1,"filename":"a.cr2","imageWidth":1200,"ops":[{"crop":{"x":0,"y":0,"width":10,"height":10}}]}`, false, false},
+		{"wrong type", `{"id":"1"}`, false, true},
+		{"negative uint", `{"imageWidth":-1}`, false, true},
+		{"float for an int", `{"id":1.5}`, false, true},
+		{"integer for a float", `{"megapixels":2}`, false, false},
+		{"nested wrong type", `{"ops":[{"crop":{"x":"0"}}]}`, false, true},
+		{"array item wrong type", `{"files":["a.jpg",2]}`, false, true},
+		{"null anywhere", `{"filename":null,"ops":null,"tileOverlap":null,"imageWidth":null}`, false, false},
+		{"pointer", `{"tileOverlap":4}`, false, false},
+		{"meta is anything", `{"meta":{"any":["thing",1]}}`, false, false},
+		{"unknown field", `{"filenme":"a.cr2"}`, false, false},
+		{"unknown field, strict", `{"filenme":"a.cr2"}`, true, true},
+		// as encoding/json reads it
+		{"field in another case, strict", `{"FileName":"a.cr2"}`, true, false},
+		{"not an object", `[1]`, false, true},
+		{"not JSON", `{"id":`, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			strictTasks = tt.strict
+			err := validateTask([]byte(tt.task))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateTask() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if c, ok := err.(*codedError); ok && c.code != "INVALID_TASK" {
+				t.Errorf("validateTask() code = %s, want INVALID_TASK", c.code)
+			}
+			// whatever validates also unmarshals
+			var task Task
+			if err == nil {
+				if err := json.Unmarshal([]byte(tt.task), &task); err != nil {
+					t.Errorf("validated, but json.Unmarshal() error = %v", err)
+				}
+			}
+		})
+	}
+}
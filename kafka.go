@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	kafkaBrokers string
+	kafkaTasks   string
+	kafkaResults string
+	kafkaGroup   string
+	kafkaKey     string
+)
+
+func checkKafka() error {
+	if kafkaBrokers == "" {
+		return nil
+	}
+	if redisURL != "" {
+		return fmt.Errorf("Tasks come from -redis or -kafka, not both")
+	}
+	switch kafkaKey {
+	case "id", "none":
+		return nil
+	}
+	return fmt.Errorf("Unknown -kafkaKey %q (id or none)", kafkaKey)
+}
+
+// kafkaWriter produces each result to -kafkaResults, keyed by its task's id
+// (so a task's results land on one partition, in order) unless -kafkaKey is
+// none. Each write waits for every replica, so a task is only committed once
+// its result can't be lost; the workers write at once, and what they write
+// within BatchTimeout is produced together.
+type kafkaWriter struct {
+	w *kafka.Writer
+}
+
+func (w *kafkaWriter) Write(p []byte) (int, error) {
+	value := p
+	if encoding != "msgpack" {
+		value = bytes.TrimSuffix(p, []byte("\n"))
+	}
+	m := kafka.Message{Value: append([]byte(nil), value...)}
+	if kafkaKey == "id" {
+		var r struct {
+			Id *int `json:"id"`
+		}
+		// heartbeats have no id
+		if unmarshal(value, &r) == nil && r.Id != nil {
+			m.Key = []byte(strconv.Itoa(*r.Id))
+		}
+	}
+	return len(p), w.w.WriteMessages(context.Background(), m)
+}
+
+func openKafka() (*kafka.Reader, *kafka.Writer) {
+	brokers := strings.Split(kafkaBrokers, ",")
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:  brokers,
+		GroupID:  kafkaGroup,
+		Topic:    kafkaTasks,
+		MinBytes: 1,
+		MaxBytes: 10 << 20,
+		// a new group starts at the oldest task, not just the ones after it joined
+		StartOffset: kafka.FirstOffset,
+	})
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        kafkaResults,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// not the default second, which each result would wait out
+		BatchTimeout: 5 * time.Millisecond,
+		BatchSize:    numWorkers,
+	}
+	return r, w
+}
+
+// readKafka hands each task of the consumer group's partitions to handle
+// until kafka fails, along with a func to commit it once its result is
+// produced. Tasks finish in any order, but an offset is only committed when
+// every task before it on the partition is done too, so whatever a crash or
+// rebalance interrupts is delivered again (at least once). Only as many
+// tasks as there are workers are taken at once.
+//
+// The reader doesn't say when the group's generation changes, but a
+// partition that's reassigned goes back to its committed offset, before the
+// next: then what was pending on it is forgotten, as its offsets are no
+// longer ours to commit. Offsets skipped ahead are just a gap, as compacted
+// and transactional topics have.
+func readKafka(r *kafka.Reader, handle func(task []byte, ack func())) error {
+	taken := make(chan struct{}, numWorkers)
+	offsets := map[int]*partitionOffsets{}
+	var mu sync.Mutex
+
+	for {
+		taken <- struct{}{}
+		m, err := r.FetchMessage(context.Background())
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		p, ok := offsets[m.Partition]
+		if ok && m.Offset < p.next {
+			logf("info", "Partition %d was reassigned, from offset %d", m.Partition, m.Offset)
+			p.stale = true
+			ok = false
+		}
+		if !ok {
+			p = &partitionOffsets{done: map[int64]bool{}}
+			offsets[m.Partition] = p
+		}
+		p.pending = append(p.pending, m.Offset)
+		p.next = m.Offset + 1
+		mu.Unlock()
+
+		handle(m.Value, func() {
+			mu.Lock()
+			last, ok := p.finish(m.Offset)
+			ok = ok && !p.stale
+			mu.Unlock()
+			if ok {
+				commit := kafka.Message{Topic: m.Topic, Partition: m.Partition, Offset: last}
+				if err := r.CommitMessages(context.Background(), commit); err != nil {
+					logf("error", "Could not commit partition %d at offset %d: %s", m.Partition, last, err)
+				}
+			}
+			<-taken
+		})
+	}
+}
+
+// partitionOffsets are the tasks taken from a partition that aren't committed
+type partitionOffsets struct {
+	pending []int64
+	done    map[int64]bool
+	// next is the offset expected next, stale is set once the partition's
+	// been reassigned
+	next  int64
+	stale bool
+}
+
+// finish marks an offset done, and is the last offset that can be committed
+// because it and everything before it are
+func (p *partitionOffsets) finish(offset int64) (int64, bool) {
+	p.done[offset] = true
+	// a rebalance can hand a partition back from an earlier offset
+	sort.Slice(p.pending, func(i, j int) bool { return p.pending[i] < p.pending[j] })
+
+	var last int64
+	committable := false
+	for len(p.pending) > 0 && p.done[p.pending[0]] {
+		last, committable = p.pending[0], true
+		delete(p.done, last)
+		p.pending = p.pending[1:]
+	}
+	return last, committable
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPartitionOffsetsFinish(t *testing.T) {
+	type step struct {
+		offset      int64
+		last        int64
+		committable bool
+	}
+	tests := []struct {
+		name    string
+		pending []int64
+		steps   []step
+	}{
+		{"in order", []int64{1, 2, 3}, []step{{1, 1, true}, {2, 2, true}, {3, 3, true}}},
+		{"out of order", []int64{1, 2, 3}, []step{{3, 0, false}, {2, 0, false}, {1, 3, true}}},
+		{"a gap", []int64{1, 2, 3}, []step{{1, 1, true}, {3, 0, false}, {2, 3, true}}},
+		// handed back from an earlier offset after a rebalance
+		{"unsorted", []int64{5, 6, 2}, []step{{2, 2, true}, {6, 0, false}, {5, 6, true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &partitionOffsets{pending: tt.pending, done: map[int64]bool{}}
+			for _, s := range tt.steps {
+				last, ok := p.finish(s.offset)
+				if ok != s.committable || ok && last != s.last {
+					t.Errorf("finish(%d) = %d, %v, want %d, %v", s.offset, last, ok, s.last, s.committable)
+				}
+			}
+			if len(p.pending) != 0 || len(p.done) != 0 {
+				t.Errorf("left pending %v, done %v", p.pending, p.done)
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/image/tiff/lzw"
+	"image"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// TIFFs past -largeTIFFMB (film scans, mostly) are downsampled as they're
+// read, a strip or row of tiles at a time, rather than decoded whole
+var largeTIFFMB int64
+
+// the tags needed to read strips and tiles, besides those in dng.go
+const (
+	tagBitsPerSample   = 258
+	tagPhotometric     = 262
+	tagSamplesPerPixel = 277
+	tagRowsPerStrip    = 278
+	tagPlanarConfig    = 284
+	tagPredictor       = 317
+	tagTileWidth       = 322
+	tagTileLength      = 323
+	tagTileOffsets     = 324
+	tagTileByteCounts  = 325
+)
+
+// largeTIFF is the layout of a TIFF page that can be read in chunks
+type largeTIFF struct {
+	f     *os.File
+	order binary.ByteOrder
+
+	width, height int
+	samples       int
+	bytesPerValue int
+	photometric   int
+	compression   int
+	predictor     int
+
+	// strips are chunkWidth (the image's) by chunkHeight, tiles are smaller
+	chunkWidth, chunkHeight int
+	offsets, byteCounts     []float64
+	tiled                   bool
+}
+
+// isLargeTIFF is whether f is a TIFF past -largeTIFFMB
+func isLargeTIFF(f *os.File) bool {
+	if largeTIFFMB <= 0 {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil || info.Size() < largeTIFFMB<<20 {
+		return false
+	}
+	_, _, err = tiffIFDs(f)
+	return err == nil
+}
+
+// unsupportedTIFF is a TIFF the chunked reader doesn't handle, which can
+// still be decoded whole
+type unsupportedTIFF string
+
+func (e unsupportedTIFF) Error() string {
+	return "Unsupported TIFF: " + string(e)
+}
+
+func openLargeTIFF(f *os.File, page int) (*largeTIFF, error) {
+	offsets, order, err := tiffIFDs(f)
+	if err != nil {
+		return nil, err
+	}
+	if page < 1 {
+		page = 1
+	}
+	if page > len(offsets) {
+		return nil, fmt.Errorf("Page %d requested but the TIFF has %d page(s)", page, len(offsets))
+	}
+	ifd, err := readIFD(f, order, offsets[page-1])
+	if err != nil {
+		return nil, err
+	}
+
+	l := &largeTIFF{
+		f:             f,
+		order:         order,
+		width:         int(ifd[tagImageWidth].value(order)),
+		height:        int(ifd[tagImageLength].value(order)),
+		samples:       int(ifd[tagSamplesPerPixel].value(order)),
+		bytesPerValue: int(ifd[tagBitsPerSample].value(order)) / 8,
+		photometric:   int(ifd[tagPhotometric].value(order)),
+		compression:   int(ifd[tagCompression].value(order)),
+		predictor:     int(ifd[tagPredictor].value(order)),
+	}
+	if l.samples == 0 {
+		l.samples = 1
+	}
+	if l.compression == 0 {
+		l.compression = 1
+	}
+
+	if _, ok := ifd[tagTileOffsets]; ok {
+		l.tiled = true
+		l.chunkWidth = int(ifd[tagTileWidth].value(order))
+		l.chunkHeight = int(ifd[tagTileLength].value(order))
+		l.offsets = ifd[tagTileOffsets].values(order)
+		l.byteCounts = ifd[tagTileByteCounts].values(order)
+	} else {
+		l.chunkWidth = l.width
+		l.chunkHeight = int(ifd[tagRowsPerStrip].value(order))
+		if l.chunkHeight == 0 || l.chunkHeight > l.height {
+			l.chunkHeight = l.height
+		}
+		l.offsets = ifd[tagStripOffsets].values(order)
+		l.byteCounts = ifd[tagStripByteCounts].values(order)
+	}
+
+	switch {
+	case l.width == 0 || l.height == 0 || l.chunkWidth == 0 || l.chunkHeight == 0:
+		return nil, fmt.Errorf("TIFF has no dimensions")
+	case l.bytesPerValue != 1 && l.bytesPerValue != 2:
+		return nil, unsupportedTIFF(fmt.Sprintf("%d bits per sample", l.bytesPerValue*8))
+	case l.photometric > 2 || (l.photometric == 2 && l.samples < 3):
+		return nil, unsupportedTIFF(fmt.Sprintf("photometric interpretation %d", l.photometric))
+	case ifd[tagPlanarConfig].value(order) == 2:
+		return nil, unsupportedTIFF("planar samples")
+	case l.compression != 1 && l.compression != 5 && l.compression != 8 && l.compression != 32946 && l.compression != 32773:
+		return nil, unsupportedTIFF(fmt.Sprintf("compression %d", l.compression))
+	case len(l.offsets) == 0 || len(l.offsets) != len(l.byteCounts):
+		return nil, fmt.Errorf("TIFF has no strips or tiles")
+	}
+	return l, nil
+}
+
+// chunk reads and decompresses strip or tile i, without the predictor
+func (l *largeTIFF) chunk(i int) ([]byte, error) {
+	if i >= len(l.offsets) {
+		return nil, fmt.Errorf("TIFF is missing strip or tile %d", i)
+	}
+	stride := l.chunkWidth * l.samples * l.bytesPerValue
+	size := stride * l.chunkHeight
+	r := io.NewSectionReader(l.f, int64(l.offsets[i]), int64(l.byteCounts[i]))
+
+	var data []byte
+	var err error
+	switch l.compression {
+	case 1:
+		data, err = ioutil.ReadAll(r)
+	case 5:
+		lr := lzw.NewReader(r, lzw.MSB, 8)
+		data, err = ioutil.ReadAll(lr)
+		lr.Close()
+	case 8, 32946:
+		var zr io.ReadCloser
+		if zr, err = zlib.NewReader(r); err == nil {
+			data, err = ioutil.ReadAll(zr)
+			zr.Close()
+		}
+	case 32773:
+		// the last strip is only as long as the rows left
+		rows := l.chunkHeight
+		if !l.tiled && (i+1)*rows > l.height {
+			rows = l.height - i*rows
+		}
+		var packed []byte
+		if packed, err = ioutil.ReadAll(r); err == nil {
+			data, err = unpackBits(packed, stride*rows)
+		}
+	}
+	if err != nil && len(data) < size {
+		return nil, fmt.Errorf("Could not read TIFF strip or tile %d: %s", i, err)
+	}
+	// the last strip can be short, the rest reads as black
+	if len(data) < size {
+		data = append(data, make([]byte, size-len(data))...)
+	}
+	data = data[:size]
+
+	if l.predictor == 2 {
+		// horizontal differencing, per row
+		n := l.samples
+		for y := 0; y < l.chunkHeight; y++ {
+			row := data[y*stride : (y+1)*stride]
+			if l.bytesPerValue == 1 {
+				for x := n; x < len(row); x++ {
+					row[x] += row[x-n]
+				}
+				continue
+			}
+			for x := n * 2; x+1 < len(row); x += 2 {
+				l.order.PutUint16(row[x:], l.order.Uint16(row[x:])+l.order.Uint16(row[x-n*2:]))
+			}
+		}
+	}
+	return data, nil
+}
+
+// band reads the rows of the chunks starting at chunk row cy, the image's
+// width across
+func (l *largeTIFF) band(cy int) ([]byte, int, error) {
+	bpp := l.samples * l.bytesPerValue
+	if !l.tiled {
+		data, err := l.chunk(cy)
+		return data, l.width * bpp, err
+	}
+
+	across := (l.width + l.chunkWidth - 1) / l.chunkWidth
+	stride := l.width * bpp
+	band := make([]byte, stride*l.chunkHeight)
+	for cx := 0; cx < across; cx++ {
+		tile, err := l.chunk(cy*across + cx)
+		if err != nil {
+			return nil, 0, err
+		}
+		tileStride := l.chunkWidth * bpp
+		w := tileStride
+		if (cx+1)*l.chunkWidth > l.width {
+			w = (l.width - cx*l.chunkWidth) * bpp
+		}
+		for y := 0; y < l.chunkHeight; y++ {
+			copy(band[y*stride+cx*tileStride:y*stride+cx*tileStride+w], tile[y*tileStride:])
+		}
+	}
+	return band, stride, nil
+}
+
+// decodeLargeTIFF decodes a TIFF shrunk by the whole factor factorFor picks
+// for its size, averaging each factor x factor block of pixels. Only a band
+// of chunks and a row of sums are held at once.
+func decodeLargeTIFF(f *os.File, page int, factorFor func(image.Rectangle) int) (image.Image, error) {
+	l, err := openLargeTIFF(f, page)
+	if err != nil {
+		return nil, err
+	}
+	factor := factorFor(image.Rect(0, 0, l.width, l.height))
+	if factor < 1 {
+		factor = 1
+	}
+	outW := (l.width + factor - 1) / factor
+	outH := (l.height + factor - 1) / factor
+	dst := image.NewRGBA(image.Rect(0, 0, outW, outH))
+
+	sums := make([]uint64, outW*3)
+	counts := make([]uint64, outW)
+	flush := func(oy int) {
+		row := dst.Pix[oy*dst.Stride:]
+		for ox := 0; ox < outW; ox++ {
+			if counts[ox] == 0 {
+				continue
+			}
+			for c := 0; c < 3; c++ {
+				row[ox*4+c] = uint8(sums[ox*3+c] / counts[ox])
+				sums[ox*3+c] = 0
+			}
+			row[ox*4+3] = 0xff
+			counts[ox] = 0
+		}
+	}
+
+	maxValue := uint64(1)<<uint(l.bytesPerValue*8) - 1
+	sample := func(b []byte) uint64 {
+		if l.bytesPerValue == 2 {
+			return uint64(l.order.Uint16(b))
+		}
+		return uint64(b[0])
+	}
+	bpp := l.samples * l.bytesPerValue
+	chunkRows := (l.height + l.chunkHeight - 1) / l.chunkHeight
+	for cy := 0; cy < chunkRows; cy++ {
+		band, stride, err := l.band(cy)
+		if err != nil {
+			return nil, err
+		}
+		for by := 0; by < l.chunkHeight; by++ {
+			y := cy*l.chunkHeight + by
+			if y >= l.height {
+				break
+			}
+			row := band[by*stride:]
+			for x := 0; x < l.width; x++ {
+				p := row[x*bpp:]
+				var r, g, b uint64
+				if l.photometric == 2 {
+					r, g, b = sample(p), sample(p[l.bytesPerValue:]), sample(p[2*l.bytesPerValue:])
+				} else {
+					r = sample(p)
+					if l.photometric == 0 {
+						// WhiteIsZero
+						r = maxValue - r
+					}
+					g, b = r, r
+				}
+				ox := x / factor
+				// summed at 8 bits, so a big factor of 16 bit values can't overflow
+				sums[ox*3] += r * 255 / maxValue
+				sums[ox*3+1] += g * 255 / maxValue
+				sums[ox*3+2] += b * 255 / maxValue
+				counts[ox]++
+			}
+			if (y+1)%factor == 0 || y == l.height-1 {
+				flush(y / factor)
+			}
+		}
+	}
+	return dst, nil
+}
+
+// decodeLarge decodes the task's file with decodeLargeTIFF if it's a large
+// TIFF, to twice the size of its largest output so that's still resized down
+// to; ok is false if it isn't one, or is one the chunked reader can't read
+func decodeLarge(t Task) (img image.Image, ok bool, err error) {
+	f, err := os.Open(t.Filename)
+	if err != nil {
+		return nil, false, nil // decodeSource will say what's wrong
+	}
+	defer f.Close()
+	if !isLargeTIFF(f) {
+		return nil, false, nil
+	}
+	img, err = decodeLargeTIFF(f, t.Page, func(b image.Rectangle) int {
+		return shrinkFactor(t, b) / 2
+	})
+	if _, ok := err.(unsupportedTIFF); ok {
+		logTaskf(t.Id, "debug", "Decoding all of %s: %s", t.Filename, err)
+		return nil, false, nil
+	}
+	return img, true, err
+}
+
+// shrinkFactor is the most the source (of size b) can be shrunk by and still
+// be as big as each of the task's outputs, 1 if it needs every pixel: tasks
+// with no ImageWidth (tiles, diffs and full size outputs), ops in source
+// pixels and outputs sized by the image
+func shrinkFactor(t Task, b image.Rectangle) int {
+	if t.Op != "" || t.ImageWidth == 0 || len(t.Ops) > 0 || t.LensCorrection || t.PrintSize != "" || t.Panorama != "" || t.HDR {
+		return 1
+	}
+	factor := b.Dx()
+	for _, width := range outputWidths(t) {
+		w, h := fitSize(t, b, width)
+		if w > 0 && b.Dx()/int(w) < factor {
+			factor = b.Dx() / int(w)
+		}
+		if h > 0 && b.Dy()/int(h) < factor {
+			factor = b.Dy() / int(h)
+		}
+	}
+	if factor < 1 {
+		return 1
+	}
+	return factor
+}
+
+// outputWidths are the widths of the preview, thumbnail and renditions
+func outputWidths(t Task) []uint {
+	widths := []uint{previewWidth, thumbWidth}
+	for _, r := range t.Renditions {
+		widths = append(widths, r.Width)
+	}
+	return widths
+}
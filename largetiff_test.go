@@ -0,0 +1,122 @@
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testGrayTIFF is a 4x4 8 bit gray TIFF in strips of rowsPerStrip, each
+// pixel its x+y*4 times 10, with the extra tags
+func testGrayTIFF(rowsPerStrip int, extra ...testTag) []byte {
+	pix := make([]byte, 16)
+	for i := range pix {
+		pix[i] = byte(i * 10)
+	}
+	var offsets, counts []uint32
+	for y := 0; y < 4; y += rowsPerStrip {
+		offsets = append(offsets, uint32(8+y*4))
+		counts = append(counts, uint32(rowsPerStrip*4))
+	}
+	tags := []testTag{
+		{tagImageWidth, 3, []uint32{4}},
+		{tagImageLength, 3, []uint32{4}},
+		{tagBitsPerSample, 3, []uint32{8}},
+		{tagCompression, 3, []uint32{1}},
+		{tagPhotometric, 3, []uint32{1}},
+		{tagStripOffsets, 4, offsets},
+		{tagRowsPerStrip, 3, []uint32{uint32(rowsPerStrip)}},
+		{tagStripByteCounts, 4, counts},
+	}
+	return testTIFF(pix, append(tags, extra...))
+}
+
+func writeTestFile(t *testing.T, data []byte) *os.File {
+	name := filepath.Join(t.TempDir(), "test.tif")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestDecodeLargeTIFF(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		factor      int
+		want        []uint8
+		unsupported bool
+		wantErr     bool
+	}{
+		{"whole", testGrayTIFF(4), 1, []uint8{0, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100, 110, 120, 130, 140, 150}, false, false},
+		// each 2x2 block averaged, e.g. (0+10+40+50)/4
+		{"halved, a strip a row", testGrayTIFF(1), 2, []uint8{25, 45, 105, 125}, false, false},
+		{"quartered", testGrayTIFF(2), 4, []uint8{75}, false, false},
+		{"32 bits", testGrayTIFF(4, testTag{tagBitsPerSample, 3, []uint32{32}}), 1, nil, true, true},
+		{"planar", testGrayTIFF(4, testTag{tagPlanarConfig, 3, []uint32{2}}), 1, nil, true, true},
+		{"JPEG compressed", testGrayTIFF(4, testTag{tagCompression, 3, []uint32{7}}), 1, nil, true, true},
+		{"no strips", testTIFF(make([]byte, 16), []testTag{
+			{tagImageWidth, 3, []uint32{4}},
+			{tagImageLength, 3, []uint32{4}},
+			{tagBitsPerSample, 3, []uint32{8}},
+		}), 1, nil, false, true},
+		{"no size", testTIFF(nil, []testTag{{tagBitsPerSample, 3, []uint32{8}}}), 1, nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := writeTestFile(t, tt.data)
+			img, err := decodeLargeTIFF(f, 1, func(image.Rectangle) int { return tt.factor })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeLargeTIFF() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, ok := err.(unsupportedTIFF); ok != tt.unsupported {
+				t.Errorf("decodeLargeTIFF() error = %v, unsupported %v", err, tt.unsupported)
+			}
+			if err != nil {
+				return
+			}
+			rgba := img.(*image.RGBA)
+			var got []uint8
+			for i := 0; i < len(rgba.Pix); i += 4 {
+				got = append(got, rgba.Pix[i])
+			}
+			if string(got) != string(tt.want) {
+				t.Errorf("decodeLargeTIFF() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShrinkFactor(t *testing.T) {
+	defer func(p, th uint) { previewWidth, thumbWidth = p, th }(previewWidth, thumbWidth)
+	previewWidth, thumbWidth = 1000, 200
+
+	tests := []struct {
+		name string
+		t    Task
+		b    image.Rectangle
+		want int
+	}{
+		{"by the preview", Task{ImageWidth: 1}, image.Rect(0, 0, 8000, 6000), 8},
+		{"no smaller than the preview", Task{ImageWidth: 1}, image.Rect(0, 0, 800, 600), 1},
+		{"by a wider rendition", Task{ImageWidth: 1, Renditions: []Rendition{{Width: 2000}}}, image.Rect(0, 0, 8000, 6000), 4},
+		{"portrait by its long edge", Task{ImageWidth: 1, Sizing: "longEdge"}, image.Rect(0, 0, 6000, 8000), 8},
+		{"an op", Task{ImageWidth: 1, Op: "tile"}, image.Rect(0, 0, 8000, 6000), 1},
+		{"no ImageWidth", Task{}, image.Rect(0, 0, 8000, 6000), 1},
+		{"ops in source pixels", Task{ImageWidth: 1, Ops: []Op{{}}}, image.Rect(0, 0, 8000, 6000), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shrinkFactor(tt.t, tt.b); got != tt.want {
+				t.Errorf("shrinkFactor() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// lensDB is loaded from the lensfun database directory given by -lensfun
+var lensDB *lensDatabase
+
+type lensfunName struct {
+	Lang  string `xml:"lang,attr"`
+	Value string `xml:",chardata"`
+}
+
+type lensfunCamera struct {
+	Makers     []lensfunName `xml:"maker"`
+	Models     []lensfunName `xml:"model"`
+	CropFactor float64       `xml:"cropfactor"`
+}
+
+type lensfunDistortion struct {
+	Model string  `xml:"model,attr"`
+	Focal float64 `xml:"focal,attr"`
+	A     float64 `xml:"a,attr"`
+	B     float64 `xml:"b,attr"`
+	C     float64 `xml:"c,attr"`
+	K1    float64 `xml:"k1,attr"`
+	K2    float64 `xml:"k2,attr"`
+}
+
+type lensfunVignetting struct {
+	Model    string  `xml:"model,attr"`
+	Focal    float64 `xml:"focal,attr"`
+	Aperture float64 `xml:"aperture,attr"`
+	Distance float64 `xml:"distance,attr"`
+	K1       float64 `xml:"k1,attr"`
+	K2       float64 `xml:"k2,attr"`
+	K3       float64 `xml:"k3,attr"`
+}
+
+type lensfunLens struct {
+	Makers     []lensfunName       `xml:"maker"`
+	Models     []lensfunName       `xml:"model"`
+	CropFactor float64             `xml:"cropfactor"`
+	Distortion []lensfunDistortion `xml:"calibration>distortion"`
+	Vignetting []lensfunVignetting `xml:"calibration>vignetting"`
+}
+
+type lensDatabase struct {
+	Cameras []lensfunCamera `xml:"camera"`
+	Lenses  []lensfunLens   `xml:"lens"`
+}
+
+// loadLensfun reads every lensfun XML file in dir into a single database
+func loadLensfun(dir string) (*lensDatabase, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.xml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("No lensfun database files found in %s", dir)
+	}
+
+	db := &lensDatabase{}
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		part := lensDatabase{}
+		if err := xml.Unmarshal(data, &part); err != nil {
+			return nil, fmt.Errorf("Could not parse %s: %s", name, err)
+		}
+		db.Cameras = append(db.Cameras, part.Cameras...)
+		db.Lenses = append(db.Lenses, part.Lenses...)
+	}
+
+	return db, nil
+}
+
+// matchName compares dcraw's (or the task's) name against any of the
+// localized lensfun names, with or without the maker prepended
+func matchName(name string, makers, models []lensfunName) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, model := range models {
+		m := strings.ToLower(model.Value)
+		if name == m || strings.HasSuffix(name, " "+m) {
+			return true
+		}
+		for _, maker := range makers {
+			if name == strings.ToLower(maker.Value)+" "+m {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (db *lensDatabase) camera(name string) *lensfunCamera {
+	for i := range db.Cameras {
+		if matchName(name, db.Cameras[i].Makers, db.Cameras[i].Models) {
+			return &db.Cameras[i]
+		}
+	}
+	return nil
+}
+
+func (db *lensDatabase) lens(name string) *lensfunLens {
+	for i := range db.Lenses {
+		if matchName(name, db.Lenses[i].Makers, db.Lenses[i].Models) {
+			return &db.Lenses[i]
+		}
+	}
+	return nil
+}
+
+// distortion interpolates the calibration linearly between the two nearest
+// focal lengths, or without a pair of them in the same model takes the
+// nearest one. It's never extrapolated.
+func (l *lensfunLens) distortion(focal float64) (lensfunDistortion, bool) {
+	if len(l.Distortion) == 0 {
+		return lensfunDistortion{}, false
+	}
+	cal := append([]lensfunDistortion{}, l.Distortion...)
+	sort.SliceStable(cal, func(i, j int) bool { return cal[i].Focal < cal[j].Focal })
+
+	if focal <= cal[0].Focal {
+		return cal[0], true
+	}
+	// the first calibration at or past the focal length, which is past cal[0]
+	i := sort.Search(len(cal), func(i int) bool { return cal[i].Focal >= focal })
+	if i == len(cal) {
+		return cal[len(cal)-1], true
+	}
+	// the calibrations at the focal lengths either side, as there can be
+	// more than one at each (of different models)
+	var below, above []lensfunDistortion
+	for j := i - 1; j >= 0 && cal[j].Focal == cal[i-1].Focal; j-- {
+		below = append(below, cal[j])
+	}
+	for j := i; j < len(cal) && cal[j].Focal == cal[i].Focal; j++ {
+		above = append(above, cal[j])
+	}
+	for _, lo := range below {
+		for _, hi := range above {
+			if lo.Model != hi.Model {
+				continue
+			}
+			// hi.Focal >= focal > lo.Focal, so never 0
+			t := (focal - lo.Focal) / (hi.Focal - lo.Focal)
+			mix := func(a, b float64) float64 { return a + (b-a)*t }
+			return lensfunDistortion{
+				Model: lo.Model,
+				Focal: focal,
+				A:     mix(lo.A, hi.A),
+				B:     mix(lo.B, hi.B),
+				C:     mix(lo.C, hi.C),
+				K1:    mix(lo.K1, hi.K1),
+				K2:    mix(lo.K2, hi.K2),
+			}, true
+		}
+	}
+	if focal-below[0].Focal < above[0].Focal-focal {
+		return below[0], true
+	}
+	return above[0], true
+}
+
+// vignetting picks the calibration nearest to the focal length and aperture,
+// preferring the farthest focus distance
+func (l *lensfunLens) vignetting(focal, aperture float64) (lensfunVignetting, bool) {
+	var best lensfunVignetting
+	bestScore := math.Inf(1)
+	for _, v := range l.Vignetting {
+		score := math.Abs(v.Focal-focal)*100 + math.Abs(v.Aperture-aperture)*10 - v.Distance
+		if score < bestScore {
+			best, bestScore = v, score
+		}
+	}
+	return best, !math.IsInf(bestScore, 1)
+}
+
+// radius returns the distorted radius for an undistorted radius ru
+func (d lensfunDistortion) radius(ru float64) float64 {
+	r2 := ru * ru
+	switch d.Model {
+	case "poly3":
+		return ru * (1 - d.K1 + d.K1*r2)
+	case "poly5":
+		return ru * (1 + d.K1*r2 + d.K2*r2*r2)
+	case "ptlens":
+		return ru * (d.A*r2*ru + d.B*r2 + d.C*ru + 1 - d.A - d.B - d.C)
+	}
+	return ru
+}
+
+// correctLens removes distortion and vignetting from img using the lensfun
+// calibration of the task's lens, at the focal length and aperture dcraw reports
+func correctLens(t Task, img image.Image) (image.Image, error) {
+	if lensDB == nil {
+		return nil, fmt.Errorf("Lens correction requested but no lensfun database is loaded")
+	}
+	if t.Lens == "" {
+		return nil, fmt.Errorf("Lens correction requested without a lens")
+	}
+
+	lens := lensDB.lens(t.Lens)
+	if lens == nil {
+		return nil, fmt.Errorf("Lens %q is not in the lensfun database", t.Lens)
+	}
+
+	info, err := identify(t.Filename)
+	if err != nil {
+		return nil, err
+	}
+	if info.FocalLength == 0 {
+		return nil, fmt.Errorf("No focal length recorded in %s", t.Filename)
+	}
+
+	// calibrations are made on the lens' own sensor size, rescale for this camera
+	scale := 1.0
+	if cam := lensDB.camera(info.Camera); cam != nil && cam.CropFactor > 0 && lens.CropFactor > 0 {
+		scale = lens.CropFactor / cam.CropFactor
+	}
+
+	src := image.NewRGBA(img.Bounds())
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	out := src
+	if dist, ok := lens.distortion(info.FocalLength); ok {
+		out = undistort(src, dist, scale)
+	}
+	if vig, ok := lens.vignetting(info.FocalLength, info.Aperture); ok && vig.Model == "pa" {
+		devignette(out, vig, scale)
+	}
+
+	return out, nil
+}
+
+// undistort remaps src so straight lines are straight again. lensfun
+// normalizes coordinates so the shorter side of the image is 2 units long.
+func undistort(src *image.RGBA, d lensfunDistortion, scale float64) *image.RGBA {
+	b := src.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	cx, cy := w/2, h/2
+	norm := math.Min(w, h) / 2
+
+	// zoom in just enough that the corners and edges don't sample outside the source
+	zoom := 1.0
+	for _, p := range [][2]float64{{cx, cy}, {cx, 0}, {0, cy}} {
+		ru := math.Hypot(p[0], p[1]) / norm * scale
+		if ru > 0 {
+			if f := d.radius(ru) / ru; f > zoom {
+				zoom = f
+			}
+		}
+	}
+
+	dst := image.NewRGBA(b)
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			xu := (float64(x) + 0.5 - cx) / norm * scale / zoom
+			yu := (float64(y) + 0.5 - cy) / norm * scale / zoom
+			ru := math.Hypot(xu, yu)
+			f := 1.0
+			if ru > 0 {
+				f = d.radius(ru) / ru
+			}
+			sx := xu*f/scale*norm + cx - 0.5
+			sy := yu*f/scale*norm + cy - 0.5
+			bilinear(src, dst, sx, sy, dst.PixOffset(x+b.Min.X, y+b.Min.Y))
+		}
+	}
+
+	return dst
+}
+
+// bilinear samples src at (sx, sy), relative to its bounds, into dst.Pix[i:i+4]
+func bilinear(src, dst *image.RGBA, sx, sy float64, i int) {
+	b := src.Bounds()
+	x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+	if x0 < 0 || y0 < 0 || x0+1 >= b.Dx() || y0+1 >= b.Dy() {
+		return // left black
+	}
+	fx, fy := sx-float64(x0), sy-float64(y0)
+	p00 := src.PixOffset(x0+b.Min.X, y0+b.Min.Y)
+	p10 := p00 + 4
+	p01 := p00 + src.Stride
+	p11 := p01 + 4
+	for c := 0; c < 4; c++ {
+		top := float64(src.Pix[p00+c])*(1-fx) + float64(src.Pix[p10+c])*fx
+		bottom := float64(src.Pix[p01+c])*(1-fx) + float64(src.Pix[p11+c])*fx
+		dst.Pix[i+c] = uint8(top*(1-fy) + bottom*fy + 0.5)
+	}
+}
+
+// devignette brightens the corners in place using the "pa" model, in linear
+// light. Unlike distortion, vignetting is normalized to half the diagonal.
+func devignette(img *image.RGBA, v lensfunVignetting, scale float64) {
+	var toLinear [256]float64
+	for i := range toLinear {
+		toLinear[i] = math.Pow(float64(i)/255, 2.2)
+	}
+
+	b := img.Bounds()
+	w, h := float64(b.Dx()), float64(b.Dy())
+	cx, cy := w/2, h/2
+	norm := math.Hypot(cx, cy)
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			r := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy) / norm * scale
+			r2 := r * r
+			gain := 1 / (1 + v.K1*r2 + v.K2*r2*r2 + v.K3*r2*r2*r2)
+			i := img.PixOffset(x+b.Min.X, y+b.Min.Y)
+			for c := 0; c < 3; c++ {
+				l := toLinear[img.Pix[i+c]] * gain
+				img.Pix[i+c] = uint8(math.Min(math.Pow(l, 1/2.2), 1)*255 + 0.5)
+			}
+		}
+	}
+}
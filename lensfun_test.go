@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistortion(t *testing.T) {
+	tests := []struct {
+		name      string
+		cal       []lensfunDistortion
+		focal     float64
+		wantModel string
+		wantK1    float64
+	}{
+		{"between two", []lensfunDistortion{{Model: "poly3", Focal: 24, K1: 0.1}, {Model: "poly3", Focal: 70, K1: 0.3}}, 47, "poly3", 0.2},
+		{"below the first", []lensfunDistortion{{Model: "poly3", Focal: 24, K1: 0.1}, {Model: "poly3", Focal: 70, K1: 0.3}}, 10, "poly3", 0.1},
+		{"past the last", []lensfunDistortion{{Model: "poly3", Focal: 24, K1: 0.1}, {Model: "poly3", Focal: 70, K1: 0.3}}, 200, "poly3", 0.3},
+		{"on one", []lensfunDistortion{{Model: "poly3", Focal: 24, K1: 0.1}, {Model: "poly3", Focal: 70, K1: 0.3}}, 70, "poly3", 0.3},
+		{"two at the same focal length", []lensfunDistortion{{Model: "poly3", Focal: 24, K1: 0.1}, {Model: "poly3", Focal: 70, K1: 0.3}, {Model: "poly3", Focal: 70, K1: 0.5}}, 47, "poly3", 0.2},
+		// neither divided by 0 (70-70) nor extrapolated from the pair above 47
+		{"two at the same focal length past another model", []lensfunDistortion{{Model: "ptlens", Focal: 24}, {Model: "poly3", Focal: 70, K1: 0.3}, {Model: "poly3", Focal: 70, K1: 0.5}}, 47, "poly3", 0.3},
+		{"models differ, nearest below", []lensfunDistortion{{Model: "ptlens", Focal: 24}, {Model: "poly3", Focal: 70, K1: 0.3}, {Model: "poly3", Focal: 100, K1: 0.9}}, 30, "ptlens", 0},
+		{"models differ, nearest above", []lensfunDistortion{{Model: "ptlens", Focal: 24}, {Model: "poly3", Focal: 70, K1: 0.3}, {Model: "poly3", Focal: 100, K1: 0.9}}, 60, "poly3", 0.3},
+		{"the same model among others", []lensfunDistortion{{Model: "poly3", Focal: 24, K1: 0.1}, {Model: "ptlens", Focal: 70}, {Model: "poly3", Focal: 70, K1: 0.3}}, 47, "poly3", 0.2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := lensfunLens{Distortion: tt.cal}
+			got, ok := l.distortion(tt.focal)
+			if !ok || got.Model != tt.wantModel || math.Abs(got.K1-tt.wantK1) > 1e-9 {
+				t.Errorf("distortion(%g) = %s %g, %v, want %s %g", tt.focal, got.Model, got.K1, ok, tt.wantModel, tt.wantK1)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	quiet   bool
+	verbose bool
+	logMu   sync.Mutex
+)
+
+// logLine is written to stderr as JSON, like the failed results it's mixed with
+type logLine struct {
+	SchemaVersion int    `json:"schemaVersion,omitempty"`
+	Level         string `json:"level"`
+	Id            *int   `json:"id,omitempty"`
+	Msg           string `json:"msg"`
+}
+
+func writeLog(l logLine) {
+	if quiet || (l.Level == "debug" && !verbose) {
+		return
+	}
+	l.SchemaVersion = stampSchema()
+	lBytes, _ := json.Marshal(l)
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	fmt.Fprintln(os.Stderr, string(lBytes))
+}
+
+// logf logs at "error", "warn", "info" or "debug" (only shown with -verbose)
+func logf(level string, format string, args ...interface{}) {
+	writeLog(logLine{Level: level, Msg: fmt.Sprintf(format, args...)})
+}
+
+// logTaskf is logf for something that happened to a task
+func logTaskf(id int, level string, format string, args ...interface{}) {
+	writeLog(logLine{Level: level, Id: &id, Msg: fmt.Sprintf(format, args...)})
+}
+
+// fatal logs err, even with -quiet, and exits once the results are flushed
+func fatal(err error) {
+	results.flush()
+	quiet = false
+	logf("fatal", "%s", err)
+	os.Exit(1)
+}
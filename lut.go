@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cubeLUT is an Adobe/Resolve .cube file, a 1D curve (per channel) or a 3D
+// table of Size^3 colors, red changing fastest
+type cubeLUT struct {
+	size     int
+	threeD   bool
+	min, max [3]float64
+	table    [][3]float64
+}
+
+// maxLUTs is how many parsed LUTs are kept, the least recently used
+// dropped past it
+const maxLUTs = 32
+
+var (
+	lutsMu sync.Mutex
+	luts   = map[string]*loadedLUT{}
+)
+
+type loadedLUT struct {
+	lut     *cubeLUT
+	modTime time.Time
+	used    time.Time
+}
+
+// loadLUT reads a .cube file, or has it from the last task that used it if
+// it hasn't changed since
+func loadLUT(filename string) (*cubeLUT, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read lut: %s", err)
+	}
+	lutsMu.Lock()
+	loaded, ok := luts[filename]
+	if ok && loaded.modTime.Equal(info.ModTime()) {
+		loaded.used = time.Now()
+		lutsMu.Unlock()
+		return loaded.lut, nil
+	}
+	lutsMu.Unlock()
+
+	lut, err := parseCube(filename)
+	if err != nil {
+		return nil, err
+	}
+	lutsMu.Lock()
+	defer lutsMu.Unlock()
+	luts[filename] = &loadedLUT{lut, info.ModTime(), time.Now()}
+	for len(luts) > maxLUTs {
+		var oldest string
+		for name, l := range luts {
+			if oldest == "" || l.used.Before(luts[oldest].used) {
+				oldest = name
+			}
+		}
+		delete(luts, oldest)
+	}
+	return lut, nil
+}
+
+func parseCube(filename string) (*cubeLUT, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read lut: %s", err)
+	}
+	defer f.Close()
+
+	lut := &cubeLUT{max: [3]float64{1, 1, 1}}
+	triple := func(fields []string) ([3]float64, error) {
+		var v [3]float64
+		if len(fields) != 3 {
+			return v, fmt.Errorf("expected 3 numbers")
+		}
+		for i, field := range fields {
+			var err error
+			if v[i], err = strconv.ParseFloat(field, 64); err != nil {
+				return v, err
+			}
+		}
+		return v, nil
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var err error
+		switch fields[0] {
+		case "TITLE":
+		case "LUT_1D_SIZE", "LUT_3D_SIZE":
+			if len(fields) != 2 {
+				err = fmt.Errorf("expected a size")
+			} else if lut.size, err = strconv.Atoi(fields[1]); err == nil && lut.size < 2 {
+				err = fmt.Errorf("size %d is too small", lut.size)
+			}
+			lut.threeD = fields[0] == "LUT_3D_SIZE"
+		case "DOMAIN_MIN":
+			lut.min, err = triple(fields[1:])
+		case "DOMAIN_MAX":
+			lut.max, err = triple(fields[1:])
+		case "LUT_1D_INPUT_RANGE", "LUT_3D_INPUT_RANGE":
+			// Resolve's domain, the same for every channel
+			var min, max float64
+			if len(fields) != 3 {
+				err = fmt.Errorf("expected a min and max")
+			} else if min, err = strconv.ParseFloat(fields[1], 64); err == nil {
+				max, err = strconv.ParseFloat(fields[2], 64)
+			}
+			lut.min, lut.max = [3]float64{min, min, min}, [3]float64{max, max, max}
+		default:
+			var v [3]float64
+			if v, err = triple(fields); err == nil {
+				lut.table = append(lut.table, v)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read lut %s, line %d: %s", filename, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Could not read lut: %s", err)
+	}
+
+	want := lut.size
+	if lut.threeD {
+		want = lut.size * lut.size * lut.size
+	}
+	if lut.size == 0 || len(lut.table) != want {
+		return nil, fmt.Errorf("Could not read lut %s: %d entries for size %d", filename, len(lut.table), lut.size)
+	}
+	for c := 0; c < 3; c++ {
+		if lut.max[c] <= lut.min[c] {
+			return nil, fmt.Errorf("Could not read lut %s: empty domain", filename)
+		}
+	}
+	return lut, nil
+}
+
+// applyLUT maps the colors of img through the task's LUT, e.g. a film
+// emulation, or a curve inverting scanned negatives. Alpha is left as it is.
+func applyLUT(img image.Image, t Task) (image.Image, error) {
+	if t.LUT == "" {
+		return img, nil
+	}
+	lut, err := loadLUT(t.LUT)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+
+	if !lut.threeD {
+		// a curve only has 256 inputs a channel
+		var curves [3][256]uint8
+		for c := range curves {
+			for i := range curves[c] {
+				curves[c][i] = lut.channel(c, float64(i)/255)
+			}
+		}
+		for i := 0; i < len(dst.Pix); i += 4 {
+			for c := 0; c < 3; c++ {
+				dst.Pix[i+c] = curves[c][dst.Pix[i+c]]
+			}
+		}
+		return dst, nil
+	}
+
+	for i := 0; i < len(dst.Pix); i += 4 {
+		rgb := lut.color(float64(dst.Pix[i])/255, float64(dst.Pix[i+1])/255, float64(dst.Pix[i+2])/255)
+		for c := 0; c < 3; c++ {
+			dst.Pix[i+c] = toByte(rgb[c])
+		}
+	}
+	return dst, nil
+}
+
+// position is where v (0 to 1) of channel c falls in the table, as the
+// index below it and how far it is towards the next
+func (l *cubeLUT) position(c int, v float64) (int, float64) {
+	x := (v - l.min[c]) / (l.max[c] - l.min[c]) * float64(l.size-1)
+	x = math.Max(0, math.Min(float64(l.size-1), x))
+	i := int(x)
+	if i == l.size-1 {
+		i--
+	}
+	return i, x - float64(i)
+}
+
+// channel is a 1D LUT's curve for channel c at v, interpolated
+func (l *cubeLUT) channel(c int, v float64) uint8 {
+	i, f := l.position(c, v)
+	return toByte(l.table[i][c]*(1-f) + l.table[i+1][c]*f)
+}
+
+// color is a 3D LUT at r, g, b, trilinearly interpolated
+func (l *cubeLUT) color(r, g, b float64) [3]float64 {
+	ri, rf := l.position(0, r)
+	gi, gf := l.position(1, g)
+	bi, bf := l.position(2, b)
+	at := func(dr, dg, db int) [3]float64 {
+		return l.table[(ri+dr)+(gi+dg)*l.size+(bi+db)*l.size*l.size]
+	}
+	lerp := func(a, b, f float64) float64 { return a*(1-f) + b*f }
+	var out [3]float64
+	for c := 0; c < 3; c++ {
+		c00 := lerp(at(0, 0, 0)[c], at(1, 0, 0)[c], rf)
+		c10 := lerp(at(0, 1, 0)[c], at(1, 1, 0)[c], rf)
+		c01 := lerp(at(0, 0, 1)[c], at(1, 0, 1)[c], rf)
+		c11 := lerp(at(0, 1, 1)[c], at(1, 1, 1)[c], rf)
+		out[c] = lerp(lerp(c00, c10, gf), lerp(c01, c11, gf), bf)
+	}
+	return out
+}
+
+func toByte(v float64) uint8 {
+	return uint8(math.Round(clamp(v, 0, 1) * 255))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeCube(t *testing.T, cube string) string {
+	name := filepath.Join(t.TempDir(), "test.cube")
+	if err := ioutil.WriteFile(name, []byte(cube), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// identityCube is a 2x2x2 3D LUT that leaves colors as they are
+const identityCube = `LUT_3D_SIZE 2
+0 0 0
+1 0 0
+0 1 0
+1 1 0
+0 0 1
+1 0 1
+0 1 1
+1 1 1
+`
+
+func TestParseCube(t *testing.T) {
+	tests := []struct {
+		name     string
+		cube     string
+		threeD   bool
+		min, max float64
+		wantErr  bool
+	}{
+		{"1D", "TITLE \"invert\"\n# a comment\nLUT_1D_SIZE 2\n1 1 1\n0 0 0\n", false, 0, 1, false},
+		{"3D", identityCube, true, 0, 1, false},
+		{"domain", "DOMAIN_MIN 0 0 0\nDOMAIN_MAX 2 2 2\n" + identityCube, true, 0, 2, false},
+		{"1D input range", "LUT_1D_INPUT_RANGE 0.5 4\nLUT_1D_SIZE 2\n0 0 0\n1 1 1\n", false, 0.5, 4, false},
+		{"3D input range", "LUT_3D_INPUT_RANGE -1 1\n" + identityCube, true, -1, 1, false},
+		{"input range without a max", "LUT_3D_INPUT_RANGE 0\n" + identityCube, true, 0, 0, true},
+		{"empty domain", "LUT_3D_INPUT_RANGE 1 1\n" + identityCube, true, 0, 0, true},
+		{"too few entries", "LUT_3D_SIZE 2\n0 0 0\n1 1 1\n", true, 0, 0, true},
+		{"too small", "LUT_1D_SIZE 1\n0 0 0\n", false, 0, 0, true},
+		{"no size", "0 0 0\n1 1 1\n", false, 0, 0, true},
+		{"not a number", "LUT_1D_SIZE 2\n0 0 x\n1 1 1\n", false, 0, 0, true},
+		{"unknown keyword", "LUT_4D_SIZE 2\n" + identityCube, true, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lut, err := parseCube(writeCube(t, tt.cube))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCube() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if lut.threeD != tt.threeD {
+				t.Errorf("parseCube() threeD = %v, want %v", lut.threeD, tt.threeD)
+			}
+			for c := 0; c < 3; c++ {
+				if lut.min[c] != tt.min || lut.max[c] != tt.max {
+					t.Errorf("parseCube() domain = %v to %v, want %g to %g", lut.min, lut.max, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyLUT(t *testing.T) {
+	tests := []struct {
+		name string
+		cube string
+		in   color.NRGBA
+		want color.NRGBA
+	}{
+		{"1D invert", "LUT_1D_SIZE 2\n1 1 1\n0 0 0\n", color.NRGBA{255, 0, 51, 128}, color.NRGBA{0, 255, 204, 128}},
+		{"3D identity", identityCube, color.NRGBA{10, 128, 250, 255}, color.NRGBA{10, 128, 250, 255}},
+		// 0 to 2 in, so 255 is halfway
+		{"3D domain", "LUT_3D_INPUT_RANGE 0 2\n" + identityCube, color.NRGBA{255, 0, 0, 255}, color.NRGBA{128, 0, 0, 255}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+			img.SetNRGBA(0, 0, tt.in)
+			got, err := applyLUT(img, Task{LUT: writeCube(t, tt.cube)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := got.(*image.NRGBA).NRGBAAt(0, 0); c != tt.want {
+				t.Errorf("applyLUT() = %v, want %v", c, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadLUTBounded(t *testing.T) {
+	defer func(l map[string]*loadedLUT) { luts = l }(luts)
+	luts = map[string]*loadedLUT{}
+
+	dir := t.TempDir()
+	var names []string
+	for i := 0; i < maxLUTs+5; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("%d.cube", i))
+		if err := ioutil.WriteFile(name, []byte(identityCube), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadLUT(name); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if len(luts) != maxLUTs {
+		t.Errorf("kept %d LUTs, want %d", len(luts), maxLUTs)
+	}
+	if _, ok := luts[names[len(names)-1]]; !ok {
+		t.Errorf("the latest LUT was dropped")
+	}
+}
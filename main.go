@@ -1,22 +1,27 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/andykillmer/go-dcraw-json"
+	"github.com/go-redis/redis"
 	"github.com/jbuchbinder/gopnm"
-	"github.com/jeffail/tunny"
+	"github.com/klauspost/compress/zstd"
 	"github.com/nfnt/resize"
-	"github.com/pkg/profile"
+	"github.com/segmentio/kafka-go"
 	"golang.org/x/image/tiff"
 	"image"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
+	"io"
 	"io/ioutil"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -24,96 +29,902 @@ var (
 	previewWidth uint
 	thumbWidth   uint
 	debug        bool
+	lensfunPath  string
+	zstdInput    bool
+	zstdOutput   bool
+	numWorkers   int
 )
 
 type Task struct {
-	Id         int    `json:"id"`
-	Filename   string `json:"filename"`
-	ImageWidth uint   `json:"imageWidth"`
-	ThumbWidth uint   `json:"thumbWidth"`
+	Id int `json:"id"`
+	// Filename can be an entry in a ZIP or TAR archive, "shoot.zip!DSC0001.NEF"
+	Filename string `json:"filename"`
+	// FilenameBase64 is the Filename's bytes instead, for names that aren't
+	// UTF-8
+	FilenameBase64 string `json:"filenameBase64,omitempty"`
+	// Inline tasks on stdin are followed by the file itself, see readTasks
+	Inline bool `json:"inline"`
+	// Preset names a template from -presets (or a built-in -preset) for
+	// what the task doesn't set
+	Preset string `json:"preset"`
+	// GroupId puts the task in a group of GroupSize tasks, a "group" event
+	// following the result of the last of them to finish
+	GroupId   string `json:"groupId,omitempty"`
+	GroupSize int    `json:"groupSize,omitempty"`
+	// APIKey is the client's, for its share of the workers (see -clientKeys)
+	APIKey string `json:"apiKey,omitempty"`
+	// Priority "background" runs the task at -backgroundNice, at most
+	// -backgroundWorkers at once, so bulk jobs leave room for interactive ones
+	Priority string `json:"priority,omitempty"`
+	// Meta is anything (user, album or request ids, say) to have back in
+	// the task's result, untouched
+	Meta Meta `json:"meta,omitempty"`
+	// IfUnchangedToken is the token of a previous result for the file. If
+	// the file still matches it, the result is NOT_MODIFIED instead of new outputs.
+	// Only a task with one is hashed for a token, so the first can be anything.
+	IfUnchangedToken string `json:"ifUnchangedToken,omitempty"`
+	ImageWidth       uint   `json:"imageWidth"`
+	ThumbWidth       uint   `json:"thumbWidth"`
+	// Op is what to do with the file, a preview and thumbnail unless it's
+	// "identify", "tiles" (a Deep Zoom pyramid of TileSize tiles) or "diff"
+	// (comparing the file to CompareTo), "hdrmerge" (fusing the file and
+	// its Brackets, 1 to 6 other exposures of it), "sprite" (a sheet of the
+	// thumbnails of Files, SpriteColumns across) or "burst" (the best of
+	// Files, near duplicates, with the scores of each). "ack" keeps the outputs of task Id from -outputTTL,
+	// and "reload" reloads -presets.
+	Op          string   `json:"op"`
+	TileSize    int      `json:"tileSize"`
+	TileOverlap *int     `json:"tileOverlap"`
+	CompareTo   string   `json:"compareTo"`
+	Brackets    []string `json:"brackets"`
+	Files       []string `json:"files"`
+	// SpriteColumns is how many thumbnails across a sprite sheet is
+	SpriteColumns int `json:"spriteColumns"`
+	// Page of a multi-page TIFF to render, counting from 1
+	Page int `json:"page"`
+	// Format of the preview and thumbnail, "jpeg" (the default) or "png".
+	// Transparency is kept in PNGs, and flattened over Background in JPEGs.
+	Format     string `json:"format"`
+	Background string `json:"background"`
+	// Quality of the JPEGs, from 1 to 100 (75 if unset)
+	Quality int `json:"quality,omitempty"`
+	// Encoder of the JPEGs, "stdlib" or "mozjpeg" (smaller, and slower, in
+	// builds with -tags mozjpeg), -jpegEncoder if unset
+	Encoder string `json:"encoder,omitempty"`
+	// TargetQuality "perceptual" picks each JPEG's quality, the lowest with
+	// at least QualityTarget SSIM to the image (0.985 if unset), or with
+	// QualityMetric "butteraugli" at most that distance (1.5), via -butteraugli
+	TargetQuality string  `json:"targetQuality"`
+	QualityMetric string  `json:"qualityMetric"`
+	QualityTarget float64 `json:"qualityTarget"`
+	// Sizing is how -previewWidth and -thumbWidth apply, to the "width" (the
+	// default) or the "longEdge", or "megapixels" sizes the preview by area
+	// instead. Panorama "strip" adds a Strip of segments to scroll through
+	// for images at least -panoramaRatio times wider than tall.
+	Sizing     string  `json:"sizing"`
+	Megapixels float64 `json:"megapixels"`
+	Panorama   string  `json:"panorama"`
+	// Animate adds an Animation of animated sources to the thumbnail
+	Animate *Animation `json:"animate"`
+	// AllowUpscale false keeps renditions, resize ops and print sizes from
+	// being bigger than the source, they're its size instead (-allowUpscale
+	// if unset). Previews and thumbnails are never bigger.
+	AllowUpscale *bool `json:"allowUpscale,omitempty"`
+	// Renditions are more sizes of the preview, encoded alongside each other
+	Renditions []Rendition `json:"renditions"`
+	// Placeholder makes gray outputs with the filename and error written on
+	// them (the source's shape, if that can be told) when it can't be decoded
+	Placeholder bool `json:"placeholder"`
+	// Partial keeps the outputs that were made when others fail (listing
+	// those in the result's failures), as long as the preview is made
+	Partial bool `json:"partial"`
+	// HDR keeps the HDR gain map of an UltraHDR (or Adobe gain map) JPEG in
+	// the preview and thumbnail, so they look right on HDR displays
+	HDR bool `json:"hdr"`
+	// DisplayP3 adds a Display P3 preview and thumbnail, with the wider
+	// colors of RAWs (from the same decode), and tags all four with their ICC profiles
+	DisplayP3 bool `json:"displayP3"`
+	// PrintSize sizes the preview to print, e.g. "4x6in" or "10x15cm", at
+	// DPI (300 if unset). DPI is also written to the outputs' metadata.
+	PrintSize string `json:"printSize"`
+	DPI       int    `json:"dpi"`
+	// Ops make the preview instead of resizing to -previewWidth, in order
+	Ops []Op `json:"ops"`
+	// ThumbStyle is a border and/or rounded corners for the thumbnail
+	ThumbStyle *ThumbStyle `json:"thumbStyle"`
+	// ThumbSource "source" resizes the thumbnail from the decoded source
+	// rather than the "preview" (the default, cheaper but softer), with
+	// ThumbFilter (as in a resize op, "nearest" if unset)
+	ThumbSource string `json:"thumbSource"`
+	ThumbFilter string `json:"thumbFilter"`
+	// Scores adds sharpness and exposure heuristics to the result
+	Scores bool `json:"scores"`
+	// RawStats adds the clipping and histogram of a RAW's sensor data, by channel
+	RawStats bool `json:"rawStats"`
+	// Regions adds the camera's focus points and detected faces, via -exiftool
+	Regions bool `json:"regions"`
+	// WhiteBalance of RAWs is "camera" (the default), "auto" or "daylight".
+	// Instead, WBMultipliers (r, g, b[, g2]) or a Temperature in kelvin can be set.
+	WhiteBalance  string    `json:"whiteBalance"`
+	WBMultipliers []float64 `json:"wbMultipliers"`
+	Temperature   int       `json:"temperature"`
+	// Demosaic is dcraw's interpolation of RAWs, "fast" (bilinear), "vng",
+	// "ppg" or "ahd"; dcraw's default (ahd) if unset
+	Demosaic string `json:"demosaic"`
+	// Exposure (in EV), Brightness (a multiplier) and Gamma (above 1
+	// lightens the midtones) adjust the rendering; dcraw applies them to RAWs
+	Exposure   float64 `json:"exposure"`
+	Brightness float64 `json:"brightness"`
+	Gamma      float64 `json:"gamma"`
+	// LUT is a .cube file, a 3D LUT or 1D curve, to map the colors of the
+	// preview and thumbnail through (a film look, or inverting negatives)
+	LUT string `json:"lut,omitempty"`
+	// Trim crops away uniform borders (a scanner bed's edges, letterbox bars)
+	// before resizing, their pixels within TrimTolerance (0 to 255, 24 if
+	// unset) of the border's color
+	Trim          bool `json:"trim,omitempty"`
+	TrimTolerance int  `json:"trimTolerance,omitempty"`
+	// Denoise is noise reduction from 1 to 100, dcraw's wavelets for RAWs
+	Denoise int `json:"denoise"`
+	// IgnoreEdits renders the RAW flat even if it has darktable/RawTherapee edits
+	IgnoreEdits bool `json:"ignoreEdits"`
+	// LensCorrection removes distortion and vignetting of Lens, which must
+	// be named as it is in the lensfun database (dcraw can't tell us)
+	LensCorrection bool   `json:"lensCorrection"`
+	Lens           string `json:"lens"`
+	// OutputDir is where the preview and thumbnail are written instead of
+	// the temp dir, FileMode is octal (e.g. "0644"), Uid/Gid are left alone if unset
+	OutputDir string `json:"outputDir"`
+	FileMode  string `json:"fileMode"`
+	Uid       *int   `json:"uid"`
+	Gid       *int   `json:"gid"`
+	// OutputName names the outputs in OutputDir instead of at random, e.g.
+	// "{name}_{output}" (see outputName). OnCollision is what happens when
+	// that's taken: a "suffix" (the default), "overwrite" or an "error".
+	OutputName  string `json:"outputName"`
+	OnCollision string `json:"onCollision"`
+	// CaptureMtime gives the outputs the photo's capture time (from its EXIF)
+	// as their modification time, DateFolders puts them in "2024/05/17/"
+	// folders of OutputDir by it
+	CaptureMtime bool `json:"captureMtime"`
+	DateFolders  bool `json:"dateFolders"`
+
+	progress *progress
+	// source is Filename as it was sent, before it's fetched or extracted
+	source string
+	// tenant is its APIKey's, from -clientKeys
+	tenant string
+	// owner is who it's counted against and whose outputs it can ack, its
+	// tenant or key
+	owner string
+	// from is the address of the -http client that sent it
+	from string
+	// token is the hash of the source, when it's been hashed
+	token string
+	// decode is filled in by decodeSource, when set
+	decode *Decode
+	// release frees the task's -prefetch slot once a worker takes it
+	release func()
+	// icc is the ICC profile encodeImage tags outputs with, "srgb" or "p3"
+	icc string
+}
+
+// decoded records how decodeSource got the image (dcraw's args, if it was used)
+func (t Task) decoded(strategy string, dcrawArgs []string) {
+	if t.decode != nil {
+		t.decode.Strategy = strategy
+		t.decode.DcrawArgs = dcrawArgs
+	}
+}
+
+// decodedBy records which of -decoders decoded the source
+func (t Task) decodedBy(decoder string) {
+	if t.decode != nil {
+		t.decode.Decoder = decoder
+	}
 }
 
 type Resp struct {
-	Preview   string `json:"preview"`
-	Thumbnail string `json:"thumbnail"`
+	Preview   string   `json:"preview"`
+	Thumbnail string   `json:"thumbnail"`
+	Info      *Info    `json:"info,omitempty"`
+	Scores    *Scores  `json:"scores,omitempty"`
+	Regions   []Region `json:"regions,omitempty"`
+	Decode    *Decode  `json:"decode,omitempty"`
+	RawStats  RawStats `json:"rawStats,omitempty"`
+	// Resized is false when the source was no bigger than the preview would
+	// be, so the preview is the source's pixels, only re-encoded
+	Resized *bool `json:"resized,omitempty"`
+	// Token is the hash of the source, to send back as IfUnchangedToken
+	Token string `json:"token,omitempty"`
+	// FilenameBase64 is the source's name in base64 if it isn't UTF-8, as
+	// the JSON can't have it as it was sent
+	FilenameBase64 string `json:"filenameBase64,omitempty"`
+	// Placeholder is whether the outputs are placeholders, the result's
+	// detail saying why the source couldn't be decoded
+	Placeholder bool `json:"placeholder,omitempty"`
+	// Strip is the segments of a panorama, left to right
+	Strip []string `json:"strip,omitempty"`
+	// Animation is the animated thumbnail of a task that asked to Animate
+	Animation string `json:"animation,omitempty"`
+	// HDR is whether the preview and thumbnail have the source's gain map
+	HDR bool `json:"hdr,omitempty"`
+	// Renditions of the task, by name
+	Renditions map[string]string `json:"renditions,omitempty"`
+	// Failures are the outputs of a Partial task that couldn't be made
+	Failures []OutputFailure `json:"failures,omitempty"`
+	// the Display P3 outputs of a DisplayP3 task
+	PreviewP3   string `json:"previewP3,omitempty"`
+	ThumbnailP3 string `json:"thumbnailP3,omitempty"`
+	// Manifest is the .dzi of a "tiles" op, next to its tiles
+	Manifest string `json:"manifest,omitempty"`
+	// Burst is how each file of a "burst" op scored, and which was best
+	Burst []BurstFrame `json:"burst,omitempty"`
+	// Sprite is the sheet of a "sprite" op, SpriteMap the JSON of where
+	// each file's thumbnail is in it
+	Sprite    string `json:"sprite,omitempty"`
+	SpriteMap string `json:"spriteMap,omitempty"`
+	// Diff is the image of a "diff" op, where the files differ
+	Diff       string      `json:"diff,omitempty"`
+	Comparison *Comparison `json:"comparison,omitempty"`
+	// public URLs of the preview and thumbnail, when uploaded to a bucket
+	PreviewURL   string `json:"previewUrl,omitempty"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+}
+
+// files are every output of the result, some maybe uploaded
+func (r Resp) files() []string {
+	files := append([]string{r.Preview, r.Thumbnail, r.Diff, r.Animation, r.PreviewP3, r.ThumbnailP3, r.Sprite, r.SpriteMap}, r.Strip...)
+	for _, f := range r.Renditions {
+		files = append(files, f)
+	}
+	return files
+}
+
+// Decode is how the source was decoded, to see why a preview came out the
+// way it did. Strategy is "embedded" (the camera's JPEG), "halfSize" or
+// "full" (demosaiced by dcraw), "dngPreview", "embeddedInProcess" (the
+// camera's JPEG, without dcraw), "placeholder" (it couldn't be), "edits" (darktable or
+// RawTherapee), "direct" (not a RAW), "jpegScaled" (not a RAW, and a JPEG
+// decoded smaller by -djpeg), "chunked" (a TIFF past -largeTIFFMB,
+// downsampled as it's read) or "lossless" (jpegtran).
+type Decode struct {
+	Strategy  string   `json:"strategy"`
+	DcrawArgs []string `json:"dcrawArgs,omitempty"`
+	// Decoder is which of -decoders did it
+	Decoder string `json:"decoder,omitempty"`
+	// WhiteBalance is what dcraw rendered with, "camera", "auto",
+	// "daylight", "multipliers" or "temperature" (-wbFallback, if the
+	// camera's wasn't usable)
+	WhiteBalance string `json:"whiteBalance,omitempty"`
+}
+
+// Info is the response to an "identify" task
+type Info struct {
+	Format string `json:"format"`
+	Camera string `json:"camera,omitempty"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Pages  int    `json:"pages"`
 }
 
 type TaskResult struct {
-	Id       int    `json:"id"`
-	Error    string `json:"error"`
+	SchemaVersion int    `json:"schemaVersion,omitempty"`
+	Id            int    `json:"id"`
+	Error         string `json:"error"`
+	// Code identifies the error, e.g. FILE_BUSY, when there's one to act on.
+	// NOT_MODIFIED (without an error) means the source matched IfUnchangedToken.
+	Code      string `json:"code,omitempty"`
+	Retryable bool   `json:"retryable,omitempty"`
+	// Detail has more to go on when debugging an error (or a placeholder),
+	// like dcraw's stderr
+	Detail   string `json:"detail,omitempty"`
 	Response Resp   `json:"response"`
+	// Meta is the task's, as it was sent
+	Meta Meta `json:"meta,omitempty"`
+	// Diagnostics is the -diagnostics bundle of a source that failed to decode
+	Diagnostics string `json:"diagnostics,omitempty"`
+	// Tenant is the task's apiKey's, from -clientKeys, to label metrics by
+	Tenant string `json:"tenant,omitempty"`
+
+	// Previous is the id of the task whose response a NOT_MODIFIED result
+	// has, when that's still known
+	Previous *int `json:"previous,omitempty"`
+
+	// owner is the task's, whose ack keeps its outputs
+	owner string
 }
 
 func main() {
-	numCPUs := runtime.NumCPU()
-	runtime.GOMAXPROCS(numCPUs)
+	if len(os.Args) > 1 && os.Args[1] == sandboxExec {
+		runSandboxed(os.Args[2:])
+	}
+
+	numWorkers = runtime.NumCPU()
+	runtime.GOMAXPROCS(numWorkers)
 
 	cmdPath := strings.TrimSuffix(os.Args[0], "imaging") + "dcraw-json"
 
 	flag.StringVar(&dcrawPath, "dcraw", cmdPath, "path to dcraw-json program")
 	flag.UintVar(&previewWidth, "previewWidth", 1200, "preview image width")
 	flag.UintVar(&thumbWidth, "thumbWidth", 400, "thumbnail image width")
-	flag.BoolVar(&debug, "debug", true, "enable debug mode")
-	flag.Parse()
+	flag.BoolVar(&debug, "debug", false, "enable debug mode (outputs are removed)")
+	flag.StringVar(&profileMode, "profile", "", "write a cpu, mem, block or mutex profile on exit")
+	flag.StringVar(&profilePath, "profilePath", "./profiling/", "directory to write -profile to")
+	flag.StringVar(&pprofAddr, "pprof", "", "serve live net/http/pprof profiles on this address, e.g. localhost:6060")
+	flag.BoolVar(&deterministic, "deterministic", false, "byte-identical outputs for identical inputs and options: Go's JPEG encoder whatever the task's, and no timestamps")
+	flag.BoolVar(&strictTasks, "strictTasks", false, "fail tasks with fields the task schema doesn't have, rather than warn")
+	flag.StringVar(&jpegEncoder, "jpegEncoder", "stdlib", "JPEG encoder of tasks that don't set one, stdlib or mozjpeg (with -tags mozjpeg)")
+	flag.StringVar(&background, "background", "#ffffff", "color transparent images are flattened over for JPEG output")
+	flag.StringVar(&encoding, "encoding", "json", "encoding of tasks and results, json or msgpack")
+	flag.StringVar(&compat, "compat", "", "emit results in an older layout, \"v1\" has no schemaVersion")
+	flag.IntVar(&minWorkers, "minWorkers", numWorkers, "workers kept running when idle")
+	flag.IntVar(&maxWorkers, "maxWorkers", numWorkers, "workers to scale up to while tasks are queued")
+	flag.DurationVar(&scaleIdle, "scaleIdle", 30*time.Second, "stop workers past -minWorkers after this long idle")
+	flag.DurationVar(&sessionTTL, "sessionTTL", 0, "keep decoded sources in memory this long since last used, for clients adjusting the crop and size of the same one")
+	flag.Int64Var(&sessionCacheMB, "sessionCacheMB", 1024, "with -sessionTTL, MB of decoded sources to keep")
+	flag.DurationVar(&stableFor, "stableFor", 0, "fail with FILE_BUSY unless the file is unchanged for this long before processing")
+	flag.BoolVar(&dedupe, "dedupe", false, "share one result between identical tasks queued at the same time")
+	flag.BoolVar(&quiet, "quiet", false, "only write results, no log messages")
+	flag.BoolVar(&verbose, "verbose", false, "log each stage of every task")
+	flag.DurationVar(&dcrawTimeout, "dcrawTimeout", 2*time.Minute, "kill dcraw if it takes longer than this, 0 for no limit")
+	flag.StringVar(&wbFallback, "wbFallback", "auto", "white balance of RAWs without a usable camera one, auto or daylight")
+	flag.Float64Var(&maxMegapixels, "maxMegapixels", 1000, "refuse to decode (or make) images larger than this, 0 for no limit")
+	flag.StringVar(&diagnosticsDir, "diagnostics", "", "save dcraw's output and the start of each source that fails to decode in a new directory of this one")
+	flag.IntVar(&diagnosticsKB, "diagnosticsKB", 256, "KB of the source (and of dcraw's output) to save with -diagnostics")
+	flag.DurationVar(&diagnosticsTTL, "diagnosticsTTL", 7*24*time.Hour, "remove -diagnostics bundles this long after they're saved, 0 to keep them")
+	flag.IntVar(&diagnosticsMB, "diagnosticsMB", 1024, "remove the oldest -diagnostics bundles once they take more MB than this, 0 for no limit")
+	flag.StringVar(&decodersList, "decoders", "dcraw,native", "decoders to try in order: libraw, dcraw, embedded and native, dcraw and libraw with their own timeout (libraw:30s)")
+	flag.StringVar(&librawPath, "libraw", "", "path to LibRaw's dcraw_emu, for the libraw decoder")
+	flag.IntVar(&dcrawParallel, "dcrawParallel", 0, "dcraw processes to run at once, 0 for as many as there are workers")
+	flag.IntVar(&encodeParallel, "encodeParallel", 0, "tasks to resize and encode at once, 0 for as many as there are workers")
+	flag.StringVar(&previewCacheDir, "previewCache", "", "cache the previews embedded in RAWs in this directory, by content hash")
+	flag.Int64Var(&previewCacheMB, "previewCacheMB", 1024, "evict the least recently used from -previewCache past this size")
+	flag.StringVar(&cameraProfilesPath, "cameraProfiles", "", "JSON array of {camera, dcrawArgs, curve, sharpen} RAW rendering defaults by camera")
+	flag.BoolVar(&sandboxHelpers, "sandbox", false, "run dcraw and the other helpers without network, in their own temp dir and within the -sandbox limits (Linux only)")
+	flag.IntVar(&sandboxCPU, "sandboxCPU", 120, "with -sandbox, CPU seconds a helper may use, 0 for no limit")
+	flag.IntVar(&sandboxMemMB, "sandboxMemMB", 2048, "with -sandbox, address space a helper may map, 0 for no limit")
+	flag.IntVar(&sandboxFileMB, "sandboxFileMB", 1024, "with -sandbox, largest file a helper may write, 0 for no limit")
+	flag.BoolVar(&sandboxLandlock, "landlock", false, "with -sandbox, only let helpers write to their own temp dir and outputs (needs Linux 5.13)")
+	flag.IntVar(&sandboxUid, "sandboxUid", -1, "with -sandbox, run helpers as this user when running as root")
+	flag.IntVar(&sandboxGid, "sandboxGid", -1, "with -sandboxUid, run helpers as this group")
+	flag.IntVar(&niceness, "nice", 0, "nice value to run at, helpers included (Linux only)")
+	flag.StringVar(&cgroupDir, "cgroup", "", "cgroup v2 dir to move the process (and so its helpers) into, for its cpu.weight and cpu.max (Linux only)")
+	flag.IntVar(&backgroundNice, "backgroundNice", 10, "nice value of background priority tasks and their helpers (Linux only)")
+	flag.IntVar(&backgroundWorkers, "backgroundWorkers", 1, "background priority tasks to run at once, 0 for no limit")
+	flag.StringVar(&lensfunPath, "lensfun", "", "path to lensfun database directory, for lens correction")
+	flag.StringVar(&djpegPath, "djpeg", "", "path to libjpeg-turbo's djpeg, to decode large JPEGs at 1/2, 1/4 or 1/8 size when that's enough")
+	flag.StringVar(&jpegtranPath, "jpegtran", "", "path to jpegtran, to rotate and crop JPEGs losslessly when those are a task's only ops")
+	flag.StringVar(&img2webpPath, "img2webp", "", "path to libwebp's img2webp, for animated WebP thumbnails")
+	flag.StringVar(&ffmpegPath, "ffmpeg", "", "path to ffmpeg, to animate the videos of motion photos")
+	flag.StringVar(&exiftoolPath, "exiftool", "", "path to exiftool, to read focus points and faces for tasks asking for regions")
+	flag.BoolVar(&keepExif, "keepExif", false, "copy the EXIF of sources to their previews and thumbnails, with -exiftool")
+	flag.StringVar(&exifTags, "exifTags", "", "copy only these tags (comma separated exiftool names) of sources to their outputs, implies -keepExif")
+	flag.StringVar(&gpsPolicy, "gps", "strip", "with -keepExif, strip or keep locations, or strip them only within -geofences (geofence)")
+	flag.StringVar(&geofencePath, "geofences", "", "JSON array of {name, lat, lon, radius} circles (radius in meters) for -gps geofence")
+	flag.DurationVar(&groupTTL, "groupTTL", 24*time.Hour, "write a group's event (as expired) if the rest of its tasks haven't come this long after its first")
+	flag.DurationVar(&outputTTL, "outputTTL", 0, "remove local outputs this long after their result unless an {\"op\":\"ack\",\"id\":...} task confirms them")
+	flag.Uint64Var(&minFreeMB, "minFreeMB", 0, "fail tasks with NO_SPACE when the temp or output dir has less free than this")
+	flag.BoolVar(&pauseOnSpace, "pauseOnSpace", false, "with -minFreeMB, stop taking tasks while the temp dir is low instead")
+	flag.StringVar(&allowFormats, "allowFormats", "", "only accept inputs with these extensions or MIME types, comma separated (e.g. \"jpg,nef,image/png\")")
+	flag.StringVar(&denyFormats, "denyFormats", "", "reject inputs with these extensions or MIME types, comma separated (e.g. \"tif,image/tiff\")")
+	flag.Int64Var(&largeTIFFMB, "largeTIFFMB", 1024, "downsample TIFFs larger than this as they're read, instead of decoding them whole, 0 never")
+	flag.BoolVar(&allowUpscale, "allowUpscale", true, "let renditions, resize ops and print sizes be bigger than the source, unless a task's allowUpscale says otherwise (previews and thumbnails never are)")
+	flag.IntVar(&renditionWorkers, "renditionWorkers", 4, "resize and encode up to this many of a task's renditions at once")
+	flag.Float64Var(&panoramaRatio, "panoramaRatio", 4, "aspect ratio from which a task's panorama policy applies")
+	flag.IntVar(&prefetch, "prefetch", 0, "download up to this many remote inputs ahead of the workers")
+	flag.Int64Var(&downloadKBps, "downloadKBps", 0, "limit the combined bandwidth of remote input downloads, 0 for no limit")
+	flag.BoolVar(&zstdOutput, "zstdOutput", false, "zstd compress results (failures on stderr are left as text)")
+	flag.IntVar(&flushEvery, "flushEvery", 1, "flush the results every this many, 0 to only flush on -flushInterval and exit")
+	flag.DurationVar(&flushInterval, "flushInterval", 0, "also flush buffered results this often")
+	flag.StringVar(&resultsPath, "results", "", "write all results, failures included, to fd:N, unix:path, tcp:host:port or a file instead of stdout and stderr")
+	flag.StringVar(&butteraugliPath, "butteraugli", "", "path to butteraugli, for tasks' butteraugli perceptual quality")
+	flag.StringVar(&darktablePath, "darktable", "", "path to darktable-cli, to render RAWs with .xmp edits")
+	flag.StringVar(&rawtherapeePath, "rawtherapee", "", "path to rawtherapee-cli, to render RAWs with .pp3 edits")
+	flag.StringVar(&gcsBucket, "gcsBucket", "", "upload previews and thumbnails to this Google Cloud Storage bucket")
+	flag.StringVar(&gcsPrefix, "gcsPrefix", "", "object name prefix within -gcsBucket")
+	flag.StringVar(&gcsCacheControl, "gcsCacheControl", "", "Cache-Control header for uploaded objects")
+	flag.StringVar(&azureAccount, "azureAccount", "", "Azure storage account for azblob:// URLs, signed in as the managed identity")
+	flag.StringVar(&azureConnectionString, "azureConnectionString", "", "connect to Azure Blob Storage with this instead of -azureAccount")
+	flag.StringVar(&s3Endpoint, "s3Endpoint", "", "S3 compatible endpoint (e.g. https://minio.local:9000) for s3:// URLs instead of AWS")
+	flag.StringVar(&s3Region, "s3Region", "", "region of s3:// buckets, instead of the AWS config's (us-east-1 with -s3Endpoint)")
+	flag.BoolVar(&s3PathStyle, "s3PathStyle", false, "address buckets as endpoint/bucket rather than bucket.endpoint, as MinIO and Ceph RGW usually need")
+	flag.StringVar(&s3CA, "s3CA", "", "PEM bundle of the CAs to trust for -s3Endpoint, e.g. its self-signed certificate")
+	flag.StringVar(&sftpUser, "sftpUser", "", "user for sftp:// URLs without one (default $USER)")
+	flag.StringVar(&sftpKey, "sftpKey", "", "private key for sftp:// URLs (default ~/.ssh/id_ed25519, id_ecdsa or id_rsa)")
+	flag.StringVar(&sftpKnownHosts, "sftpKnownHosts", "", "only connect to SFTP servers with keys listed here (default ~/.ssh/known_hosts)")
+	flag.StringVar(&ftpUser, "ftpUser", "", "user for ftp:// URLs without one (default anonymous)")
+	flag.StringVar(&ftpPassword, "ftpPassword", "", "password for -ftpUser")
+	flag.IntVar(&ftpConns, "ftpConns", 4, "idle FTP connections to keep open to each server")
+	flag.StringVar(&eventsPath, "events", "", "write progress events to stdout, stderr or this file")
+	flag.DurationVar(&heartbeat, "heartbeat", 0, "write a {\"event\":\"heartbeat\",\"queued\":N,\"running\":M} line to the results this often, 0 for none")
+	flag.DurationVar(&progressAfter, "progressAfter", 2*time.Second, "only report progress for tasks running longer than this")
+	flag.DurationVar(&progressInterval, "progressInterval", time.Second, "how often to report progress")
+	flag.StringVar(&presetsPath, "presets", "", "JSON object of task templates by name, for tasks' preset (reloaded on SIGHUP)")
+	command, files, err := parseArgs()
+	if err != nil {
+		fatal(err)
+	}
+	if command == "schema" {
+		if err := printSchema(); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if command == "version" {
+		fmt.Printf("imaging %s (results schema %d, %s)\n", version, schemaVersion, runtime.Version())
+		return
+	}
+	numWorkers = maxWorkers
 
-	if debug {
-		defer profile.Start(profile.MemProfile, profile.ProfilePath("./profiling/")).Stop()
+	if err := checkCompat(); err != nil {
+		fatal(err)
+	}
+	if err := checkEncoding(); err != nil {
+		fatal(err)
+	}
+	if err := checkKafka(); err != nil {
+		fatal(err)
+	}
+	if err := checkHTTP(); err != nil {
+		fatal(err)
+	}
+	if err := checkWBFallback(); err != nil {
+		fatal(err)
+	}
+	if err := checkEncoder(jpegEncoder); err != nil {
+		fatal(err)
+	}
+
+	if err := loadMetadataPolicy(); err != nil {
+		fatal(err)
+	}
+	if err := loadDecoders(); err != nil {
+		fatal(err)
+	}
+	if err := checkSandbox(); err != nil {
+		fatal(err)
+	}
+	if err := applyPriority(); err != nil {
+		fatal(err)
+	}
+	if err := loadPresets(); err != nil {
+		fatal(err)
+	}
+	if err := loadClientKeys(); err != nil {
+		fatal(err)
+	}
+	reloadPresetsOnSignal()
+
+	removeOrphans()
+	removeTempsOnSignal()
+	go removeExpired()
+	defer removeTemps()
+
+	prof, err := startProfiling()
+	if err != nil {
+		fatal(err)
+	}
+	if prof != nil {
+		defer prof.Stop()
 	}
 
 	if err := dcraw.Path(dcrawPath); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		logf("warn", "%s, RAWs are only decoded by the other -decoders (embedded, for their previews)", err)
+		dcrawMissing = true
+	}
+
+	if gcsBucket != "" {
+		if err := openGCS(); err != nil {
+			fatal(err)
+		}
+	}
+
+	if renderCacheDir != "" {
+		cache, err := openCache(renderCacheDir, renderCacheMB<<20)
+		if err != nil {
+			fatal(err)
+		}
+		renderCache = cache
+	}
+	if previewCacheDir != "" {
+		cache, err := openCache(previewCacheDir, previewCacheMB<<20)
+		if err != nil {
+			fatal(err)
+		}
+		previewCache = cache
+	}
+
+	if cameraProfilesPath != "" {
+		if err := loadCameraProfiles(cameraProfilesPath); err != nil {
+			fatal(err)
+		}
+	}
+
+	if lensfunPath != "" {
+		db, err := loadLensfun(lensfunPath)
+		if err != nil {
+			fatal(err)
+		}
+		lensDB = db
 	}
 
 	// setup the worker pool
-	pool, _ := tunny.CreatePool(numCPUs, func(object interface{}) interface{} {
-		task, _ := object.(Task)
-		return resizeImage(task)
-	}).Open()
-
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		input := scanner.Bytes()
+	pool := newWorkerPool(minWorkers, maxWorkers, prioritized)
+
+	var input io.Reader = os.Stdin
+	if zstdInput {
+		dec, err := zstd.NewReader(os.Stdin)
+		if err != nil {
+			fatal(err)
+		}
+		defer dec.Close()
+		input = dec
+	}
+
+	closer, err := openResults()
+	if err != nil {
+		fatal(err)
+	}
+	// after the deferred flush of the results, or on a signal
+	defer runExit()
+	if closer != nil {
+		atExit(func() { closer.Close() })
+	}
+
+	if zstdOutput {
+		enc, err := zstd.NewWriter(results.w)
+		if err != nil {
+			fatal(err)
+		}
+		// closing writes the end of the frame, after every result is in
+		atExit(func() { enc.Close() })
+		results.w = enc
+	}
+
+	var redisClient *redis.Client
+	if redisURL != "" {
+		client, err := openRedis()
+		if err != nil {
+			fatal(err)
+		}
+		defer client.Close()
+		redisClient = client
+		// every result belongs on the queue, failed or not
+		results = &stream{w: &redisWriter{client}, mu: &sync.Mutex{}}
+		failures = results
+	}
+	var kafkaReader *kafka.Reader
+	if kafkaBrokers != "" {
+		reader, writer := openKafka()
+		defer reader.Close()
+		defer writer.Close()
+		kafkaReader = reader
+		results = &stream{w: &kafkaWriter{writer}, mu: &sync.Mutex{}, concurrent: true}
+		failures = results
+	}
+	if redisClient == nil && kafkaReader == nil {
+		// (each result is its own redis push or kafka message)
+		bufferResults()
+	}
+	// before the compressor is closed
+	defer results.flush()
+
+	if err := openEvents(); err != nil {
+		fatal(err)
+	}
+	// stopped before the results are flushed, or closed on a signal
+	stopHeartbeats := startHeartbeats(pool)
+	defer stopHeartbeats()
+	atExit(stopHeartbeats)
+
+	// wait on the tasks still in the pool before the streams are closed
+	var wg sync.WaitGroup
+
+	// queue queues up a task from a client (its address, "" for the one
+	// stream), done is called with its result once it's been emitted
+	queue := func(input []byte, from string, emit func(TaskResult), done func(TaskResult)) {
+		// reject is done with a task that's turned down before it starts,
+		// which the hooks hear of too
+		reject := func(r TaskResult) {
+			emit(r)
+			taskDone(r, 0)
+			done(r)
+		}
 		t := Task{}
-		if err := json.Unmarshal(input, &t); err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to unmarshal task: %s\n", err)
-			continue
+		if err := unmarshalTask(input, &t); err != nil {
+			logf("error", "Failed to unmarshal task: %s", err)
+			g := groupOf(input)
+			r := TaskResult{Id: g.Id}
+			r.setError(err)
+			r.Error = "Failed to unmarshal task: " + r.Error
+			done = trackGroup(g, done)
+			reject(r)
+			return
 		}
 
-		go func() {
-			resp, err := pool.SendWork(t)
+		if t.Op == "ack" {
+			// the client has the outputs of t.Id, they can stay
+			limits, err := limitsFor(t.APIKey)
 			if err != nil {
-				r := TaskResult{}
-				r.Id = t.Id
-				r.Error = fmt.Sprintf("Failed to send work to pool: %s", err)
-				printResult(r)
-			} else {
-				printResult(resp.(TaskResult))
+				r := TaskResult{Id: t.Id}
+				r.setError(err)
+				done(r)
+				return
 			}
+			ackOutputs(ownerOf(t.APIKey, limits), t.Id)
+			done(TaskResult{Id: t.Id})
+			return
+		}
+		if t.Op == "reload" {
+			reloadPresets()
+			done(TaskResult{Id: t.Id})
+			return
+		}
+		done = trackGroup(t, done)
+		if err := applyPreset(input, &t); err != nil {
+			r := TaskResult{Id: t.Id, Error: err.Error(), Meta: t.Meta}
+			reject(r)
+			return
+		}
+
+		if err := decodeFilename(&t); err != nil {
+			r := TaskResult{Id: t.Id, Error: err.Error(), Meta: t.Meta}
+			reject(r)
+			return
+		}
+		if err := checkGroup(t); err != nil {
+			r := TaskResult{Id: t.Id, Error: err.Error(), Meta: t.Meta}
+			reject(r)
+			return
+		}
+		if err := checkPriority(t); err != nil {
+			r := TaskResult{Id: t.Id, Error: err.Error(), Meta: t.Meta}
+			reject(r)
+			return
+		}
+		if err := scopeTask(&t); err != nil {
+			r := TaskResult{Id: t.Id, Meta: t.Meta}
+			r.setError(err)
+			reject(r)
+			return
+		}
+		if err := checkOutputName(t); err != nil {
+			r := TaskResult{Id: t.Id, Error: err.Error(), Meta: t.Meta}
+			reject(r)
+			return
+		}
+		t.from = from
+		if err := admit(t); err != nil {
+			r := TaskResult{Id: t.Id, Meta: t.Meta}
+			r.setError(err)
+			reject(r)
+			return
+		}
+
+		waitForSpace()
+		t.source = t.Filename
+		t.progress = trackProgress(t.Id)
+		taskStarted(t)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			r := coalesce(t, func(t Task) TaskResult {
+				return throttle(t, func(t Task) TaskResult {
+					return share(t, func(t Task) TaskResult {
+						return prefetchTask(t, pool.SendWork)
+					})
+				})
+			})
+			// (identical tasks can differ in meta)
+			r.Meta, r.Tenant, r.owner = t.Meta, t.tenant, t.owner
+			r.Response.FilenameBase64 = filenameBase64(t.source)
+			emit(r)
+			t.progress.finish()
+			taskDone(r, time.Since(start))
+			done(r)
 		}()
 	}
+	// submit queues up a task, done is called with its result once it's written
+	submit := func(input []byte, done func(TaskResult)) {
+		queue(input, "", printResult, done)
+	}
+	// submitFrom is submit for a client of -http, render for its /render,
+	// whose results aren't the stream's
+	submitFrom := func(from string, input []byte, done func(TaskResult)) {
+		queue(input, from, printResult, done)
+	}
+	render := func(from string, input []byte, done func(TaskResult)) {
+		queue(input, from, func(TaskResult) {}, done)
+	}
+	// handle is submit for readers that only need to know a task is done
+	handle := func(input []byte, done func()) {
+		submit(input, func(TaskResult) { done() })
+	}
+
+	switch command {
+	case "process", "identify":
+		template := Task{Op: "identify"}
+		if command == "process" {
+			if template, err = presetTask(); err != nil {
+				fatal(err)
+			}
+		}
+		if err := processFiles(files, template, handle); err != nil {
+			logf("error", "Failed to process files: %s", err)
+		}
+		wg.Wait()
+		return
+	case "watch":
+		if err := checkWatch(); err != nil {
+			fatal(err)
+		}
+		template, err := presetTask()
+		if err != nil {
+			fatal(err)
+		}
+		if err := watchFiles(files, template, handle); err != nil {
+			logf("error", "Failed to watch files: %s", err)
+		}
+		wg.Wait()
+		return
+	case "import":
+		template, err := presetTask()
+		if err != nil {
+			fatal(err)
+		}
+		if err := importCamera(template, submit); err != nil {
+			logf("error", "Failed to import from the camera: %s", err)
+		}
+		wg.Wait()
+		return
+	}
+
+	if redisClient != nil {
+		if err := readRedis(redisClient, handle); err != nil {
+			logf("error", "Failed to read tasks from redis: %s", err)
+		}
+		wg.Wait()
+		return
+	}
+
+	if kafkaReader != nil {
+		if err := readKafka(kafkaReader, handle); err != nil {
+			logf("error", "Failed to read tasks from kafka: %s", err)
+		}
+		wg.Wait()
+		return
+	}
+
+	if httpAddr != "" {
+		if err := serveHTTP(httpAddr, submitFrom, render); err != nil {
+			logf("error", "Failed to serve tasks over HTTP: %s", err)
+		}
+		wg.Wait()
+		return
+	}
+
+	if err := readTasks(input, handle); err != nil {
+		logf("error", "Failed to read tasks: %s", err)
+	}
+
+	wg.Wait()
 }
 
 func printResult(r TaskResult) {
 
-	rBytes, err := json.Marshal(r)
+	expireOutputs(r)
+
+	r, rBytes, err := resultRecord(r)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Could not unmarshal task result: %+v", r)
+		logTaskf(r.Id, "error", "Could not marshal task result: %+v", r)
+		return
 	}
 
-	rString := string(rBytes)
+	out := results
 	if r.Error != "" {
-		fmt.Fprintln(os.Stderr, rString)
-	} else {
-		fmt.Fprintln(os.Stdout, rString)
+		out = failures
+	}
+	if err := out.writeRecord(rBytes); err != nil {
+		logTaskf(r.Id, "error", "Could not write task result: %s", err)
 	}
 }
 
+func processTask(t Task) TaskResult {
+	if err := checkSpace(t); err != nil {
+		r := TaskResult{Id: t.Id}
+		r.setError(err)
+		return r
+	}
+
+	if t.release != nil {
+		t.release()
+	}
+
+	// by name, so a remote source that won't be accepted isn't fetched
+	if err := checkFormat(t.source, ""); isRemote(t.Filename) && err != nil {
+		r := TaskResult{Id: t.Id}
+		r.setError(err)
+		return r
+	}
+
+	// an archive is fetched whole, and its entry extracted below
+	t, fetched, err := fetchTask(t)
+	if err != nil {
+		r := TaskResult{Id: t.Id}
+		r.setError(err)
+		return r
+	}
+	if fetched != "" {
+		defer removeTemp(fetched)
+	}
+
+	if archive, entry, ok := splitArchive(t.Filename); ok {
+		filename, err := extractEntry(archive, entry)
+		if err != nil {
+			return TaskResult{Id: t.Id, Error: err.Error()}
+		}
+		defer removeTemp(filename)
+		t.Filename = filename
+	}
+
+	source := t.source
+	if source == "" {
+		source = t.Filename
+	}
+	if err := checkFormat(source, t.Filename); err != nil {
+		r := TaskResult{Id: t.Id}
+		r.setError(err)
+		return r
+	}
+
+	switch t.Op {
+	case "":
+		// the whole file is read for it, so only when it's compared (or keys
+		// -sessionTTL's cache)
+		var token string
+		if t.IfUnchangedToken != "" || sessionTTL > 0 {
+			var err error
+			token, err = hashFile(t.Filename)
+			if err != nil && !t.Placeholder {
+				r := TaskResult{Id: t.Id}
+				r.setError(&codedError{code: "READ_FAILED", retryable: !os.IsNotExist(err), msg: "Could not read the source: " + err.Error()})
+				return r
+			}
+		}
+		if t.IfUnchangedToken != "" && t.IfUnchangedToken == token {
+			logTaskf(t.Id, "debug", "Not modified since token %s", token)
+			return notModified(t, token)
+		}
+		t.token = token
+		r := resizeImage(t)
+		if r.Error == "" && t.IfUnchangedToken != "" {
+			r.Response.Token = token
+			rememberResult(t, r)
+		}
+		return r
+	case "identify":
+		return identifyImage(t)
+	case "tiles":
+		return tileImage(t)
+	case "diff":
+		return diffImage(t)
+	case "hdrmerge":
+		return mergeImage(t)
+	case "sprite":
+		return spriteImage(t)
+	case "burst":
+		return burstImage(t)
+	}
+	return TaskResult{Id: t.Id, Error: fmt.Sprintf("Unknown op %q", t.Op)}
+}
+
 //func resizeImage(t *Task, wg *sync.WaitGroup) {
 func resizeImage(t Task) TaskResult {
 	// all of the needed vars are declared here, since goto is used a lot
 	var (
-		sourceImageFile  *os.File
 		previewImageFile *os.File
 		thumbImageFile   *os.File
 		sourceImage      image.Image
@@ -124,114 +935,731 @@ func resizeImage(t Task) TaskResult {
 
 	resp.Id = t.Id
 
+	if err := checkSizing(t); err != nil {
+		resp.setError(invalidTask(err))
+		return resp
+	}
+	if err := checkRenditions(t); err != nil {
+		resp.setError(invalidTask(err))
+		return resp
+	}
+	if err := checkQuality(t); err != nil {
+		resp.setError(invalidTask(err))
+		return resp
+	}
+	if err := checkTrim(t); err != nil {
+		resp.setError(invalidTask(err))
+		return resp
+	}
+	if err := checkThumbSource(t); err != nil {
+		resp.setError(invalidTask(err))
+		return resp
+	}
+	if err := checkHDR(t); err != nil {
+		resp.setError(invalidTask(err))
+		return resp
+	}
+	var captured time.Time
+	if t.CaptureMtime || t.DateFolders {
+		var err error
+		if captured, err = sourceTime(t); err != nil {
+			resp.setError(err)
+			return resp
+		}
+	}
+	if t.DateFolders {
+		dir, err := datedOutputDir(t, captured)
+		if err != nil {
+			resp.setError(err)
+			return resp
+		}
+		t.OutputDir = dir
+	}
+	if t.PrintSize != "" && t.DPI == 0 {
+		t.DPI = defaultDPI
+	}
+
+	// a JPEG that's only rotated and cropped needn't be decoded and re-encoded
+	lossless, err := transformJPEG(t)
+	if err != nil {
+		resp.setError(err)
+		return resp
+	}
+	t.decode = &Decode{}
+	resp.Response.Decode = t.decode
+	if lossless != "" {
+		defer removeTemp(lossless)
+		t.decoded("lossless", nil)
+		previewImage, err = decodeJPEGFile(lossless)
+	} else {
+		sourceImage, err = decodeSession(t)
+	}
+	if err != nil && t.Placeholder {
+		logTaskf(t.Id, "warn", "Making placeholders for %s: %s", t.Filename, err)
+		t.decoded("placeholder", nil)
+		resp.Response.Placeholder = true
+		resp.Detail = err.Error()
+		if c, ok := err.(*codedError); ok {
+			resp.Diagnostics = c.diagnostics
+		}
+		sourceImage, previewImage, lossless = placeholderImage(t, err), nil, ""
+		// nothing of the source is left to apply
+		t.Ops, t.LensCorrection, t.HDR, t.Animate, t.Panorama, t.LUT, t.Trim = nil, false, false, nil, "", "", false
+		err = nil
+	}
+	if err == nil && sourceImage != nil {
+		sourceImage = trimBorders(sourceImage, t)
+		// it's applied once resized, but a bad one fails the task here
+		if t.LUT != "" {
+			_, err = loadLUT(t.LUT)
+		}
+	}
+	if err != nil {
+		resp.setError(err)
+		return resp
+	}
+
+	// the source is decoded, so dcraw's slot is free while this waits for
+	// one to resize and encode in
+	release := encodeSlot()
+	defer release()
+
+	// at this point, sourceImage is ready to resize, prepare the preview/thumb files
+	previewImageFile, err = createOutput(t)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	thumbImageFile, err = createOutput(t)
+	if err != nil {
+		os.Remove(previewImageFile.Name())
+		resp.Error = err.Error()
+		return resp
+	}
+	// do the resizing in this sequence (if jpegtran hasn't made the preview)
+	t.progress.stage("resize", 70)
+	if lossless == "" && len(t.Ops) > 0 {
+		// the task's own pipeline makes the preview, lens correction has to
+		// come first for any crop to land where it's expected
+		if t.LensCorrection {
+			t.progress.stage("lens", 70)
+			if sourceImage, err = correctLens(t, sourceImage); err != nil {
+				os.Remove(previewImageFile.Name())
+				os.Remove(thumbImageFile.Name())
+				resp.Error = err.Error()
+				return resp
+			}
+		}
+		t.progress.stage("ops", 75)
+		if previewImage, err = applyOps(sourceImage, t.Ops, upscales(t)); err != nil {
+			os.Remove(previewImageFile.Name())
+			os.Remove(thumbImageFile.Name())
+			resp.Error = err.Error()
+			return resp
+		}
+	} else if lossless == "" {
+		w, h := fitSize(t, sourceImage.Bounds(), previewWidth)
+		if t.PrintSize != "" {
+			if w, h, err = printPixels(t, sourceImage.Bounds()); err != nil {
+				os.Remove(previewImageFile.Name())
+				os.Remove(thumbImageFile.Name())
+				resp.Error = err.Error()
+				return resp
+			}
+		}
+		// a source that's small enough already is only re-encoded
+		resized := (t.PrintSize != "" && upscales(t)) || !fits(sourceImage.Bounds(), w, h)
+		resp.Response.Resized = &resized
+		if resized {
+			previewImage = resize.Resize(w, h, sourceImage, resize.Bilinear)
+		} else {
+			previewImage = sourceImage
+		}
+		// correct the (much smaller) preview, the thumbnail is made from it anyway
+		if t.LensCorrection {
+			t.progress.stage("lens", 75)
+			if previewImage, err = correctLens(t, previewImage); err != nil {
+				os.Remove(previewImageFile.Name())
+				os.Remove(thumbImageFile.Name())
+				resp.Error = err.Error()
+				return resp
+			}
+		}
+	}
+	// with fewer pixels to look up than the source has
+	if previewImage, err = applyLUT(previewImage, t); err != nil {
+		os.Remove(previewImageFile.Name())
+		os.Remove(thumbImageFile.Name())
+		resp.setError(err)
+		return resp
+	}
+	// the ops make the preview, so it's the only thing to thumbnail
+	fromSource := t.ThumbSource == "source" && sourceImage != nil && len(t.Ops) == 0
+	thumbSource, thumbFilter := previewImage, resize.NearestNeighbor
+	if fromSource {
+		thumbSource = sourceImage
+	}
+	if t.ThumbFilter != "" {
+		thumbFilter = filters[t.ThumbFilter]
+	}
+	w, h := fitSize(t, thumbSource.Bounds(), thumbWidth)
+	if thumbImage = thumbSource; !fits(thumbSource.Bounds(), w, h) {
+		thumbImage = resize.Resize(w, h, thumbSource, thumbFilter)
+	}
+	if fromSource && t.LensCorrection {
+		if thumbImage, err = correctLens(t, thumbImage); err != nil {
+			os.Remove(previewImageFile.Name())
+			os.Remove(thumbImageFile.Name())
+			resp.setError(err)
+			return resp
+		}
+	}
+	if fromSource {
+		if thumbImage, err = applyLUT(thumbImage, t); err != nil {
+			os.Remove(previewImageFile.Name())
+			os.Remove(thumbImageFile.Name())
+			resp.setError(err)
+			return resp
+		}
+	}
+	if t.Scores {
+		resp.Response.Scores = computeScores(previewImage)
+	}
+	if t.Regions {
+		if resp.Response.Regions, err = focusRegions(t.Filename); err != nil {
+			logTaskf(t.Id, "warn", "Could not read the regions of %s: %s", t.Filename, err)
+		}
+	}
+	if t.RawStats && isRawDecode(t.decode) {
+		if resp.Response.RawStats, err = rawStats(t.Filename); err != nil {
+			logTaskf(t.Id, "warn", "Could not read the raw data of %s: %s", t.Filename, err)
+		}
+	}
+	if thumbImage, err = styleImage(thumbImage, t.ThumbStyle); err != nil {
+		os.Remove(previewImageFile.Name())
+		os.Remove(thumbImageFile.Name())
+		resp.Error = err.Error()
+		return resp
+	}
+	// P3 tasks are worked on in P3, their sRGB outputs are converted from it
+	var p3Preview, p3Thumb image.Image
+	if t.DisplayP3 {
+		p3Preview, p3Thumb = previewImage, thumbImage
+		previewImage, thumbImage = toSRGB(previewImage), toSRGB(thumbImage)
+		t.icc = "srgb"
+	}
+	// encode the two images to disk
+	t.progress.stage("encode", 85)
+	gm := hdrGainMap(t, sourceImage)
+	resp.Response.HDR = gm != nil
+	if lossless != "" {
+		err = copyFile(previewImageFile, lossless)
+	} else {
+		err = encodeHDR(previewImageFile, previewImage, t, gm)
+	}
+	if err != nil {
+		// remove the two temp image files
+		os.Remove(previewImageFile.Name())
+		os.Remove(thumbImageFile.Name())
+		resp.setError(noSpace(err))
+		return resp
+	}
+	resp.Response.Preview = previewImageFile.Name()
+	previewImageFile.Close()
+
+	// once there's a preview, a Partial task reports any other output that
+	// fails alongside the rest; otherwise the task fails, and this removes
+	// what it has made
+	abort := func(err error) TaskResult {
+		for _, f := range resp.Response.files() {
+			if f != "" {
+				unpublishOutput(f)
+			}
+		}
+		failed := TaskResult{Id: t.Id}
+		failed.setError(err)
+		return failed
+	}
+
+	err = encodeHDR(thumbImageFile, thumbImage, t, gm)
+	thumbImageFile.Close()
+	if err != nil {
+		os.Remove(thumbImageFile.Name())
+		if !t.Partial {
+			return abort(noSpace(err))
+		}
+		resp.Response.failed("thumbnail", noSpace(err))
+	} else {
+		resp.Response.Thumbnail = thumbImageFile.Name()
+	}
+	release()
+	made := []string{resp.Response.Preview}
+	if resp.Response.Thumbnail != "" {
+		made = append(made, resp.Response.Thumbnail)
+	}
+
+	if keepExif && !resp.Response.Placeholder {
+		// (never partly, it may be what strips the location)
+		if err := copyMetadata(t.Filename, made...); err != nil {
+			return abort(err)
+		}
+	}
+
+	if deterministic {
+		// nothing about when the outputs were made is left, not even on disk
+		for _, f := range made {
+			os.Chtimes(f, time.Unix(0, 0), time.Unix(0, 0))
+		}
+	}
+
+	if err := uploadOutputs(&resp, t); err != nil {
+		return abort(err)
+	}
+
+	if t.Panorama == "strip" && len(t.Ops) == 0 && isPanorama(sourceImage.Bounds()) {
+		t.progress.stage("strip", 95)
+		if resp.Response.Strip, err = writeStrip(t, sourceImage); err != nil {
+			if !t.Partial {
+				return abort(err)
+			}
+			resp.Response.failed("strip", err)
+		}
+	}
+
+	if t.DisplayP3 {
+		t.progress.stage("p3", 95)
+		if resp.Response.PreviewP3, resp.Response.ThumbnailP3, err = writeDisplayP3(t, p3Preview, p3Thumb); err != nil {
+			if !t.Partial {
+				return abort(err)
+			}
+			resp.Response.failed("displayP3", err)
+		}
+	}
+
+	if t.Animate != nil {
+		t.progress.stage("animation", 95)
+		if resp.Response.Animation, err = writeAnimation(t); err != nil {
+			if !t.Partial {
+				return abort(err)
+			}
+			resp.Response.failed("animation", err)
+		}
+	}
+
+	if len(t.Renditions) > 0 {
+		t.progress.stage("renditions", 95)
+		// from the full decode, unless the preview is all there is
+		src := sourceImage
+		if lossless != "" || len(t.Ops) > 0 {
+			src, t.LensCorrection, t.LUT = previewImage, false, ""
+			if t.DisplayP3 {
+				src = p3Preview
+			}
+		}
+		var failures map[string]error
+		resp.Response.Renditions, failures = writeRenditions(t, src)
+		for _, r := range t.Renditions {
+			if err := failures[r.name()]; err != nil {
+				if !t.Partial {
+					return abort(err)
+				}
+				resp.Response.failed("rendition "+r.name(), err)
+			}
+		}
+	}
+
+	if t.CaptureMtime {
+		setCaptureTimes(resp.Response, captured)
+	}
+
+	if debug {
+		defer os.Remove(previewImageFile.Name())
+		defer os.Remove(thumbImageFile.Name())
+	}
+
+	return resp
+}
+
+// decodeSource decodes the task's file at (or as near as possible above) the
+// size needed for the preview
+func decodeSource(t Task) (image.Image, error) {
 	halfSize := t.ImageWidth / 2
 	// the rest to be filled out below
 	args := []string{"-c"}
+	renderArgs, err := whiteBalanceArgs(t)
+	if err != nil {
+		return nil, err
+	}
+	demosaic, err := demosaicArgs(t)
+	if err != nil {
+		return nil, err
+	}
+	renderArgs = append(renderArgs, demosaic...)
+	tone, err := toneArgs(t)
+	if err != nil {
+		return nil, err
+	}
+	renderArgs = append(renderArgs, tone...)
+	noise, err := denoiseArgs(t)
+	if err != nil {
+		return nil, err
+	}
+	renderArgs = append(renderArgs, noise...)
+	if t.DisplayP3 {
+		// ProPhoto, and 16 bits so the conversion to P3 doesn't band
+		renderArgs = append(renderArgs, "-o", "4", "-6")
+	}
+	embedded := cameraWhiteBalance(t)
+	profile := profileFor(t.Filename)
+	if profile != nil {
+		profileArgs := profile.DcrawArgs
+		if len(demosaic) > 0 {
+			// the task's demosaic wins over the profile's
+			profileArgs = withoutArg(profileArgs, "-q", 1)
+		}
+		// and so do its exposure, gamma and denoising
+		if t.Exposure != 0 || t.Brightness != 0 {
+			profileArgs = withoutArg(profileArgs, "-b", 1)
+		}
+		if t.Gamma != 0 {
+			profileArgs = withoutArg(profileArgs, "-g", 2)
+		}
+		if t.Denoise != 0 {
+			profileArgs = withoutArg(profileArgs, "-n", 1)
+		}
+		renderArgs = append(renderArgs, profileArgs...)
+	}
 
 	// the preview image is going to be the source image for the thumbnail
 	// extract or decode the largest and nearest size
-	if t.ThumbWidth >= previewWidth && t.ThumbWidth <= halfSize {
+	if embedded && t.ThumbWidth >= previewWidth && t.ThumbWidth <= halfSize {
 		// embedded thumbnails can be full res, only opt for this if the embedded thumbnail
 		// is smaller than the -h option (less memory needed)
 		args = append(args, "-e")
 	} else if halfSize >= previewWidth {
 		// use the half size option for dcraw
-		args = append(args, []string{"-w", "-h", "-T"}...)
-		// camera's white balance, half size, TIFF output
-	} else if t.ThumbWidth >= previewWidth {
+		args = append(append(args, renderArgs...), "-h", "-T")
+		// the task's white balance, half size, TIFF output
+	} else if embedded && t.ThumbWidth >= previewWidth {
 		// the camera's embedded thumbnail is now preferred to the full res,
 		// since the camera generated this image
 		args = append(args, "-e")
 	} else {
 		// finally, the only option is the full resolution image
-		args = append(args, []string{"-w", "-T"}...)
-		// camera white balance, TIFF output
+		args = append(append(args, renderArgs...), "-T")
+		// the task's white balance, TIFF output
 	}
 	args = append(args, t.Filename)
 
-	sourceImageFile, err := ioutil.TempFile("", "")
+	// files still being copied (e.g. off a card) decode to garbage, or not at all
+	if err := checkStable(t.Filename); err != nil {
+		return nil, err
+	}
+
+	// DNGs usually carry a full size preview rendered by the converter
+	dng, err := readDNG(t.Filename)
 	if err != nil {
-		resp.Error = err.Error()
-		return resp
+		logTaskf(t.Id, "warn", "Could not read DNG tags of %s: %s", t.Filename, err)
+	}
+	// (which has the camera's white balance baked in, but not the sidecar's
+	// edits, and is a flat render only of the first page)
+	if embedded && !t.IgnoreEdits && t.Page <= 1 && !hasEdits(t) {
+		if preview := dng.decodePreview(t.Filename); preview != nil {
+			t.decoded("dngPreview", nil)
+			t.decodedBy("embedded")
+			return develop(preview, t), nil
+		}
+	}
+
+	// the camera's JPEG can be had without running dcraw at all, if it's as
+	// wide as every output
+	if args[1] == "-e" && !hasEdits(t) {
+		var minWidth uint
+		for _, w := range outputWidths(t) {
+			if w > minWidth {
+				minWidth = w
+			}
+		}
+		if preview := decodeEmbedded(t.Filename, minWidth); preview != nil {
+			t.decoded("embeddedInProcess", nil)
+			t.decodedBy("embedded")
+			return develop(uprightPreview(t, cropToActive(t, preview)), t), nil
+		}
+	}
+
+	// huge scans are downsampled as they're read, rather than decoded whole
+	if dng == nil {
+		if large, ok, err := decodeLarge(t); ok {
+			if err != nil {
+				return nil, err
+			}
+			t.decoded("chunked", nil)
+			t.decodedBy("native")
+			return develop(large, t), nil
+		}
+	}
+
+	sourceImageFile, err := createTemp("")
+	if err != nil {
+		return nil, err
+	}
+	// removed however this returns, as sourceImageFile may be replaced below
+	dcrawOut := sourceImageFile.Name()
+	defer removeTemp(dcrawOut)
+	defer sourceImageFile.Close()
+
+	demosaiced, direct := false, false
+	t.progress.stage("dcraw", 0)
+	rendered := renderEdits(t, sourceImageFile)
+	// only TIFFs have more than one page, dcraw doesn't decode those anyway
+	var dcrawErr error
+	decoder := "native"
+	if !rendered && t.Page <= 1 {
+		decoder = ""
+	chain:
+		for _, d := range decoders {
+			switch d.name {
+			case "embedded":
+				if preview := decodeEmbedded(t.Filename, 0); preview != nil {
+					t.decoded("embeddedInProcess", nil)
+					t.decodedBy("embedded")
+					return develop(uprightPreview(t, cropToActive(t, preview)), t), nil
+				}
+			case "native":
+				// Go would only find a RAW's tiny TIFF thumbnail
+				if isTimeout(dcrawErr) {
+					return nil, withDiagnostics(dcrawErr, saveDiagnostics(t, dcrawOut, dcrawErr, dcrawErr))
+				}
+				decoder = "native"
+				break chain
+			default:
+				var err error
+				if args, err = rawDecode(t, d, args, sourceImageFile); err == nil {
+					decoder, dcrawErr = d.name, nil
+					break chain
+				}
+				logTaskf(t.Id, "debug", "Could not decode %s with %s: %s", t.Filename, d.name, err)
+				dcrawErr = err
+			}
+		}
+		if decoder == "" {
+			if dcrawErr == nil {
+				dcrawErr = fmt.Errorf("None of -decoders could decode it")
+			}
+			return nil, withDiagnostics(dcrawErr, saveDiagnostics(t, dcrawOut, dcrawErr, dcrawErr))
+		}
 	}
 
-	if err := dcraw.Run(args, sourceImageFile); err == nil {
+	if rendered {
+		t.decoded("edits", nil)
+	} else if decoder != "native" {
 		// dcraw successfully decoded the image, prepare it for reading
+		// (-e extracts the embedded thumbnail, which is already cropped)
+		demosaiced = args[1] != "-e"
+		switch {
+		case !demosaiced:
+			t.decoded("embedded", args)
+		case args[len(args)-3] == "-h":
+			t.decoded("halfSize", args)
+		default:
+			t.decoded("full", args)
+		}
+		t.decodedBy(decoder)
 		sourceImageFile.Sync()
 		sourceImageFile.Seek(0, 0)
-		defer os.Remove(sourceImageFile.Name())
 	} else {
+		direct = true
+		t.decoded("direct", nil)
+		t.decodedBy("native")
 		// determine if the file exists (it may have changed while in queue)
 		if _, err := os.Stat(t.Filename); os.IsNotExist(err) {
-			resp.Error = "File does not exist"
-			return resp
+			return nil, fmt.Errorf("File does not exist")
 		}
 		// dcraw could not decode the image, but maybe its already a JPEG or similar
-		os.Remove(sourceImageFile.Name()) // no longer needed (an empty file)
 		sourceImageFile, _ = os.Open(t.Filename)
 		defer sourceImageFile.Close()
 	}
 
 	// now sourceImageFile has the image we want to use for resizing
-	sourceImage, err = decodeImage(sourceImageFile)
+	t.progress.stage("decode", 50)
+	var sourceImage image.Image
+	if direct {
+		sourceImage = decodeScaled(t)
+	}
+	err = nil
+	if sourceImage == nil {
+		sourceImage, err = decodeImage(sourceImageFile, t.Page)
+	}
 	if err != nil {
-		resp.Error = err.Error()
-		return resp
+		bundle := saveDiagnostics(t, dcrawOut, dcrawErr, err)
+		if c, ok := dcrawErr.(*codedError); ok {
+			// it was probably meant to be a RAW, what dcraw said is more useful
+			return nil, &codedError{code: "DECODE_FAILED", msg: err.Error(), detail: c.detail, diagnostics: bundle}
+		}
+		return nil, withDiagnostics(err, bundle)
 	}
 
-	// at this point, sourceImage is ready to resize, prepare the preview/thumb files
-	previewImageFile, err = ioutil.TempFile("", "")
+	// dcraw doesn't apply the DNG's default crop
+	if demosaiced {
+		if t.DisplayP3 {
+			sourceImage = toDisplayP3(sourceImage, t, true)
+		}
+		sourceImage = dng.applyCrop(sourceImage)
+		if t.Temperature > 0 {
+			sourceImage = applyTemperature(sourceImage, t)
+		}
+		sourceImage = profile.apply(sourceImage)
+	} else {
+		if args[1] == "-e" && !rendered && t.Page <= 1 && dcrawErr == nil {
+			sourceImage = uprightPreview(t, cropToActive(t, sourceImage))
+		}
+		sourceImage = develop(sourceImage, t)
+	}
+
+	return sourceImage, nil
+}
+
+// develop adjusts (and denoises) a source dcraw didn't render, as it would have
+func develop(img image.Image, t Task) image.Image {
+	if t.DisplayP3 {
+		img = toDisplayP3(img, t, false)
+	}
+	return denoise(applyTone(img, t), t.Denoise)
+}
+
+// uploadOutputs replaces the local preview and thumbnail in resp with where
+// they were uploaded, if the task's outputs go to a Storage
+func uploadOutputs(resp *TaskResult, t Task) error {
+	preview, previewURL, err := publishOutput(t, resp.Response.Preview, outputName(t, resp.Response.Preview, "preview", formatExt(t)), formatType(t))
 	if err != nil {
-		resp.Error = err.Error()
-		return resp
+		return err
+	}
+	resp.Response.Preview, resp.Response.PreviewURL = preview, previewURL
+	if resp.Response.Thumbnail == "" {
+		// a Partial task's, which failed
+		return nil
+	}
+
+	thumb, thumbURL, err := publishOutput(t, resp.Response.Thumbnail, outputName(t, resp.Response.Thumbnail, "thumbnail", formatExt(t)), formatType(t))
+	if err != nil && t.Partial {
+		resp.Response.Thumbnail = ""
+		resp.Response.failed("thumbnail", err)
+		return nil
+	} else if err != nil {
+		return err
 	}
-	thumbImageFile, err = ioutil.TempFile("", "")
+	resp.Response.Thumbnail, resp.Response.ThumbnailURL = thumb, thumbURL
+	return nil
+}
+
+// createOutput makes a new, uniquely named file for a preview or thumbnail in
+// the task's output dir, with the requested permissions and ownership
+func createOutput(t Task) (*os.File, error) {
+	f, err := ioutil.TempFile(localOutputDir(t), "")
 	if err != nil {
-		resp.Error = err.Error()
-		return resp
+		return nil, err
 	}
-	// do the resizing in this sequence
-	previewImage = resize.Resize(previewWidth, 0, sourceImage, resize.Bilinear)
-	thumbImage = resize.Resize(thumbWidth, 0, previewImage, resize.NearestNeighbor)
-	// encode the two images to disk
-	if err := jpeg.Encode(previewImageFile, previewImage, nil); err != nil {
-		// remove the two temp image files
-		os.Remove(previewImageFile.Name())
-		os.Remove(thumbImageFile.Name())
-		resp.Error = err.Error()
-		return resp
+	// removed on the way out unless it's published
+	trackTemp(f.Name())
+
+	if err := setOwnership(f.Name(), t); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
 	}
-	if err := jpeg.Encode(thumbImageFile, thumbImage, nil); err != nil {
-		os.Remove(thumbImageFile.Name())
-		resp.Error = err.Error()
-		return resp
+
+	return f, nil
+}
+
+// setOwnership gives an output the task's FileMode, Uid and Gid
+func setOwnership(filename string, t Task) error {
+	if t.FileMode != "" {
+		mode, err := strconv.ParseUint(t.FileMode, 8, 32)
+		if err == nil {
+			err = os.Chmod(filename, os.FileMode(mode))
+		}
+		if err != nil {
+			return fmt.Errorf("Could not set file mode %s: %s", t.FileMode, err)
+		}
 	}
-	// got this far? success!
-	resp.Response.Preview = previewImageFile.Name()
-	resp.Response.Thumbnail = thumbImageFile.Name()
-	previewImageFile.Close()
-	thumbImageFile.Close()
 
-	if debug {
-		defer os.Remove(previewImageFile.Name())
-		defer os.Remove(thumbImageFile.Name())
+	if t.Uid != nil || t.Gid != nil {
+		// -1 leaves that id unchanged
+		uid, gid := -1, -1
+		if t.Uid != nil {
+			uid = *t.Uid
+		}
+		if t.Gid != nil {
+			gid = *t.Gid
+		}
+		if err := os.Chown(filename, uid, gid); err != nil {
+			return fmt.Errorf("Could not set file owner: %s", err)
+		}
 	}
 
-	return resp
+	return nil
+}
+
+// maxMegapixels is the largest image that's decoded, so a crafted header
+// can't have gigabytes allocated for it
+var maxMegapixels float64
+
+// checkPixels fails with TOO_LARGE if a w by h image is over -maxMegapixels
+func checkPixels(w, h int) error {
+	if maxMegapixels > 0 && float64(w)*float64(h) > maxMegapixels*1e6 {
+		return &codedError{code: "TOO_LARGE", msg: fmt.Sprintf("%dx%d is more than -maxMegapixels %g", w, h, maxMegapixels)}
+	}
+	return nil
 }
 
-func decodeImage(f *os.File) (image.Image, error) {
+func decodeImage(f *os.File, page int) (image.Image, error) {
+	if page > 1 {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return decodeTIFFPage(f, info.Size(), page)
+	}
+
+	// by its header, before anything's allocated for it
+	f.Seek(0, 0)
+	if config, _, err := image.DecodeConfig(f); err == nil {
+		if err := checkPixels(config.Width, config.Height); err != nil {
+			return nil, err
+		}
+	}
+
+	// each decoder reads from wherever the last one gave up, so rewind
+	f.Seek(0, 0)
 	if result, err := jpeg.Decode(f); err == nil {
 		return result, nil
 	}
 
+	f.Seek(0, 0)
 	if result, err := tiff.Decode(f); err == nil {
 		return result, nil
 	}
 
+	f.Seek(0, 0)
+	if result, err := png.Decode(f); err == nil {
+		return result, nil
+	}
+
+	f.Seek(0, 0)
 	if result, err := pnm.Decode(f); err == nil {
 		return result, nil
 	}
 
-	return nil, fmt.Errorf("Could not decode image (not jpeg/tiff/pnm)")
+	f.Seek(0, 0)
+	if result, err := decodePSD(f); err == nil {
+		return result, nil
+	}
+
+	// the first frame, if animated
+	f.Seek(0, 0)
+	if result, err := gif.Decode(f); err == nil {
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("Could not decode image (not jpeg/tiff/png/pnm/psd/gif)")
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// the outputs have no metadata unless -keepExif, which copies the source's
+// EXIF with exiftool (or only the -exifTags, e.g. "Copyright,Artist,
+// DateTimeOriginal"), and -gps decides what happens to its location
+var (
+	keepExif     bool
+	exifTags     string
+	gpsPolicy    string
+	geofencePath string
+	geofences    []geofence
+)
+
+// geofence is a circle, Radius in meters, that locations are hidden within
+type geofence struct {
+	Name   string  `json:"name"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+	Radius float64 `json:"radius"`
+}
+
+// loadMetadataPolicy checks the flags, and reads -geofences, a JSON array
+func loadMetadataPolicy() error {
+	switch gpsPolicy {
+	case "strip", "keep":
+	case "geofence":
+		data, err := ioutil.ReadFile(geofencePath)
+		if err == nil {
+			err = json.Unmarshal(data, &geofences)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read -geofences: %s", err)
+		}
+	default:
+		return fmt.Errorf("Unknown -gps %q (strip, keep or geofence)", gpsPolicy)
+	}
+	for _, tag := range splitTags(exifTags) {
+		// (they're passed to exiftool as options)
+		if !exifTagName.MatchString(tag) {
+			return fmt.Errorf("Unknown tag %q in -exifTags", tag)
+		}
+	}
+	if exifTags != "" {
+		keepExif = true
+	}
+	if keepExif && exiftoolPath == "" {
+		return fmt.Errorf("-keepExif needs -exiftool")
+	}
+	return nil
+}
+
+// exifTagName is a tag exiftool can copy, maybe with its group ("XMP:Rights")
+var exifTagName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*(:[A-Za-z][A-Za-z0-9_-]*)?$`)
+
+func splitTags(list string) []string {
+	var tags []string
+	for _, tag := range strings.Split(list, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// within is the fence a location is inside, if any
+func within(lat, lon float64) *geofence {
+	const earthRadius = 6371000
+	rad := math.Pi / 180
+	for i, g := range geofences {
+		// haversine
+		dLat, dLon := (g.Lat-lat)*rad, (g.Lon-lon)*rad
+		a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+			math.Cos(lat*rad)*math.Cos(g.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+		if 2*earthRadius*math.Asin(math.Sqrt(a)) <= g.Radius {
+			return &geofences[i]
+		}
+	}
+	return nil
+}
+
+// keepGPS is whether the source's location can be copied to its outputs
+func keepGPS(filename string) (bool, error) {
+	switch gpsPolicy {
+	case "keep":
+		return true, nil
+	case "strip":
+		return false, nil
+	}
+
+	source, unlink, err := plainPath(filename)
+	if err != nil {
+		return false, err
+	}
+	defer unlink()
+	cmd := exec.Command(exiftoolPath, "-j", "-n", "-GPSLatitude", "-GPSLongitude", source)
+	release, err := sandbox(cmd)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	out, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("exiftool failed: %s", err)
+	}
+	var tags []struct {
+		GPSLatitude, GPSLongitude *float64
+	}
+	if err := json.Unmarshal(out, &tags); err != nil || len(tags) == 0 {
+		return false, fmt.Errorf("Could not read exiftool output: %s", err)
+	}
+	if tags[0].GPSLatitude == nil || tags[0].GPSLongitude == nil {
+		return true, nil // nothing to hide
+	}
+	if g := within(*tags[0].GPSLatitude, *tags[0].GPSLongitude); g != nil {
+		logf("debug", "Stripping the location of %s, it's within %q", filename, g.Name)
+		return false, nil
+	}
+	return true, nil
+}
+
+// copyMetadata copies the EXIF of filename to the outputs, except what no
+// longer applies (they're upright and resized) and maybe the location. With
+// -exifTags it's only those tags, an Orientation among them written as 1
+// (upright) since that's what the outputs are.
+func copyMetadata(filename string, outputs ...string) error {
+	gps, err := keepGPS(filename)
+	if err != nil {
+		return err
+	}
+	source, unlink, err := plainPath(filename)
+	if err != nil {
+		return err
+	}
+	defer unlink()
+
+	args := []string{"-q", "-overwrite_original", "-TagsFromFile", source}
+	if tags := splitTags(exifTags); len(tags) > 0 {
+		for _, tag := range tags {
+			if strings.EqualFold(tag[strings.LastIndex(tag, ":")+1:], "Orientation") {
+				args = append(args, "-Orientation#=1")
+				continue
+			}
+			args = append(args, "-"+tag)
+		}
+	} else {
+		args = append(args, "-exif:all",
+			"--Orientation", "--ExifImageWidth", "--ExifImageHeight", "--ThumbnailImage")
+	}
+	if !gps {
+		args = append(args, "--gps:all")
+	}
+	// exiftool writes a copy beside each output and renames it over
+	var dirs []string
+	for _, output := range outputs {
+		dirs = append(dirs, filepath.Dir(output))
+	}
+	cmd := exec.Command(exiftoolPath, append(args, outputs...)...)
+	release, err := sandbox(cmd, dirs...)
+	if err != nil {
+		return err
+	}
+	defer release()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return &codedError{code: "METADATA_FAILED", msg: fmt.Sprintf("exiftool failed: %s", err), detail: string(out)}
+	}
+	return nil
+}
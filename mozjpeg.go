@@ -0,0 +1,112 @@
+//go:build mozjpeg && cgo
+// +build mozjpeg,cgo
+
+package main
+
+/*
+#cgo LDFLAGS: -ljpeg
+#include <setjmp.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <jpeglib.h>
+
+// libjpeg's own error_exit exits the process, this jumps back out of
+// encode_mozjpeg with the message instead
+struct moz_error {
+	struct jpeg_error_mgr mgr;
+	jmp_buf jump;
+	char *msg;
+};
+
+static void moz_error_exit(j_common_ptr c) {
+	struct moz_error *e = (struct moz_error *)c->err;
+	(*c->err->format_message)(c, e->msg);
+	longjmp(e->jump, 1);
+}
+
+// mozjpeg's defaults are its best compression: trellis quantization,
+// optimized progressive scans and the ImageMagick quant tables
+static int encode_mozjpeg(unsigned char *pix, int width, int height, int quality, int dpi, unsigned char **out, unsigned long *size, char *msg) {
+	struct jpeg_compress_struct c;
+	struct moz_error e;
+	c.err = jpeg_std_error(&e.mgr);
+	e.mgr.error_exit = moz_error_exit;
+	e.msg = msg;
+	if (setjmp(e.jump)) {
+		jpeg_destroy_compress(&c);
+		return 1;
+	}
+	jpeg_create_compress(&c);
+	jpeg_mem_dest(&c, out, size);
+	c.image_width = width;
+	c.image_height = height;
+	c.input_components = 3;
+	c.in_color_space = JCS_RGB;
+	jpeg_c_set_int_param(&c, JINT_COMPRESS_PROFILE, JCP_MAX_COMPRESSION);
+	jpeg_set_defaults(&c);
+	jpeg_set_quality(&c, quality, TRUE);
+	// 4:2:0, as Go's encoder, whatever the library's default
+	c.comp_info[0].h_samp_factor = 2;
+	c.comp_info[0].v_samp_factor = 2;
+	c.comp_info[1].h_samp_factor = c.comp_info[1].v_samp_factor = 1;
+	c.comp_info[2].h_samp_factor = c.comp_info[2].v_samp_factor = 1;
+	if (dpi > 0) {
+		// in the JFIF segment libjpeg writes anyway
+		c.density_unit = 1;
+		c.X_density = dpi;
+		c.Y_density = dpi;
+	}
+	jpeg_start_compress(&c, TRUE);
+	while (c.next_scanline < c.image_height) {
+		JSAMPROW row = pix + c.next_scanline * width * 3;
+		jpeg_write_scanlines(&c, &row, 1);
+	}
+	jpeg_finish_compress(&c);
+	jpeg_destroy_compress(&c);
+	return 0;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"unsafe"
+)
+
+const mozjpegBuilt = true
+
+// encodeMozJPEG encodes img (already flattened, so opaque) with mozjpeg, at
+// dpi if it's more than 0
+func encodeMozJPEG(w io.Writer, img image.Image, quality, dpi int) error {
+	b := img.Bounds()
+	if b.Empty() {
+		return errors.New("Can't encode an empty image")
+	}
+	rgb := make([]byte, 3*b.Dx()*b.Dy())
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			rgb[i], rgb[i+1], rgb[i+2] = byte(r>>8), byte(g>>8), byte(bl>>8)
+			i += 3
+		}
+	}
+
+	pix := C.CBytes(rgb)
+	defer C.free(pix)
+	var out *C.uchar
+	var size C.ulong
+	var msg [C.JMSG_LENGTH_MAX]C.char
+	failed := C.encode_mozjpeg((*C.uchar)(pix), C.int(b.Dx()), C.int(b.Dy()), C.int(quality), C.int(dpi), &out, &size, &msg[0])
+	if out != nil {
+		defer C.free(unsafe.Pointer(out))
+	}
+	if failed != 0 {
+		return fmt.Errorf("Could not encode with mozjpeg: %s", C.GoString(&msg[0]))
+	}
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(out), C.int(size)))
+	return err
+}
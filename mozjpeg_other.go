@@ -0,0 +1,15 @@
+//go:build !mozjpeg || !cgo
+// +build !mozjpeg !cgo
+
+package main
+
+import (
+	"image"
+	"io"
+)
+
+const mozjpegBuilt = false
+
+func encodeMozJPEG(w io.Writer, img image.Image, quality, dpi int) error {
+	return checkEncoder("mozjpeg")
+}
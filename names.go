@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	claimedMu sync.Mutex
+	// claimed are the names in a Storage that outputs are being uploaded as,
+	// by OutputDir, which don't exist there yet
+	claimed = map[string]bool{}
+)
+
+func checkOutputName(t Task) error {
+	switch t.OnCollision {
+	case "", "suffix", "overwrite", "error":
+	default:
+		return fmt.Errorf("Unknown onCollision %q (suffix, overwrite or error)", t.OnCollision)
+	}
+	if t.OutputName != "" && t.OutputDir == "" {
+		return fmt.Errorf("outputName needs an outputDir")
+	}
+	return nil
+}
+
+// outputName is what an output of the task is called where it's published,
+// its OutputName with "{name}" (the source's, without its extension), "{id}"
+// and "{output}" (preview, thumbnail, strip-1, ...) filled in, then ext.
+// Without one it's the local file's random name.
+func outputName(t Task, local, output, ext string) string {
+	if t.OutputName == "" {
+		return filepath.Base(local) + ext
+	}
+	source := t.source
+	if source == "" {
+		source = t.Filename
+	}
+	if _, entry, ok := splitArchive(source); ok {
+		source = entry
+	}
+	source = path.Base(filepath.ToSlash(source))
+	source = strings.TrimSuffix(source, path.Ext(source))
+	// the name is in the result, which is JSON
+	source = strings.ToValidUTF8(source, "_")
+
+	name := strings.NewReplacer("{name}", source, "{id}", strconv.Itoa(t.Id), "{output}", output).Replace(t.OutputName)
+	return name + ext
+}
+
+// freeName is name, unless the task's OutputName already names something
+// that exists and its OnCollision is "suffix" (the default): then the first
+// of "name-1.ext", "name-2.ext" and so on that doesn't. "error" fails with
+// OUTPUT_EXISTS instead, "overwrite" leaves name as it is.
+func freeName(t Task, name string, exists func(string) bool) (string, error) {
+	if t.OutputName == "" || t.OnCollision == "overwrite" || !exists(name) {
+		return name, nil
+	}
+	if t.OnCollision == "error" {
+		return "", &codedError{code: "OUTPUT_EXISTS", msg: fmt.Sprintf("%s already exists", name)}
+	}
+	ext := path.Ext(name)
+	for i := 1; ; i++ {
+		suffixed := strings.TrimSuffix(name, ext) + "-" + strconv.Itoa(i) + ext
+		if !exists(suffixed) {
+			return suffixed, nil
+		}
+	}
+}
+
+// claimName is freeName for a Storage, which can't create a file only if
+// there's nothing there yet: names this process is still uploading as count
+// as taken, until the func returned is called once the upload is done.
+func claimName(t Task, name string, exists func(string) bool) (string, func(), error) {
+	claimedMu.Lock()
+	defer claimedMu.Unlock()
+	key := func(name string) string {
+		return t.OutputDir + "\x00" + name
+	}
+	name, err := freeName(t, name, func(name string) bool {
+		return claimed[key(name)] || exists(name)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	claimed[key(name)] = true
+	return name, func() {
+		claimedMu.Lock()
+		delete(claimed, key(name))
+		claimedMu.Unlock()
+	}, nil
+}
+
+// renameOutput moves a local output to its OutputName, never over another
+// file unless OnCollision is "overwrite". Tasks racing for a name each get
+// their own, as the file is linked there only if there's nothing yet (or,
+// where there are no hard links, a placeholder is made to rename over).
+func renameOutput(t Task, local, name string) (string, error) {
+	if t.OutputName == "" {
+		return local, nil
+	}
+	target := filepath.Join(filepath.Dir(local), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", noSpace(err)
+	}
+	if t.OnCollision == "overwrite" {
+		return target, os.Rename(local, target)
+	}
+	for {
+		free, err := freeName(t, target, func(name string) bool {
+			_, err := os.Lstat(name)
+			return err == nil
+		})
+		if err != nil {
+			return "", err
+		}
+		err = os.Link(local, free)
+		if os.IsExist(err) {
+			// taken since it was checked
+			continue
+		} else if err == nil {
+			os.Remove(local)
+			return free, nil
+		}
+
+		placeholder, err := os.OpenFile(free, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		placeholder.Close()
+		if err := os.Rename(local, free); err != nil {
+			os.Remove(free)
+			return "", err
+		}
+		return free, nil
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFreeName(t *testing.T) {
+	taken := map[string]bool{"a.jpg": true, "a-1.jpg": true, "b": true}
+	exists := func(name string) bool { return taken[name] }
+
+	tests := []struct {
+		name    string
+		t       Task
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{"free", Task{OutputName: "x"}, "c.jpg", "c.jpg", false},
+		{"suffixed", Task{OutputName: "x"}, "a.jpg", "a-2.jpg", false},
+		{"suffixed without an extension", Task{OutputName: "x"}, "b", "b-1", false},
+		{"overwritten", Task{OutputName: "x", OnCollision: "overwrite"}, "a.jpg", "a.jpg", false},
+		{"an error", Task{OutputName: "x", OnCollision: "error"}, "a.jpg", "", true},
+		// random names never collide
+		{"no OutputName", Task{}, "a.jpg", "a.jpg", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := freeName(tt.t, tt.output, exists)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("freeName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("freeName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimName(t *testing.T) {
+	none := func(string) bool { return false }
+	task := Task{OutputName: "x", OutputDir: "s3://bucket"}
+
+	first, releaseFirst, err := claimName(task, "a.jpg", none)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, releaseSecond, err := claimName(task, "a.jpg", none)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, releaseOther, err := claimName(Task{OutputName: "x", OutputDir: "s3://other"}, "a.jpg", none)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer releaseOther()
+
+	tests := []struct {
+		name      string
+		got, want string
+	}{
+		{"first", first, "a.jpg"},
+		{"while the first uploads", second, "a-1.jpg"},
+		{"in another OutputDir", other, "a.jpg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("claimName() = %q, want %q", tt.got, tt.want)
+			}
+		})
+	}
+
+	releaseFirst()
+	releaseSecond()
+	if again, release, _ := claimName(task, "a.jpg", none); again != "a.jpg" {
+		t.Errorf("claimName() once released = %q, want a.jpg", again)
+	} else {
+		release()
+	}
+}
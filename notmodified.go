@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+)
+
+// maxUnchanged is how many results are kept for NOT_MODIFIED to refer to
+const maxUnchanged = 10000
+
+var (
+	unchangedMu sync.Mutex
+	// unchanged are the latest results by owner and token, unchangedOrder
+	// when each was kept, oldest first
+	unchanged      = map[string]previousResult{}
+	unchangedOrder []keptResult
+	unchangedSeq   int
+)
+
+type previousResult struct {
+	id   int
+	resp Resp
+	seq  int
+}
+
+// keptResult is a result kept in unchanged, unless a newer one of the same
+// key (with a later seq) replaced it
+type keptResult struct {
+	key string
+	seq int
+}
+
+func unchangedKey(t Task, token string) string {
+	return t.owner + "\x00" + token
+}
+
+// rememberResult keeps a task's result, for a later task sending back its
+// token to be pointed at
+func rememberResult(t Task, r TaskResult) {
+	if r.Response.Token == "" {
+		return
+	}
+	unchangedMu.Lock()
+	defer unchangedMu.Unlock()
+	key := unchangedKey(t, r.Response.Token)
+	unchangedSeq++
+	unchanged[key] = previousResult{r.Id, r.Response, unchangedSeq}
+	unchangedOrder = append(unchangedOrder, keptResult{key, unchangedSeq})
+	for len(unchangedOrder) > maxUnchanged {
+		oldest := unchangedOrder[0]
+		unchangedOrder = unchangedOrder[1:]
+		if unchanged[oldest.key].seq == oldest.seq {
+			delete(unchanged, oldest.key)
+		}
+	}
+}
+
+// notModified is the NOT_MODIFIED result of a task whose source matches its
+// IfUnchangedToken: the last result of the source (as its client), with
+// Previous its task's id, if it's still known here. Its outputs are gone if
+// -outputTTL removed them.
+func notModified(t Task, token string) TaskResult {
+	r := TaskResult{Id: t.Id, Code: "NOT_MODIFIED", Response: Resp{Token: token}}
+	unchangedMu.Lock()
+	defer unchangedMu.Unlock()
+	if p, ok := unchanged[unchangedKey(t, token)]; ok {
+		id := p.id
+		r.Response, r.Previous = p.resp, &id
+	}
+	return r
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestNotModified(t *testing.T) {
+	defer func() { unchanged, unchangedOrder = map[string]previousResult{}, nil }()
+	unchanged, unchangedOrder = map[string]previousResult{}, nil
+
+	alice, bob := Task{owner: "key alice"}, Task{owner: "key bob"}
+	rememberResult(alice, TaskResult{Id: 1, Response: Resp{Preview: "old.jpg", Token: "abc"}})
+	rememberResult(alice, TaskResult{Id: 2, Response: Resp{Preview: "new.jpg", Token: "abc"}})
+	rememberResult(alice, TaskResult{Id: 3, Response: Resp{Preview: "other.jpg"}})
+
+	tests := []struct {
+		name        string
+		t           Task
+		token       string
+		wantPrev    int
+		wantPreview string
+	}{
+		{"the latest", alice, "abc", 2, "new.jpg"},
+		{"another client's", bob, "abc", 0, ""},
+		{"never seen", alice, "def", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := notModified(tt.t, tt.token)
+			if r.Code != "NOT_MODIFIED" || r.Response.Token != tt.token {
+				t.Errorf("notModified() = %s with token %q", r.Code, r.Response.Token)
+			}
+			prev := 0
+			if r.Previous != nil {
+				prev = *r.Previous
+			}
+			if prev != tt.wantPrev || r.Response.Preview != tt.wantPreview {
+				t.Errorf("notModified() previous = %d, %q, want %d, %q", prev, r.Response.Preview, tt.wantPrev, tt.wantPreview)
+			}
+		})
+	}
+}
+
+func TestRememberResultEvicts(t *testing.T) {
+	defer func() { unchanged, unchangedOrder = map[string]previousResult{}, nil }()
+	unchanged, unchangedOrder = map[string]previousResult{}, nil
+
+	task := Task{owner: "key alice"}
+	rememberResult(task, TaskResult{Id: 0, Response: Resp{Token: "first"}})
+	for i := 1; i < maxUnchanged; i++ {
+		rememberResult(task, TaskResult{Id: i, Response: Resp{Token: strconv.Itoa(i)}})
+	}
+	// kept again, so it's no longer the oldest
+	rememberResult(task, TaskResult{Id: 0, Response: Resp{Token: "first"}})
+	rememberResult(task, TaskResult{Id: maxUnchanged, Response: Resp{Token: "last"}})
+
+	if len(unchangedOrder) > maxUnchanged || len(unchanged) > maxUnchanged {
+		t.Errorf("kept %d results in order of %d, want at most %d", len(unchanged), len(unchangedOrder), maxUnchanged)
+	}
+	for _, token := range []string{"first", "last", "2"} {
+		if notModified(task, token).Previous == nil {
+			t.Errorf("%s was evicted", token)
+		}
+	}
+	if notModified(task, "1").Previous != nil {
+		t.Errorf("the oldest wasn't evicted")
+	}
+}
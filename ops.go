@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+)
+
+// Op is one step of a task's pipeline, exactly one of its fields is set, e.g.
+// [{"crop":{...}},{"resize":{"width":1200}},{"sharpen":{"amount":0.5}}]
+type Op struct {
+	Crop      *CropOp      `json:"crop,omitempty"`
+	Resize    *ResizeOp    `json:"resize,omitempty"`
+	Rotate    *RotateOp    `json:"rotate,omitempty"`
+	Sharpen   *SharpenOp   `json:"sharpen,omitempty"`
+	Watermark *WatermarkOp `json:"watermark,omitempty"`
+	Key       *KeyOp       `json:"key,omitempty"`
+}
+
+// CropOp is in pixels of the image as it is at that step
+type CropOp struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ResizeOp keeps the aspect ratio if either side is 0
+type ResizeOp struct {
+	Width  uint   `json:"width"`
+	Height uint   `json:"height"`
+	Filter string `json:"filter"`
+}
+
+// RotateOp turns clockwise by a multiple of 90 degrees
+type RotateOp struct {
+	Degrees int `json:"degrees"`
+}
+
+// SharpenOp is an unsharp mask, Radius is the blur's sigma in pixels
+type SharpenOp struct {
+	Amount float64 `json:"amount"`
+	Radius float64 `json:"radius"`
+}
+
+// WatermarkOp overlays an image, scaled to Scale of the width (if set), in a
+// corner ("topleft", "topright", "bottomleft", "bottomright") or the "center"
+type WatermarkOp struct {
+	File     string  `json:"file"`
+	Position string  `json:"position"`
+	Opacity  float64 `json:"opacity"`
+	Scale    float64 `json:"scale"`
+	Margin   int     `json:"margin"`
+}
+
+// KeyOp makes a solid background transparent: pixels within Tolerance (0-100,
+// as a percentage of the RGB distance) of Color, which is the average of the
+// corners if unset, fading out over Softness more. Only PNG keeps the alpha.
+type KeyOp struct {
+	Color     string  `json:"color"`
+	Tolerance float64 `json:"tolerance"`
+	Softness  float64 `json:"softness"`
+}
+
+var filters = map[string]resize.InterpolationFunction{
+	"":         resize.Bilinear,
+	"nearest":  resize.NearestNeighbor,
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"mitchell": resize.MitchellNetravali,
+	"lanczos2": resize.Lanczos2,
+	"lanczos3": resize.Lanczos3,
+}
+
+// applyOps runs the ops over img in order
+func applyOps(img image.Image, ops []Op, upscale bool) (image.Image, error) {
+	for i, op := range ops {
+		var err error
+		switch {
+		case op.Crop != nil && op.count() == 1:
+			c := op.Crop
+			r := image.Rect(c.X, c.Y, c.X+c.Width, c.Y+c.Height)
+			if r.Empty() || !r.In(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy())) {
+				err = fmt.Errorf("crop %v is outside the %dx%d image", r, img.Bounds().Dx(), img.Bounds().Dy())
+			} else {
+				img = cropImage(img, r)
+			}
+		case op.Resize != nil && op.count() == 1:
+			filter, ok := filters[op.Resize.Filter]
+			if !ok {
+				err = fmt.Errorf("unknown filter %q", op.Resize.Filter)
+			} else if w, h := op.Resize.Width, op.Resize.Height; upscale {
+				img = resize.Resize(w, h, img, filter)
+			} else if w, h = noUpscale(img.Bounds(), w, h); !fits(img.Bounds(), w, h) || (w > 0 && h > 0) {
+				img = resize.Resize(w, h, img, filter)
+			}
+		case op.Rotate != nil && op.count() == 1:
+			img, err = rotate(img, op.Rotate.Degrees)
+		case op.Sharpen != nil && op.count() == 1:
+			img = sharpen(img, op.Sharpen.Amount, op.Sharpen.Radius)
+		case op.Watermark != nil && op.count() == 1:
+			img, err = watermark(img, op.Watermark)
+		case op.Key != nil && op.count() == 1:
+			img, err = key(img, op.Key)
+		default:
+			err = fmt.Errorf("expected exactly one operation")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Op %d: %s", i+1, err)
+		}
+	}
+	return img, nil
+}
+
+// count is how many operations are set, which should be 1
+func (op Op) count() int {
+	n := 0
+	for _, set := range []bool{op.Crop != nil, op.Resize != nil, op.Rotate != nil, op.Sharpen != nil, op.Watermark != nil, op.Key != nil} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+func rotate(img image.Image, degrees int) (image.Image, error) {
+	switch ((degrees % 360) + 360) % 360 {
+	case 0:
+		return img, nil
+	case 90:
+		return orient(img, 6), nil
+	case 180:
+		return orient(img, 3), nil
+	case 270:
+		return orient(img, 8), nil
+	}
+	return nil, fmt.Errorf("can only rotate by multiples of 90 degrees, not %d", degrees)
+}
+
+// sharpen adds amount of the difference between img and a gaussian blur of it
+func sharpen(img image.Image, amount, radius float64) image.Image {
+	if radius <= 0 {
+		radius = 1
+	}
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	blurred := gaussianBlur(src, radius)
+
+	for i := range src.Pix {
+		if i%4 == 3 {
+			continue // leave alpha alone
+		}
+		v := float64(src.Pix[i]) + amount*(float64(src.Pix[i])-float64(blurred.Pix[i]))
+		src.Pix[i] = uint8(clamp(v, 0, 255) + 0.5)
+	}
+	return src
+}
+
+// gaussianBlur blurs horizontally then vertically with a kernel out to 3 sigma
+func gaussianBlur(src *image.RGBA, sigma float64) *image.RGBA {
+	size := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, size*2+1)
+	var total float64
+	for i := range kernel {
+		d := float64(i - size)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		total += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= total
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	pass := func(in *image.RGBA, dx, dy int) *image.RGBA {
+		out := image.NewRGBA(in.Bounds())
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				var sum [4]float64
+				for k, weight := range kernel {
+					sx := clampInt(x+(k-size)*dx, 0, w-1)
+					sy := clampInt(y+(k-size)*dy, 0, h-1)
+					p := in.PixOffset(sx, sy)
+					for c := 0; c < 4; c++ {
+						sum[c] += float64(in.Pix[p+c]) * weight
+					}
+				}
+				p := out.PixOffset(x, y)
+				for c := 0; c < 4; c++ {
+					out.Pix[p+c] = uint8(sum[c] + 0.5)
+				}
+			}
+		}
+		return out
+	}
+
+	return pass(pass(src, 1, 0), 0, 1)
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func watermark(img image.Image, wm *WatermarkOp) (image.Image, error) {
+	f, err := os.Open(wm.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mark, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode watermark %s: %s", wm.File, err)
+	}
+
+	b := img.Bounds()
+	if wm.Scale > 0 {
+		mark = resize.Resize(uint(float64(b.Dx())*wm.Scale), 0, mark, resize.Bilinear)
+	}
+	opacity := wm.Opacity
+	if opacity <= 0 || opacity > 1 {
+		opacity = 1
+	}
+
+	mw, mh := mark.Bounds().Dx(), mark.Bounds().Dy()
+	var at image.Point
+	switch wm.Position {
+	case "topleft":
+		at = image.Pt(wm.Margin, wm.Margin)
+	case "topright":
+		at = image.Pt(b.Dx()-mw-wm.Margin, wm.Margin)
+	case "bottomleft":
+		at = image.Pt(wm.Margin, b.Dy()-mh-wm.Margin)
+	case "center":
+		at = image.Pt((b.Dx()-mw)/2, (b.Dy()-mh)/2)
+	case "", "bottomright":
+		at = image.Pt(b.Dx()-mw-wm.Margin, b.Dy()-mh-wm.Margin)
+	default:
+		return nil, fmt.Errorf("unknown watermark position %q", wm.Position)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	r := image.Rectangle{at, at.Add(image.Pt(mw, mh))}
+	draw.DrawMask(dst, r, mark, mark.Bounds().Min, image.NewUniform(colorAlpha(opacity)), image.ZP, draw.Over)
+	return dst, nil
+}
+
+// key removes the background by its color, see KeyOp
+func key(img image.Image, k *KeyOp) (image.Image, error) {
+	if k.Tolerance < 0 || k.Softness < 0 {
+		return nil, fmt.Errorf("tolerance and softness can't be negative")
+	}
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+	if w == 0 || h == 0 {
+		return dst, nil
+	}
+
+	var bg [3]float64
+	if k.Color != "" {
+		c, err := parseColor(k.Color)
+		if err != nil {
+			return nil, err
+		}
+		bg = [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+	} else {
+		for _, p := range []image.Point{{0, 0}, {w - 1, 0}, {0, h - 1}, {w - 1, h - 1}} {
+			c := dst.NRGBAAt(p.X, p.Y)
+			bg[0] += float64(c.R) / 4
+			bg[1] += float64(c.G) / 4
+			bg[2] += float64(c.B) / 4
+		}
+	}
+
+	// the distance between black and white is 100
+	scale := 100 / math.Sqrt(3*255*255)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dr := float64(dst.Pix[i]) - bg[0]
+		dg := float64(dst.Pix[i+1]) - bg[1]
+		db := float64(dst.Pix[i+2]) - bg[2]
+		d := math.Sqrt(dr*dr+dg*dg+db*db) * scale
+
+		switch {
+		case d <= k.Tolerance:
+			dst.Pix[i+3] = 0
+		case d < k.Tolerance+k.Softness:
+			dst.Pix[i+3] = uint8(float64(dst.Pix[i+3]) * (d - k.Tolerance) / k.Softness)
+		}
+	}
+	return dst, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"math"
+	"os"
+	"strconv"
+)
+
+// panoramaRatio is how many times longer than it is tall (or wide) an image
+// has to be for a task's Panorama policy to apply
+var panoramaRatio float64
+
+// fitSize is the size to resize to, for the task's Sizing: width (0 keeps the
+// aspect ratio) unless it's "longEdge", when width bounds the longer side, or
+// "megapixels", when the preview is about Megapixels whatever its shape (and
+// the thumbnail smaller by as much as -thumbWidth is than -previewWidth), up
+// to -maxMegapixels
+func fitSize(t Task, b image.Rectangle, width uint) (uint, uint) {
+	switch {
+	case t.Sizing == "longEdge" && b.Dy() > b.Dx():
+		return 0, width
+	case t.Sizing == "megapixels" && b.Dx() > 0 && b.Dy() > 0:
+		megapixels := t.Megapixels
+		if maxMegapixels > 0 {
+			megapixels = math.Min(megapixels, maxMegapixels)
+		}
+		scale := float64(width) / float64(previewWidth)
+		pixels := megapixels * 1e6 * scale * scale
+		aspect := float64(b.Dx()) / float64(b.Dy())
+		if w := uint(math.Round(math.Sqrt(pixels * aspect))); w > 0 {
+			return w, 0
+		}
+		return 1, 0
+	}
+	return width, 0
+}
+
+// fits is true if b is no bigger than fitSize's w, h (one of them 0)
+func fits(b image.Rectangle, w, h uint) bool {
+	return (w == 0 || uint(b.Dx()) <= w) && (h == 0 || uint(b.Dy()) <= h)
+}
+
+// allowUpscale is whether renditions, resize ops and print sizes can be
+// bigger than the source, for tasks that don't say
+var allowUpscale bool
+
+func upscales(t Task) bool {
+	if t.AllowUpscale != nil {
+		return *t.AllowUpscale
+	}
+	return allowUpscale
+}
+
+// noUpscale is w, h (either can be 0, for the aspect ratio) shrunk to b's
+// size if they're bigger, keeping their shape
+func noUpscale(b image.Rectangle, w, h uint) (uint, uint) {
+	k := 1.0
+	if w > 0 && int(w) > b.Dx() {
+		k = float64(b.Dx()) / float64(w)
+	}
+	if h > 0 && int(h) > b.Dy() {
+		k = math.Min(k, float64(b.Dy())/float64(h))
+	}
+	return uint(math.Round(float64(w) * k)), uint(math.Round(float64(h) * k))
+}
+
+func checkSizing(t Task) error {
+	switch t.Sizing {
+	case "", "width", "longEdge":
+	case "megapixels":
+		if t.Megapixels <= 0 {
+			return fmt.Errorf("Sizing by megapixels needs megapixels, e.g. 2")
+		}
+	default:
+		return fmt.Errorf("Unknown sizing %q (width, longEdge or megapixels)", t.Sizing)
+	}
+	switch t.Panorama {
+	case "", "strip":
+	default:
+		return fmt.Errorf("Unknown panorama %q (strip)", t.Panorama)
+	}
+	return nil
+}
+
+// isPanorama is whether an image is extremely wide
+func isPanorama(b image.Rectangle) bool {
+	return b.Dy() > 0 && float64(b.Dx())/float64(b.Dy()) >= panoramaRatio
+}
+
+// writeStrip renders a panorama as tall as a 3:2 preview would be, cut into
+// -previewWidth wide segments to scroll through, left to right
+func writeStrip(t Task, src image.Image) ([]string, error) {
+	height := previewWidth * 2 / 3
+	strip, err := applyLUT(resize.Resize(0, height, src, resize.Bilinear), t)
+	if err != nil {
+		return nil, err
+	}
+	if t.DisplayP3 {
+		// the source is in P3, the strip goes with the sRGB outputs
+		strip = toSRGB(strip)
+	}
+	b := strip.Bounds()
+
+	var segments []string
+	fail := func(err error) ([]string, error) {
+		for _, s := range segments {
+			unpublishOutput(s)
+		}
+		return nil, err
+	}
+	for x := 0; x < b.Dx(); x += int(previewWidth) {
+		segment := cropImage(strip, image.Rect(x, 0, x+int(previewWidth), b.Dy()))
+
+		f, err := createOutput(t)
+		if err != nil {
+			return fail(err)
+		}
+		err = encodeInSlot(f, segment, t)
+		f.Close()
+		if err != nil {
+			os.Remove(f.Name())
+			return fail(noSpace(err))
+		}
+		location, _, err := publishOutput(t, f.Name(), outputName(t, f.Name(), "strip-"+strconv.Itoa(len(segments)+1), formatExt(t)), formatType(t))
+		if err != nil {
+			os.Remove(f.Name())
+			return fail(err)
+		}
+		segments = append(segments, location)
+	}
+	return segments, nil
+}
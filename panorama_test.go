@@ -0,0 +1,36 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFitSize(t *testing.T) {
+	defer func(p uint, m float64) { previewWidth, maxMegapixels = p, m }(previewWidth, maxMegapixels)
+	previewWidth, maxMegapixels = 1000, 100
+
+	landscape, portrait := image.Rect(0, 0, 6000, 4000), image.Rect(0, 0, 4000, 6000)
+	tests := []struct {
+		name  string
+		t     Task
+		b     image.Rectangle
+		width uint
+		w, h  uint
+	}{
+		{"width", Task{}, portrait, 1000, 1000, 0},
+		{"long edge, landscape", Task{Sizing: "longEdge"}, landscape, 1000, 1000, 0},
+		{"long edge, portrait", Task{Sizing: "longEdge"}, portrait, 1000, 0, 1000},
+		// 2MP at 3:2 is about 1732x1155
+		{"megapixels", Task{Sizing: "megapixels", Megapixels: 2}, landscape, 1000, 1732, 0},
+		{"megapixels, thumbnail", Task{Sizing: "megapixels", Megapixels: 2}, landscape, 200, 346, 0},
+		{"megapixels past -maxMegapixels", Task{Sizing: "megapixels", Megapixels: 1e6}, landscape, 1000, 12247, 0},
+		{"a sliver of a megapixel", Task{Sizing: "megapixels", Megapixels: 1e-9}, landscape, 1000, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w, h := fitSize(tt.t, tt.b, tt.width); w != tt.w || h != tt.h {
+				t.Errorf("fitSize() = %d, %d, want %d, %d", w, h, tt.w, tt.h)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// decodeFilename sets the task's Filename from its FilenameBase64, for names
+// that aren't UTF-8 and so can't be sent as a JSON string
+func decodeFilename(t *Task) error {
+	if t.FilenameBase64 == "" {
+		return nil
+	}
+	name, err := base64.StdEncoding.DecodeString(t.FilenameBase64)
+	if err != nil {
+		return fmt.Errorf("filenameBase64 isn't base64: %s", err)
+	}
+	t.Filename = string(name)
+	return nil
+}
+
+// filenameBase64 is the filename's bytes in base64 if it isn't UTF-8 (which
+// JSON would replace with U+FFFD), so a result can still be matched to it
+func filenameBase64(filename string) string {
+	if utf8.ValidString(filename) {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(filename))
+}
+
+// plainPath is filename, or if it's anything but printable ASCII (or could
+// be taken for an option) a symlink to it in a temp dir that is, until
+// release. dcraw and the other programs run on sources don't all agree with
+// us on how to read a Japanese (or worse, non-UTF-8) name.
+func plainPath(filename string) (string, func(), error) {
+	if isPlain(filename) && !strings.HasPrefix(filename, "-") {
+		return filename, func() {}, nil
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := createTempDir()
+	if err != nil {
+		return "", nil, err
+	}
+	// some of them go by the extension
+	ext := filepath.Ext(filename)
+	if !isPlain(ext) {
+		ext = ""
+	}
+	link := filepath.Join(dir, "source"+ext)
+	if err := os.Symlink(abs, link); err != nil {
+		removeTemp(dir)
+		return "", nil, err
+	}
+	return link, func() { removeTemp(dir) }, nil
+}
+
+func isPlain(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/nfnt/resize"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	placeholderGray = color.RGBA{0xc8, 0xc8, 0xc8, 0xff}
+	placeholderInk  = color.RGBA{0x50, 0x50, 0x50, 0xff}
+)
+
+// placeholderImage stands in for a source that couldn't be decoded: gray,
+// the source's shape (3:2 if even that can't be told) and previewWidth wide,
+// with its filename and why it failed written across it
+func placeholderImage(t Task, cause error) image.Image {
+	w, h := sourceSize(t.Filename)
+	if w <= 0 || h <= 0 {
+		w, h = 3, 2
+	}
+	width := int(previewWidth)
+	if width <= 0 {
+		width = 1024
+	}
+	height := width * h / w
+	if height < 1 {
+		height = 1
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{placeholderGray}, image.Point{}, draw.Src)
+
+	lines := []string{filepath.Base(t.Filename)}
+	lines = append(lines, wrapText(cause.Error(), 40)...)
+	text := drawText(lines)
+
+	// the 7x13 font is scaled up (by whole pixels, so it stays crisp) to
+	// most of the width
+	tb := text.Bounds()
+	scale := width * 8 / 10 / tb.Dx()
+	if max := height * 8 / 10 / tb.Dy(); max < scale {
+		scale = max
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	scaled := resize.Resize(uint(tb.Dx()*scale), uint(tb.Dy()*scale), text, resize.NearestNeighbor)
+	sb := scaled.Bounds()
+	at := image.Pt((width-sb.Dx())/2, (height-sb.Dy())/2)
+	draw.Draw(img, sb.Sub(sb.Min).Add(at), scaled, sb.Min, draw.Over)
+	return img
+}
+
+// sourceSize is the width and height a file says it has, 0 if it can't be read
+func sourceSize(filename string) (int, int) {
+	if f, err := os.Open(filename); err == nil {
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err == nil {
+			return config.Width, config.Height
+		}
+	}
+	if raw, err := identify(filename); err == nil {
+		return raw.Width, raw.Height
+	}
+	return 0, 0
+}
+
+// drawText is lines in the basic font, centered, on a transparent image
+func drawText(lines []string) image.Image {
+	face := basicfont.Face7x13
+	var width int
+	for _, line := range lines {
+		if w := font.MeasureString(face, line).Ceil(); w > width {
+			width = w
+		}
+	}
+	height := face.Height * len(lines)
+	img := image.NewNRGBA(image.Rect(0, 0, width+2, height+2))
+	d := &font.Drawer{Dst: img, Src: &image.Uniform{placeholderInk}, Face: face}
+	for i, line := range lines {
+		x := (width - font.MeasureString(face, line).Ceil()) / 2
+		d.Dot = fixed.P(1+x, 1+face.Ascent+i*face.Height)
+		d.DrawString(line)
+	}
+	return img
+}
+
+// wrapText breaks s into lines of up to width characters, between words
+func wrapText(s string, width int) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(s) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
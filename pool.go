@@ -0,0 +1,139 @@
+package main
+
+import (
+	runtimedebug "runtime/debug"
+	"sync"
+	"time"
+)
+
+var (
+	minWorkers int
+	maxWorkers int
+	scaleIdle  time.Duration
+)
+
+// workerPool runs tasks on between min and max workers. A worker is started
+// when a task is queued and none are idle, and idle workers past min exit,
+// releasing the memory they held.
+type workerPool struct {
+	min, max int
+	work     func(Task) TaskResult
+
+	mu      sync.Mutex
+	workers int
+	// idle workers, waiting for a task; only a worker counts itself in or out
+	idle int
+	// latency is a moving average of how long tasks take
+	latency time.Duration
+	// tasks waiting for a worker, on one, and finished, for heartbeats
+	queued, running, completed int
+
+	queue chan poolJob
+}
+
+type poolJob struct {
+	t    Task
+	done chan TaskResult
+}
+
+func newWorkerPool(min, max int, work func(Task) TaskResult) *workerPool {
+	if max < 1 {
+		max = 1
+	}
+	if min > max {
+		min = max
+	}
+	p := &workerPool{min: min, max: max, work: work, queue: make(chan poolJob)}
+	p.mu.Lock()
+	for i := 0; i < min; i++ {
+		p.start()
+	}
+	p.mu.Unlock()
+	return p
+}
+
+// SendWork runs t on a worker, waiting for one if all max are busy
+func (p *workerPool) SendWork(t Task) TaskResult {
+	job := poolJob{t: t, done: make(chan TaskResult, 1)}
+
+	p.mu.Lock()
+	// each queued task is counting on an idle worker
+	p.queued++
+	if p.queued > p.idle && p.workers < p.max {
+		p.start()
+		logf("debug", "Scaled up to %d workers", p.workers)
+	}
+	p.mu.Unlock()
+
+	p.queue <- job
+	return <-job.done
+}
+
+// stats is how many tasks are queued, running and completed
+func (p *workerPool) stats() (queued, running, completed int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queued, p.running, p.completed
+}
+
+// start adds a worker, with p.mu held
+func (p *workerPool) start() {
+	p.workers++
+	p.idle++
+	go p.run()
+}
+
+// idleTimeout is how long a worker past min waits for a task before exiting.
+// Slow tasks arrive in slow bursts, so it's at least a few tasks long.
+func (p *workerPool) idleTimeout() time.Duration {
+	if d := 4 * p.latency; d > scaleIdle {
+		return d
+	}
+	return scaleIdle
+}
+
+func (p *workerPool) run() {
+	for {
+		p.mu.Lock()
+		timeout := p.idleTimeout()
+		p.mu.Unlock()
+
+		select {
+		case job := <-p.queue:
+			p.mu.Lock()
+			p.idle--
+			p.queued--
+			p.running++
+			p.mu.Unlock()
+
+			start := time.Now()
+			job.done <- p.work(job.t)
+
+			p.mu.Lock()
+			p.idle++
+			p.running--
+			p.completed++
+			p.latency = (p.latency*7 + time.Since(start)) / 8
+			p.mu.Unlock()
+
+		case <-time.After(timeout):
+			p.mu.Lock()
+			// with no more idle workers than queued tasks, one is counting on this one
+			if p.workers <= p.min || p.idle <= p.queued {
+				p.mu.Unlock()
+				continue
+			}
+			p.workers--
+			p.idle--
+			workers := p.workers
+			p.mu.Unlock()
+
+			logf("debug", "Scaled down to %d workers", workers)
+			if workers == p.min {
+				// the decoded images are garbage now, hand the memory back
+				runtimedebug.FreeOSMemory()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	prefetch     int
+	downloadKBps int64
+
+	prefetchOnce  sync.Once
+	prefetchSlots chan struct{}
+)
+
+// prefetchTask downloads a remote task's input before handing it to send, so
+// up to -prefetch inputs are ready while the workers are busy with others.
+// The slot is held until a worker takes the task, so fetching never runs
+// further ahead than that.
+func prefetchTask(t Task, send func(Task) TaskResult) TaskResult {
+	if prefetch <= 0 || !isRemote(t.Filename) {
+		return send(t)
+	}
+	prefetchOnce.Do(func() {
+		prefetchSlots = make(chan struct{}, prefetch)
+	})
+
+	prefetchSlots <- struct{}{}
+	var once sync.Once
+	t.release = func() {
+		once.Do(func() { <-prefetchSlots })
+	}
+	defer t.release()
+
+	t, fetched, err := fetchTask(t)
+	if err != nil {
+		r := TaskResult{Id: t.Id}
+		r.setError(err)
+		return r
+	}
+	defer removeTemp(fetched)
+	logTaskf(t.Id, "debug", "Prefetched to %s", fetched)
+
+	return send(t)
+}
+
+// downloads share one rate, reserved a read at a time
+var downloadRate struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+type limitedReader struct {
+	r io.Reader
+}
+
+// limitRate paces r so all downloads together stay within -downloadKBps
+func limitRate(r io.Reader) io.Reader {
+	if downloadKBps <= 0 {
+		return r
+	}
+	return limitedReader{r}
+}
+
+func (l limitedReader) Read(p []byte) (int, error) {
+	// small reads keep the pacing smooth across concurrent downloads
+	if len(p) > 32*1024 {
+		p = p[:32*1024]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		downloadRate.mu.Lock()
+		now := time.Now()
+		if downloadRate.next.Before(now) {
+			// idle time isn't saved up for a burst
+			downloadRate.next = now
+		}
+		downloadRate.next = downloadRate.next.Add(time.Duration(n) * time.Second / time.Duration(downloadKBps*1024))
+		wait := time.Until(downloadRate.next)
+		downloadRate.mu.Unlock()
+		time.Sleep(wait)
+	}
+	return n, err
+}
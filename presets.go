@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	presetsPath string
+
+	// namedPresets are the -presets file's templates, kept as JSON so each
+	// task gets its own copy of their pointer fields
+	namedPresets   map[string]json.RawMessage
+	namedPresetsMu sync.RWMutex
+)
+
+// loadPresets reads -presets, a JSON object of task templates by name, which
+// a task's Preset names. On error the presets already loaded are kept.
+func loadPresets() error {
+	if presetsPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(presetsPath)
+	if err != nil {
+		return fmt.Errorf("Could not read -presets: %s", err)
+	}
+	var loaded map[string]json.RawMessage
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("Could not parse -presets: %s", err)
+	}
+	for name, raw := range loaded {
+		var t Task
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return fmt.Errorf("Could not parse preset %q: %s", name, err)
+		}
+	}
+
+	namedPresetsMu.Lock()
+	namedPresets = loaded
+	namedPresetsMu.Unlock()
+	return nil
+}
+
+// reloadPresets reloads -presets, for SIGHUP and {"op":"reload"}. Queued
+// tasks keep the presets they were read with, later ones get the new ones.
+func reloadPresets() {
+	if presetsPath == "" {
+		logf("warn", "Nothing to reload, -presets is not set")
+		return
+	}
+	if err := loadPresets(); err != nil {
+		logf("error", "%s, keeping the presets already loaded", err)
+		return
+	}
+	logf("info", "Reloaded the presets from %s", presetsPath)
+}
+
+func reloadPresetsOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			reloadPresets()
+		}
+	}()
+}
+
+// applyPreset fills in t from its Preset, with what the task itself sets
+// (input, which t was read from) on top
+func applyPreset(input []byte, t *Task) error {
+	if t.Preset == "" {
+		return nil
+	}
+	preset, err := lookupPreset(t.Preset)
+	if err != nil {
+		return err
+	}
+	if err := unmarshalTask(input, &preset); err != nil {
+		return err
+	}
+	*t = preset
+	return nil
+}
+
+// lookupPreset is the template a preset names, from -presets or built in
+func lookupPreset(name string) (Task, error) {
+	namedPresetsMu.RLock()
+	raw, ok := namedPresets[name]
+	namedPresetsMu.RUnlock()
+
+	var preset Task
+	if ok {
+		err := json.Unmarshal(raw, &preset)
+		return preset, err
+	}
+	if preset, ok = presets[name]; !ok {
+		return Task{}, fmt.Errorf("Unknown preset %q", name)
+	}
+	return preset, nil
+}
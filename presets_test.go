@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestPresetFileTask(t *testing.T) {
+	defer func(p string, named map[string]json.RawMessage) { preset, namedPresets = p, named }(preset, namedPresets)
+	namedPresets = map[string]json.RawMessage{
+		"site": json.RawMessage(`{"format":"png","scores":true,"thumbWidth":120}`),
+	}
+	file := filepath.Join(t.TempDir(), "site.json")
+	if err := ioutil.WriteFile(file, []byte(`{"preset":"site","thumbWidth":80}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		preset     string
+		format     string
+		scores     bool
+		thumbWidth uint
+	}{
+		{"site", "png", true, 120},
+		{"web", "jpeg", false, 0},
+		// the file's own fields over the preset it names
+		{file, "png", true, 80},
+	}
+	for _, tt := range tests {
+		t.Run(tt.preset, func(t *testing.T) {
+			preset = tt.preset
+			template, err := presetTask()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// as "imaging process" hands a file over, and queue reads it
+			data, err := fileTask(template, 1, "missing.jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Task
+			if err := unmarshalTask(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyPreset(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Id != 1 || got.Filename != "missing.jpg" {
+				t.Errorf("task = id %d, filename %q, want 1, missing.jpg", got.Id, got.Filename)
+			}
+			if got.Format != tt.format || got.Scores != tt.scores || got.ThumbWidth != tt.thumbWidth {
+				t.Errorf("task = format %q, scores %v, thumbWidth %d, want %q, %v, %d", got.Format, got.Scores, got.ThumbWidth, tt.format, tt.scores, tt.thumbWidth)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const defaultDPI = 300
+
+// printPixels is the size to resize to for the task's PrintSize, like "4x6in"
+// or "10x15cm" at its DPI: the largest that fits, the box turned to match
+// the image's orientation
+func printPixels(t Task, b image.Rectangle) (uint, uint, error) {
+	s := strings.ToLower(strings.TrimSpace(t.PrintSize))
+	perInch := 1.0
+	switch {
+	case strings.HasSuffix(s, "in"):
+		s = strings.TrimSuffix(s, "in")
+	case strings.HasSuffix(s, "mm"):
+		s, perInch = strings.TrimSuffix(s, "mm"), 25.4
+	case strings.HasSuffix(s, "cm"):
+		s, perInch = strings.TrimSuffix(s, "cm"), 2.54
+	default:
+		return 0, 0, fmt.Errorf("Invalid printSize %q, expected e.g. 4x6in, 10x15cm or 100x150mm", t.PrintSize)
+	}
+	parts := strings.Split(s, "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid printSize %q, expected e.g. 4x6in, 10x15cm or 100x150mm", t.PrintSize)
+	}
+	bw, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	bh, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil || bw <= 0 || bh <= 0 {
+		return 0, 0, fmt.Errorf("Invalid printSize %q, expected e.g. 4x6in, 10x15cm or 100x150mm", t.PrintSize)
+	}
+
+	dpi := float64(t.DPI)
+	if dpi == 0 {
+		dpi = defaultDPI
+	}
+	bw, bh = bw/perInch*dpi, bh/perInch*dpi
+	if (bw > bh) != (b.Dx() > b.Dy()) {
+		bw, bh = bh, bw
+	}
+	scale := math.Min(bw/float64(b.Dx()), bh/float64(b.Dy()))
+	return uint(math.Round(float64(b.Dx()) * scale)), uint(math.Round(float64(b.Dy()) * scale)), nil
+}
+
+// withDPI adds the resolution to an encoded JPEG (a JFIF segment, Go writes
+// none) or PNG (a pHYs chunk, after the IHDR)
+func withDPI(data []byte, format string, dpi int) []byte {
+	if dpi <= 0 {
+		return data
+	}
+	var out bytes.Buffer
+	if format == "png" {
+		// the 8 byte signature, then IHDR's length, type, 13 bytes and CRC
+		const ihdrEnd = 8 + 4 + 4 + 13 + 4
+		if len(data) < ihdrEnd {
+			return data
+		}
+		ppm := uint32(math.Round(float64(dpi) / 0.0254))
+		chunk := make([]byte, 4+9)
+		copy(chunk, "pHYs")
+		binary.BigEndian.PutUint32(chunk[4:], ppm)
+		binary.BigEndian.PutUint32(chunk[8:], ppm)
+		chunk[12] = 1 // meters
+
+		out.Write(data[:ihdrEnd])
+		binary.Write(&out, binary.BigEndian, uint32(9))
+		out.Write(chunk)
+		binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+		out.Write(data[ihdrEnd:])
+		return out.Bytes()
+	}
+
+	if len(data) < 2 {
+		return data
+	}
+	// APP0: length, "JFIF\0", version 1.02, units 1 (dots per inch), x and y
+	// density, and no thumbnail
+	app0 := []byte{0xff, 0xe0, 0, 16, 'J', 'F', 'I', 'F', 0, 1, 2, 1,
+		byte(dpi >> 8), byte(dpi), byte(dpi >> 8), byte(dpi), 0, 0}
+	out.Write(data[:2])
+	out.Write(app0)
+	out.Write(data[2:])
+	return out.Bytes()
+}
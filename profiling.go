@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/profile"
+	"net/http"
+	_ "net/http/pprof"
+)
+
+var (
+	profileMode string
+	profilePath string
+	pprofAddr   string
+)
+
+// startProfiling starts the -profile profiler (whose Stop writes the profile
+// out) and the live -pprof endpoint, if either is set
+func startProfiling() (interface {
+	Stop()
+}, error) {
+	if pprofAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(pprofAddr, nil); err != nil {
+				logf("error", "pprof endpoint stopped: %s", err)
+			}
+		}()
+	}
+
+	var mode func(*profile.Profile)
+	switch profileMode {
+	case "":
+		return nil, nil
+	case "cpu":
+		mode = profile.CPUProfile
+	case "mem":
+		mode = profile.MemProfile
+	case "block":
+		mode = profile.BlockProfile
+	case "mutex":
+		mode = profile.MutexProfile
+	default:
+		return nil, fmt.Errorf("Unknown profile %q (cpu, mem, block or mutex)", profileMode)
+	}
+
+	// quiet, profile's own logging isn't JSON
+	return profile.Start(mode, profile.ProfilePath(profilePath), profile.Quiet), nil
+}
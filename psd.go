@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+)
+
+// PSDs (and PSBs, their large version) keep a flattened composite of every
+// layer after the layers themselves, that's what's decoded here
+func init() {
+	image.RegisterFormat("psd", "8BPS", decodePSD, decodePSDConfig)
+}
+
+// the color modes there's a composite for
+const (
+	psdGray = 1
+	psdRGB  = 3
+	psdCMYK = 4
+)
+
+type psdHeader struct {
+	Signature [4]byte
+	Version   uint16
+	Reserved  [6]byte
+	Channels  uint16
+	Height    uint32
+	Width     uint32
+	Depth     uint16
+	Mode      uint16
+}
+
+func readPSDHeader(r io.Reader) (psdHeader, error) {
+	var h psdHeader
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return h, err
+	}
+	if string(h.Signature[:]) != "8BPS" || (h.Version != 1 && h.Version != 2) {
+		return h, fmt.Errorf("not a PSD")
+	}
+	if h.Depth != 8 && h.Depth != 16 {
+		return h, fmt.Errorf("unsupported PSD depth %d", h.Depth)
+	}
+	switch h.Mode {
+	case psdGray, psdRGB, psdCMYK:
+	default:
+		return h, fmt.Errorf("unsupported PSD color mode %d", h.Mode)
+	}
+	// the format's own limits, PSBs are up to 300,000 pixels a side
+	maxSide := uint32(30000)
+	if h.Version == 2 {
+		maxSide = 300000
+	}
+	if h.Width == 0 || h.Height == 0 || h.Width > maxSide || h.Height > maxSide {
+		return h, fmt.Errorf("bad PSD size %dx%d", h.Width, h.Height)
+	}
+	if need := psdChannels[h.Mode]; h.Channels < uint16(need) || h.Channels > 56 {
+		return h, fmt.Errorf("PSD has %d channels, expected %d to 56", h.Channels, need)
+	}
+	return h, nil
+}
+
+// psdChannels are the channels of each color mode's composite, any after
+// them (alpha and spot colors) aren't
+var psdChannels = map[uint16]int{psdGray: 1, psdRGB: 3, psdCMYK: 4}
+
+func decodePSDConfig(r io.Reader) (image.Config, error) {
+	h, err := readPSDHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.RGBAModel, Width: int(h.Width), Height: int(h.Height)}, nil
+}
+
+func decodePSD(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	h, err := readPSDHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	psb := h.Version == 2
+
+	// skip the color mode data, image resources and layers, to the composite
+	for section := 0; section < 3; section++ {
+		var length uint64
+		if section == 2 && psb {
+			err = binary.Read(br, binary.BigEndian, &length)
+		} else {
+			var l uint32
+			err = binary.Read(br, binary.BigEndian, &l)
+			length = uint64(l)
+		}
+		if err == nil {
+			_, err = io.CopyN(ioutil.Discard, br, int64(length))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not read PSD: %s", err)
+		}
+	}
+
+	var compression uint16
+	if err := binary.Read(br, binary.BigEndian, &compression); err != nil {
+		return nil, err
+	}
+
+	w, height := int(h.Width), int(h.Height)
+	if err := checkPixels(w, height); err != nil {
+		return nil, err
+	}
+	rowBytes := w * int(h.Depth) / 8
+	channels := int(h.Channels)
+	// only the channels of the composite are kept
+	planes := make([][]byte, psdChannels[h.Mode])
+	switch compression {
+	case 0: // raw
+		for c := range planes {
+			planes[c] = make([]byte, rowBytes*height)
+			if _, err := io.ReadFull(br, planes[c]); err != nil {
+				return nil, err
+			}
+		}
+	case 1: // PackBits, each row's length first (for every channel)
+		lengths := make([]uint32, channels*height)
+		for i := range lengths {
+			if psb {
+				err = binary.Read(br, binary.BigEndian, &lengths[i])
+			} else {
+				var l uint16
+				err = binary.Read(br, binary.BigEndian, &l)
+				lengths[i] = uint32(l)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		// at worst PackBits adds a byte for every 128
+		maxPacked := uint32(rowBytes + rowBytes/128 + 1)
+		for c := range planes {
+			planes[c] = make([]byte, 0, rowBytes*height)
+			for y := 0; y < height; y++ {
+				if lengths[c*height+y] > maxPacked {
+					return nil, fmt.Errorf("bad PackBits data")
+				}
+				packed := make([]byte, lengths[c*height+y])
+				if _, err := io.ReadFull(br, packed); err != nil {
+					return nil, err
+				}
+				row, err := unpackBits(packed, rowBytes)
+				if err != nil {
+					return nil, err
+				}
+				planes[c] = append(planes[c], row...)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PSD compression %d", compression)
+	}
+
+	// the most significant byte of 16 bit samples is enough for a preview
+	step := int(h.Depth) / 8
+	sample := func(c, i int) uint8 { return planes[c][i*step] }
+
+	img := image.NewRGBA(image.Rect(0, 0, w, height))
+	for i := 0; i < w*height; i++ {
+		var r, g, b uint8
+		switch h.Mode {
+		case psdGray:
+			r = sample(0, i)
+			g, b = r, r
+		case psdRGB:
+			r, g, b = sample(0, i), sample(1, i), sample(2, i)
+		case psdCMYK:
+			// stored inverted, 255 is no ink
+			r, g, b = color.CMYKToRGB(255-sample(0, i), 255-sample(1, i), 255-sample(2, i), 255-sample(3, i))
+		}
+		img.Pix[i*4], img.Pix[i*4+1], img.Pix[i*4+2], img.Pix[i*4+3] = r, g, b, 0xff
+	}
+	return img, nil
+}
+
+// unpackBits decodes n bytes of PackBits (a PSD row, or a TIFF strip)
+func unpackBits(packed []byte, n int) ([]byte, error) {
+	row := make([]byte, 0, n)
+	for i := 0; i < len(packed) && len(row) < n; {
+		c := int(int8(packed[i]))
+		i++
+		switch {
+		case c >= 0: // c+1 literal bytes
+			if i+c+1 > len(packed) {
+				return nil, fmt.Errorf("bad PackBits data")
+			}
+			row = append(row, packed[i:i+c+1]...)
+			i += c + 1
+		case c > -128: // the next byte 1-c times
+			if i >= len(packed) {
+				return nil, fmt.Errorf("bad PackBits data")
+			}
+			for j := 0; j < 1-c; j++ {
+				row = append(row, packed[i])
+			}
+			i++
+		}
+	}
+	if len(row) != n {
+		return nil, fmt.Errorf("bad PackBits data")
+	}
+	return row, nil
+}
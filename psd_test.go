@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testPSD is a PSD (or for version 2 a PSB) of the header's fields, empty
+// color mode, resource and layer sections, then the composite's compression
+// and data
+func testPSD(version, channels uint16, height, width uint32, compression uint16, data []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("8BPS")
+	binary.Write(&b, binary.BigEndian, version)
+	b.Write(make([]byte, 6))
+	binary.Write(&b, binary.BigEndian, channels)
+	binary.Write(&b, binary.BigEndian, height)
+	binary.Write(&b, binary.BigEndian, width)
+	binary.Write(&b, binary.BigEndian, uint16(8))
+	binary.Write(&b, binary.BigEndian, uint16(psdRGB))
+	b.Write(make([]byte, 4*2))
+	if version == 2 {
+		// a PSB's layer section has an 8 byte length
+		b.Write(make([]byte, 4))
+	}
+	b.Write(make([]byte, 4))
+	binary.Write(&b, binary.BigEndian, compression)
+	b.Write(data)
+	return b.Bytes()
+}
+
+func TestDecodePSD(t *testing.T) {
+	// 2x1 RGB, raw: the red plane, green, then blue
+	raw := []byte{255, 0, 0, 0, 0, 255}
+	// the same with PackBits, each row's length first: 2 literal bytes
+	packed := []byte{0, 3, 0, 3, 0, 3, 1, 255, 0, 1, 0, 0, 1, 0, 255}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"raw", testPSD(1, 3, 1, 2, 0, raw), false},
+		{"packbits", testPSD(1, 3, 1, 2, 1, packed), false},
+		{"alpha channel", testPSD(1, 4, 1, 2, 0, append(raw, 9, 9)), false},
+		{"truncated header", testPSD(1, 3, 1, 2, 0, raw)[:20], true},
+		{"truncated data", testPSD(1, 3, 1, 2, 0, raw[:4]), true},
+		{"no width", testPSD(1, 3, 1, 0, 0, nil), true},
+		{"too wide for a PSD", testPSD(1, 3, 1, 30001, 0, raw), true},
+		{"too few channels", testPSD(1, 2, 1, 2, 0, raw), true},
+		{"too many channels", testPSD(1, 57, 1, 2, 0, raw), true},
+		{"too many pixels", testPSD(2, 3, 100000, 100000, 0, raw), true},
+		{"row longer than PackBits makes", testPSD(1, 3, 1, 2, 1, []byte{0xff, 0xff, 0, 3, 0, 3}), true},
+		{"bad PackBits", testPSD(1, 3, 1, 2, 1, []byte{0, 1, 0, 1, 0, 1, 5, 5, 5}), true},
+		{"unknown compression", testPSD(1, 3, 1, 2, 3, raw), true},
+	}
+	defer func(m float64) { maxMegapixels = m }(maxMegapixels)
+	maxMegapixels = 1000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := decodePSD(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodePSD() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if r, g, b, _ := img.At(0, 0).RGBA(); r>>8 != 255 || g != 0 || b != 0 {
+				t.Errorf("pixel 0 = %d,%d,%d, want red", r>>8, g>>8, b>>8)
+			}
+			if r, g, b, _ := img.At(1, 0).RGBA(); r != 0 || g != 0 || b>>8 != 255 {
+				t.Errorf("pixel 1 = %d,%d,%d, want blue", r>>8, g>>8, b>>8)
+			}
+		})
+	}
+}
+
+func TestUnpackBits(t *testing.T) {
+	tests := []struct {
+		name    string
+		packed  []byte
+		n       int
+		want    []byte
+		wantErr bool
+	}{
+		{"literal", []byte{2, 1, 2, 3}, 3, []byte{1, 2, 3}, false},
+		{"run", []byte{0xfe, 7}, 3, []byte{7, 7, 7}, false},
+		{"no-op", []byte{0x80, 0, 4}, 1, []byte{4}, false},
+		{"literal past the end", []byte{5, 1}, 6, nil, true},
+		{"run past the end", []byte{0xfe}, 3, nil, true},
+		{"short", []byte{0, 1}, 2, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unpackBits(tt.packed, tt.n)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unpackBits() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("unpackBits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// butteraugliPath, if set, scores "butteraugli" perceptual quality
+var butteraugliPath string
+
+// the JPEG qualities perceptual quality picks from, and the default targets:
+// the least SSIM, the most Butteraugli distance
+const (
+	minQuality         = 30
+	maxQuality         = 95
+	defaultSSIM        = 0.985
+	defaultButteraugli = 1.5
+)
+
+func checkQuality(t Task) error {
+	if err := checkEncoder(t.Encoder); err != nil {
+		return err
+	}
+	if t.Quality < 0 || t.Quality > 100 {
+		return fmt.Errorf("Invalid quality %d, expected 1 to 100", t.Quality)
+	}
+	switch t.TargetQuality {
+	case "", "fixed":
+		return nil
+	case "perceptual":
+	default:
+		return fmt.Errorf("Unknown targetQuality %q (fixed or perceptual)", t.TargetQuality)
+	}
+	switch t.QualityMetric {
+	case "", "ssim":
+		if t.QualityTarget < 0 || t.QualityTarget > 1 {
+			return fmt.Errorf("Invalid SSIM qualityTarget %g, expected 0 to 1", t.QualityTarget)
+		}
+	case "butteraugli":
+		if butteraugliPath == "" {
+			return fmt.Errorf("Butteraugli quality needs -butteraugli")
+		}
+		if t.QualityTarget < 0 {
+			return fmt.Errorf("Invalid Butteraugli qualityTarget %g", t.QualityTarget)
+		}
+	default:
+		return fmt.Errorf("Unknown qualityMetric %q (ssim or butteraugli)", t.QualityMetric)
+	}
+	return nil
+}
+
+// jpegQualityFor is the quality to encode img at: the lowest that still
+// looks like img by the task's metric, or the fixed jpegQuality
+func jpegQualityFor(img image.Image, t Task) (int, error) {
+	if t.TargetQuality != "perceptual" {
+		if t.Quality > 0 {
+			return t.Quality, nil
+		}
+		return jpegQuality, nil
+	}
+
+	good := ssimGood(img, t)
+	if t.QualityMetric == "butteraugli" {
+		var done func()
+		var err error
+		if good, done, err = butteraugliGood(img, t); err != nil {
+			return 0, err
+		}
+		defer done()
+	}
+
+	// the scores only get better as the quality goes up
+	lo, hi := minQuality, maxQuality
+	for lo < hi {
+		q := (lo + hi) / 2
+		ok, err := good(q)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			hi = q
+		} else {
+			lo = q + 1
+		}
+	}
+	return lo, nil
+}
+
+// ssimGood is whether img at a quality has at least the target SSIM to img
+func ssimGood(img image.Image, t Task) func(int) (bool, error) {
+	target, encode := t.QualityTarget, encodeJPEG(t)
+	if target == 0 {
+		target = defaultSSIM
+	}
+	ref := toRGBA(img)
+	return func(q int) (bool, error) {
+		var buf bytes.Buffer
+		if err := encode(&buf, img, q); err != nil {
+			return false, err
+		}
+		decoded, err := jpeg.Decode(&buf)
+		if err != nil {
+			return false, err
+		}
+		return ssim(ref, toRGBA(decoded)) >= target, nil
+	}
+}
+
+// butteraugliGood is whether img at a quality is at most the target
+// Butteraugli distance from img, done removes the reference it writes
+func butteraugliGood(img image.Image, t Task) (func(int) (bool, error), func(), error) {
+	target, encode := t.QualityTarget, encodeJPEG(t)
+	if target == 0 {
+		target = defaultButteraugli
+	}
+	ref, err := createTemp("*.png")
+	if err != nil {
+		return nil, nil, err
+	}
+	err = png.Encode(ref, img)
+	ref.Close()
+	if err != nil {
+		removeTemp(ref.Name())
+		return nil, nil, noSpace(err)
+	}
+
+	good := func(q int) (bool, error) {
+		candidate, err := createTemp("*.jpg")
+		if err != nil {
+			return false, err
+		}
+		defer removeTemp(candidate.Name())
+		err = encode(candidate, img, q)
+		candidate.Close()
+		if err != nil {
+			return false, noSpace(err)
+		}
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(butteraugliPath, ref.Name(), candidate.Name())
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		release, err := sandbox(cmd)
+		if err != nil {
+			return false, err
+		}
+		defer release()
+		if err := cmd.Run(); err != nil {
+			return false, fmt.Errorf("butteraugli failed: %s %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		// the distance is the first thing it prints
+		fields := strings.Fields(stdout.String())
+		if len(fields) == 0 {
+			return false, fmt.Errorf("butteraugli printed no distance")
+		}
+		distance, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return false, fmt.Errorf("Could not parse butteraugli's distance %q", fields[0])
+		}
+		return distance <= target, nil
+	}
+	return good, func() { removeTemp(ref.Name()) }, nil
+}
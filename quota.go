@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	clientRate     float64
+	clientBurst    int
+	clientDaily    int
+	clientKeysPath string
+
+	// clientKeys are the API keys tasks must have, with their own limits, if
+	// -clientKeys is set
+	clientKeys map[string]clientLimits
+	clients    = map[string]*clientUsage{}
+	clientsMu  sync.Mutex
+	// clientsSwept is when clients last had its idle entries removed
+	clientsSwept time.Time
+)
+
+// clientLimits are how many tasks a client can send: Rate a second (with
+// bursts of up to Burst) and Daily a UTC day, 0 for no limit. Workers is how
+// many can run at once, OutputDir (a dir or storage URL) is where all of
+// its outputs go and InputDir where its inputs are (OutputDir if unset), and
+// Tenant names it in results and metrics (rather than the key). Keys with
+// the same Tenant share its quota and workers.
+type clientLimits struct {
+	Rate      float64 `json:"rate"`
+	Burst     int     `json:"burst"`
+	Daily     int     `json:"daily"`
+	Workers   int     `json:"workers"`
+	OutputDir string  `json:"outputDir"`
+	InputDir  string  `json:"inputDir"`
+	Tenant    string  `json:"tenant"`
+}
+
+// clientUsage is a client's token bucket, filling at rate up to burst, and
+// its tasks today
+type clientUsage struct {
+	tokens      float64
+	filled      time.Time
+	rate, burst float64
+	day         string
+	today       int
+}
+
+// idle is whether the usage is as good as a new client's, its bucket full
+// again and none of its tasks today
+func (u *clientUsage) idle(now time.Time) bool {
+	if u.day == now.UTC().Format("2006-01-02") && u.today > 0 {
+		return false
+	}
+	return u.rate <= 0 || u.tokens+now.Sub(u.filled).Seconds()*u.rate >= u.burst
+}
+
+// clientOf is who a task's tokens are taken from: its owner with
+// -clientKeys, otherwise the -http client that sent it, as anyone can make
+// up an apiKey
+func clientOf(t Task) string {
+	if clientKeys == nil {
+		return "client " + t.from
+	}
+	return t.owner
+}
+
+func loadClientKeys() error {
+	if clientKeysPath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(clientKeysPath)
+	if err == nil {
+		err = json.Unmarshal(data, &clientKeys)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not read -clientKeys: %s", err)
+	}
+	return nil
+}
+
+// limitsFor are the limits of a task's API key, the flags' unless
+// -clientKeys gives it its own
+func limitsFor(key string) (clientLimits, error) {
+	defaults := clientLimits{Rate: clientRate, Burst: clientBurst, Daily: clientDaily}
+	if clientKeys == nil {
+		return defaults, nil
+	}
+	limits, ok := clientKeys[key]
+	if !ok {
+		return clientLimits{}, &codedError{code: "UNAUTHORIZED", msg: "Unknown apiKey"}
+	}
+	if limits.Burst == 0 {
+		limits.Burst = defaults.Burst
+	}
+	return limits, nil
+}
+
+// admit takes one of the task's client's tokens, or fails with RATE_LIMITED
+// (try again in a moment) or QUOTA_EXCEEDED (try again tomorrow), so one
+// client can't take all of the workers
+func admit(t Task) error {
+	limits, err := limitsFor(t.APIKey)
+	if err != nil || (limits.Rate <= 0 && limits.Daily <= 0) {
+		return err
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	now := time.Now()
+	burst := math.Max(float64(limits.Burst), 1)
+	if now.Sub(clientsSwept) > time.Minute {
+		for client, u := range clients {
+			if u.idle(now) {
+				delete(clients, client)
+			}
+		}
+		clientsSwept = now
+	}
+	u, ok := clients[clientOf(t)]
+	if !ok {
+		u = &clientUsage{tokens: burst, filled: now}
+		clients[clientOf(t)] = u
+	}
+	u.rate, u.burst = limits.Rate, burst
+
+	if day := now.UTC().Format("2006-01-02"); u.day != day {
+		u.day, u.today = day, 0
+	}
+	if limits.Daily > 0 && u.today >= limits.Daily {
+		return &codedError{code: "QUOTA_EXCEEDED", retryable: true, msg: fmt.Sprintf("The daily quota of %d tasks is used up", limits.Daily)}
+	}
+
+	if limits.Rate > 0 {
+		u.tokens = math.Min(burst, u.tokens+now.Sub(u.filled).Seconds()*limits.Rate)
+		u.filled = now
+		if u.tokens < 1 {
+			wait := time.Duration((1 - u.tokens) / limits.Rate * float64(time.Second))
+			return &codedError{
+				code:      "RATE_LIMITED",
+				retryable: true,
+				msg:       fmt.Sprintf("Over the limit of %g tasks a second", limits.Rate),
+				detail:    fmt.Sprintf("retry after %s", wait.Round(time.Millisecond)),
+			}
+		}
+		u.tokens--
+	}
+	u.today++
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdmit(t *testing.T) {
+	defer func(rate float64, burst, daily int, keys map[string]clientLimits) {
+		clientRate, clientBurst, clientDaily, clientKeys = rate, burst, daily, keys
+	}(clientRate, clientBurst, clientDaily, clientKeys)
+	defer func(c map[string]*clientUsage) { clients = c }(clients)
+
+	tests := []struct {
+		name        string
+		rate        float64
+		burst       int
+		daily       int
+		keys        map[string]clientLimits
+		tasks       []Task
+		wantErrCode []string
+	}{
+		{"no limits", 0, 10, 0, nil, []Task{{}, {}, {}}, []string{"", "", ""}},
+		{"burst", 0.001, 2, 0, nil, []Task{{}, {}, {}}, []string{"", "", "RATE_LIMITED"}},
+		{"daily", 0, 10, 2, nil, []Task{{}, {}, {}}, []string{"", "", "QUOTA_EXCEEDED"}},
+		// made up apiKeys don't get a bucket each
+		{"made up keys", 0.001, 1, 0, nil, []Task{{APIKey: "a", from: "1.2.3.4"}, {APIKey: "b", from: "1.2.3.4"}}, []string{"", "RATE_LIMITED"}},
+		{"each client", 0.001, 1, 0, nil, []Task{{from: "1.2.3.4"}, {from: "5.6.7.8"}}, []string{"", ""}},
+		{"each key", 0.001, 1, 0, map[string]clientLimits{"a": {Rate: 0.001}, "b": {Rate: 0.001}},
+			[]Task{{APIKey: "a"}, {APIKey: "b"}, {APIKey: "a"}}, []string{"", "", "RATE_LIMITED"}},
+		{"a tenant's keys", 0.001, 1, 0, map[string]clientLimits{"a": {Rate: 0.001, Tenant: "t"}, "b": {Rate: 0.001, Tenant: "t"}},
+			[]Task{{APIKey: "a"}, {APIKey: "b"}}, []string{"", "RATE_LIMITED"}},
+		{"unknown key", 0, 10, 0, map[string]clientLimits{"a": {}}, []Task{{APIKey: "c"}}, []string{"UNAUTHORIZED"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientRate, clientBurst, clientDaily, clientKeys = tt.rate, tt.burst, tt.daily, tt.keys
+			clients = map[string]*clientUsage{}
+			for i, task := range tt.tasks {
+				err := scopeTask(&task)
+				if err == nil {
+					err = admit(task)
+				}
+				code := ""
+				if c, ok := err.(*codedError); ok {
+					code = c.code
+				} else if err != nil {
+					t.Fatalf("task %d: error = %v, not a codedError", i, err)
+				}
+				if code != tt.wantErrCode[i] {
+					t.Errorf("task %d: error = %v, want %s", i, err, tt.wantErrCode[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClientUsageIdle(t *testing.T) {
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		u    clientUsage
+		want bool
+	}{
+		{"full", clientUsage{tokens: 5, filled: now, rate: 1, burst: 5}, true},
+		{"refilled since", clientUsage{tokens: 0, filled: now.Add(-10 * time.Second), rate: 1, burst: 5}, true},
+		{"refilling", clientUsage{tokens: 0, filled: now.Add(-2 * time.Second), rate: 1, burst: 5}, false},
+		{"tasks today", clientUsage{tokens: 5, filled: now, rate: 1, burst: 5, day: "2026-10-14", today: 3}, false},
+		{"tasks yesterday", clientUsage{tokens: 5, filled: now, rate: 1, burst: 5, day: "2026-10-13", today: 3}, true},
+		{"no rate", clientUsage{day: "2026-10-13"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.u.idle(now); got != tt.want {
+				t.Errorf("idle() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const rawHistogramBins = 16
+
+// RawStats are how a RAW's sensor data is exposed, before white balance, the
+// tone curve and 8 bits can hide (or exaggerate) clipping. By channel, "R",
+// "G" and "B", or "all" for sensors without a Bayer filter.
+type RawStats map[string]*RawChannel
+
+// RawChannel is the percentage of a channel's photosites clipped at the
+// white level (Highlights) or at or below the black level (Shadows), and of
+// them in each of 16 linear bins from black to white
+type RawChannel struct {
+	Highlights float64   `json:"highlights"`
+	Shadows    float64   `json:"shadows"`
+	Histogram  []float64 `json:"histogram"`
+
+	clipped, crushed, count int
+	bins                    [rawHistogramBins]int
+}
+
+// isRawDecode is true if the source was decoded as a RAW
+func isRawDecode(d *Decode) bool {
+	switch d.Strategy {
+	case "embedded", "embeddedInProcess", "dngPreview", "halfSize", "full", "edits":
+		return true
+	}
+	return false
+}
+
+// rawStats reads the RAW's photosites with dcraw, undemosaiced and scaled
+// (but not white balanced) so black is 0 and white 65535
+func rawStats(filename string) (RawStats, error) {
+	raw, err := identify(filename)
+	if err != nil {
+		return nil, err
+	}
+	// dcraw prints the colors of the first 8 rows by 2 columns, some builds
+	// only the first 2 by 2 ("RG/GB")
+	pattern := raw.Fields["Filter pattern"]
+	if len(pattern) == 5 && pattern[2] == '/' {
+		pattern = strings.Repeat(pattern[:2]+pattern[3:], 4)
+	}
+	if len(pattern) != 16 {
+		pattern = ""
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(runDcraw([]string{"-c", "-d", "-r", "1", "1", "1", "1", "-4", "-t", "0", filename}, w))
+	}()
+	defer r.Close()
+
+	in := bufio.NewReaderSize(r, 1<<16)
+	var width, height, max int
+	if _, err := fmt.Fscanf(in, "P5\n%d %d\n%d", &width, &height, &max); err != nil {
+		return nil, fmt.Errorf("Could not read dcraw's raw data: %s", err)
+	}
+	if _, err := in.ReadByte(); err != nil || max != 65535 {
+		return nil, fmt.Errorf("Could not read dcraw's raw data: not 16 bit")
+	}
+
+	// the channel of each photosite, by its row % 8 and column % 2
+	stats := RawStats{}
+	var channels [16]*RawChannel
+	for i := range channels {
+		name := "all"
+		if pattern != "" {
+			name = pattern[i : i+1]
+		}
+		if stats[name] == nil {
+			stats[name] = &RawChannel{}
+		}
+		channels[i] = stats[name]
+	}
+	row := make([]byte, width*2)
+	for y := 0; y < height; y++ {
+		if _, err := io.ReadFull(in, row); err != nil {
+			return nil, fmt.Errorf("Could not read dcraw's raw data: %s", err)
+		}
+		for x := 0; x < width; x++ {
+			c := channels[(y%8)*2+x%2]
+			v := int(row[x*2])<<8 | int(row[x*2+1])
+			c.count++
+			if v >= 65535 {
+				c.clipped++
+			} else if v == 0 {
+				c.crushed++
+			}
+			c.bins[v*rawHistogramBins/65536]++
+		}
+	}
+
+	for _, c := range stats {
+		n := float64(c.count)
+		c.Highlights = float64(c.clipped) * 100 / n
+		c.Shadows = float64(c.crushed) * 100 / n
+		c.Histogram = make([]float64, rawHistogramBins)
+		for i, b := range c.bins {
+			c.Histogram[i] = float64(b) * 100 / n
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/go-redis/redis"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	redisURL      string
+	redisTasks    string
+	redisResults  string
+	redisGroup    string
+	redisConsumer string
+)
+
+// redisWriter pushes each result line onto a list, or adds it to a stream
+// when a consumer group is used
+type redisWriter struct {
+	client *redis.Client
+}
+
+func (w *redisWriter) Write(p []byte) (int, error) {
+	line := string(p)
+	if encoding != "msgpack" {
+		line = string(bytes.TrimSuffix(p, []byte("\n")))
+	}
+	var err error
+	if redisGroup != "" {
+		err = w.client.XAdd(&redis.XAddArgs{
+			Stream: redisResults,
+			Values: map[string]interface{}{"result": line},
+		}).Err()
+	} else {
+		err = w.client.RPush(redisResults, line).Err()
+	}
+	return len(p), err
+}
+
+func openRedis() (*redis.Client, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping().Err(); err != nil {
+		return nil, fmt.Errorf("Could not connect to redis: %s", err)
+	}
+
+	if redisGroup != "" {
+		if redisConsumer == "" {
+			host, _ := os.Hostname()
+			redisConsumer = fmt.Sprintf("%s-%d", host, os.Getpid())
+		}
+		err := client.XGroupCreateMkStream(redisTasks, redisGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil, fmt.Errorf("Could not create consumer group: %s", err)
+		}
+	}
+
+	return client, nil
+}
+
+// readRedis hands each task to handle until redis fails, along with a func
+// to acknowledge it once its result is pushed. Only as many tasks as there
+// are workers are taken at once, leaving the rest for other consumers.
+func readRedis(client *redis.Client, handle func(task []byte, ack func())) error {
+	taken := make(chan struct{}, numWorkers)
+
+	if redisGroup == "" {
+		for {
+			taken <- struct{}{}
+			// a list has no acknowledgement, popping the task is taking it
+			kv, err := client.BLPop(0, redisTasks).Result()
+			if err == redis.Nil {
+				<-taken
+				continue
+			} else if err != nil {
+				return err
+			}
+			handle([]byte(kv[1]), func() { <-taken })
+		}
+	}
+
+	// tasks this consumer was given but never acknowledged (it crashed
+	// before pushing their results) are paged through first, then new ones
+	start := "0"
+	for {
+		taken <- struct{}{}
+		streams, err := client.XReadGroup(&redis.XReadGroupArgs{
+			Group:    redisGroup,
+			Consumer: redisConsumer,
+			Streams:  []string{redisTasks, start},
+			Count:    1,
+			Block:    5 * time.Second,
+		}).Result()
+		if err == redis.Nil {
+			<-taken
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		var messages []redis.XMessage
+		for _, s := range streams {
+			messages = append(messages, s.Messages...)
+		}
+		if len(messages) == 0 {
+			start = ">"
+			<-taken
+			continue
+		}
+
+		m := messages[0]
+		if start != ">" {
+			start = m.ID
+		}
+		task, _ := m.Values["task"].(string)
+		handle([]byte(task), func() {
+			if err := client.XAck(redisTasks, redisGroup, m.ID).Err(); err != nil {
+				logf("error", "Could not acknowledge task %s: %s", m.ID, err)
+			}
+			<-taken
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var exiftoolPath string
+
+// Region is where the camera focused, or found a face, normalized to the
+// upright image: 0,0 is the top left and 1,1 the bottom right. A focus point
+// without an area has no width or height.
+type Region struct {
+	Type   string  `json:"type"`
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// the tags exiftool is asked for, from EXIF and the maker notes that have them
+var regionTags = []string{
+	"Orientation", "ExifImageWidth", "ExifImageHeight", "ImageWidth", "ImageHeight",
+	"SubjectArea",
+	// Canon
+	"AFImageWidth", "AFImageHeight", "AFAreaWidths", "AFAreaHeights",
+	"AFAreaXPositions", "AFAreaYPositions", "AFPointsInFocus",
+	// Nikon
+	"AFAreaXPosition", "AFAreaYPosition", "AFAreaWidth", "AFAreaHeight",
+	// Sony
+	"FocusLocation",
+	// Fujifilm
+	"FocusPixel", "FacePositions",
+}
+
+// exifNumbers reads a numeric (or space separated numbers) exiftool value
+func exifNumbers(v interface{}) []float64 {
+	switch v := v.(type) {
+	case float64:
+		return []float64{v}
+	case string:
+		var nums []float64
+		for _, field := range strings.Fields(v) {
+			if f, err := strconv.ParseFloat(field, 64); err == nil {
+				nums = append(nums, f)
+			}
+		}
+		return nums
+	}
+	return nil
+}
+
+// focusRegions reads the focus points and faces recorded by the camera
+func focusRegions(filename string) ([]Region, error) {
+	if exiftoolPath == "" {
+		return nil, fmt.Errorf("Regions requested but -exiftool is not set")
+	}
+
+	args := []string{"-j", "-n"}
+	for _, tag := range regionTags {
+		args = append(args, "-"+tag)
+	}
+	source, unlink, err := plainPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer unlink()
+	cmd := exec.Command(exiftoolPath, append(args, source)...)
+	release, err := sandbox(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("exiftool failed: %s", err)
+	}
+	var tags []map[string]interface{}
+	if err := json.Unmarshal(out, &tags); err != nil || len(tags) == 0 {
+		return nil, fmt.Errorf("Could not read exiftool output: %s", err)
+	}
+	get := func(name string) []float64 { return exifNumbers(tags[0][name]) }
+	first := func(names ...string) float64 {
+		for _, name := range names {
+			if v := get(name); len(v) > 0 && v[0] > 0 {
+				return v[0]
+			}
+		}
+		return 0
+	}
+
+	var regions []Region
+	// add takes a rectangle in pixels of a w x h (unturned) image
+	add := func(kind string, x, y, rw, rh, w, h float64) {
+		if w > 0 && h > 0 {
+			regions = append(regions, Region{kind, x / w, y / h, rw / w, rh / h})
+		}
+	}
+	width := first("ExifImageWidth", "ImageWidth")
+	height := first("ExifImageHeight", "ImageHeight")
+
+	// EXIF: a point, a circle (x, y, diameter) or a rectangle (x, y, w, h) by its center
+	switch area := get("SubjectArea"); len(area) {
+	case 2:
+		add("focus", area[0], area[1], 0, 0, width, height)
+	case 3:
+		add("focus", area[0]-area[2]/2, area[1]-area[2]/2, area[2], area[2], width, height)
+	case 4:
+		add("focus", area[0]-area[2]/2, area[1]-area[3]/2, area[2], area[3], width, height)
+	}
+
+	// Canon: every AF area relative to the center (y is up), and a bitmask of
+	// which were in focus
+	aw, ah := first("AFImageWidth"), first("AFImageHeight")
+	widths, heights := get("AFAreaWidths"), get("AFAreaHeights")
+	xs, ys := get("AFAreaXPositions"), get("AFAreaYPositions")
+	inFocus := get("AFPointsInFocus")
+	for i := range xs {
+		word := i / 16
+		if i >= len(ys) || i >= len(widths) || i >= len(heights) || word >= len(inFocus) {
+			break
+		}
+		if int(inFocus[word])&(1<<uint(i%16)) == 0 {
+			continue
+		}
+		add("focus", aw/2+xs[i]-widths[i]/2, ah/2-ys[i]-heights[i]/2, widths[i], heights[i], aw, ah)
+	}
+
+	// Nikon: the AF area by its center
+	nx, ny := get("AFAreaXPosition"), get("AFAreaYPosition")
+	nw, nh := first("AFAreaWidth"), first("AFAreaHeight")
+	if len(nx) > 0 && len(ny) > 0 && len(xs) == 0 {
+		add("focus", nx[0]-nw/2, ny[0]-nh/2, nw, nh, aw, ah)
+	}
+
+	// Sony: the image size, then the focus point
+	if loc := get("FocusLocation"); len(loc) == 4 {
+		add("focus", loc[2], loc[3], 0, 0, loc[0], loc[1])
+	}
+
+	// Fujifilm: the focus point, and each face's left, top, right and bottom
+	if px := get("FocusPixel"); len(px) == 2 {
+		add("focus", px[0], px[1], 0, 0, width, height)
+	}
+	faces := get("FacePositions")
+	for i := 0; i+3 < len(faces); i += 4 {
+		add("face", faces[i], faces[i+1], faces[i+2]-faces[i], faces[i+3]-faces[i+1], width, height)
+	}
+
+	orientation := int(first("Orientation"))
+	for i := range regions {
+		regions[i] = orientRegion(regions[i], orientation)
+	}
+	return regions, nil
+}
+
+// orientRegion is orientRect for a normalized region
+func orientRegion(r Region, orientation int) Region {
+	x0, y0, x1, y1 := r.X, r.Y, r.X+r.Width, r.Y+r.Height
+	switch orientation {
+	case 2:
+		x0, x1 = 1-x1, 1-x0
+	case 3:
+		x0, y0, x1, y1 = 1-x1, 1-y1, 1-x0, 1-y0
+	case 4:
+		y0, y1 = 1-y1, 1-y0
+	case 5:
+		x0, y0, x1, y1 = y0, x0, y1, x1
+	case 6:
+		x0, y0, x1, y1 = 1-y1, x0, 1-y0, x1
+	case 7:
+		x0, y0, x1, y1 = 1-y1, 1-x1, 1-y0, 1-x0
+	case 8:
+		x0, y0, x1, y1 = y0, 1-x1, y1, 1-x0
+	}
+	return Region{r.Type, x0, y0, x1 - x0, y1 - y0}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var renditionWorkers int
+
+// Rendition is another size of the preview, made from the same decode. Width
+// applies like -previewWidth (so by the task's Sizing), Format is the task's
+// if unset, and Name (the width if unset) is its key in the result.
+type Rendition struct {
+	Name   string `json:"name"`
+	Width  uint   `json:"width"`
+	Format string `json:"format"`
+}
+
+func (r Rendition) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return strconv.Itoa(int(r.Width))
+}
+
+func checkRenditions(t Task) error {
+	names := map[string]bool{}
+	for _, r := range t.Renditions {
+		if r.Width == 0 {
+			return fmt.Errorf("Rendition %q needs a width", r.Name)
+		}
+		switch r.Format {
+		case "", "jpeg", "png":
+		default:
+			return fmt.Errorf("Unknown rendition format %q (jpeg or png)", r.Format)
+		}
+		if names[r.name()] {
+			return fmt.Errorf("Rendition %q is there twice", r.name())
+		}
+		names[r.name()] = true
+	}
+	return nil
+}
+
+// writeRenditions resizes and encodes the task's renditions from src, up to
+// -renditionWorkers at once. The ones that fail are in failures by name,
+// removed unless the task is Partial (so it has all of them or none).
+func writeRenditions(t Task, src image.Image) (map[string]string, map[string]error) {
+	locations := make([]string, len(t.Renditions))
+	errs := make([]error, len(t.Renditions))
+
+	workers := renditionWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	slots := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, r := range t.Renditions {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, r Rendition) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			locations[i], errs[i] = writeRendition(t, src, r)
+		}(i, r)
+	}
+	wg.Wait()
+
+	renditions, failures := map[string]string{}, map[string]error{}
+	for i, r := range t.Renditions {
+		if errs[i] != nil {
+			failures[r.name()] = errs[i]
+		} else {
+			renditions[r.name()] = locations[i]
+		}
+	}
+	if len(failures) > 0 && !t.Partial {
+		for _, location := range renditions {
+			unpublishOutput(location)
+		}
+		return nil, failures
+	}
+	return renditions, failures
+}
+
+func writeRendition(t Task, src image.Image, r Rendition) (string, error) {
+	w, h := fitSize(t, src.Bounds(), r.Width)
+	img := src
+	if upscales(t) || !fits(src.Bounds(), w, h) {
+		img = resize.Resize(w, h, src, resize.Bilinear)
+	}
+	if t.LensCorrection {
+		var err error
+		if img, err = correctLens(t, img); err != nil {
+			return "", err
+		}
+	}
+	img, err := applyLUT(img, t)
+	if err != nil {
+		return "", err
+	}
+	if t.DisplayP3 {
+		// like the strip, renditions go with the sRGB outputs
+		img = toSRGB(img)
+	}
+
+	if r.Format != "" {
+		t.Format = r.Format
+	}
+	f, err := createOutput(t)
+	if err != nil {
+		return "", err
+	}
+	err = encodeInSlot(f, img, t)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", noSpace(err)
+	}
+	location, _, err := publishOutput(t, f.Name(), outputName(t, f.Name(), "rendition-"+r.name(), formatExt(t)), formatType(t))
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return location, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
+	"os"
+	"sync"
+)
+
+var (
+	// -s3Endpoint and the rest point s3:// URLs at MinIO, Ceph RGW or another
+	// S3 compatible service instead of AWS
+	s3Endpoint  string
+	s3Region    string
+	s3PathStyle bool
+	s3CA        string
+
+	// s3Session is made once something is stored in a bucket, configured
+	// the usual AWS way (environment, shared config, instance role)
+	s3Session    *session.Session
+	s3SessionErr error
+	s3Once       sync.Once
+)
+
+// s3Storage is an S3 bucket, "s3://bucket/key"
+type s3Storage struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+func newS3Storage(bucket string) (Storage, error) {
+	s3Once.Do(func() {
+		s3Session, s3SessionErr = openS3Session()
+		if s3SessionErr != nil {
+			s3SessionErr = fmt.Errorf("Could not configure S3: %s", s3SessionErr)
+		}
+	})
+	if s3SessionErr != nil {
+		return nil, s3SessionErr
+	}
+	return &s3Storage{s3.New(s3Session), s3manager.NewUploader(s3Session), bucket}, nil
+}
+
+func openS3Session() (*session.Session, error) {
+	opts := session.Options{SharedConfigState: session.SharedConfigEnable}
+	if s3Endpoint != "" {
+		opts.Config.Endpoint = aws.String(s3Endpoint)
+		// MinIO and the like don't care, but the SDK wants one to sign with
+		if s3Region == "" {
+			s3Region = "us-east-1"
+		}
+	}
+	if s3Region != "" {
+		opts.Config.Region = aws.String(s3Region)
+	}
+	if s3PathStyle {
+		// "host/bucket/key", as virtual hosted buckets need DNS for each
+		opts.Config.S3ForcePathStyle = aws.Bool(true)
+	}
+	if s3CA != "" {
+		ca, err := os.Open(s3CA)
+		if err != nil {
+			return nil, err
+		}
+		defer ca.Close()
+		opts.CustomCABundle = ca
+	}
+	return session.NewSessionWithOptions(opts)
+}
+
+func (s *s3Storage) Open(name string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(name)})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s *s3Storage) Write(name string, r io.Reader, contentType string) error {
+	_, err := s.uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(name),
+		Body:        r,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s *s3Storage) Stat(name string) (StorageInfo, error) {
+	out, err := s.client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(name)})
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Size: aws.Int64Value(out.ContentLength), ModTime: aws.TimeValue(out.LastModified)}, nil
+}
+
+func (s *s3Storage) Remove(name string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(name)})
+	return err
+}
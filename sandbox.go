@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sandboxExec is the hidden subcommand a helper is started through, to
+// confine itself before exec'ing the real program
+const sandboxExec = "sandbox-exec"
+
+var (
+	sandboxHelpers  bool
+	sandboxCPU      int
+	sandboxMemMB    int
+	sandboxFileMB   int
+	sandboxLandlock bool
+	sandboxUid      int
+	sandboxGid      int
+)
+
+// checkSandbox fails rather than run untrusted files through unconfined
+// helpers, when -sandbox can't be had here
+func checkSandbox() error {
+	if sandboxHelpers && !sandboxSupported {
+		return fmt.Errorf("-sandbox is only supported on Linux")
+	}
+	if sandboxHelpers && sandboxLandlock {
+		if err := probeLandlock(); err != nil {
+			return fmt.Errorf("-landlock isn't supported by this kernel: %s", err)
+		}
+	}
+	return nil
+}
+
+// sandbox confines cmd with -sandbox: its own temp dir (for TMPDIR, HOME and
+// the working dir), no network, the resource limits and, with -landlock,
+// writes only to that dir and writable. The caller calls the func returned
+// once cmd is done.
+func sandbox(cmd *exec.Cmd, writable ...string) (func(), error) {
+	if !sandboxHelpers {
+		return func() {}, nil
+	}
+
+	dir, err := createTempDir()
+	if err != nil {
+		return nil, err
+	}
+	if sandboxUid >= 0 {
+		if err := os.Chown(dir, sandboxUid, sandboxGid); err != nil {
+			removeTemp(dir)
+			return nil, fmt.Errorf("Could not hand the sandbox dir to %d: %s", sandboxUid, err)
+		}
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, "TMPDIR="+dir, "TMP="+dir, "TEMP="+dir, "HOME="+dir)
+	// relative paths were relative to our working dir, not the sandbox's
+	if cmd.Path, err = absPath(cmd.Path); err != nil {
+		removeTemp(dir)
+		return nil, err
+	}
+	for i, arg := range cmd.Args[1:] {
+		if !isPathArg(arg) {
+			continue
+		}
+		if cmd.Args[i+1], err = absPath(arg); err != nil {
+			removeTemp(dir)
+			return nil, err
+		}
+	}
+	dirs := []string{dir}
+	for _, w := range writable {
+		abs, err := absPath(w)
+		if err != nil {
+			removeTemp(dir)
+			return nil, err
+		}
+		dirs = append(dirs, abs)
+	}
+	cmd.Dir = dir
+
+	if err := confine(cmd, dirs); err != nil {
+		removeTemp(dir)
+		return nil, err
+	}
+	return func() { removeTemp(dir) }, nil
+}
+
+func absPath(path string) (string, error) {
+	if path == "" || filepath.IsAbs(path) {
+		return path, nil
+	}
+	return filepath.Abs(path)
+}
+
+// isPathArg is whether a helper's arg is a relative path: a file or dir that
+// exists, or one to be written in a dir that does
+func isPathArg(arg string) bool {
+	if arg == "" || strings.HasPrefix(arg, "-") || filepath.IsAbs(arg) {
+		return false
+	}
+	if _, err := os.Stat(arg); err == nil {
+		return true
+	}
+	if dir := filepath.Dir(arg); dir != "." {
+		info, err := os.Stat(dir)
+		return err == nil && info.IsDir()
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const sandboxSupported = true
+
+// confine starts cmd through sandboxExec, in new network (and, unless
+// we're root, user) namespaces
+func confine(cmd *exec.Cmd, writable []string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Could not find the imaging binary to sandbox with: %s", err)
+	}
+
+	args := []string{self, sandboxExec,
+		"-cpu", strconv.Itoa(sandboxCPU),
+		"-memMB", strconv.Itoa(sandboxMemMB),
+		"-fileMB", strconv.Itoa(sandboxFileMB),
+	}
+	if sandboxLandlock {
+		args = append(args, "-landlock")
+		for _, dir := range writable {
+			args = append(args, "-write", dir)
+		}
+	}
+	cmd.Args = append(append(args, "--", cmd.Path), cmd.Args[1:]...)
+	cmd.Path = self
+
+	attr := &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNET,
+		// helpers don't outlive us
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if uid, gid := os.Getuid(), os.Getgid(); uid != 0 {
+		// only a user namespace lets us have a network namespace
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	} else if sandboxUid >= 0 {
+		attr.Credential = &syscall.Credential{Uid: uint32(sandboxUid), Gid: uint32(sandboxGid)}
+	}
+	cmd.SysProcAttr = attr
+	return nil
+}
+
+// runSandboxed is sandboxExec: it sets the limits it's given on itself, then
+// becomes the helper, which inherits them
+func runSandboxed(args []string) {
+	fs := flag.NewFlagSet(sandboxExec, flag.ExitOnError)
+	cpu := fs.Int("cpu", 0, "")
+	memMB := fs.Int("memMB", 0, "")
+	fileMB := fs.Int("fileMB", 0, "")
+	landlock := fs.Bool("landlock", false, "")
+	var writable stringList
+	fs.Var(&writable, "write", "")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "sandbox: no program to run")
+		os.Exit(2)
+	}
+
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_CPU, uint64(*cpu)},
+		{syscall.RLIMIT_AS, uint64(*memMB) << 20},
+		{syscall.RLIMIT_FSIZE, uint64(*fileMB) << 20},
+		// no core dumps of untrusted files lying around
+		{syscall.RLIMIT_CORE, 0},
+	}
+	for _, l := range limits {
+		if l.value == 0 && l.resource != syscall.RLIMIT_CORE {
+			continue
+		}
+		if err := syscall.Setrlimit(l.resource, &syscall.Rlimit{Cur: l.value, Max: l.value}); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: could not set rlimit %d: %s\n", l.resource, err)
+			os.Exit(2)
+		}
+	}
+
+	// and no setuid helpers regaining what was dropped
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		fmt.Fprintf(os.Stderr, "sandbox: could not set no_new_privs: %s\n", errno)
+		os.Exit(2)
+	}
+	if *landlock {
+		if err := restrictWrites(writable); err != nil {
+			fmt.Fprintf(os.Stderr, "sandbox: could not apply landlock: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	program := fs.Args()
+	err := syscall.Exec(program[0], program, os.Environ())
+	fmt.Fprintf(os.Stderr, "sandbox: could not run %s: %s\n", program[0], err)
+	os.Exit(2)
+}
+
+// the landlock ABI (v1), which the syscall package doesn't have
+const (
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000
+
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockRulePathBeneath = 1
+
+	landlockWriteFile  = 1 << 1
+	landlockRemoveDir  = 1 << 4
+	landlockRemoveFile = 1 << 5
+	landlockMakeChar   = 1 << 6
+	landlockMakeDir    = 1 << 7
+	landlockMakeReg    = 1 << 8
+	landlockMakeSock   = 1 << 9
+	landlockMakeFifo   = 1 << 10
+	landlockMakeBlock  = 1 << 11
+	landlockMakeSym    = 1 << 12
+
+	landlockWrites = landlockWriteFile | landlockRemoveDir | landlockRemoveFile | landlockMakeChar |
+		landlockMakeDir | landlockMakeReg | landlockMakeSock | landlockMakeFifo | landlockMakeBlock | landlockMakeSym
+)
+
+// probeLandlock asks the kernel for its landlock ABI version, which fails
+// if it has none (or it's disabled)
+func probeLandlock() error {
+	const landlockCreateRulesetVersion = 1 << 0
+	version, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return errno
+	}
+	if version < 1 {
+		return fmt.Errorf("ABI version %d", version)
+	}
+	return nil
+}
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// landlockPathBeneath is packed in the kernel, which reads the first 12 bytes
+type landlockPathBeneath struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// restrictWrites denies this process (and what it execs) writing anywhere but
+// beneath dirs; reads are left alone, as helpers need their libraries
+func restrictWrites(dirs []string) error {
+	attr := landlockRulesetAttr{handledAccessFS: landlockWrites}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock_create_ruleset: %s", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	for _, dir := range dirs {
+		dirFd, err := syscall.Open(dir, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("%s: %s", dir, err)
+		}
+		rule := landlockPathBeneath{allowedAccess: landlockWrites, parentFd: int32(dirFd)}
+		_, _, errno := syscall.Syscall6(sysLandlockAddRule, fd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		syscall.Close(dirFd)
+		if errno != 0 {
+			return fmt.Errorf("landlock_add_rule %s: %s", dir, errno)
+		}
+	}
+
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_restrict_self: %s", errno)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// there are no namespaces or landlock here, checkSandbox refuses -sandbox
+const sandboxSupported = false
+
+func confine(cmd *exec.Cmd, writable []string) error {
+	return errors.New("not supported")
+}
+
+func probeLandlock() error {
+	return errors.New("not supported")
+}
+
+func runSandboxed(args []string) {
+	os.Exit(2)
+}
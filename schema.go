@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+)
+
+// schemaVersion is stamped on every result, event and log line. Bump it when
+// TaskResult changes shape, and keep marshalResult's -compat layouts intact.
+const schemaVersion = 2
+
+var compat string
+
+func checkCompat() error {
+	switch compat {
+	case "", "v2", "v1":
+		return nil
+	}
+	return fmt.Errorf("Unknown -compat %q (v1 or v2)", compat)
+}
+
+// stampSchema is the schemaVersion to put on a line, 0 (omitted) for v1
+func stampSchema() int {
+	if compat == "v1" {
+		return 0
+	}
+	return schemaVersion
+}
+
+// resultV1 is TaskResult as it was before versioning, for -compat v1
+type resultV1 struct {
+	Id       int    `json:"id"`
+	Error    string `json:"error"`
+	Response struct {
+		Preview   string `json:"preview"`
+		Thumbnail string `json:"thumbnail"`
+		Info      *Info  `json:"info,omitempty"`
+	} `json:"response"`
+}
+
+func marshalResult(r TaskResult) ([]byte, error) {
+	if compat == "v1" {
+		v1 := resultV1{Id: r.Id, Error: r.Error}
+		v1.Response.Preview = r.Response.Preview
+		v1.Response.Thumbnail = r.Response.Thumbnail
+		v1.Response.Info = r.Response.Info
+		return marshal(v1)
+	}
+
+	r.SchemaVersion = schemaVersion
+	return marshal(r)
+}
+
+// resultRecord is r marshalled, or if it can't be (its Meta, say) an
+// ENCODE_FAILED result of the same task, so the client still hears of it in
+// the encoding it reads. It's the result it marshalled.
+func resultRecord(r TaskResult) (TaskResult, []byte, error) {
+	rBytes, err := marshalResult(r)
+	if err == nil {
+		return r, rBytes, nil
+	}
+	logTaskf(r.Id, "error", "Could not marshal task result: %s", err)
+	failed := TaskResult{Id: r.Id, Tenant: r.Tenant, owner: r.owner}
+	failed.setError(&codedError{code: "ENCODE_FAILED", msg: "Could not encode the result: " + err.Error()})
+	rBytes, err = marshalResult(failed)
+	return failed, rBytes, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+)
+
+// Scores are rough quality heuristics for culling, computed on the preview
+type Scores struct {
+	// Sharpness is the variance of the Laplacian of the luma, higher is sharper
+	Sharpness float64 `json:"sharpness"`
+	// OverExposed and UnderExposed are the percentage of (nearly) clipped pixels
+	OverExposed  float64 `json:"overExposed"`
+	UnderExposed float64 `json:"underExposed"`
+	// Eyes is the sharpness of where eyes would be in the camera's faces,
+	// for comparing the frames of a burst (closed eyes have less detail)
+	Eyes *float64 `json:"eyes,omitempty"`
+}
+
+func computeScores(img image.Image) *Scores {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w < 3 || h < 3 {
+		return &Scores{}
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, w, h))
+	draw.Draw(gray, gray.Bounds(), img, b.Min, draw.Src)
+
+	s := &Scores{}
+	for _, y := range gray.Pix {
+		if y >= 250 {
+			s.OverExposed++
+		} else if y <= 5 {
+			s.UnderExposed++
+		}
+	}
+	s.OverExposed = s.OverExposed * 100 / float64(len(gray.Pix))
+	s.UnderExposed = s.UnderExposed * 100 / float64(len(gray.Pix))
+
+	s.Sharpness = laplacianVariance(gray, gray.Bounds())
+
+	return s
+}
+
+// laplacianVariance is the variance of the 4-neighbour Laplacian over the
+// interior of r
+func laplacianVariance(gray *image.Gray, r image.Rectangle) float64 {
+	r = r.Intersect(gray.Bounds())
+	if r.Dx() < 3 || r.Dy() < 3 {
+		return 0
+	}
+	var sum, sumSq float64
+	n := float64((r.Dx() - 2) * (r.Dy() - 2))
+	for y := r.Min.Y + 1; y < r.Max.Y-1; y++ {
+		row := gray.PixOffset(0, y)
+		for x := r.Min.X + 1; x < r.Max.X-1; x++ {
+			i := row + x
+			l := float64(gray.Pix[i-1]) + float64(gray.Pix[i+1]) +
+				float64(gray.Pix[i-gray.Stride]) + float64(gray.Pix[i+gray.Stride]) -
+				4*float64(gray.Pix[i])
+			sum += l
+			sumSq += l * l
+		}
+	}
+	mean := sum / n
+	return sumSq/n - mean*mean
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"sync"
+	"time"
+)
+
+// sessionTTL, if set, keeps decoded sources in memory that long after they
+// were last used, up to sessionCacheMB, so an interactive client cropping
+// and resizing the same source over and over only has it decoded once
+var (
+	sessionTTL     time.Duration
+	sessionCacheMB int64
+
+	sessionMu    sync.Mutex
+	sessions     = map[string]*cachedDecode{}
+	sessionBytes int64
+)
+
+type cachedDecode struct {
+	img    image.Image
+	decode Decode
+	size   int64
+	used   time.Time
+}
+
+// decodeSession is decodeSource, from the session cache if the same source
+// was decoded the same way within -sessionTTL. What's cached is shared, so
+// like everything decoded it's only read from, never drawn on.
+func decodeSession(t Task) (image.Image, error) {
+	if sessionTTL <= 0 || t.token == "" {
+		return decodeSource(t)
+	}
+	key, err := sessionKey(t)
+	if err != nil {
+		return decodeSource(t)
+	}
+
+	sessionMu.Lock()
+	s, ok := sessions[key]
+	if ok {
+		s.used = time.Now()
+	}
+	sessionMu.Unlock()
+	if ok {
+		logTaskf(t.Id, "debug", "Decoded %s earlier this session", t.Filename)
+		if t.decode != nil {
+			*t.decode = s.decode
+		}
+		return s.img, nil
+	}
+
+	img, err := decodeSource(t)
+	if err != nil {
+		return img, err
+	}
+	s = &cachedDecode{img: img, size: imageBytes(img), used: time.Now()}
+	if t.decode != nil {
+		s.decode = *t.decode
+	}
+	if s.size > sessionCacheMB<<20 {
+		return img, nil
+	}
+
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	if _, ok := sessions[key]; ok {
+		// decoded twice at once
+		return img, nil
+	}
+	sessions[key] = s
+	sessionBytes += s.size
+	for sessionBytes > sessionCacheMB<<20 {
+		var oldest string
+		for k, other := range sessions {
+			if oldest == "" || other.used.Before(sessions[oldest].used) {
+				oldest = k
+			}
+		}
+		removeSession(oldest)
+	}
+	expireSession(key, s)
+	return img, nil
+}
+
+// expireSession removes s once it's gone unused for -sessionTTL
+func expireSession(key string, s *cachedDecode) {
+	time.AfterFunc(sessionTTL, func() {
+		sessionMu.Lock()
+		defer sessionMu.Unlock()
+		if sessions[key] != s {
+			return
+		}
+		if left := sessionTTL - time.Since(s.used); left > 0 {
+			time.AfterFunc(left, func() { expireSession(key, s) })
+			return
+		}
+		removeSession(key)
+	})
+}
+
+func removeSession(key string) {
+	sessionBytes -= sessions[key].size
+	delete(sessions, key)
+}
+
+// sessionKey is the source's hash and the task less what's done after the
+// decode: the crop, size, format and so on, which the client adjusts
+func sessionKey(t Task) (string, error) {
+	k := t
+	k.Id, k.Meta, k.GroupId, k.GroupSize, k.Priority, k.APIKey = 0, nil, "", 0, "", ""
+	if k.source != "" {
+		k.Filename = k.source
+	}
+	// whether there are any ops matters, the decode scales for their absence
+	if len(k.Ops) > 0 {
+		k.Ops = []Op{}
+	}
+	k.Format, k.Background, k.Quality, k.Encoder = "", "", 0, ""
+	k.TargetQuality, k.QualityMetric, k.QualityTarget = "", "", 0
+	k.LUT, k.Trim, k.TrimTolerance, k.ThumbStyle, k.ThumbFilter = "", false, 0, nil, ""
+	k.OutputDir, k.FileMode, k.Uid, k.Gid, k.OutputName, k.OnCollision = "", "", nil, nil, "", ""
+	k.CaptureMtime, k.DateFolders, k.IfUnchangedToken = false, false, ""
+	data, err := json.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(t.token+"\n"), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// imageBytes is about how much memory img takes up
+func imageBytes(img image.Image) int64 {
+	b := img.Bounds()
+	perPixel := int64(4)
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64:
+		perPixel = 8
+	case *image.Gray:
+		perPixel = 1
+	case *image.Gray16:
+		perPixel = 2
+	}
+	return int64(b.Dx()) * int64(b.Dy()) * perPixel
+}
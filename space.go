@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+var (
+	// minFreeMB is the space the temp dir and OutputDir need to take a task
+	minFreeMB    uint64
+	pauseOnSpace bool
+)
+
+// checkSpace fails with NO_SPACE if the task's temp or output dir is low, so
+// it's failed before a truncated JPEG is written, rather than after
+func checkSpace(t Task) error {
+	dirs := []string{os.TempDir()}
+	if t.OutputDir != "" {
+		dirs = append(dirs, t.OutputDir)
+	}
+	for _, dir := range dirs {
+		if err := checkDirSpace(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkDirSpace(dir string) error {
+	if minFreeMB == 0 {
+		return nil
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		// not knowing is no reason to fail the task, writing will tell
+		return nil
+	}
+	if free < minFreeMB<<20 {
+		return &codedError{
+			code:      "NO_SPACE",
+			retryable: true,
+			msg:       fmt.Sprintf("Only %dMB free in %s, -minFreeMB is %d", free>>20, dir, minFreeMB),
+		}
+	}
+	return nil
+}
+
+// waitForSpace holds up taking tasks, with -pauseOnSpace, while the temp dir
+// is low (each task's OutputDir is still checked once it's taken)
+func waitForSpace() {
+	if !pauseOnSpace {
+		return
+	}
+	logged := false
+	for checkDirSpace(os.TempDir()) != nil {
+		if !logged {
+			logf("warn", "Pausing intake until %s has %dMB free", os.TempDir(), minFreeMB)
+			logged = true
+		}
+		time.Sleep(5 * time.Second)
+	}
+	if logged {
+		logf("info", "Resuming intake")
+	}
+}
+
+// noSpace turns a write that ran out of space into a NO_SPACE error
+func noSpace(err error) error {
+	if errors.Is(err, syscall.ENOSPC) {
+		return &codedError{code: "NO_SPACE", retryable: true, msg: err.Error()}
+	}
+	return err
+}
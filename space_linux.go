@@ -0,0 +1,12 @@
+package main
+
+import "syscall"
+
+// freeSpace is the bytes available to us (not root) on dir's filesystem
+func freeSpace(dir string) (uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, err
+	}
+	return fs.Bavail * uint64(fs.Bsize), nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+// freeSpace can't tell on this OS, so -minFreeMB isn't checked
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("not supported")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/nfnt/resize"
+	"image"
+	"image/draw"
+	"math"
+	"os"
+)
+
+// SpriteMap is where each of a "sprite" task's thumbnails is in the sheet,
+// written next to it as JSON
+type SpriteMap struct {
+	Width   int          `json:"width"`
+	Height  int          `json:"height"`
+	Sprites []SpriteCell `json:"sprites"`
+}
+
+type SpriteCell struct {
+	Filename string `json:"filename"`
+	X        int    `json:"x"`
+	Y        int    `json:"y"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// spriteImage is a "sprite" task: the thumbnails of Files packed into one
+// sheet, a grid of -thumbWidth wide cells SpriteColumns across (about
+// square if unset), so a gallery loads one image rather than hundreds
+func spriteImage(t Task) TaskResult {
+	resp := TaskResult{Id: t.Id}
+	if len(t.Files) == 0 {
+		resp.Error = "A sprite needs files"
+		return resp
+	}
+
+	var thumbs []image.Image
+	var names []string
+	for i, filename := range t.Files {
+		thumb, err := spriteThumb(t, filename)
+		if err != nil {
+			if !t.Partial {
+				resp.setError(err)
+				return resp
+			}
+			resp.Response.failed("sprite "+filename, err)
+			continue
+		}
+		thumbs = append(thumbs, thumb)
+		names = append(names, filename)
+		t.progress.stage("decode", 80*(i+1)/len(t.Files))
+	}
+	if len(thumbs) == 0 {
+		resp.Error = "None of the sprite's files could be decoded"
+		return resp
+	}
+
+	columns := t.SpriteColumns
+	if columns <= 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(len(thumbs)))))
+	}
+	if columns > len(thumbs) {
+		columns = len(thumbs)
+	}
+	var cellHeight int
+	for _, thumb := range thumbs {
+		if h := thumb.Bounds().Dy(); h > cellHeight {
+			cellHeight = h
+		}
+	}
+	rows := (len(thumbs) + columns - 1) / columns
+	sheet := image.NewNRGBA(image.Rect(0, 0, columns*int(thumbWidth), rows*cellHeight))
+	sprites := SpriteMap{Width: sheet.Bounds().Dx(), Height: sheet.Bounds().Dy()}
+	for i, thumb := range thumbs {
+		b := thumb.Bounds()
+		at := image.Pt(i%columns*int(thumbWidth), i/columns*cellHeight)
+		draw.Draw(sheet, b.Sub(b.Min).Add(at), thumb, b.Min, draw.Src)
+		sprites.Sprites = append(sprites.Sprites, SpriteCell{names[i], at.X, at.Y, b.Dx(), b.Dy()})
+	}
+
+	t.progress.stage("encode", 85)
+	f, err := createOutput(t)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	err = encodeInSlot(f, sheet, t)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		resp.setError(noSpace(err))
+		return resp
+	}
+	if resp.Response.Sprite, _, err = publishOutput(t, f.Name(), outputName(t, f.Name(), "sprite", formatExt(t)), formatType(t)); err != nil {
+		os.Remove(f.Name())
+		resp.Error = err.Error()
+		return resp
+	}
+
+	if resp.Response.SpriteMap, err = writeSpriteMap(t, sprites); err != nil {
+		unpublishOutput(resp.Response.Sprite)
+		failed := TaskResult{Id: t.Id}
+		failed.setError(err)
+		return failed
+	}
+	return resp
+}
+
+// spriteThumb is a file's thumbnail, -thumbWidth wide
+func spriteThumb(t Task, filename string) (image.Image, error) {
+	one := t
+	one.Filename, one.decode = filename, nil
+	if isRemote(filename) {
+		local, err := fetchSource(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer removeTemp(local)
+		one.Filename = local
+	}
+	if err := checkFormat(filename, one.Filename); err != nil {
+		return nil, err
+	}
+	img, err := decodeSource(one)
+	if err != nil {
+		return nil, err
+	}
+	// each cell is -thumbWidth wide, whatever the Sizing
+	return resize.Resize(thumbWidth, 0, img, resize.Bilinear), nil
+}
+
+func writeSpriteMap(t Task, sprites SpriteMap) (string, error) {
+	f, err := createOutput(t)
+	if err != nil {
+		return "", err
+	}
+	err = json.NewEncoder(f).Encode(sprites)
+	f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", noSpace(err)
+	}
+	location, _, err := publishOutput(t, f.Name(), outputName(t, f.Name(), "spriteMap", ".json"), "application/json")
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return location, nil
+}
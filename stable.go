@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+var stableFor time.Duration
+
+// checkStable fails with FILE_BUSY if the file is still being written: its
+// size or modification time change over -stableFor, or (where the OS can tell
+// us) a process has it open for writing
+func checkStable(filename string) error {
+	if stableFor <= 0 {
+		return nil
+	}
+
+	before, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	time.Sleep(stableFor)
+	after, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	if before.Size() != after.Size() || !before.ModTime().Equal(after.ModTime()) {
+		return &codedError{code: "FILE_BUSY", retryable: true, msg: fmt.Sprintf("%s is still changing", filename)}
+	}
+	if writing, _ := openForWriting(filename); writing {
+		return &codedError{code: "FILE_BUSY", retryable: true, msg: fmt.Sprintf("%s is open for writing", filename)}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// openForWriting looks through /proc for a process with filename open for
+// writing. Processes we aren't allowed to look at are skipped.
+func openForWriting(filename string) (bool, error) {
+	target, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return false, err
+	}
+	for _, fd := range fds {
+		info, err := os.Stat(fd)
+		if err != nil || !os.SameFile(info, target) {
+			continue
+		}
+
+		// the flags line of fdinfo is octal, O_WRONLY is 01 and O_RDWR 02
+		fdinfo, err := ioutil.ReadFile(strings.Replace(fd, "/fd/", "/fdinfo/", 1))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(fdinfo), "\n") {
+			if !strings.HasPrefix(line, "flags:") {
+				continue
+			}
+			flags, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "flags:")), 8, 64)
+			if err == nil && flags&03 != 0 {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
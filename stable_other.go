@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// openForWriting can't tell on this OS, the size/mtime check has to do
+func openForWriting(filename string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage is somewhere sources are read from and outputs written to. A
+// task's Filename and OutputDir pick one by URL scheme, e.g. "s3://bucket/key",
+// "gs://bucket/key", "azblob://container/name", "sftp://user@host/path" or
+// "mem://key", and plain paths are the local disk.
+type Storage interface {
+	Open(name string) (io.ReadCloser, error)
+	// Write stores an output, contentType is a MIME type
+	Write(name string, r io.Reader, contentType string) error
+	Stat(name string) (StorageInfo, error)
+	Remove(name string) error
+}
+
+// StorageInfo is what Stat knows about an object
+type StorageInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// publicStorage is a Storage whose objects can be fetched over HTTP
+type publicStorage interface {
+	PublicURL(name string) string
+}
+
+// storages make a Storage for a URL's host (a bucket, or a server with its
+// login), by scheme. Adding a backend is adding it here.
+var storages = map[string]func(u *url.URL) (Storage, error){
+	"file":   func(*url.URL) (Storage, error) { return localStorage{}, nil },
+	"mem":    func(*url.URL) (Storage, error) { return memory, nil },
+	"gs":     func(u *url.URL) (Storage, error) { return newGCSStorage(u.Host) },
+	"s3":     func(u *url.URL) (Storage, error) { return newS3Storage(u.Host) },
+	"azblob": func(u *url.URL) (Storage, error) { return newAzureStorage(u.Host) },
+	"sftp":   newSFTPStorage,
+	"ftp":    newFTPStorage,
+}
+
+// isRemote is whether a filename is a URL (even file://) rather than a path,
+// and so has to be fetched or uploaded through its Storage: it has "://" or
+// the scheme of a Storage, as "IMG:01.jpg" or "C:\photos" parse with one too.
+// A single letter is always a Windows drive.
+func isRemote(filename string) bool {
+	u, err := url.Parse(filename)
+	if err != nil || len(u.Scheme) <= 1 {
+		return false
+	}
+	_, known := storages[u.Scheme]
+	return known || strings.Contains(filename, "://")
+}
+
+// openStorage is the Storage for a URL, and the object's name within it
+func openStorage(location string) (Storage, string, error) {
+	if !isRemote(location) {
+		return localStorage{}, location, nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, "", err
+	}
+	newStorage, ok := storages[u.Scheme]
+	if !ok {
+		return nil, "", fmt.Errorf("Unknown storage %q", u.Scheme)
+	}
+	s, err := newStorage(u)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme == "file" || u.Scheme == "mem" {
+		return s, u.Host + u.Path, nil
+	}
+	return s, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// fetchSource copies a remote source to a temp file (keeping its name, for
+// its extension), which the caller removes
+func fetchSource(location string) (string, error) {
+	s, name, err := openStorage(location)
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.Stat(name); err != nil {
+		return "", fmt.Errorf("File does not exist")
+	}
+	r, err := s.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("Could not open %s: %s", location, err)
+	}
+	defer r.Close()
+
+	f, err := createTemp("*-" + path.Base(name))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, limitRate(r)); err != nil {
+		removeTemp(f.Name())
+		return "", noSpace(fmt.Errorf("Could not download %s: %s", location, err))
+	}
+	return f.Name(), nil
+}
+
+// fetchTask fetches a task's remote Filename, an archive whole with its entry
+// kept, and rewrites it to the temp file. The temp file is "" for local ones.
+func fetchTask(t Task) (Task, string, error) {
+	if !isRemote(t.Filename) {
+		return t, "", nil
+	}
+	source, entry, ok := splitArchive(t.Filename)
+	if !ok {
+		source = t.Filename
+	}
+	filename, err := fetchSource(source)
+	if err != nil {
+		return t, "", err
+	}
+	t.Filename = filename
+	if ok {
+		t.Filename += "!" + entry
+	}
+	return t, filename, nil
+}
+
+// outputStorage is where the task's outputs are uploaded once written locally:
+// its OutputDir if that's a URL, otherwise -gcsBucket if set, otherwise nil
+func outputStorage(t Task) (Storage, string, error) {
+	if isRemote(t.OutputDir) {
+		return openStorage(t.OutputDir)
+	}
+	if gcsBucket != "" {
+		s, err := newGCSStorage(gcsBucket)
+		return s, gcsPrefix, err
+	}
+	return nil, "", nil
+}
+
+// loginKey is what sftp and ftp connections are pooled by, the user and
+// server and a hash of the password, so only a task with the same password
+// gets a connection someone else logged in
+func loginKey(user, password, addr string) string {
+	sum := sha256.Sum256([]byte(user + "\x00" + password))
+	return user + "@" + addr + "/" + hex.EncodeToString(sum[:8])
+}
+
+// localOutputDir is where outputs are written, a temp dir for remote outputs
+func localOutputDir(t Task) string {
+	if isRemote(t.OutputDir) {
+		return ""
+	}
+	return t.OutputDir
+}
+
+// publishOutput uploads a local output as name (under the task's output
+// prefix) and removes it, returning where it went and its public URL, if
+// the Storage has one. Without an output Storage the local file stays put,
+// renamed to name if the task has an OutputName.
+func publishOutput(t Task, local, name, contentType string) (string, string, error) {
+	s, prefix, err := outputStorage(t)
+	if err != nil {
+		return local, "", err
+	}
+	if s == nil {
+		location, err := renameOutput(t, local, name)
+		if err == nil {
+			untrackTemp(local)
+		}
+		return location, "", err
+	}
+
+	f, err := os.Open(local)
+	if err != nil {
+		return "", "", err
+	}
+	defer removeTemp(local)
+	defer f.Close()
+
+	name = path.Join(prefix, name)
+	name, release, err := claimName(t, name, func(name string) bool {
+		_, err := s.Stat(name)
+		return err == nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	defer release()
+	if err := s.Write(name, f, contentType); err != nil {
+		return "", "", fmt.Errorf("Could not upload %s: %s", name, err)
+	}
+
+	location := name
+	if u, err := url.Parse(t.OutputDir); err == nil && isRemote(t.OutputDir) {
+		// an sftp:// or ftp:// user is kept, for unpublishOutput to log in
+		// as, but never the password, as locations are logged and streamed
+		login := ""
+		if name := u.User.Username(); name != "" {
+			login = url.User(name).String() + "@"
+		}
+		location = u.Scheme + "://" + login + path.Join(u.Host, name)
+	} else if gcsBucket != "" {
+		location = "gs://" + path.Join(gcsBucket, name)
+	}
+	public := ""
+	if p, ok := s.(publicStorage); ok {
+		public = p.PublicURL(name)
+	}
+	return location, public, nil
+}
+
+// unpublishOutput removes an output published to a Storage, when the task
+// fails after all. A location has no password, so sftp:// and ftp:// ones log
+// in with -sftpKey or -ftpPassword.
+func unpublishOutput(location string) {
+	if !isRemote(location) {
+		os.Remove(location)
+		return
+	}
+	if s, name, err := openStorage(location); err == nil {
+		s.Remove(name)
+	}
+}
+
+// localStorage is the disk
+type localStorage struct{}
+
+func (localStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (localStorage) Write(name string, r io.Reader, contentType string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (localStorage) Stat(name string) (StorageInfo, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	return StorageInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (localStorage) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// memory is the "mem://" Storage, for embedding and trying things out
+var memory = &memStorage{objects: map[string]memObject{}}
+
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (m *memStorage) Open(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(o.data)), nil
+}
+
+func (m *memStorage) Write(name string, r io.Reader, contentType string) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.objects[name] = memObject{data, time.Now()}
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memStorage) Stat(name string) (StorageInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[name]
+	if !ok {
+		return StorageInfo{}, os.ErrNotExist
+	}
+	return StorageInfo{Size: int64(len(o.data)), ModTime: o.modTime}, nil
+}
+
+func (m *memStorage) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[name]; !ok {
+		return os.ErrNotExist
+	}
+	delete(m.objects, name)
+	return nil
+}
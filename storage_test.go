@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestIsRemote(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     bool
+	}{
+		{"photo.jpg", false},
+		{"/photos/photo.jpg", false},
+		{"IMG:01.jpg", false},
+		{`C:\photos\photo.jpg`, false},
+		{"C:/photos/photo.jpg", false},
+		{"s3://bucket/photo.jpg", true},
+		{"file:///photos/photo.jpg", true},
+		{"sftp://user@host/photo.jpg", true},
+		// a known scheme, without the slashes
+		{"mem:photo.jpg", true},
+		// unknown, which openStorage turns down
+		{"webdav://host/photo.jpg", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			if got := isRemote(tt.filename); got != tt.want {
+				t.Errorf("isRemote(%q) = %v, want %v", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenStorage(t *testing.T) {
+	tests := []struct {
+		location string
+		local    bool
+		name     string
+		wantErr  bool
+	}{
+		{"IMG:01.jpg", true, "IMG:01.jpg", false},
+		{`C:\photos\photo.jpg`, true, `C:\photos\photo.jpg`, false},
+		{"mem://key/photo.jpg", false, "key/photo.jpg", false},
+		{"webdav://host/photo.jpg", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			s, name, err := openStorage(tt.location)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("openStorage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if _, local := s.(localStorage); local != tt.local || name != tt.name {
+				t.Errorf("openStorage() = %T, %q, want local %v, %q", s, name, tt.local, tt.name)
+			}
+		})
+	}
+}
+
+func TestNewFTPStorage(t *testing.T) {
+	defer func(u, p string) { ftpUser, ftpPassword = u, p }(ftpUser, ftpPassword)
+	ftpUser, ftpPassword = "photos", "secret"
+
+	tests := []struct {
+		url                  string
+		addr, user, password string
+	}{
+		{"ftp://host/out", "host:21", "photos", "secret"},
+		{"ftp://ann:pw@host:2121/out", "host:2121", "ann", "pw"},
+		{"ftp://ann@host/out", "host:21", "ann", ""},
+		// a location, which is written without the password
+		{"ftp://photos@host/out", "host:21", "photos", "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, _ := newFTPStorage(u)
+			f := s.(*ftpStorage)
+			if f.addr != tt.addr || f.user != tt.user || f.password != tt.password {
+				t.Errorf("newFTPStorage() = %s %s %s, want %s %s %s", f.addr, f.user, f.password, tt.addr, tt.user, tt.password)
+			}
+		})
+	}
+}
+
+func TestLoginKey(t *testing.T) {
+	key := loginKey("ann", "pw", "host:22")
+	tests := []struct {
+		name                 string
+		user, password, addr string
+		same                 bool
+	}{
+		{"same login", "ann", "pw", "host:22", true},
+		{"no password", "ann", "", "host:22", false},
+		{"wrong password", "ann", "pw2", "host:22", false},
+		{"another user", "bob", "pw", "host:22", false},
+		{"another server", "ann", "pw", "other:22", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := loginKey(tt.user, tt.password, tt.addr) == key; got != tt.same {
+				t.Errorf("loginKey(%q, %q, %q) same = %v, want %v", tt.user, tt.password, tt.addr, got, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stream is an NDJSON output shared by every worker, one line per write
+type stream struct {
+	w  io.Writer
+	mu *sync.Mutex
+	// records written since the last flush
+	pending int
+	// concurrent is whether w can be written by every worker at once (a
+	// queue's, which batches them), so writes don't hold mu
+	concurrent bool
+}
+
+// flusher is a writer that holds on to writes, like a compressor
+type flusher interface {
+	Flush() error
+}
+
+var (
+	// results is where successful task results are written, stdout unless
+	// it's wrapped by a compressor or replaced by a queue
+	results = &stream{w: os.Stdout, mu: &sync.Mutex{}}
+	// failures are results too, but go to stderr along with the logs
+	failures = &stream{w: os.Stderr, mu: &logMu}
+
+	resultsPath string
+
+	flushEvery    int
+	flushInterval time.Duration
+)
+
+// openResults sends every result, failed or not, to -results instead: an
+// inherited file descriptor ("fd:3"), a socket ("unix:/path" or
+// "tcp:host:port") or a file, leaving stderr to the logs. The returned
+// io.Closer is nil if there's nothing to close.
+func openResults() (io.Closer, error) {
+	var w io.WriteCloser
+	switch {
+	case resultsPath == "" || resultsPath == "stdout":
+		return nil, nil
+	case strings.HasPrefix(resultsPath, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(resultsPath, "fd:"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -results %q: %s", resultsPath, err)
+		}
+		w = os.NewFile(uintptr(fd), resultsPath)
+	case strings.HasPrefix(resultsPath, "unix:"), strings.HasPrefix(resultsPath, "tcp:"):
+		i := strings.Index(resultsPath, ":")
+		conn, err := net.Dial(resultsPath[:i], resultsPath[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Could not connect -results: %s", err)
+		}
+		w = conn
+	default:
+		f, err := os.OpenFile(resultsPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open -results: %s", err)
+		}
+		w = f
+	}
+
+	results = &stream{w: w, mu: &sync.Mutex{}}
+	failures = results
+	return w, nil
+}
+
+func (s *stream) writeLine(line []byte) error {
+	if s.concurrent {
+		_, err := s.w.Write(append(line, '\n'))
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.written()
+}
+
+// written counts a record, with s.mu held, and pushes the records out every
+// -flushEvery (each one by default, as a compressor holds on to small writes)
+func (s *stream) written() error {
+	s.pending++
+	if flushEvery > 0 && s.pending < flushEvery {
+		return nil
+	}
+	s.pending = 0
+	if f, ok := s.w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// flush pushes out the records held since the last flush
+func (s *stream) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == 0 {
+		return nil
+	}
+	s.pending = 0
+	if f, ok := s.w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// bufferedWriter holds results until the stream flushes it, then flushes
+// what it wraps as well
+type bufferedWriter struct {
+	*bufio.Writer
+	next io.Writer
+}
+
+func (b bufferedWriter) Flush() error {
+	if err := b.Writer.Flush(); err != nil {
+		return err
+	}
+	if f, ok := b.next.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// bufferResults buffers the results when they're flushed less often than
+// every one, and flushes them every -flushInterval too, so a slow trickle
+// of results isn't left waiting on -flushEvery
+func bufferResults() {
+	if flushEvery == 1 && flushInterval <= 0 {
+		return
+	}
+	results.w = bufferedWriter{bufio.NewWriterSize(results.w, 64*1024), results.w}
+	if flushInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(flushInterval) {
+			if err := results.flush(); err != nil {
+				logf("error", "Could not flush results: %s", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// ThumbStyle is drawn onto the thumbnail. The border is inside the edge so the
+// thumbnail keeps its width. Rounded corners are transparent, which only a
+// PNG keeps; a JPEG flattens them over the background color.
+type ThumbStyle struct {
+	Border      int    `json:"border"`
+	BorderColor string `json:"borderColor"`
+	Radius      int    `json:"radius"`
+}
+
+func checkThumbSource(t Task) error {
+	switch t.ThumbSource {
+	case "", "preview", "source":
+	default:
+		return fmt.Errorf("Unknown thumbSource %q (preview or source)", t.ThumbSource)
+	}
+	if _, ok := filters[t.ThumbFilter]; !ok {
+		return fmt.Errorf("Unknown thumbFilter %q", t.ThumbFilter)
+	}
+	return nil
+}
+
+func styleImage(img image.Image, s *ThumbStyle) (image.Image, error) {
+	if s == nil || (s.Border <= 0 && s.Radius <= 0) {
+		return img, nil
+	}
+	border := color.RGBA{0, 0, 0, 0xff}
+	if s.BorderColor != "" {
+		var err error
+		if border, err = parseColor(s.BorderColor); err != nil {
+			return nil, err
+		}
+	}
+
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+
+	w, h := float64(b.Dx()), float64(b.Dy())
+	r := math.Min(float64(s.Radius), math.Min(w, h)/2)
+	bw := float64(s.Border)
+
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			// distance of the pixel's center inside the (rounded) edge
+			px, py := float64(x)+0.5, float64(y)+0.5
+			dx := math.Max(math.Max(r-px, px-(w-r)), 0)
+			dy := math.Max(math.Max(r-py, py-(h-r)), 0)
+			var dist float64
+			if dx > 0 && dy > 0 {
+				dist = r - math.Hypot(dx, dy)
+			} else {
+				dist = math.Min(math.Min(px, w-px), math.Min(py, h-py))
+			}
+
+			i := dst.PixOffset(x, y)
+			// antialiased blend into the border, then out to transparent
+			if mix := clamp(bw+0.5-dist, 0, 1); bw > 0 && mix > 0 {
+				dst.Pix[i] = lerp8(dst.Pix[i], border.R, mix)
+				dst.Pix[i+1] = lerp8(dst.Pix[i+1], border.G, mix)
+				dst.Pix[i+2] = lerp8(dst.Pix[i+2], border.B, mix)
+			}
+			if coverage := clamp(dist+0.5, 0, 1); coverage < 1 {
+				dst.Pix[i+3] = uint8(float64(dst.Pix[i+3]) * coverage)
+			}
+		}
+	}
+
+	return dst, nil
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
+
+func lerp8(a, b uint8, t float64) uint8 {
+	return uint8(float64(a)*(1-t) + float64(b)*t + 0.5)
+}
+
+// colorAlpha is a mask of the given opacity, 0 to 1
+func colorAlpha(opacity float64) color.Alpha {
+	return color.Alpha{uint8(clamp(opacity, 0, 1)*255 + 0.5)}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// tempPrefix starts the name of every temp file and dir, followed by the pid
+// that made it, so orphans of a crashed run can be told apart from the temp
+// files of runs still going
+const tempPrefix = "imaging-"
+
+var (
+	tempMu sync.Mutex
+	temps  = map[string]bool{}
+
+	exitMu    sync.Mutex
+	exitFuncs []func()
+
+	// outputTTL is how long outputs are kept for a client to say it has them
+	// (with an "ack" task of the same id) before they're removed
+	outputTTL time.Duration
+	outputsMu sync.Mutex
+	outputs   = map[taskOf][]expiringOutput{}
+	// outputFiles are the tasks holding each output, more than one for
+	// tasks coalesced by -dedupe, which share theirs
+	outputFiles = map[string]*outputFile{}
+)
+
+type expiringOutput struct {
+	name    string
+	expires time.Time
+}
+
+// outputFile is an output's tasks not yet acked or expired, and whether any
+// was acked, which keeps it
+type outputFile struct {
+	holders int
+	acked   bool
+}
+
+// createTemp is ioutil.TempFile, tracked until removeTemp
+func createTemp(pattern string) (*os.File, error) {
+	f, err := ioutil.TempFile("", tempName(pattern))
+	if err == nil {
+		trackTemp(f.Name())
+	}
+	return f, err
+}
+
+// createTempDir is ioutil.TempDir, tracked until removeTemp
+func createTempDir() (string, error) {
+	dir, err := ioutil.TempDir("", tempName(""))
+	if err == nil {
+		trackTemp(dir)
+	}
+	return dir, err
+}
+
+func tempName(pattern string) string {
+	return tempPrefix + strconv.Itoa(os.Getpid()) + "-" + pattern
+}
+
+func trackTemp(name string) {
+	tempMu.Lock()
+	temps[name] = true
+	tempMu.Unlock()
+}
+
+// untrackTemp keeps a tracked file, e.g. an output once it's published
+func untrackTemp(name string) {
+	tempMu.Lock()
+	delete(temps, name)
+	tempMu.Unlock()
+}
+
+// removeTemp removes a temp file or dir (and anything in it)
+func removeTemp(name string) {
+	tempMu.Lock()
+	delete(temps, name)
+	tempMu.Unlock()
+	os.RemoveAll(name)
+}
+
+// removeTemps removes whatever temp files are left, on the way out
+func removeTemps() {
+	tempMu.Lock()
+	defer tempMu.Unlock()
+	for name := range temps {
+		os.RemoveAll(name)
+		delete(temps, name)
+	}
+}
+
+// atExit registers f to close something on the way out, whether main
+// returns or is interrupted, the last registered first
+func atExit(f func()) {
+	exitMu.Lock()
+	exitFuncs = append(exitFuncs, f)
+	exitMu.Unlock()
+}
+
+// runExit runs the atExit funcs, once
+func runExit() {
+	exitMu.Lock()
+	defer exitMu.Unlock()
+	for i := len(exitFuncs) - 1; i >= 0; i-- {
+		exitFuncs[i]()
+	}
+	exitFuncs = nil
+}
+
+// removeTempsOnSignal removes the temp files, flushes the results and closes
+// what atExit has when interrupted or terminated, which would otherwise skip
+// the deferred ones
+func removeTempsOnSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		results.flush()
+		runExit()
+		removeTemps()
+		logf("warn", "Exiting on %s", sig)
+		os.Exit(1)
+	}()
+}
+
+// removeOrphans removes the temp files of runs that are no longer running
+func removeOrphans() {
+	names, _ := filepath.Glob(filepath.Join(os.TempDir(), tempPrefix+"*"))
+	for _, name := range names {
+		rest := strings.TrimPrefix(filepath.Base(name), tempPrefix)
+		pid, err := strconv.Atoi(rest[:strings.IndexByte(rest+"-", '-')])
+		if err != nil || pid == os.Getpid() || processAlive(pid) {
+			continue
+		}
+		if err := os.RemoveAll(name); err != nil {
+			logf("warn", "Could not remove orphaned %s: %s", name, err)
+		} else {
+			logf("debug", "Removed orphaned %s", name)
+		}
+	}
+}
+
+// processAlive is whether pid is running, signal 0 checks without sending one
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+// expireOutputs registers a result's local outputs to be removed after
+// -outputTTL, unless the task is acked first
+func expireOutputs(r TaskResult) {
+	if outputTTL == 0 || r.Error != "" {
+		return
+	}
+	names := r.Response.files()
+	if r.Response.Manifest != "" {
+		// the tiles are in the same dir
+		names = append(names, filepath.Dir(r.Response.Manifest))
+	}
+
+	expires := time.Now().Add(outputTTL)
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	for _, name := range names {
+		if name != "" && !isRemote(name) {
+			key := taskOf{r.owner, r.Id}
+			outputs[key] = append(outputs[key], expiringOutput{name, expires})
+			if outputFiles[name] == nil {
+				outputFiles[name] = &outputFile{}
+			}
+			outputFiles[name].holders++
+		}
+	}
+}
+
+// taskOf is a task by its owner's id for it, as ids are only the client's
+type taskOf struct {
+	owner string
+	id    int
+}
+
+// ackOutputs keeps the outputs of the owner's task id, the client has them
+func ackOutputs(owner string, id int) {
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	key := taskOf{owner, id}
+	for _, o := range outputs[key] {
+		releaseOutput(o.name, true)
+	}
+	delete(outputs, key)
+}
+
+// releaseOutput lets go of a task's hold on an output (outputsMu held),
+// removing it once no task holds it, unless one acked it
+func releaseOutput(name string, acked bool) {
+	f := outputFiles[name]
+	if f == nil {
+		return
+	}
+	f.holders--
+	f.acked = f.acked || acked
+	if f.holders > 0 {
+		return
+	}
+	delete(outputFiles, name)
+	if !f.acked {
+		os.RemoveAll(name)
+	}
+}
+
+// removeExpired removes outputs past their TTL, every so often
+func removeExpired() {
+	if outputTTL == 0 {
+		return
+	}
+	interval := outputTTL / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	for range time.Tick(interval) {
+		removeExpiredAt(time.Now())
+	}
+}
+
+// removeExpiredAt lets go of the outputs of tasks past their TTL at now,
+// removing those that no other task holds
+func removeExpiredAt(now time.Time) {
+	outputsMu.Lock()
+	defer outputsMu.Unlock()
+	for key, list := range outputs {
+		if now.Before(list[0].expires) {
+			continue
+		}
+		for _, o := range list {
+			releaseOutput(o.name, false)
+		}
+		delete(outputs, key)
+		logTaskf(key.id, "debug", "Outputs weren't acked within -outputTTL, removed unless another task has them")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSharedOutputs(t *testing.T) {
+	defer func(ttl time.Duration) { outputTTL = ttl }(outputTTL)
+	outputTTL = time.Minute
+
+	tests := []struct {
+		name  string
+		acked []int
+		kept  bool
+	}{
+		{"neither acked", nil, false},
+		{"one acked", []int{2}, true},
+		{"both acked", []int{1, 2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preview := filepath.Join(t.TempDir(), "preview.jpg")
+			if err := ioutil.WriteFile(preview, []byte("jpeg"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// two of a client's tasks coalesced by -dedupe, with the same preview
+			for _, id := range []int{1, 2} {
+				r := TaskResult{Id: id, owner: "key a"}
+				r.Response.Preview = preview
+				expireOutputs(r)
+			}
+			for _, id := range tt.acked {
+				ackOutputs("key a", id)
+			}
+			removeExpiredAt(time.Now().Add(2 * outputTTL))
+
+			if _, err := os.Stat(preview); (err == nil) != tt.kept {
+				t.Errorf("preview kept = %v, want %v", err == nil, tt.kept)
+			}
+			if len(outputs) != 0 || len(outputFiles) != 0 {
+				t.Errorf("%d tasks and %d files still tracked, want none", len(outputs), len(outputFiles))
+			}
+		})
+	}
+}
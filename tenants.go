@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	tenantsMu    sync.Mutex
+	tenantsSlots = map[string]chan struct{}{}
+)
+
+// ownerOf is who a key's tasks are counted and acked as: its tenant, the
+// key itself if it doesn't name one
+func ownerOf(key string, limits clientLimits) string {
+	if limits.Tenant != "" {
+		return "tenant " + limits.Tenant
+	}
+	return "key " + key
+}
+
+// scopeTask keeps a task within its tenant's dirs (from -clientKeys): its
+// inputs are relative to InputDir (OutputDir, if that's unset) and its own
+// OutputDir to OutputDir, and none of them can climb out
+func scopeTask(t *Task) error {
+	limits, err := limitsFor(t.APIKey)
+	if err != nil {
+		return err
+	}
+	t.tenant, t.owner = limits.Tenant, ownerOf(t.APIKey, limits)
+	if err := scopeInputs(t, limits); err != nil {
+		return err
+	}
+	if limits.OutputDir == "" {
+		return nil
+	}
+	rel := filepath.ToSlash(t.OutputDir)
+	if isRemote(rel) || path.IsAbs(rel) || filepath.IsAbs(t.OutputDir) {
+		return &codedError{code: "FORBIDDEN", msg: fmt.Sprintf("outputDir %s is outside of the apiKey's", t.OutputDir)}
+	}
+	for _, name := range []string{rel, filepath.ToSlash(t.OutputName)} {
+		if clean := path.Clean(name); clean == ".." || strings.HasPrefix(clean, "../") {
+			return &codedError{code: "FORBIDDEN", msg: fmt.Sprintf("%s is outside of the apiKey's outputDir", name)}
+		}
+	}
+	if isRemote(limits.OutputDir) {
+		t.OutputDir = strings.TrimSuffix(limits.OutputDir, "/")
+		if rel != "" {
+			t.OutputDir += "/" + path.Clean(rel)
+		}
+	} else {
+		t.OutputDir = filepath.Join(limits.OutputDir, filepath.FromSlash(rel))
+	}
+	return nil
+}
+
+// scopeInputs puts each of the task's inputs beneath its tenant's InputDir
+func scopeInputs(t *Task, limits clientLimits) error {
+	root := limits.InputDir
+	if root == "" {
+		root = limits.OutputDir
+	}
+	if root == "" {
+		return nil
+	}
+	scope := func(name *string) error {
+		if *name == "" {
+			return nil
+		}
+		rel := filepath.ToSlash(*name)
+		clean := path.Clean(rel)
+		if isRemote(rel) || path.IsAbs(rel) || filepath.IsAbs(*name) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return &codedError{code: "FORBIDDEN", msg: fmt.Sprintf("%s is outside of the apiKey's inputDir", *name)}
+		}
+		if isRemote(root) {
+			*name = strings.TrimSuffix(root, "/") + "/" + clean
+		} else {
+			*name = filepath.Join(root, filepath.FromSlash(clean))
+		}
+		return nil
+	}
+	names := []*string{&t.Filename, &t.CompareTo, &t.LUT}
+	for i := range t.Brackets {
+		names = append(names, &t.Brackets[i])
+	}
+	for i := range t.Files {
+		names = append(names, &t.Files[i])
+	}
+	for _, name := range names {
+		if err := scope(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// share runs at most Workers (from -clientKeys) of a client's tasks at once,
+// so one busy product leaves the rest of the workers to the others
+func share(t Task, send func(Task) TaskResult) TaskResult {
+	limits, err := limitsFor(t.APIKey)
+	if err != nil || limits.Workers <= 0 {
+		return send(t)
+	}
+	tenantsMu.Lock()
+	slots, ok := tenantsSlots[t.owner]
+	if !ok {
+		slots = make(chan struct{}, limits.Workers)
+		tenantsSlots[t.owner] = slots
+	}
+	tenantsMu.Unlock()
+	slots <- struct{}{}
+	defer func() { <-slots }()
+	return send(t)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/image/tiff"
+	"image"
+	"io"
+)
+
+// tiffIFDs walks the chain of image file directories (one per page) in a
+// TIFF, returning where each starts and where the header points to the first
+func tiffIFDs(r io.ReaderAt) ([]uint32, binary.ByteOrder, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, nil, err
+	}
+
+	var order binary.ByteOrder
+	switch string(header[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, nil, fmt.Errorf("Not a TIFF")
+	}
+	if order.Uint16(header[2:4]) != 42 {
+		return nil, nil, fmt.Errorf("Not a TIFF (or a BigTIFF, which isn't supported)")
+	}
+
+	var offsets []uint32
+	seen := map[uint32]bool{}
+	buf := make([]byte, 4)
+	for offset := order.Uint32(header[4:8]); offset != 0; {
+		if seen[offset] {
+			return nil, nil, fmt.Errorf("TIFF page %d loops back on itself", len(offsets)+1)
+		}
+		seen[offset] = true
+		offsets = append(offsets, offset)
+
+		if _, err := r.ReadAt(buf[:2], int64(offset)); err != nil {
+			return nil, nil, err
+		}
+		// skip the 12-byte entries to reach the offset of the next IFD
+		next := int64(offset) + 2 + int64(order.Uint16(buf[:2]))*12
+		if _, err := r.ReadAt(buf, next); err != nil {
+			return nil, nil, err
+		}
+		offset = order.Uint32(buf)
+	}
+
+	return offsets, order, nil
+}
+
+// tiffPageCount is the number of pages in a TIFF
+func tiffPageCount(r io.ReaderAt) (int, error) {
+	offsets, _, err := tiffIFDs(r)
+	return len(offsets), err
+}
+
+// pageReader presents a TIFF as if page was its first, by patching the first
+// IFD offset in the header; everything else is read through untouched
+type pageReader struct {
+	r      io.ReaderAt
+	header [8]byte
+}
+
+func (p *pageReader) ReadAt(b []byte, off int64) (int, error) {
+	n, err := p.r.ReadAt(b, off)
+	for i := off; i < int64(len(p.header)) && i-off < int64(n); i++ {
+		b[i-off] = p.header[i]
+	}
+	return n, err
+}
+
+// decodeTIFFPage decodes a single page of a TIFF, counting from 1
+func decodeTIFFPage(r io.ReaderAt, size int64, page int) (image.Image, error) {
+	offsets, order, err := tiffIFDs(r)
+	if err != nil {
+		return nil, err
+	}
+	if page < 1 || page > len(offsets) {
+		return nil, fmt.Errorf("Page %d requested but the TIFF has %d page(s)", page, len(offsets))
+	}
+
+	p := &pageReader{r: r}
+	if _, err := r.ReadAt(p.header[:], 0); err != nil {
+		return nil, err
+	}
+	order.PutUint32(p.header[4:8], offsets[page-1])
+
+	return tiff.Decode(io.NewSectionReader(p, 0, size))
+}
+
+// tiffEntry is one tag of an IFD, with its value still encoded
+type tiffEntry struct {
+	Type  uint16
+	Count uint32
+	Data  []byte
+}
+
+// tiffTypeSizes is the size in bytes of each TIFF field type
+var tiffTypeSizes = map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// the most readIFD reads for a value, and for all of an IFD's, so a crafted
+// file can't have it allocate much more than the preview it might hold
+const (
+	maxTIFFEntry  = 1 << 24
+	maxTIFFValues = 1 << 25
+)
+
+// readIFD reads the tags of the IFD at offset, skipping any of an unknown type
+// or past the limits
+func readIFD(r io.ReaderAt, order binary.ByteOrder, offset uint32) (map[uint16]tiffEntry, error) {
+	buf := make([]byte, 2)
+	if _, err := r.ReadAt(buf, int64(offset)); err != nil {
+		return nil, err
+	}
+	entries := make([]byte, int(order.Uint16(buf))*12)
+	if _, err := r.ReadAt(entries, int64(offset)+2); err != nil {
+		return nil, err
+	}
+
+	tags := map[uint16]tiffEntry{}
+	// what's read for the IFD's values, all told
+	var total uint64
+	for i := 0; i < len(entries); i += 12 {
+		e := tiffEntry{Type: order.Uint16(entries[i+2:]), Count: order.Uint32(entries[i+4:])}
+		size, ok := tiffTypeSizes[e.Type]
+		// (up to 16MB, MakerNotes can hold a whole preview)
+		n := uint64(size) * uint64(e.Count)
+		if !ok || n > maxTIFFEntry || (n > 4 && total+n > maxTIFFValues) {
+			continue
+		}
+		if n > 4 {
+			total += n
+		}
+		// values of 4 bytes or less are stored in place of their offset
+		if size*e.Count <= 4 {
+			e.Data = entries[i+8 : i+8+int(size*e.Count)]
+		} else {
+			e.Data = make([]byte, size*e.Count)
+			if _, err := r.ReadAt(e.Data, int64(order.Uint32(entries[i+8:]))); err != nil {
+				return nil, err
+			}
+		}
+		tags[order.Uint16(entries[i:])] = e
+	}
+
+	return tags, nil
+}
+
+// values decodes a numeric tag, rationals are divided out
+func (e tiffEntry) values(order binary.ByteOrder) []float64 {
+	size := tiffTypeSizes[e.Type]
+	values := make([]float64, 0, e.Count)
+	for i := uint32(0); i < e.Count; i++ {
+		b := e.Data[i*size:]
+		switch e.Type {
+		case 1, 7:
+			values = append(values, float64(b[0]))
+		case 6:
+			values = append(values, float64(int8(b[0])))
+		case 3:
+			values = append(values, float64(order.Uint16(b)))
+		case 8:
+			values = append(values, float64(int16(order.Uint16(b))))
+		case 4, 13:
+			values = append(values, float64(order.Uint32(b)))
+		case 9:
+			values = append(values, float64(int32(order.Uint32(b))))
+		case 5:
+			values = append(values, float64(order.Uint32(b))/float64(order.Uint32(b[4:])))
+		case 10:
+			values = append(values, float64(int32(order.Uint32(b)))/float64(int32(order.Uint32(b[4:]))))
+		default:
+			return nil
+		}
+	}
+	return values
+}
+
+// value is the first value of a numeric tag, or 0 if the tag is missing
+func (e tiffEntry) value(order binary.ByteOrder) float64 {
+	if v := e.values(order); len(v) > 0 {
+		return v[0]
+	}
+	return 0
+}
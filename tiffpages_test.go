@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testTag is a tag of a test TIFF, its values encoded as its type's size
+type testTag struct {
+	tag, typ uint16
+	values   []uint32
+}
+
+// testTIFF is a little endian TIFF of data (at offset 8) and then an IFD for
+// each page, every value that doesn't fit in its entry after the entries
+func testTIFF(data []byte, pages ...[]testTag) []byte {
+	var b bytes.Buffer
+	b.WriteString("II")
+	binary.Write(&b, binary.LittleEndian, uint16(42))
+	binary.Write(&b, binary.LittleEndian, uint32(8+len(data)))
+	b.Write(data)
+	for i, tags := range pages {
+		start := b.Len()
+		outOfLine := start + 2 + len(tags)*12 + 4
+		var entries, values bytes.Buffer
+		for _, tag := range tags {
+			var v bytes.Buffer
+			for _, value := range tag.values {
+				switch tiffTypeSizes[tag.typ] {
+				case 1:
+					v.WriteByte(byte(value))
+				case 2:
+					binary.Write(&v, binary.LittleEndian, uint16(value))
+				default:
+					binary.Write(&v, binary.LittleEndian, value)
+				}
+			}
+			binary.Write(&entries, binary.LittleEndian, tag.tag)
+			binary.Write(&entries, binary.LittleEndian, tag.typ)
+			binary.Write(&entries, binary.LittleEndian, uint32(len(tag.values)))
+			if v.Len() <= 4 {
+				entries.Write(append(v.Bytes(), make([]byte, 4-v.Len())...))
+			} else {
+				binary.Write(&entries, binary.LittleEndian, uint32(outOfLine+values.Len()))
+				values.Write(v.Bytes())
+			}
+		}
+		binary.Write(&b, binary.LittleEndian, uint16(len(tags)))
+		b.Write(entries.Bytes())
+		next := uint32(0)
+		if i < len(pages)-1 {
+			next = uint32(outOfLine + values.Len())
+		}
+		binary.Write(&b, binary.LittleEndian, next)
+		b.Write(values.Bytes())
+	}
+	return b.Bytes()
+}
+
+func TestTiffIFDs(t *testing.T) {
+	page := []testTag{{tagImageWidth, 3, []uint32{1}}}
+	looped := testTIFF(nil, page)
+	// the IFD's next offset back to itself
+	binary.LittleEndian.PutUint32(looped[8+2+12:], 8)
+	bigTIFF := testTIFF(nil, page)
+	bigTIFF[2] = 43
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr bool
+	}{
+		{"one page", testTIFF(nil, page), 1, false},
+		{"three pages", testTIFF([]byte{1, 2, 3}, page, page, page), 3, false},
+		{"loop", looped, 0, true},
+		{"not a TIFF", []byte("GIF89a..."), 0, true},
+		{"BigTIFF", bigTIFF, 0, true},
+		{"truncated header", []byte("II*"), 0, true},
+		{"truncated IFD", testTIFF(nil, page)[:12], 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tiffPageCount(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tiffPageCount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want && !tt.wantErr {
+				t.Errorf("tiffPageCount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadIFD(t *testing.T) {
+	tiff := testTIFF(nil, []testTag{
+		{tagImageWidth, 3, []uint32{640}},
+		{tagStripOffsets, 4, []uint32{8, 1000, 2000}},
+		{tagCompression, 99, []uint32{1}},
+	})
+	ifd, err := readIFD(bytes.NewReader(tiff), binary.LittleEndian, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		tag  uint16
+		want []float64
+	}{
+		{"in place", tagImageWidth, []float64{640}},
+		{"out of line", tagStripOffsets, []float64{8, 1000, 2000}},
+		{"unknown type", tagCompression, nil},
+		{"missing", tagImageLength, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ifd[tt.tag].values(binary.LittleEndian)
+			if len(got) != len(tt.want) {
+				t.Fatalf("values() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("values() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadIFDLimits(t *testing.T) {
+	entry := func(count uint32, offset uint32) []byte {
+		e := make([]byte, 12)
+		binary.LittleEndian.PutUint16(e, tagMakerNote)
+		binary.LittleEndian.PutUint16(e[2:], 7)
+		binary.LittleEndian.PutUint32(e[4:], count)
+		binary.LittleEndian.PutUint32(e[8:], offset)
+		return e
+	}
+	ifd := func(entries ...[]byte) []byte {
+		b := []byte{byte(len(entries)), 0}
+		for _, e := range entries {
+			b = append(b, e...)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr bool
+	}{
+		// a count past maxTIFFEntry is skipped, never allocated
+		{"huge entry", ifd(entry(1<<31, 0)), 0, false},
+		{"entry past the file", ifd(entry(16, 1<<20)), 0, true},
+		{"truncated entries", ifd(entry(1, 0))[:8], 0, true},
+		{"in place", ifd(entry(4, 0)), 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, err := readIFD(bytes.NewReader(tt.data), binary.LittleEndian, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readIFD() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(tags) != tt.want {
+				t.Errorf("readIFD() has %d tags, want %d", len(tags), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"github.com/nfnt/resize"
+	"image"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// the Deep Zoom defaults, tiles of 254 with a pixel of overlap make 256
+const (
+	defaultTileSize    = 254
+	defaultTileOverlap = 1
+)
+
+// dziManifest is the Deep Zoom Image XML, which viewers like OpenSeadragon read
+const dziManifest = `<?xml version="1.0" encoding="UTF-8"?>
+<Image xmlns="http://schemas.microsoft.com/deepzoom/2008" Format="%s" Overlap="%d" TileSize="%d">
+  <Size Width="%d" Height="%d"/>
+</Image>
+`
+
+// tileImage renders the file at full resolution into a Deep Zoom pyramid: a
+// directory with image.dzi and image_files/<level>/<column>_<row>.<ext>, level
+// 0 being 1x1 and the last level full size
+func tileImage(t Task) TaskResult {
+	resp := TaskResult{Id: t.Id}
+
+	size, overlap := t.TileSize, defaultTileOverlap
+	if size == 0 {
+		size = defaultTileSize
+	}
+	if t.TileOverlap != nil {
+		overlap = *t.TileOverlap
+	}
+	if size < 1 || overlap < 0 || overlap >= size {
+		resp.Error = fmt.Sprintf("Invalid tileSize %d or tileOverlap %d", size, overlap)
+		return resp
+	}
+
+	// without sizes dcraw decodes the full resolution image
+	t.ImageWidth, t.ThumbWidth = 0, 0
+	t.decode = &Decode{}
+	resp.Response.Decode = t.decode
+	img, err := decodeSource(t)
+	if err != nil {
+		resp.setError(err)
+		return resp
+	}
+
+	dir, err := ioutil.TempDir(localOutputDir(t), "")
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	// TempDir is private, the tiles are meant to be served
+	if err := os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		resp.Error = err.Error()
+		return resp
+	}
+	if err := writePyramid(dir, img, size, overlap, t); err != nil {
+		os.RemoveAll(dir)
+		resp.Error = err.Error()
+		return resp
+	}
+
+	ext := formatExt(t)[1:]
+	b := img.Bounds()
+	manifest := filepath.Join(dir, "image.dzi")
+	err = writeOutputFile(manifest, []byte(fmt.Sprintf(dziManifest, ext, overlap, size, b.Dx(), b.Dy())), t)
+	if err != nil {
+		os.RemoveAll(dir)
+		resp.Error = err.Error()
+		return resp
+	}
+	resp.Response.Manifest = manifest
+
+	if isRemote(t.OutputDir) || gcsBucket != "" {
+		if resp.Response.Manifest, err = publishTiles(t, dir); err != nil {
+			resp = TaskResult{Id: t.Id}
+			resp.Error = err.Error()
+		}
+		os.RemoveAll(dir)
+	}
+
+	return resp
+}
+
+// publishTiles uploads the pyramid in dir, as it's laid out there, returning
+// where the manifest went
+func publishTiles(t Task, dir string) (string, error) {
+	// (tiles are named by where they are in the pyramid)
+	t.OutputName = ""
+	var manifest string
+	var published []string
+	err := filepath.Walk(dir, func(local string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(filepath.Dir(dir), local)
+		contentType := formatType(t)
+		if filepath.Ext(local) == ".dzi" {
+			contentType = "application/xml"
+		}
+		location, _, err := publishOutput(t, local, filepath.ToSlash(rel), contentType)
+		if err != nil {
+			return err
+		}
+		published = append(published, location)
+		if local == filepath.Join(dir, "image.dzi") {
+			manifest = location
+		}
+		return nil
+	})
+	if err != nil {
+		for _, location := range published {
+			unpublishOutput(location)
+		}
+		return "", err
+	}
+	return manifest, nil
+}
+
+func writePyramid(dir string, img image.Image, size, overlap int, t Task) error {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	maxLevel := int(math.Ceil(math.Log2(math.Max(float64(w), float64(h)))))
+
+	for level := maxLevel; level >= 0; level-- {
+		t.progress.stage(fmt.Sprintf("level %d", level), 100*(maxLevel-level)/(maxLevel+1))
+		if level < maxLevel {
+			// each level is half the one above, rounding up
+			w, h = (w+1)/2, (h+1)/2
+			img = resize.Resize(uint(w), uint(h), img, resize.Bilinear)
+		}
+
+		levelDir := filepath.Join(dir, "image_files", fmt.Sprint(level))
+		if err := os.MkdirAll(levelDir, 0755); err != nil {
+			return err
+		}
+		for row := 0; row*size < h; row++ {
+			for col := 0; col*size < w; col++ {
+				r := image.Rect(col*size-overlap, row*size-overlap, (col+1)*size+overlap, (row+1)*size+overlap)
+				tile := cropImage(img, r.Intersect(image.Rect(0, 0, w, h)))
+				if err := writeTile(filepath.Join(levelDir, fmt.Sprintf("%d_%d%s", col, row, formatExt(t))), tile, t); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func writeTile(filename string, tile image.Image, t Task) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := encodeInSlot(f, tile, t); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return setOwnership(filename, t)
+}
+
+func writeOutputFile(filename string, data []byte, t Task) error {
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		return err
+	}
+	return setOwnership(filename, t)
+}
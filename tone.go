@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+)
+
+// dcraw's default gamma curve, BT.709's power and toe slope
+const (
+	dcrawGamma = 2.222
+	dcrawSlope = 4.5
+)
+
+// brightness is the task's Exposure and Brightness as one multiplier
+func brightness(t Task) float64 {
+	b := t.Brightness
+	if b == 0 {
+		b = 1
+	}
+	return b * math.Pow(2, t.Exposure)
+}
+
+func checkTone(t Task) error {
+	if t.Exposure < -5 || t.Exposure > 5 {
+		return fmt.Errorf("Invalid exposure %v, expected -5 to 5 EV", t.Exposure)
+	}
+	if t.Brightness < 0 {
+		return fmt.Errorf("Invalid brightness %v, expected a multiplier above 0", t.Brightness)
+	}
+	if t.Gamma < 0 || t.Gamma > 10 {
+		return fmt.Errorf("Invalid gamma %v, expected above 0 to 10", t.Gamma)
+	}
+	return nil
+}
+
+// toneArgs are the dcraw options for the task's exposure, brightness and gamma:
+// -b scales the linear data before the curve, and -g replaces the curve
+func toneArgs(t Task) ([]string, error) {
+	if err := checkTone(t); err != nil {
+		return nil, err
+	}
+	var args []string
+	if t.Exposure != 0 || t.Brightness != 0 {
+		args = append(args, "-b", strconv.FormatFloat(brightness(t), 'f', -1, 64))
+	}
+	if t.Gamma != 0 {
+		args = append(args, "-g", strconv.FormatFloat(dcrawGamma*t.Gamma, 'f', -1, 64), strconv.FormatFloat(dcrawSlope, 'f', -1, 64))
+	}
+	return args, nil
+}
+
+// applyTone adjusts an image dcraw didn't render (an embedded preview, a
+// JPEG), undoing its gamma to scale the brightness as dcraw would
+func applyTone(img image.Image, t Task) image.Image {
+	if t.Exposure == 0 && t.Brightness == 0 && t.Gamma == 0 {
+		return img
+	}
+	scale := brightness(t)
+	gamma := t.Gamma
+	if gamma == 0 {
+		gamma = 1
+	}
+
+	var lut [256]uint8
+	for i := range lut {
+		linear := math.Pow(float64(i)/255, dcrawGamma) * scale
+		v := math.Pow(math.Min(1, linear), 1/(dcrawGamma*gamma))
+		lut[i] = uint8(math.Round(v * 255))
+	}
+
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] = lut[dst.Pix[i]]
+		dst.Pix[i+1] = lut[dst.Pix[i+1]]
+		dst.Pix[i+2] = lut[dst.Pix[i+2]]
+	}
+	return dst
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+)
+
+// orient turns img upright according to an EXIF/TIFF orientation (1-8)
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// 5 to 8 swap the width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // needs a turn clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // needs a turn anticlockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(x+b.Min.X, y+b.Min.Y))
+		}
+	}
+
+	return dst
+}
+
+// orientRect maps a rectangle within a w x h image to where it ends up once
+// the image is turned upright by orient
+func orientRect(r image.Rectangle, w, h, orientation int) image.Rectangle {
+	switch orientation {
+	case 2:
+		return image.Rect(w-r.Max.X, r.Min.Y, w-r.Min.X, r.Max.Y)
+	case 3:
+		return image.Rect(w-r.Max.X, h-r.Max.Y, w-r.Min.X, h-r.Min.Y)
+	case 4:
+		return image.Rect(r.Min.X, h-r.Max.Y, r.Max.X, h-r.Min.Y)
+	case 5:
+		return image.Rect(r.Min.Y, r.Min.X, r.Max.Y, r.Max.X)
+	case 6:
+		return image.Rect(h-r.Max.Y, r.Min.X, h-r.Min.Y, r.Max.X)
+	case 7:
+		return image.Rect(h-r.Max.Y, w-r.Max.X, h-r.Min.Y, w-r.Min.X)
+	case 8:
+		return image.Rect(r.Min.Y, w-r.Max.X, r.Max.Y, w-r.Min.X)
+	}
+	return r
+}
+
+// cropImage copies the part of img within r (relative to its bounds)
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	r = r.Add(img.Bounds().Min).Intersect(img.Bounds())
+	if r.Empty() || r == img.Bounds() {
+		return img
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+// defaultTrimTolerance is how far, in 0-255 per channel, a border's pixels
+// can be from its color, for scans whose bed edges aren't quite flat
+const defaultTrimTolerance = 24
+
+// minTrimmed is the least of a side that trimming leaves, a tenth of it (or
+// 16 pixels, if that's more): any less and the image is blank or so faint
+// that its content was taken for border
+func minTrimmed(side int) int {
+	if side/10 > 16 {
+		return side / 10
+	}
+	if side < 16 {
+		return side
+	}
+	return 16
+}
+
+func checkTrim(t Task) error {
+	if t.TrimTolerance < 0 || t.TrimTolerance > 255 {
+		return fmt.Errorf("Invalid trimTolerance %d, expected 0 to 255", t.TrimTolerance)
+	}
+	return nil
+}
+
+// trimBorders crops away a Trim task's uniform borders: from each edge, the
+// rows or columns within TrimTolerance of the color of the outermost one,
+// but for specks of dust (a pixel in 100, or 2 of a short edge). An edge
+// that isn't uniform to start with keeps all of it, and so does the whole
+// image if less than minTrimmed of it would be left.
+func trimBorders(img image.Image, t Task) image.Image {
+	if !t.Trim {
+		return img
+	}
+	tolerance := t.TrimTolerance
+	if tolerance == 0 {
+		tolerance = defaultTrimTolerance
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// border is how many of the columns or rows from an edge are uniform, up
+	// to limit, at(i, j) being the jth pixel of the ith of n
+	border := func(at func(i, j int) (int, int), n, limit int) int {
+		var ref [3]int
+		for j := 0; j < n; j++ {
+			r, g, bl, _ := img.At(at(0, j)).RGBA()
+			ref[0], ref[1], ref[2] = ref[0]+int(r>>8), ref[1]+int(g>>8), ref[2]+int(bl>>8)
+		}
+		for c := range ref {
+			ref[c] /= n
+		}
+		for i := 0; i < limit; i++ {
+			off := 0
+			for j := 0; j < n; j++ {
+				r, g, bl, _ := img.At(at(i, j)).RGBA()
+				if !near([3]int{int(r >> 8), int(g >> 8), int(bl >> 8)}, ref, tolerance) {
+					off++
+				}
+			}
+			if off > 2 && off*100 > n {
+				return i
+			}
+		}
+		return limit
+	}
+	l := border(func(i, j int) (int, int) { return b.Min.X + i, b.Min.Y + j }, h, w/2)
+	r := border(func(i, j int) (int, int) { return b.Max.X - 1 - i, b.Min.Y + j }, h, w/2)
+	tp := border(func(i, j int) (int, int) { return b.Min.X + j, b.Min.Y + i }, w, h/2)
+	bt := border(func(i, j int) (int, int) { return b.Min.X + j, b.Max.Y - 1 - i }, w, h/2)
+	if l+r+tp+bt == 0 {
+		return img
+	}
+	if w-l-r < minTrimmed(w) || h-tp-bt < minTrimmed(h) {
+		logTaskf(t.Id, "debug", "Not trimming %s, only %dx%d would be left", t.Filename, w-l-r, h-tp-bt)
+		return img
+	}
+
+	logTaskf(t.Id, "debug", "Trimming borders of %d, %d, %d and %d pixels off %s", l, tp, r, bt, t.Filename)
+	return cropImage(img, image.Rect(l, tp, w-r, h-bt))
+}
+
+func near(c, ref [3]int, tolerance int) bool {
+	for i := range c {
+		if d := c[i] - ref[i]; d > tolerance || d < -tolerance {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// testScan is a w by h white scan bed with a gray photo within it
+func testScan(w, h int, photo image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	for y := photo.Min.Y; y < photo.Max.Y; y++ {
+		for x := photo.Min.X; x < photo.Max.X; x++ {
+			v := uint8(60 + (x*7+y*3)%100)
+			img.SetRGBA(x, y, color.RGBA{v, v, v, 0xff})
+		}
+	}
+	return img
+}
+
+func TestTrimBorders(t *testing.T) {
+	dusty := testScan(200, 100, image.Rect(20, 10, 180, 90))
+	dusty.SetRGBA(5, 50, color.RGBA{0, 0, 0, 0xff})
+
+	tests := []struct {
+		name string
+		img  image.Image
+		t    Task
+		want image.Rectangle
+	}{
+		{"off", testScan(200, 100, image.Rect(20, 10, 180, 90)), Task{}, image.Rect(0, 0, 200, 100)},
+		{"borders", testScan(200, 100, image.Rect(20, 10, 180, 90)), Task{Trim: true}, image.Rect(0, 0, 160, 80)},
+		{"one edge", testScan(200, 100, image.Rect(0, 0, 150, 100)), Task{Trim: true}, image.Rect(0, 0, 150, 100)},
+		{"no border", testScan(200, 100, image.Rect(0, 0, 200, 100)), Task{Trim: true}, image.Rect(0, 0, 200, 100)},
+		{"a speck of dust", dusty, Task{Trim: true}, image.Rect(0, 0, 160, 80)},
+		// nothing but bed
+		{"blank", testScan(200, 100, image.Rectangle{}), Task{Trim: true}, image.Rect(0, 0, 200, 100)},
+		{"a sliver left", testScan(200, 100, image.Rect(98, 10, 102, 90)), Task{Trim: true}, image.Rect(0, 0, 200, 100)},
+		{"a tenth left", testScan(200, 100, image.Rect(90, 10, 110, 90)), Task{Trim: true}, image.Rect(0, 0, 20, 80)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trimBorders(tt.img, tt.t).Bounds(); got != tt.want {
+				t.Errorf("trimBorders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinTrimmed(t *testing.T) {
+	tests := []struct {
+		side, want int
+	}{
+		{8, 8},
+		{100, 16},
+		{1000, 100},
+	}
+	for _, tt := range tests {
+		if got := minTrimmed(tt.side); got != tt.want {
+			t.Errorf("minTrimmed(%d) = %d, want %d", tt.side, got, tt.want)
+		}
+	}
+}
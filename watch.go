@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// the "imaging watch <directories>" command
+var (
+	watchInterval time.Duration
+	watchExisting bool
+)
+
+func checkWatch() error {
+	if watchInterval <= 0 {
+		return fmt.Errorf("Invalid -watchInterval %s, expected more than 0", watchInterval)
+	}
+	return nil
+}
+
+// watchedFile is what a file was when it was last looked at
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// watchFiles looks for images in the directories (and their subdirectories)
+// every -watchInterval, handing a task for each new or changed one, numbered
+// from 1. A file has to look the same twice running before it's handed over,
+// so ones still being copied in are left until they're done.
+func watchFiles(args []string, template Task, handle func([]byte, func())) error {
+	recursive = true
+	handled := map[string]watchedFile{}
+	pending := map[string]watchedFile{}
+	id := 0
+
+	for first := true; ; first = false {
+		found := map[string]bool{}
+		for _, filename := range expandFiles(args) {
+			info, err := os.Stat(filename)
+			if err != nil || info.IsDir() {
+				continue
+			}
+			found[filename] = true
+			f := watchedFile{info.Size(), info.ModTime()}
+			if first && !watchExisting {
+				handled[filename] = f
+				continue
+			}
+			if h, ok := handled[filename]; ok && h.size == f.size && h.modTime.Equal(f.modTime) {
+				continue
+			}
+			if p, ok := pending[filename]; !ok || p.size != f.size || !p.modTime.Equal(f.modTime) {
+				pending[filename] = f
+				continue
+			}
+
+			delete(pending, filename)
+			handled[filename] = f
+			id++
+			task, err := fileTask(template, id, filename)
+			if err != nil {
+				return err
+			}
+			handle(task, func() {})
+		}
+
+		// forget removed files, they're new if they come back
+		for filename := range handled {
+			if !found[filename] {
+				delete(handled, filename)
+			}
+		}
+		for filename := range pending {
+			if !found[filename] {
+				delete(pending, filename)
+			}
+		}
+		time.Sleep(watchInterval)
+	}
+}
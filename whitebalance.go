@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// wbFallback is the white balance ("auto" or "daylight") of RAWs without a
+// usable camera white balance, when the task wants the camera's
+var wbFallback string
+
+func checkWBFallback() error {
+	switch wbFallback {
+	case "auto", "daylight":
+		return nil
+	}
+	return fmt.Errorf("Unknown -wbFallback %q (auto or daylight)", wbFallback)
+}
+
+// whiteBalanceArgs are the dcraw options for the task's white balance: the
+// camera's (-w, the default), auto (-a), daylight (dcraw's own multipliers,
+// which -temperature starts from) or explicit multipliers (-r)
+func whiteBalanceArgs(t Task) ([]string, error) {
+	if len(t.WBMultipliers) > 0 || t.Temperature > 0 {
+		if t.WhiteBalance != "" {
+			return nil, fmt.Errorf("whiteBalance can't be combined with wbMultipliers or temperature")
+		}
+		if t.Temperature > 0 && len(t.WBMultipliers) > 0 {
+			return nil, fmt.Errorf("Only one of wbMultipliers and temperature can be set")
+		}
+	}
+	if t.Temperature > 0 {
+		if t.Temperature < 1000 || t.Temperature > 40000 {
+			return nil, fmt.Errorf("Invalid temperature %dK, expected 1000 to 40000", t.Temperature)
+		}
+		return nil, nil
+	}
+
+	switch m := t.WBMultipliers; len(m) {
+	case 0:
+	case 3, 4:
+		if len(m) == 3 {
+			// the second green is the same as the first
+			m = append(m, m[1])
+		}
+		args := []string{"-r"}
+		for _, v := range m {
+			if v <= 0 {
+				return nil, fmt.Errorf("Invalid wbMultipliers %v", t.WBMultipliers)
+			}
+			args = append(args, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		return args, nil
+	default:
+		return nil, fmt.Errorf("wbMultipliers needs 3 or 4 values (r, g, b[, g2]), got %d", len(m))
+	}
+
+	switch t.WhiteBalance {
+	case "", "camera":
+		return []string{"-w"}, nil
+	case "auto":
+		return []string{"-a"}, nil
+	case "daylight":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Unknown whiteBalance %q (camera, auto or daylight)", t.WhiteBalance)
+}
+
+// cameraWhiteBalance is whether the task keeps the camera's white balance, so
+// the camera's embedded JPEG can stand in for the RAW
+func cameraWhiteBalance(t Task) bool {
+	return (t.WhiteBalance == "" || t.WhiteBalance == "camera") && len(t.WBMultipliers) == 0 && t.Temperature == 0
+}
+
+// whiteBalanceMode names the task's white balance, for its result
+func whiteBalanceMode(t Task) string {
+	switch {
+	case len(t.WBMultipliers) > 0:
+		return "multipliers"
+	case t.Temperature > 0:
+		return "temperature"
+	case t.WhiteBalance == "":
+		return "camera"
+	}
+	return t.WhiteBalance
+}
+
+// fallbackWhiteBalance swaps dcraw's -w in args for -wbFallback if the RAW
+// hasn't a camera white balance worth using (scans and astro cameras often
+// don't, and dcraw's unity multipliers come out green), recording which
+// white balance was used in the task's decode
+func fallbackWhiteBalance(t Task, args []string) []string {
+	mode := whiteBalanceMode(t)
+	i := indexOf(args, "-w")
+	if i >= 0 {
+		if raw, err := identify(t.Filename); err == nil && !usableMultipliers(raw.Fields["Camera multipliers"]) {
+			logTaskf(t.Id, "warn", "%s has no usable camera white balance, using %s", t.Filename, wbFallback)
+			mode = wbFallback
+			fallback := []string{"-a"}
+			if wbFallback == "daylight" {
+				fallback = nil
+			}
+			args = append(append(append([]string{}, args[:i]...), fallback...), args[i+1:]...)
+		}
+	}
+	if t.decode != nil {
+		t.decode.WhiteBalance = mode
+	}
+	return args
+}
+
+// usableMultipliers is whether dcraw's "Camera multipliers" are there, and
+// not all the same (no white balance at all). Only red, green and blue count,
+// the 4th (a second green) is 0 when it's the same as the 2nd.
+func usableMultipliers(s string) bool {
+	var m []float64
+	for _, f := range strings.Fields(s) {
+		if len(m) == 3 {
+			break
+		}
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil || v <= 0 {
+			return false
+		}
+		m = append(m, v)
+	}
+	if len(m) < 3 {
+		return false
+	}
+	return math.Abs(m[0]-m[1]) > m[1]*0.01 || math.Abs(m[2]-m[1]) > m[1]*0.01
+}
+
+func indexOf(list []string, s string) int {
+	for i, v := range list {
+		if v == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// blackbody approximates the sRGB color of a black body at kelvin, from Tanner
+// Helland's fit of the CIE 1964 data
+func blackbody(kelvin int) (r, g, b float64) {
+	k := float64(kelvin) / 100
+	if k <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(k) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(k-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(k-60, -0.0755148492)
+	}
+	switch {
+	case k >= 66:
+		b = 255
+	case k <= 19:
+		b = 0
+	default:
+		b = 138.5177312231*math.Log(k-10) - 305.0447927307
+	}
+	c := func(v float64) float64 { return math.Max(1, math.Min(255, v)) }
+	return c(r), c(g), c(b)
+}
+
+// applyTemperature neutralizes light of the task's color temperature, in an
+// image dcraw rendered with daylight white balance (dcraw has no option for
+// it). Light adds up linearly, so the gains are of the linear colors, scaling
+// the image off dcraw's curve and then back on to it.
+func applyTemperature(img image.Image, t Task) image.Image {
+	linear := func(r, g, b float64) (float64, float64, float64) {
+		return srgbDecode(r / 255), srgbDecode(g / 255), srgbDecode(b / 255)
+	}
+	dr, dg, db := linear(blackbody(6500))
+	lr, lg, lb := linear(blackbody(t.Temperature))
+	gr, gg, gb := (dr/lr)/(dg/lg), 1.0, (db/lb)/(dg/lg)
+
+	p := dcrawGamma
+	if t.Gamma != 0 {
+		p *= t.Gamma
+	}
+	decode, encode := dcrawCurve(p, dcrawSlope)
+	var lut [3][256]uint8
+	for i := 0; i < 256; i++ {
+		v := decode(float64(i) / 255)
+		for c, gain := range []float64{gr, gg, gb} {
+			lut[c][i] = uint8(math.Round(encode(math.Min(1, v*gain)) * 255))
+		}
+	}
+
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	for i := 0; i < len(dst.Pix); i += 4 {
+		dst.Pix[i] = lut[0][dst.Pix[i]]
+		dst.Pix[i+1] = lut[1][dst.Pix[i+1]]
+		dst.Pix[i+2] = lut[2][dst.Pix[i+2]]
+	}
+	return dst
+}
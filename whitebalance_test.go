@@ -0,0 +1,78 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestApplyTemperature(t *testing.T) {
+	decode, _ := dcrawCurve(dcrawGamma, dcrawSlope)
+	tests := []struct {
+		name   string
+		kelvin int
+		in     uint8
+		// whether red and blue come out less, the same as (0) or more than in
+		red, blue int
+	}{
+		{"daylight", 6500, 128, 0, 0},
+		{"tungsten", 3200, 128, -1, 1},
+		{"shade", 9000, 128, 1, -1},
+		{"black stays black", 3200, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+			img.SetRGBA(0, 0, color.RGBA{tt.in, tt.in, tt.in, 0xff})
+			got := applyTemperature(img, Task{Temperature: tt.kelvin}).(*image.RGBA).RGBAAt(0, 0)
+			compare := func(v uint8) int {
+				switch d := int(v) - int(tt.in); {
+				case d < -1:
+					return -1
+				case d > 1:
+					return 1
+				}
+				return 0
+			}
+			if compare(got.R) != tt.red || compare(got.B) != tt.blue || compare(got.G) != 0 {
+				t.Errorf("applyTemperature() = %v of %d", got, tt.in)
+			}
+		})
+	}
+
+	// the gain is of the linear value, the same whatever the pixel's level
+	gain := func(in uint8) float64 {
+		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		img.SetRGBA(0, 0, color.RGBA{in, in, in, 0xff})
+		out := applyTemperature(img, Task{Temperature: 9000}).(*image.RGBA).RGBAAt(0, 0)
+		return decode(float64(out.R)/255) / decode(float64(in)/255)
+	}
+	if dark, mid := gain(60), gain(120); math.Abs(dark-mid) > 0.05 {
+		t.Errorf("red's linear gain is %.3f of a dark pixel, %.3f of a mid one", dark, mid)
+	}
+}
+
+func TestUsableMultipliers(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want bool
+	}{
+		{"camera", "2.1 1 1.5 0", true},
+		{"unity", "1 1 1 1", false},
+		{"nearly unity", "1.005 1 0.996 0", false},
+		{"too few", "2.1 1", false},
+		{"not numbers", "a b c", false},
+		{"none", "", false},
+		// only red, green and blue count
+		{"a second green", "1 1 1 2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := usableMultipliers(tt.s); got != tt.want {
+				t.Errorf("usableMultipliers(%q) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}